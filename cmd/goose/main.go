@@ -8,6 +8,8 @@ import (
 	"log"
 	"os"
 
+	pgsigningkeyserver "github.com/matrix-org/dendrite/signingkeyserver/storage/postgres/deltas"
+	slsigningkeyserver "github.com/matrix-org/dendrite/signingkeyserver/storage/sqlite3/deltas"
 	pgaccounts "github.com/matrix-org/dendrite/userapi/storage/accounts/postgres/deltas"
 	slaccounts "github.com/matrix-org/dendrite/userapi/storage/accounts/sqlite3/deltas"
 	pgdevices "github.com/matrix-org/dendrite/userapi/storage/devices/postgres/deltas"
@@ -147,6 +149,8 @@ func loadSQLiteDeltas(component string) {
 		slaccounts.LoadFromGoose()
 	case UserAPIDevices:
 		sldevices.LoadFromGoose()
+	case SigningKeyServer:
+		slsigningkeyserver.LoadFromGoose()
 	}
 }
 
@@ -156,5 +160,7 @@ func loadPostgresDeltas(component string) {
 		pgaccounts.LoadFromGoose()
 	case UserAPIDevices:
 		pgdevices.LoadFromGoose()
+	case SigningKeyServer:
+		pgsigningkeyserver.LoadFromGoose()
 	}
 }
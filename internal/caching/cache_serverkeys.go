@@ -25,6 +25,10 @@ type ServerKeyCache interface {
 	// request -> result is emulating gomatrixserverlib.StoreKeys:
 	// https://github.com/matrix-org/gomatrixserverlib/blob/f69539c86ea55d1e2cc76fd8e944e2d82d30397c/keyring.go#L112
 	StoreServerKey(request gomatrixserverlib.PublicKeyLookupRequest, response gomatrixserverlib.PublicKeyLookupResult)
+
+	// EvictServerKey removes the key for the request from the cache, if
+	// it is there, so that the next lookup won't be satisfied from it.
+	EvictServerKey(request gomatrixserverlib.PublicKeyLookupRequest)
 }
 
 func (c Caches) GetServerKey(
@@ -54,3 +58,10 @@ func (c Caches) StoreServerKey(
 	key := fmt.Sprintf("%s/%s", request.ServerName, request.KeyID)
 	c.ServerKeys.Set(key, response)
 }
+
+func (c Caches) EvictServerKey(
+	request gomatrixserverlib.PublicKeyLookupRequest,
+) {
+	key := fmt.Sprintf("%s/%s", request.ServerName, request.KeyID)
+	c.ServerKeys.Unset(key)
+}
@@ -0,0 +1,144 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/sirupsen/logrus"
+)
+
+// startGroup joins the consumer group and starts consuming whichever
+// partitions of the topic we are given, until Stop is called.
+func (c *ContinualConsumer) startGroup() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := c.stopChannel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	handler := &consumerGroupHandler{c: c, cancel: cancel}
+	c.running.Add(1)
+	go func() {
+		defer c.running.Done()
+		for {
+			// Consume only returns when the session ends, i.e. because
+			// of a rebalance, after which we need to join again.
+			err := c.ConsumerGroup.Consume(ctx, []string{c.Topic}, handler)
+			if ctx.Err() != nil || errors.Is(err, sarama.ErrClosedConsumerGroup) {
+				return
+			}
+			if err != nil {
+				logrus.WithError(err).WithField("component", c.ComponentName).Error("Failed to consume from consumer group")
+			}
+		}
+	}()
+	return nil
+}
+
+// consumerGroupHandler implements sarama.ConsumerGroupHandler for a
+// ContinualConsumer.
+type consumerGroupHandler struct {
+	c      *ContinualConsumer
+	cancel context.CancelFunc
+}
+
+// Setup is called at the start of each session, before any messages are
+// consumed. It moves each of the partitions that we have been given to
+// just after the offset in the partition store, which might be different
+// from the one committed to the consumer group if another member was
+// consuming the partition before the rebalance.
+func (h *consumerGroupHandler) Setup(session sarama.ConsumerGroupSession) error {
+	c := h.c
+	storedOffsets, err := c.PartitionStore.PartitionOffsets(session.Context(), c.Topic)
+	if err != nil {
+		return fmt.Errorf("c.PartitionStore.PartitionOffsets: %w", err)
+	}
+	stored := make(map[int32]int64, len(storedOffsets))
+	for _, offset := range storedOffsets {
+		stored[offset.Partition] = offset.Offset
+	}
+
+	var assigned []sqlutil.PartitionOffset
+	for _, partition := range session.Claims()[c.Topic] {
+		offset, ok := stored[partition]
+		if !ok {
+			// We've never consumed this partition, so start from the
+			// consumer group's initial offset.
+			continue
+		}
+		// MarkOffset only moves forwards and ResetOffset only moves
+		// backwards, so between them we end up at the stored offset.
+		session.MarkOffset(c.Topic, partition, offset+1, "")
+		session.ResetOffset(c.Topic, partition, offset+1, "")
+		assigned = append(assigned, sqlutil.PartitionOffset{Partition: partition, Offset: offset})
+	}
+	if c.PartitionsAssigned != nil {
+		c.PartitionsAssigned(assigned)
+	}
+	return nil
+}
+
+// Cleanup is called at the end of each session, once all of the claims
+// have finished being consumed.
+func (h *consumerGroupHandler) Cleanup(session sarama.ConsumerGroupSession) error {
+	if h.c.PartitionsRevoked != nil {
+		h.c.PartitionsRevoked(session.Claims()[h.c.Topic])
+	}
+	return nil
+}
+
+// ConsumeClaim consumes the messages for a single partition until the
+// session ends.
+func (h *consumerGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	c := h.c
+	for {
+		var message *sarama.ConsumerMessage
+		select {
+		case <-session.Context().Done():
+			return nil
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			message = msg
+		}
+		msgErr := c.ProcessMessage(message)
+		// Advance our position in the stream so that we will start at the right position after a restart
+		// or a rebalance. With ManualCommit, ProcessMessage has already done this if the message was
+		// processed successfully.
+		if !c.ManualCommit {
+			if err := c.PartitionStore.SetPartitionOffset(context.TODO(), c.Topic, message.Partition, message.Offset); err != nil {
+				panic(fmt.Errorf("the ContinualConsumer in %q failed to SetPartitionOffset: %w", c.ComponentName, err))
+			}
+		}
+		// Shutdown if we were told to do so. This leaves the consumer
+		// group, rather than just giving up on this partition, since
+		// the partition would otherwise be assigned to us again.
+		if msgErr == ErrShutdown {
+			if c.ShutdownCallback != nil {
+				c.ShutdownCallback()
+			}
+			h.cancel()
+			return nil
+		}
+		session.MarkMessage(message, "")
+	}
+}
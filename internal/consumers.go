@@ -17,6 +17,7 @@ package internal
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	"github.com/Shopify/sarama"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
@@ -49,6 +50,26 @@ type ContinualConsumer struct {
 	// ShutdownCallback is called when ProcessMessage returns ErrShutdown, after the partition has been saved.
 	// It is optional.
 	ShutdownCallback func()
+	// ManualCommit stops the consumer from saving the partition offset after each message. If set then
+	// ProcessMessage is responsible for calling SetPartitionOffset on the PartitionStore once a message
+	// has been processed successfully, so that failed messages are consumed again after a restart.
+	ManualCommit bool
+	// ConsumerGroup, if set, is used to consume the topic instead of Consumer, so that the partitions
+	// are shared out between all of the members of the consumer group and are rebalanced as members come
+	// and go. The PartitionStore is still used to decide where to resume each partition from, so that
+	// messages are neither skipped nor processed twice when a partition moves between members.
+	ConsumerGroup sarama.ConsumerGroup
+	// PartitionsAssigned is called when this member of the consumer group is given partitions to consume,
+	// with the stored offsets of those partitions. It is optional and only used with a ConsumerGroup.
+	PartitionsAssigned func(offsets []sqlutil.PartitionOffset)
+	// PartitionsRevoked is called once this member of the consumer group has stopped consuming the given
+	// partitions, i.e. because of a rebalance. It is optional and only used with a ConsumerGroup.
+	PartitionsRevoked func(partitions []int32)
+
+	stopMutex sync.Mutex
+	stopCh    chan struct{}
+	stopped   bool
+	running   sync.WaitGroup
 }
 
 // ErrShutdown can be returned from ContinualConsumer.ProcessMessage to stop the ContinualConsumer.
@@ -64,7 +85,13 @@ func (c *ContinualConsumer) Start() error {
 }
 
 // StartOffsets is the same as Start but returns the loaded offsets as well.
+// With a ConsumerGroup, no offsets are returned because partitions aren't
+// assigned until later. Use PartitionsAssigned to find out about them.
 func (c *ContinualConsumer) StartOffsets() ([]sqlutil.PartitionOffset, error) {
+	if c.ConsumerGroup != nil {
+		return nil, c.startGroup()
+	}
+
 	offsets := map[int32]int64{}
 
 	partitions, err := c.Consumer.Partitions(c.Topic)
@@ -98,21 +125,63 @@ func (c *ContinualConsumer) StartOffsets() ([]sqlutil.PartitionOffset, error) {
 		}
 		partitionConsumers = append(partitionConsumers, pc)
 	}
+	stop := c.stopChannel()
 	for _, pc := range partitionConsumers {
-		go c.consumePartition(pc)
+		c.running.Add(1)
+		go c.consumePartition(pc, stop)
 	}
 
 	return storedOffsets, nil
 }
 
+// Stop stops the consumer from consuming any more messages. It waits for
+// any message that is currently being processed to finish, so callers
+// should make sure that ProcessMessage will return promptly first.
+func (c *ContinualConsumer) Stop() {
+	c.stopMutex.Lock()
+	if c.stopCh == nil {
+		c.stopCh = make(chan struct{})
+	}
+	if !c.stopped {
+		close(c.stopCh)
+		c.stopped = true
+	}
+	c.stopMutex.Unlock()
+	c.running.Wait()
+}
+
+// stopChannel returns the channel that is closed when Stop is called.
+func (c *ContinualConsumer) stopChannel() chan struct{} {
+	c.stopMutex.Lock()
+	defer c.stopMutex.Unlock()
+	if c.stopCh == nil {
+		c.stopCh = make(chan struct{})
+	}
+	return c.stopCh
+}
+
 // consumePartition consumes the room events for a single partition of the kafkaesque stream.
-func (c *ContinualConsumer) consumePartition(pc sarama.PartitionConsumer) {
+func (c *ContinualConsumer) consumePartition(pc sarama.PartitionConsumer, stop <-chan struct{}) {
+	defer c.running.Done()
 	defer pc.Close() // nolint: errcheck
-	for message := range pc.Messages() {
+	for {
+		var message *sarama.ConsumerMessage
+		select {
+		case <-stop:
+			return
+		case msg, ok := <-pc.Messages():
+			if !ok {
+				return
+			}
+			message = msg
+		}
 		msgErr := c.ProcessMessage(message)
 		// Advance our position in the stream so that we will start at the right position after a restart.
-		if err := c.PartitionStore.SetPartitionOffset(context.TODO(), c.Topic, message.Partition, message.Offset); err != nil {
-			panic(fmt.Errorf("the ContinualConsumer in %q failed to SetPartitionOffset: %w", c.ComponentName, err))
+		// With ManualCommit, ProcessMessage has already done this if the message was processed successfully.
+		if !c.ManualCommit {
+			if err := c.PartitionStore.SetPartitionOffset(context.TODO(), c.Topic, message.Partition, message.Offset); err != nil {
+				panic(fmt.Errorf("the ContinualConsumer in %q failed to SetPartitionOffset: %w", c.ComponentName, err))
+			}
 		}
 		// Shutdown if we were told to do so.
 		if msgErr == ErrShutdown {
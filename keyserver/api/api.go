@@ -47,13 +47,37 @@ func (k *KeyError) Error() string {
 	return k.Err
 }
 
+// DeviceMessageType is the kind of key update that a DeviceMessage carries.
+type DeviceMessageType int
+
+const (
+	// TypeDeviceKeyUpdate is an update to the keys of one of the user's
+	// devices, or the deletion of a device if there are no keys.
+	TypeDeviceKeyUpdate DeviceMessageType = iota
+	// TypeCrossSigningKeyUpdate is an update to the user's cross-signing
+	// keys, which are in CrossSigningKeyUpdate.
+	TypeCrossSigningKeyUpdate
+)
+
 // DeviceMessage represents the message produced into Kafka by the key server.
 type DeviceMessage struct {
+	// The kind of update. Messages without a type are device key updates.
+	Type DeviceMessageType `json:",omitempty"`
 	DeviceKeys
+	// The new cross-signing keys, if this is a cross-signing key update.
+	CrossSigningKeyUpdate *CrossSigningKeyUpdate `json:",omitempty"`
 	// A monotonically increasing number which represents device changes for this user.
 	StreamID int
 }
 
+// CrossSigningKeyUpdate contains the cross-signing keys of a user that have
+// changed. The raw JSON of keys that haven't changed is nil.
+type CrossSigningKeyUpdate struct {
+	MasterKey      []byte `json:",omitempty"`
+	SelfSigningKey []byte `json:",omitempty"`
+	UserSigningKey []byte `json:",omitempty"`
+}
+
 // DeviceKeys represents a set of device keys for a single device
 // https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-keys-upload
 type DeviceKeys struct {
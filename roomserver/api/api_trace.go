@@ -315,6 +315,13 @@ func (t *RoomserverInternalAPITrace) QuerySharedUsers(ctx context.Context, req *
 	return err
 }
 
+// QueryBulkSharedUsers works like QuerySharedUsers, but for several users at once.
+func (t *RoomserverInternalAPITrace) QueryBulkSharedUsers(ctx context.Context, req *QueryBulkSharedUsersRequest, res *QueryBulkSharedUsersResponse) error {
+	err := t.Impl.QueryBulkSharedUsers(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryBulkSharedUsers req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 // QueryKnownUsers returns a list of users that we know about from our joined rooms.
 func (t *RoomserverInternalAPITrace) QueryKnownUsers(ctx context.Context, req *QueryKnownUsersRequest, res *QueryKnownUsersResponse) error {
 	err := t.Impl.QueryKnownUsers(ctx, req, res)
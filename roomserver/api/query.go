@@ -293,6 +293,18 @@ type QuerySharedUsersResponse struct {
 	UserIDsToCount map[string]int
 }
 
+// QueryBulkSharedUsersRequest asks who shares rooms with each of several
+// users at once, to save making a QuerySharedUsers request for each one.
+type QueryBulkSharedUsersRequest struct {
+	UserIDs []string
+}
+
+type QueryBulkSharedUsersResponse struct {
+	// A map of user ID => the users who share at least 1 room with them,
+	// in the same form as QuerySharedUsersResponse.UserIDsToCount.
+	UserIDsToCount map[string]map[string]int
+}
+
 type QueryRoomsForUserRequest struct {
 	UserID string
 	// The desired membership of the user. If this is the empty string then no rooms are returned.
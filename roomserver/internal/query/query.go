@@ -709,6 +709,23 @@ func (r *Queryer) QuerySharedUsers(ctx context.Context, req *api.QuerySharedUser
 	return nil
 }
 
+func (r *Queryer) QueryBulkSharedUsers(ctx context.Context, req *api.QueryBulkSharedUsersRequest, res *api.QueryBulkSharedUsersResponse) error {
+	res.UserIDsToCount = make(map[string]map[string]int, len(req.UserIDs))
+	for _, userID := range req.UserIDs {
+		if _, ok := res.UserIDsToCount[userID]; ok {
+			continue
+		}
+		var sharedRes api.QuerySharedUsersResponse
+		if err := r.QuerySharedUsers(ctx, &api.QuerySharedUsersRequest{
+			UserID: userID,
+		}, &sharedRes); err != nil {
+			return err
+		}
+		res.UserIDsToCount[userID] = sharedRes.UserIDsToCount
+	}
+	return nil
+}
+
 func (r *Queryer) QueryServerBannedFromRoom(ctx context.Context, req *api.QueryServerBannedFromRoomRequest, res *api.QueryServerBannedFromRoomResponse) error {
 	if r.ServerACLs == nil {
 		return errors.New("no server ACL tracking")
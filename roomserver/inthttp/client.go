@@ -53,6 +53,7 @@ const (
 	RoomserverQueryRoomsForUserPath            = "/roomserver/queryRoomsForUser"
 	RoomserverQueryBulkStateContentPath        = "/roomserver/queryBulkStateContent"
 	RoomserverQuerySharedUsersPath             = "/roomserver/querySharedUsers"
+	RoomserverQueryBulkSharedUsersPath         = "/roomserver/queryBulkSharedUsers"
 	RoomserverQueryKnownUsersPath              = "/roomserver/queryKnownUsers"
 	RoomserverQueryServerBannedFromRoomPath    = "/roomserver/queryServerBannedFromRoom"
 	RoomserverQueryAuthChainPath               = "/roomserver/queryAuthChain"
@@ -498,6 +499,16 @@ func (h *httpRoomserverInternalAPI) QuerySharedUsers(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
 }
 
+func (h *httpRoomserverInternalAPI) QueryBulkSharedUsers(
+	ctx context.Context, req *api.QueryBulkSharedUsersRequest, res *api.QueryBulkSharedUsersResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryBulkSharedUsers")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryBulkSharedUsersPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
 func (h *httpRoomserverInternalAPI) QueryKnownUsers(
 	ctx context.Context, req *api.QueryKnownUsersRequest, res *api.QueryKnownUsersResponse,
 ) error {
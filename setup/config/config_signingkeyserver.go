@@ -1,6 +1,13 @@
 package config
 
-import "github.com/matrix-org/gomatrixserverlib"
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
 
 type SigningKeyServer struct {
 	Matrix *Global `yaml:"-"`
@@ -17,6 +24,53 @@ type SigningKeyServer struct {
 
 	// Should we prefer direct key fetches over perspective ones?
 	PreferDirectFetch bool `yaml:"prefer_direct_fetch"`
+
+	// How long before the end of the key validity period we should start
+	// warning that our own signing key needs to be rotated. 0 disables
+	// the warning.
+	KeyExpiryWarning time.Duration `yaml:"key_expiry_warning"`
+
+	// Should public keys be gzip-compressed when they are stored in the
+	// database? Keys that are already stored can be read either way.
+	CompressKeys bool `yaml:"compress_keys"`
+
+	// Certificates to trust when fetching keys from specific servers, i.e.
+	// servers with self-signed certificates in a test network.
+	KeyServerTLSPins KeyServerTLSPins `yaml:"key_server_tls_pins"`
+
+	// The SNI and Host header to use when fetching keys from specific
+	// servers, i.e. servers whose key endpoints are behind a reverse proxy
+	// that expects a different name to the server name.
+	KeyServerOverrides KeyServerOverrides `yaml:"key_server_overrides"`
+
+	// The key algorithms to accept keys for from other servers, i.e.
+	// "ed25519". Keys for other algorithms are ignored. If empty, only
+	// ed25519 keys are accepted.
+	AcceptedKeyAlgorithms []string `yaml:"accepted_key_algorithms"`
+
+	// Log each request to a key fetcher at info level rather than debug
+	// level, i.e. while debugging federation.
+	VerboseFetchLogging bool `yaml:"verbose_fetch_logging"`
+
+	// The internal API URLs of the signing key servers of other Dendrite
+	// instances in the same deployment, i.e. "http://keys2:7780". They are
+	// asked for any keys that they already have before we go out over
+	// federation.
+	KeyServerPeers []HTTPAddress `yaml:"key_server_peers"`
+
+	// How long to wait before asking again for a key that a server hasn't
+	// published yet while it is rotating its keys, rather than reporting
+	// the key as missing straight away. 0 disables retrying.
+	KeyRolloverRetryDelay time.Duration `yaml:"key_rollover_retry_delay"`
+
+	// How long to remember that we failed to fetch a key, during which
+	// time we won't try to fetch it again. 0 disables the negative cache.
+	NegativeCacheTTL time.Duration `yaml:"negative_cache_ttl"`
+
+	// Should failed key lookups also be stored in the database, so that
+	// they are still remembered after a restart? Has no effect unless
+	// NegativeCacheTTL is set.
+	PersistNegativeCache bool `yaml:"persist_negative_cache"`
 }
 
 func (c *SigningKeyServer) Defaults() {
@@ -30,6 +84,28 @@ func (c *SigningKeyServer) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkURL(configErrs, "signing_key_server.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "signing_key_server.internal_api.bind", string(c.InternalAPI.Connect))
 	checkNotEmpty(configErrs, "signing_key_server.database.connection_string", string(c.Database.ConnectionString))
+	for i, pin := range c.KeyServerTLSPins {
+		key := fmt.Sprintf("signing_key_server.key_server_tls_pins[%d]", i)
+		checkNotEmpty(configErrs, key+".server_name", string(pin.ServerName))
+		if len(pin.SHA256Fingerprints) == 0 {
+			configErrs.Add(fmt.Sprintf("missing config key %q", key+".sha256_fingerprints"))
+		}
+		for _, fingerprint := range pin.SHA256Fingerprints {
+			if _, err := ParseCertificateFingerprint(fingerprint); err != nil {
+				configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", key+".sha256_fingerprints", err))
+			}
+		}
+	}
+	for i, peer := range c.KeyServerPeers {
+		checkURL(configErrs, fmt.Sprintf("signing_key_server.key_server_peers[%d]", i), string(peer))
+	}
+	for i, override := range c.KeyServerOverrides {
+		key := fmt.Sprintf("signing_key_server.key_server_overrides[%d]", i)
+		checkNotEmpty(configErrs, key+".server_name", string(override.ServerName))
+		if override.TLSServerName == "" && override.Host == "" {
+			configErrs.Add(fmt.Sprintf("missing config key %q or %q", key+".tls_server_name", key+".host"))
+		}
+	}
 }
 
 // KeyPerspectives are used to configure perspective key servers for
@@ -50,3 +126,41 @@ type KeyPerspectiveTrustKey struct {
 	// The public key in base64 unpadded format
 	PublicKey string `yaml:"public_key"`
 }
+
+// KeyServerTLSPins are used to pin the TLS certificates of servers that
+// we fetch keys from.
+type KeyServerTLSPins []KeyServerTLSPin
+
+type KeyServerTLSPin struct {
+	// The server name that the certificates are pinned for
+	ServerName gomatrixserverlib.ServerName `yaml:"server_name"`
+	// The SHA-256 fingerprints of the certificates to accept, in hex,
+	// optionally separated by colons as in the output of openssl
+	SHA256Fingerprints []string `yaml:"sha256_fingerprints"`
+}
+
+// KeyServerOverrides are used to change the SNI and Host header sent when
+// fetching keys from servers behind reverse proxies.
+type KeyServerOverrides []KeyServerOverride
+
+type KeyServerOverride struct {
+	// The server name that the override applies to
+	ServerName gomatrixserverlib.ServerName `yaml:"server_name"`
+	// The name to send as the SNI and to verify the certificate against
+	TLSServerName string `yaml:"tls_server_name"`
+	// The Host header to send with key requests
+	Host string `yaml:"host"`
+}
+
+// ParseCertificateFingerprint decodes a hex SHA-256 certificate fingerprint,
+// i.e. "AB:CD:..." or "abcd...".
+func ParseCertificateFingerprint(fingerprint string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(fingerprint, ":", ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 32 {
+		return nil, fmt.Errorf("fingerprint %q is not a SHA-256 hash", fingerprint)
+	}
+	return b, nil
+}
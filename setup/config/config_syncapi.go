@@ -9,6 +9,16 @@ type SyncAPI struct {
 	Database DatabaseOptions `yaml:"database"`
 
 	RealIPHeader string `yaml:"real_ip_header"`
+
+	// If set, key change events are consumed as a member of the kafka
+	// consumer group with this ID, so that they can be shared between
+	// several sync API instances. Requires kafka rather than naffka.
+	KeyChangeConsumerGroup string `yaml:"key_change_consumer_group"`
+
+	// If set, device list changes are also stored in the sync API database,
+	// so that clients that weren't syncing when the devices of someone they
+	// share a room with changed still find out about it.
+	PersistDeviceListChanges bool `yaml:"persist_device_list_changes"`
 }
 
 func (c *SyncAPI) Defaults() {
@@ -56,3 +56,22 @@ func setupNaffka(cfg *config.Kafka) (sarama.Consumer, sarama.SyncProducer) {
 	}
 	return naffkaInstance, naffkaInstance
 }
+
+// SetupConsumerGroup creates a kafka consumer group member from the config.
+// Consumer groups aren't supported by naffka, so this needs kafka.
+func SetupConsumerGroup(cfg *config.Kafka, groupID string) sarama.ConsumerGroup {
+	if cfg.UseNaffka {
+		logrus.Panic("kafka consumer groups can't be used with naffka")
+	}
+	sCfg := sarama.NewConfig()
+	sCfg.Consumer.Fetch.Default = int32(*cfg.MaxMessageBytes)
+	// Start from the beginning of any partitions that we've never consumed,
+	// like the ContinualConsumer does.
+	sCfg.Consumer.Offsets.Initial = sarama.OffsetOldest
+
+	group, err := sarama.NewConsumerGroup(cfg.Addresses, groupID, sCfg)
+	if err != nil {
+		logrus.WithError(err).Panic("failed to start kafka consumer group")
+	}
+	return group
+}
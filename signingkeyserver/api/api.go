@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -22,6 +23,17 @@ type SigningKeyServerAPI interface {
 		request *QueryPublicKeysRequest,
 		response *QueryPublicKeysResponse,
 	) error
+
+	// InvalidateKeys removes the given keys from the database and caches
+	// so that they will be fetched again the next time they are needed.
+	InvalidateKeys(
+		ctx context.Context,
+		requests []gomatrixserverlib.PublicKeyLookupRequest,
+	) error
+
+	// HealthCheck returns an error if our own signing key isn't usable or
+	// the key database can't be reached.
+	HealthCheck(ctx context.Context) error
 }
 
 type QueryPublicKeysRequest struct {
@@ -38,3 +50,71 @@ type InputPublicKeysRequest struct {
 
 type InputPublicKeysResponse struct {
 }
+
+type InvalidatePublicKeysRequest struct {
+	Requests []gomatrixserverlib.PublicKeyLookupRequest `json:"requests"`
+}
+
+type InvalidatePublicKeysResponse struct {
+}
+
+type HealthCheckRequest struct {
+}
+
+type HealthCheckResponse struct {
+}
+
+// KeyMetadata describes a key that we have stored for a remote server.
+type KeyMetadata struct {
+	KeyID        gomatrixserverlib.KeyID     `json:"key_id"`
+	ValidUntilTS gomatrixserverlib.Timestamp `json:"valid_until_ts"`
+	ExpiredTS    gomatrixserverlib.Timestamp `json:"expired_ts"`
+	// FetchedTS is when the key was last stored, or 0 if it was stored
+	// before fetch times were recorded.
+	FetchedTS gomatrixserverlib.Timestamp `json:"fetched_ts"`
+}
+
+// KeyProvenance describes where a key that we have stored for a remote
+// server came from.
+type KeyProvenance struct {
+	// FetcherName is the name of the key fetcher that the key was last
+	// stored from.
+	FetcherName string `json:"fetcher_name"`
+	// FetchedTS is when the key was last stored from that fetcher.
+	FetchedTS gomatrixserverlib.Timestamp `json:"fetched_ts"`
+}
+
+// MissingKeysError is returned from FetchKeys when one or more of the
+// requested keys couldn't be retrieved from local keys, the database or
+// any of the fetchers. Any keys that were found are still returned
+// alongside the error.
+type MissingKeysError struct {
+	Missing []gomatrixserverlib.PublicKeyLookupRequest
+}
+
+func (e *MissingKeysError) Error() string {
+	return fmt.Sprintf("server key API failed to satisfy %d key request(s)", len(e.Missing))
+}
+
+// TooManyKeyRequestsError is returned from FetchKeys when more keys were
+// asked for at once than the server key API is configured to allow. None
+// of the keys are fetched in that case.
+type TooManyKeyRequestsError struct {
+	Requested int
+	Limit     int
+}
+
+func (e *TooManyKeyRequestsError) Error() string {
+	return fmt.Sprintf("server key API refused to fetch %d keys at once, the limit is %d", e.Requested, e.Limit)
+}
+
+// EmptyLocalKeyError is returned when we are asked for one of our own
+// signing keys but don't have a public key for it, i.e. because the server
+// is misconfigured. Serving an empty key would silently break federation.
+type EmptyLocalKeyError struct {
+	KeyID gomatrixserverlib.KeyID
+}
+
+func (e *EmptyLocalKeyError) Error() string {
+	return fmt.Sprintf("server key API has no public key for local signing key %q", e.KeyID)
+}
@@ -3,9 +3,14 @@ package internal
 import (
 	"context"
 	"crypto/ed25519"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/signingkeyserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -15,14 +20,307 @@ import (
 type ServerKeyAPI struct {
 	api.SigningKeyServerAPI
 
-	ServerName        gomatrixserverlib.ServerName
-	ServerPublicKey   ed25519.PublicKey
-	ServerKeyID       gomatrixserverlib.KeyID
+	ServerName      gomatrixserverlib.ServerName
+	ServerPublicKey ed25519.PublicKey
+	ServerKeyID     gomatrixserverlib.KeyID
+	OldServerKeys   []config.OldVerifyKeys
+
+	// ServerKeyValidity is how long our own keys are reported to be valid
+	// for. Once the API is in use it must only be changed by calling
+	// SetKeyValidity, e.g. to shorten it during an incident.
 	ServerKeyValidity time.Duration
-	OldServerKeys     []config.OldVerifyKeys
+
+	// localKeyMutex guards ServerKeyID, ServerPublicKey, ServerKeyValidity
+	// and retiredKeys, which can change at runtime.
+	localKeyMutex sync.RWMutex
+	retiredKeys   []retiredLocalKey
+
+	// ServerKeys contains any other signing keys that we are advertising
+	// alongside ServerKeyID, i.e. during a key rotation.
+	ServerKeys []LocalServerKey
 
 	OurKeyRing gomatrixserverlib.KeyRing
 	FedClient  gomatrixserverlib.KeyClient
+
+	// NotaryFetchers are consulted for any keys that are still missing
+	// once all of the OurKeyRing.KeyFetchers have been tried. These are
+	// normally perspective fetchers for trusted notary servers, added
+	// using AddNotaryServer.
+	NotaryFetchers []gomatrixserverlib.KeyFetcher
+
+	// FetcherTimeout limits how long each key fetcher is given to
+	// respond. If zero, defaultFetcherTimeout is used. Individual
+	// fetchers can override this by implementing FetcherTimeout().
+	FetcherTimeout time.Duration
+
+	// FetchBudget limits how long all of the fetchers together are given
+	// to find the keys for a single request. Once it has been used up no
+	// further fetchers are tried and we return whatever keys we have. If
+	// zero, only FetcherTimeout applies.
+	FetchBudget time.Duration
+
+	// FetcherRetry controls whether fetcher requests that fail with a
+	// transient error are retried. Retries count towards the fetcher
+	// timeout. If zero, failed requests are not retried.
+	FetcherRetry FetcherRetryPolicy
+
+	// OnFetcherError, if set, is called for each key that a fetcher failed
+	// to look up because of an error, after any retries, i.e. so that a
+	// server that keeps failing can be reported or avoided.
+	OnFetcherError func(fetcherName string, req gomatrixserverlib.PublicKeyLookupRequest, err error)
+
+	// VerifyFetchedKeys makes us check again that the keys from fetchers
+	// which implement SignedKeyFetcher were signed by the server that they
+	// belong to before using or storing them. Keys that fail verification
+	// are dropped. Other fetchers are trusted to have done this already.
+	VerifyFetchedKeys bool
+
+	// TrustedNotaries, if set, are the only notary servers whose responses
+	// we will accept keys from, along with the keys that they sign their
+	// responses with. Responses from notary fetchers, i.e. those that
+	// implement NotaryKeyFetcher, that aren't signed by at least one of
+	// these are dropped before anything is stored. Otherwise each notary
+	// fetcher's responses only need to be signed by its own notary.
+	TrustedNotaries map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]ed25519.PublicKey
+
+	// CaptureRawKeysFor lists the servers whose signed key responses
+	// should be passed to OnRawKeyResponse when they are fetched, along
+	// with the keys that were taken from them, e.g. so that an admin can
+	// verify them independently later. Only fetchers that implement
+	// SignedKeyFetcher can capture responses, and they are verified as if
+	// VerifyFetchedKeys were set whenever one of these servers is fetched.
+	CaptureRawKeysFor []gomatrixserverlib.ServerName
+	OnRawKeyResponse  func(
+		fetcherName string,
+		serverName gomatrixserverlib.ServerName,
+		raw []byte,
+		results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	)
+
+	// FetcherParallelism, if greater than 1, makes FetchKeys ask all of
+	// the key fetchers for the outstanding keys at the same time, using up
+	// to this many at once, rather than one after another. If more than
+	// one fetcher finds a key then the one that is valid for the longest
+	// is used. The notary fetchers are still only asked afterwards.
+	FetcherParallelism int
+
+	// AdaptiveFetcherOrder makes FetchKeys keep track of how often each
+	// key fetcher finds keys for each server, and try the fetchers that
+	// have been most successful for the servers in a request first. The
+	// key fetchers are still always tried before the notary fetchers. By
+	// default the fetchers are tried in the order they were configured.
+	AdaptiveFetcherOrder bool
+
+	fetcherStatsMutex sync.Mutex
+	fetcherStats      map[fetcherStatsKey]*fetcherStats
+
+	// StaleWhileRevalidate allows expired keys from the database to be
+	// returned straight away, rather than waiting for the fetchers to
+	// refresh them. The refresh instead happens in the background using
+	// up to RevalidateWorkers goroutines.
+	StaleWhileRevalidate bool
+	RevalidateWorkers    int
+
+	// RefreshThreshold, if set, causes keys that are still valid but will
+	// expire within this long to be refreshed from the fetchers in the
+	// background, while the key that we have is returned straight away.
+	RefreshThreshold time.Duration
+
+	// MaxCacheAge, if set, is the longest that we will go on using a key
+	// that we fetched before fetching it again, even if it is still
+	// valid, so that key rotations are picked up promptly. Keys whose
+	// fetch time isn't known are fetched again. The key that we have is
+	// still used if fetching it again fails. If zero, keys are used for
+	// as long as they are valid.
+	MaxCacheAge time.Duration
+
+	revalidateOnce  sync.Once
+	revalidateQueue chan map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp
+
+	// NegativeCacheTTL is how long we will remember that we failed to
+	// fetch a key for, during which time we won't ask the fetchers for
+	// it again. If zero, failed lookups are not cached.
+	NegativeCacheTTL time.Duration
+
+	// PersistNegativeCache, if true, also records failed lookups in the
+	// key database so that they can be loaded again with LoadNegativeCache
+	// after a restart. Entries expire after NegativeCacheTTL as usual.
+	PersistNegativeCache bool
+
+	// FetchRateLimit is the maximum number of times per minute that we
+	// will ask the fetchers for keys belonging to any one server. Any
+	// requests beyond that are deferred, and any keys that we already
+	// have are used instead. If zero, fetches are not rate limited.
+	FetchRateLimit int
+
+	rateLimitMutex sync.Mutex
+	rateLimits     map[gomatrixserverlib.ServerName]*fetchTokenBucket
+
+	// CircuitBreakerThreshold is how many fetches in a row, within
+	// CircuitBreakerWindow, can fail for keys belonging to one server
+	// before we stop asking the fetchers for that server's keys for
+	// CircuitBreakerCooldown. Any keys that we already have for it are
+	// used in the meantime, even if they have expired. If zero, there is
+	// no circuit breaking.
+	CircuitBreakerThreshold int
+	CircuitBreakerWindow    time.Duration
+	CircuitBreakerCooldown  time.Duration
+
+	breakerMutex sync.Mutex
+	breakers     map[gomatrixserverlib.ServerName]*circuitBreaker
+
+	// KeyCacheSize is the maximum number of keys to hold in an in-memory
+	// LRU cache in front of the key database. Expired keys found in the
+	// cache are returned but are also refreshed in the background. If
+	// zero, there is no in-memory cache.
+	KeyCacheSize int
+
+	keyCacheOnce sync.Once
+	keyCacheLRU  *lru.Cache
+
+	// KeyExpiryWarning is how long before the end of the validity period
+	// of our own signing key that we should start warning that it needs
+	// to be rotated. The validity period is measured from ServerKeyIssuedAt,
+	// or from when we first checked if that isn't set. If zero, no
+	// warnings will be emitted.
+	KeyExpiryWarning  time.Duration
+	ServerKeyIssuedAt time.Time
+
+	keyExpiryMutex  sync.Mutex
+	keyFirstSeenAt  time.Time
+	keyExpiryWarned bool
+
+	// MaxKeyValidity is the furthest into the future that we will accept
+	// a fetched key's ValidUntilTS to be. Keys that claim to be valid for
+	// longer are clamped to this, so that a remote server can't get us to
+	// cache a key forever. If zero, defaultMaxKeyValidity is used.
+	MaxKeyValidity time.Duration
+
+	// MaxKeyValidityOverrides replaces MaxKeyValidity for the keys of
+	// specific servers, i.e. so that our own organisation's other servers
+	// can be trusted to advertise longer validity periods.
+	MaxKeyValidityOverrides map[gomatrixserverlib.ServerName]time.Duration
+
+	// MinStoreValidity is how long a fetched key must still be valid for
+	// in order for us to store it. Keys that expire sooner are still used
+	// for the request that fetched them, but aren't stored, as they would
+	// only need to be fetched again straight away. Keys that have already
+	// been replaced by the server, i.e. that have an ExpiredTS, are always
+	// stored. If zero, all fetched keys are stored.
+	MinStoreValidity time.Duration
+
+	// ReadReplica, if set, is asked for stored keys instead of
+	// OurKeyRing.KeyDatabase, i.e. a read-only replica of the key database
+	// in a large deployment. Keys are still only ever written to, and
+	// managed through, OurKeyRing.KeyDatabase.
+	ReadReplica gomatrixserverlib.KeyFetcher
+
+	// VerboseFetchLogging logs each call to a key fetcher, and each batch
+	// of keys stored as a result, at info level rather than debug level,
+	// i.e. while debugging federation. These are too noisy to log by
+	// default on a busy server.
+	VerboseFetchLogging bool
+
+	// AcceptedKeyAlgorithms lists the key algorithms, i.e. the "ed25519"
+	// in "ed25519:auto", that we accept keys for from the fetchers. Keys
+	// for any other algorithm are dropped before they are used or stored,
+	// since we wouldn't be able to verify anything with them. If empty,
+	// defaultAcceptedKeyAlgorithms is used.
+	AcceptedKeyAlgorithms []string
+
+	// HonourFetchCancellation makes FetchKeys stop working on a request
+	// when the caller's context is cancelled or reaches its deadline. By
+	// default we carry on regardless, so that the keys we fetch can be
+	// stored for next time. Stores are never cancelled either way.
+	HonourFetchCancellation bool
+
+	// PrefetchConcurrency is the maximum number of servers that
+	// PrefetchServerKeys will ask for keys at once. If zero,
+	// defaultPrefetchConcurrency is used.
+	PrefetchConcurrency int
+
+	// MaxRequestsPerFetch is the maximum number of keys that can be asked
+	// for in a single call to FetchKeys. Calls asking for more are refused
+	// with a TooManyKeyRequestsError before anything is fetched, so that a
+	// malicious event can't make us contact huge numbers of servers. If
+	// zero, there is no limit.
+	MaxRequestsPerFetch int
+
+	// StoreBatchSize is the maximum number of keys that will be stored
+	// in the database at once. If zero, defaultStoreBatchSize is used.
+	StoreBatchSize int
+
+	// ExportBatchSize is the maximum number of keys that ExportKeysStream
+	// will read from the database at once. If zero,
+	// defaultExportBatchSize is used.
+	ExportBatchSize int
+
+	// RolloverRetryDelay, if set, makes FetchKeys wait this long and then
+	// try again to find any keys that don't cover the requested time when
+	// a fetcher has just given us other keys for the same server, i.e.
+	// because the server is part way through rotating its keys and hasn't
+	// published the new one yet. If zero, such keys are reported straight
+	// away.
+	RolloverRetryDelay time.Duration
+
+	// ClockSkewTolerance allows for our clock being this far out from the
+	// clocks of other servers when deciding whether a key that we already
+	// have is still valid, so that we don't refetch a key just because it
+	// appears to have expired a moment ago. If zero, keys are checked
+	// against our own clock exactly.
+	ClockSkewTolerance time.Duration
+
+	// Now returns the current time. If nil, time.Now is used. This is
+	// mostly useful for testing validity periods deterministically.
+	Now func() time.Time
+
+	negativeCacheMutex   sync.Mutex
+	negativeCache        map[gomatrixserverlib.PublicKeyLookupRequest]time.Time
+	negativeCacheSweptAt time.Time
+
+	inflightMutex sync.Mutex
+	inflight      map[gomatrixserverlib.PublicKeyLookupRequest]*inflightFetch
+
+	storesMutex sync.Mutex
+	stores      sync.WaitGroup
+	draining    int
+
+	subscribersMutex sync.Mutex
+	subscribers      map[int]KeyUpdateFunc
+	nextSubscriberID int
+}
+
+// LocalServerKey is one of our own signing keys. If ValidUntilTS is
+// zero then the key is valid for the same period as our primary key.
+// If ValidUntilTS is in the past then the key will be reported as an
+// expired key.
+type LocalServerKey struct {
+	KeyID        gomatrixserverlib.KeyID
+	PublicKey    ed25519.PublicKey
+	ValidUntilTS gomatrixserverlib.Timestamp
+}
+
+// defaultAcceptedKeyAlgorithms is used when no AcceptedKeyAlgorithms have
+// been configured on the ServerKeyAPI.
+var defaultAcceptedKeyAlgorithms = []string{"ed25519"}
+
+// defaultStoreBatchSize is used when no StoreBatchSize has been
+// configured on the ServerKeyAPI.
+const defaultStoreBatchSize = 100
+
+// defaultFetcherTimeout is used when no FetcherTimeout has been
+// configured on the ServerKeyAPI.
+const defaultFetcherTimeout = time.Second * 30
+
+// defaultMaxKeyValidity is used when no MaxKeyValidity has been
+// configured on the ServerKeyAPI. The spec recommends that keys are
+// not cached for longer than 7 days.
+const defaultMaxKeyValidity = time.Hour * 24 * 7
+
+// fetcherWithTimeout is an optional interface that key fetchers can
+// implement in order to override the fetcher timeout for themselves.
+type fetcherWithTimeout interface {
+	FetcherTimeout() time.Duration
 }
 
 func (s *ServerKeyAPI) KeyRing() *gomatrixserverlib.KeyRing {
@@ -30,32 +328,181 @@ func (s *ServerKeyAPI) KeyRing() *gomatrixserverlib.KeyRing {
 	// below functions. That way we can enforce things like validity
 	// and keeping the cache up-to-date.
 	return &gomatrixserverlib.KeyRing{
-		KeyDatabase: s,
+		KeyDatabase: keyRingDatabase{s},
 		KeyFetchers: []gomatrixserverlib.KeyFetcher{},
 	}
 }
 
+// keyRingDatabase wraps the ServerKeyAPI for use as the database of a
+// keyring. The keyring works out for itself which keys are missing, so
+// we don't want a MissingKeysError to fail verification of the requests
+// that we were able to satisfy.
+type keyRingDatabase struct {
+	*ServerKeyAPI
+}
+
+func (d keyRingDatabase) FetchKeys(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	results, err := d.ServerKeyAPI.FetchKeys(ctx, requests)
+	var missing *api.MissingKeysError
+	if errors.As(err, &missing) {
+		return results, nil
+	}
+	return results, err
+}
+
 func (s *ServerKeyAPI) StoreKeys(
-	_ context.Context,
+	ctx context.Context,
 	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
 ) error {
-	// Run in a background context - we don't want to stop this work just
-	// because the caller gives up waiting.
-	ctx := context.Background()
+	// Detach from the caller's context - we don't want to stop this work
+	// just because the caller gives up waiting, but we do want to keep
+	// any tracing information.
+	ctx = detachContext(ctx)
 
 	// Store any keys that we were given in our database.
-	return s.OurKeyRing.KeyDatabase.StoreKeys(ctx, results)
+	return s.storeKeys(ctx, results, gomatrixserverlib.AsTimestamp(s.now()))
+}
+
+// keyFetchTimeStore is implemented by key databases that are able to
+// record when each key was fetched at a time other than now, such as the
+// signing key server storage.
+type keyFetchTimeStore interface {
+	StoreKeysFetchedAt(
+		ctx context.Context,
+		keyMap map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+		fetchedTS gomatrixserverlib.Timestamp,
+	) error
+}
+
+// storeKeys stores the given keys in the database, splitting them up
+// into batches of at most StoreBatchSize keys. A failure to store one
+// batch doesn't stop us from trying to store the others, and only the
+// batches that were stored are added to the in-memory cache. The keys are
+// recorded as having been fetched at fetchedTS, or if that is zero then
+// whenever the database last recorded them as being fetched.
+func (s *ServerKeyAPI) storeKeys(
+	ctx context.Context,
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	fetchedTS gomatrixserverlib.Timestamp,
+) error {
+	if len(results) == 0 {
+		return nil
+	}
+	defer s.beginStore()()
+	batchSize := s.StoreBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultStoreBatchSize
+	}
+	store := s.OurKeyRing.KeyDatabase.StoreKeys
+	if db, ok := s.OurKeyRing.KeyDatabase.(keyFetchTimeStore); ok {
+		store = func(
+			ctx context.Context,
+			keyMap map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+		) error {
+			return db.StoreKeysFetchedAt(ctx, keyMap, fetchedTS)
+		}
+	}
+	if len(results) <= batchSize {
+		if err := store(ctx, results); err != nil {
+			return err
+		}
+		s.cacheKeys(results, fetchedTS)
+		s.publishKeyUpdates(results)
+		return nil
+	}
+
+	var errs []error
+	batches := 0
+	batch := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, batchSize)
+	flush := func() {
+		batches++
+		if err := store(ctx, batch); err != nil {
+			errs = append(errs, err)
+		} else {
+			s.cacheKeys(batch, fetchedTS)
+			s.publishKeyUpdates(batch)
+		}
+		batch = make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, batchSize)
+	}
+	for req, res := range results {
+		batch[req] = res
+		if len(batch) == batchSize {
+			flush()
+		}
+	}
+	if len(batch) > 0 {
+		flush()
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to store %d of %d batch(es) of keys: %w", len(errs), batches, errs[0])
+	}
+	return nil
 }
 
 func (s *ServerKeyAPI) FetchKeys(
-	_ context.Context,
+	ctx context.Context,
 	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
 ) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
-	// Run in a background context - we don't want to stop this work just
-	// because the caller gives up waiting.
-	ctx := context.Background()
-	now := gomatrixserverlib.AsTimestamp(time.Now())
+	results, _, err := s.FetchKeysWithProvenance(ctx, requests)
+	return results, err
+}
+
+// FetchKeysWithProvenance works in the same way as FetchKeys, but also
+// returns where each of the results came from: "local" for our own keys,
+// "cache" for the in-memory key cache, "database" for the key database,
+// or otherwise the name of the key fetcher that found the key.
+//
+// Server names are normalised before the keys are looked up, so that i.e.
+// "Example.com." and "example.com" share the same cache entries, but the
+// results are returned under the requests that we were given. Requests
+// for invalid server names are reported as missing.
+func (s *ServerKeyAPI) FetchKeysWithProvenance(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (
+	map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	map[gomatrixserverlib.PublicKeyLookupRequest]string,
+	error,
+) {
+	if s.MaxRequestsPerFetch > 0 && len(requests) > s.MaxRequestsPerFetch {
+		return nil, nil, &api.TooManyKeyRequestsError{
+			Requested: len(requests),
+			Limit:     s.MaxRequestsPerFetch,
+		}
+	}
+
+	normalised, aliases, invalid := normaliseRequests(requests)
+	pending := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, len(normalised))
+	for req, ts := range normalised {
+		pending[req] = ts
+	}
+	results, provenance, err := s.fetchKeysWithProvenance(ctx, pending)
+	results, provenance, err = s.retryRolloverGaps(ctx, normalised, results, provenance, err)
+	return restoreRequests(aliases, invalid, results, provenance, err)
+}
+
+// fetchKeysWithProvenance does the work of FetchKeysWithProvenance for
+// requests whose server names have been normalised.
+func (s *ServerKeyAPI) fetchKeysWithProvenance(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (
+	map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	map[gomatrixserverlib.PublicKeyLookupRequest]string,
+	error,
+) {
+	// Unless we've been told otherwise, detach from the caller's context
+	// - we don't want to stop this work just because the caller gives up
+	// waiting, but we do want to keep any tracing information.
+	if !s.HonourFetchCancellation {
+		ctx = detachContext(ctx)
+	}
+	now := gomatrixserverlib.AsTimestamp(s.now())
 	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	provenance := map[gomatrixserverlib.PublicKeyLookupRequest]string{}
 	origRequests := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
 	for k, v := range requests {
 		origRequests[k] = v
@@ -63,79 +510,259 @@ func (s *ServerKeyAPI) FetchKeys(
 
 	// First, check if any of these key checks are for our own keys. If
 	// they are then we will satisfy them directly.
-	s.handleLocalKeys(ctx, requests, results)
+	_, localCtx, finishLocal := traceStage(ctx, "handleLocalKeys", requests)
+	localErr := s.handleLocalKeys(localCtx, requests, results)
+	finishLocal()
+	if localErr != nil {
+		return nil, nil, localErr
+	}
+	recordProvenance(provenance, results, keySourceLocal)
+
+	// Then check our in-memory cache, if we have one.
+	s.handleCachedKeys(now, requests, results)
+	recordProvenance(provenance, results, keySourceCache)
 
 	// Then consult our local database and see if we have the requested
 	// keys. These might come from a cache, depending on the database
 	// implementation used.
-	if err := s.handleDatabaseKeys(ctx, now, requests, results); err != nil {
-		return nil, err
+	_, databaseCtx, finishDatabase := traceStage(ctx, "handleDatabaseKeys", requests)
+	err := s.handleDatabaseKeys(databaseCtx, now, requests, results)
+	finishDatabase()
+	if err != nil {
+		return nil, nil, err
 	}
+	recordProvenance(provenance, results, keySourceDatabase)
+
+	// If we're allowed to serve stale keys then any expired keys that we
+	// found in the database can be returned straight away, and refreshed
+	// in the background instead.
+	if s.StaleWhileRevalidate {
+		s.revalidateStaleKeys(requests, results)
+	}
+
+	// Don't bother asking the fetchers for any keys that we recently
+	// failed to find.
+	s.skipNegativelyCached(requests, results)
+
+	// If another FetchKeys call is already fetching some of the keys
+	// that we still need then we'll wait for that instead of asking the
+	// fetchers for them a second time.
+	owned, waiting := s.claimInflight(requests)
 
 	// For any key requests that we still have outstanding, next try to
-	// fetch them directly. We'll go through each of the key fetchers to
-	// ask for the remaining keys
-	for _, fetcher := range s.OurKeyRing.KeyFetchers {
-		// If there are no more keys to look up then stop.
-		if len(requests) == 0 {
-			break
-		}
+	// fetch them directly.
+	fetchersTried, notFound := s.handleFetchers(ctx, now, requests, results, provenance)
+	s.cacheNegativeResults(ctx, notFound, results)
 
-		// Ask the fetcher to look up our keys.
-		if err := s.handleFetcherKeys(ctx, now, fetcher, requests, results); err != nil {
-			logrus.WithError(err).WithFields(logrus.Fields{
-				"fetcher_name": fetcher.FetcherName(),
-			}).Errorf("Failed to retrieve %d key(s)", len(requests))
-			continue
-		}
-	}
+	// Let anyone who was waiting for our keys know what we found, and
+	// then wait for the keys that someone else was fetching for us.
+	s.releaseInflight(owned, results, provenance)
+	s.waitInflight(waiting, results, provenance)
+	s.reportStaleServes(now, results, provenance)
 
 	// Check that we've actually satisfied all of the key requests that we
 	// were given. We should report an error if we didn't.
+	var missing []gomatrixserverlib.PublicKeyLookupRequest
 	for req := range origRequests {
 		if _, ok := results[req]; !ok {
 			// The results don't contain anything for this specific request, so
 			// we've failed to satisfy it from local keys, database keys or from
 			// all of the fetchers. Report an error.
-			logrus.Warnf("Failed to retrieve key %q for server %q", req.KeyID, req.ServerName)
+			logrus.WithFields(logrus.Fields{
+				"server_name":    req.ServerName,
+				"key_id":         req.KeyID,
+				"fetchers_tried": fetchersTried,
+			}).Warn("Failed to retrieve server key")
+			missing = append(missing, req)
+			keyLookups.WithLabelValues(keySourceMissing, "").Inc()
 		}
 	}
+	if len(missing) > 0 {
+		sortRequests(missing)
+		return results, provenance, &api.MissingKeysError{Missing: missing}
+	}
 
 	// Return the keys.
-	return results, nil
+	return results, provenance, nil
+}
+
+// sortRequests sorts key requests by server name and then by key ID, so
+// that i.e. errors listing them are stable.
+func sortRequests(requests []gomatrixserverlib.PublicKeyLookupRequest) {
+	sort.Slice(requests, func(i, j int) bool {
+		if requests[i].ServerName != requests[j].ServerName {
+			return requests[i].ServerName < requests[j].ServerName
+		}
+		return requests[i].KeyID < requests[j].KeyID
+	})
+}
+
+// recordProvenance notes the given source for any results that we don't
+// already know the source of.
+func recordProvenance(
+	provenance map[gomatrixserverlib.PublicKeyLookupRequest]string,
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	source string,
+) {
+	if provenance == nil {
+		return
+	}
+	for req := range results {
+		if _, ok := provenance[req]; !ok {
+			provenance[req] = source
+		}
+	}
+}
+
+// reportStaleServes counts the keys that we are returning from the cache
+// or the database even though they are no longer valid, i.e. because the
+// fetchers couldn't find anything newer. A lot of these for a server can
+// be a sign that we're having trouble federating with it.
+func (s *ServerKeyAPI) reportStaleServes(
+	now gomatrixserverlib.Timestamp,
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	provenance map[gomatrixserverlib.PublicKeyLookupRequest]string,
+) {
+	for req, res := range results {
+		if source := provenance[req]; source != keySourceCache && source != keySourceDatabase {
+			continue
+		}
+		if s.wasValidAt(res, now) {
+			continue
+		}
+		logrus.WithFields(logrus.Fields{
+			"server_name":    req.ServerName,
+			"key_id":         req.KeyID,
+			"valid_until_ts": res.ValidUntilTS,
+			"expired_ts":     res.ExpiredTS,
+		}).Debug("Returning a server key that is no longer valid")
+		staleKeyServes.WithLabelValues(string(req.ServerName)).Inc()
+	}
 }
 
 func (s *ServerKeyAPI) FetcherName() string {
 	return fmt.Sprintf("ServerKeyAPI (wrapping %q)", s.OurKeyRing.KeyDatabase.FetcherName())
 }
 
+// readDatabase returns the database that stored keys should be read from,
+// which is the ReadReplica if there is one.
+func (s *ServerKeyAPI) readDatabase() gomatrixserverlib.KeyFetcher {
+	if s.ReadReplica != nil {
+		return s.ReadReplica
+	}
+	return s.OurKeyRing.KeyDatabase
+}
+
+// fetchLogLevel returns the level to log each fetch at, depending on
+// VerboseFetchLogging.
+func (s *ServerKeyAPI) fetchLogLevel() logrus.Level {
+	if s.VerboseFetchLogging {
+		return logrus.InfoLevel
+	}
+	return logrus.DebugLevel
+}
+
+// FetcherChain returns the names of the places that FetchKeys looks for
+// remote keys in, in the order that it looks in them: the key database,
+// then each of the key fetchers and then each of the notary fetchers,
+// i.e. for an admin diagnostics page. If AdaptiveFetcherOrder is set then
+// the fetchers may be tried in a different order for some servers.
+func (s *ServerKeyAPI) FetcherChain() []string {
+	chain := make([]string, 0, 1+len(s.OurKeyRing.KeyFetchers)+len(s.NotaryFetchers))
+	chain = append(chain, s.OurKeyRing.KeyDatabase.FetcherName())
+	for _, fetcher := range s.OurKeyRing.KeyFetchers {
+		chain = append(chain, fetcher.FetcherName())
+	}
+	for _, fetcher := range s.NotaryFetchers {
+		chain = append(chain, fetcher.FetcherName())
+	}
+	return chain
+}
+
+// now returns the current time, according to the configured clock.
+func (s *ServerKeyAPI) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// wasValidAt returns true if the key was valid at the given time, to
+// within ClockSkewTolerance either side of it. Keys don't have a start
+// to their validity, so only the end of the validity period needs to be
+// widened.
+func (s *ServerKeyAPI) wasValidAt(res gomatrixserverlib.PublicKeyLookupResult, ts gomatrixserverlib.Timestamp) bool {
+	if res.WasValidAt(ts, true) {
+		return true
+	}
+	tolerance := gomatrixserverlib.Timestamp(s.ClockSkewTolerance / time.Millisecond)
+	return tolerance > 0 && ts > tolerance && res.WasValidAt(ts-tolerance, true)
+}
+
+// SetKeyValidity changes how long our own keys are reported to be valid
+// for from now on. It is safe to call while keys are being served.
+func (s *ServerKeyAPI) SetKeyValidity(d time.Duration) {
+	s.localKeyMutex.Lock()
+	defer s.localKeyMutex.Unlock()
+	s.ServerKeyValidity = d
+}
+
+// keyValidity returns how long our own keys are currently valid for.
+func (s *ServerKeyAPI) keyValidity() time.Duration {
+	s.localKeyMutex.RLock()
+	defer s.localKeyMutex.RUnlock()
+	return s.ServerKeyValidity
+}
+
+// fetcherTimeout returns how long the given fetcher should be allowed
+// to run for before we give up on it.
+func (s *ServerKeyAPI) fetcherTimeout(fetcher gomatrixserverlib.KeyFetcher) time.Duration {
+	if f, ok := fetcher.(fetcherWithTimeout); ok {
+		if timeout := f.FetcherTimeout(); timeout > 0 {
+			return timeout
+		}
+	}
+	if s.FetcherTimeout > 0 {
+		return s.FetcherTimeout
+	}
+	return defaultFetcherTimeout
+}
+
 // handleLocalKeys handles cases where the key request contains
 // a request for our own server keys, either current or old.
 func (s *ServerKeyAPI) handleLocalKeys(
 	_ context.Context,
 	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
 	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
-) {
+) error {
 	for req := range requests {
-		if req.ServerName != s.ServerName {
+		if !s.isLocalServerName(req.ServerName) {
 			continue
 		}
-		if req.KeyID == s.ServerKeyID {
-			// We found a key request that is supposed to be for our own
-			// keys. Remove it from the request list so we don't hit the
-			// database or the fetchers for it.
+		if res, ok := s.currentLocalKey(req.KeyID); ok {
+			// Refuse to hand out an empty key, since nothing signed by
+			// us would verify against it.
+			if len(res.Key) == 0 {
+				logrus.WithField("key_id", req.KeyID).Error("Our own signing key has no public key, check the server configuration")
+				return &api.EmptyLocalKeyError{KeyID: req.KeyID}
+			}
+
+			// We found a key request that is supposed to be for one of
+			// our own current keys. Remove it from the request list so we
+			// don't hit the database or the fetchers for it.
 			delete(requests, req)
 
 			// Insert our own key into the response.
-			results[req] = gomatrixserverlib.PublicKeyLookupResult{
-				VerifyKey: gomatrixserverlib.VerifyKey{
-					Key: gomatrixserverlib.Base64Bytes(s.ServerPublicKey),
-				},
-				ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
-				ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(s.ServerKeyValidity)),
-			}
+			results[req] = res
+			keyLookups.WithLabelValues(keySourceLocal, "").Inc()
+		} else if res, ok := s.retiredLocalKey(req.KeyID); ok {
+			// We found a key request for a key that was our primary key
+			// until it was rotated out at runtime.
+			delete(requests, req)
+			results[req] = res
+			keyLookups.WithLabelValues(keySourceLocal, "").Inc()
 		} else {
-			// The key request doesn't match our current key. Let's see
+			// The key request doesn't match our current keys. Let's see
 			// if it matches any of our old verify keys.
 			for _, oldVerifyKey := range s.OldServerKeys {
 				if req.KeyID == oldVerifyKey.KeyID {
@@ -151,6 +778,7 @@ func (s *ServerKeyAPI) handleLocalKeys(
 						ExpiredTS:    oldVerifyKey.ExpiredAt,
 						ValidUntilTS: gomatrixserverlib.PublicKeyNotValid,
 					}
+					keyLookups.WithLabelValues(keySourceLocal, "").Inc()
 
 					// No need to look at the other keys.
 					break
@@ -158,6 +786,77 @@ func (s *ServerKeyAPI) handleLocalKeys(
 			}
 		}
 	}
+	return nil
+}
+
+// ValidateLocalKeys returns an error if any of our own signing keys are
+// missing their public key or it isn't a valid ed25519 public key. It
+// should be called at startup so that a misconfiguration is caught before
+// we start serving keys.
+func (s *ServerKeyAPI) ValidateLocalKeys() error {
+	check := func(keyID gomatrixserverlib.KeyID, publicKey ed25519.PublicKey) error {
+		switch len(publicKey) {
+		case 0:
+			return &api.EmptyLocalKeyError{KeyID: keyID}
+		case ed25519.PublicKeySize:
+			return nil
+		default:
+			return fmt.Errorf("local signing key %q has a %d byte public key, expected %d bytes", keyID, len(publicKey), ed25519.PublicKeySize)
+		}
+	}
+	keyID, publicKey := s.primaryKey()
+	if err := check(keyID, publicKey); err != nil {
+		return err
+	}
+	for _, key := range s.ServerKeys {
+		if err := check(key.KeyID, key.PublicKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// currentLocalKey returns the lookup result for one of our own signing
+// keys with the given key ID, if we have one. Keys in ServerKeys whose
+// ValidUntilTS has passed are returned as expired keys.
+func (s *ServerKeyAPI) currentLocalKey(keyID gomatrixserverlib.KeyID) (gomatrixserverlib.PublicKeyLookupResult, bool) {
+	now := s.now()
+	validUntil := gomatrixserverlib.AsTimestamp(now.Add(s.keyValidity()))
+	if primaryKeyID, primaryKey := s.primaryKey(); keyID == primaryKeyID {
+		return gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey: gomatrixserverlib.VerifyKey{
+				Key: gomatrixserverlib.Base64Bytes(primaryKey),
+			},
+			ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+			ValidUntilTS: validUntil,
+		}, true
+	}
+	for _, key := range s.ServerKeys {
+		if key.KeyID != keyID {
+			continue
+		}
+		res := gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey: gomatrixserverlib.VerifyKey{
+				Key: gomatrixserverlib.Base64Bytes(key.PublicKey),
+			},
+			ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+			ValidUntilTS: validUntil,
+		}
+		switch {
+		case key.ValidUntilTS == 0:
+			// The key is valid for as long as any of our other keys.
+		case key.ValidUntilTS < gomatrixserverlib.AsTimestamp(now):
+			// The key was valid in the past but isn't any more.
+			res.ExpiredTS = key.ValidUntilTS
+			res.ValidUntilTS = gomatrixserverlib.PublicKeyNotValid
+		case key.ValidUntilTS < validUntil:
+			// The key is going to stop being valid before the usual
+			// validity period is up.
+			res.ValidUntilTS = key.ValidUntilTS
+		}
+		return res, true
+	}
+	return gomatrixserverlib.PublicKeyLookupResult{}, false
 }
 
 // handleDatabaseKeys handles cases where the key requests can be
@@ -168,13 +867,25 @@ func (s *ServerKeyAPI) handleDatabaseKeys(
 	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
 	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
 ) error {
+	// If we've already found everything then don't bother the database.
+	if len(requests) == 0 {
+		return nil
+	}
+
 	// Ask the database/cache for the keys.
-	dbResults, err := s.OurKeyRing.KeyDatabase.FetchKeys(ctx, requests)
+	dbResults, err := s.readDatabase().FetchKeys(ctx, requests)
 	if err != nil {
 		return err
 	}
+	var fetched map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp
+	checkAge := false
+	if s.MaxCacheAge > 0 {
+		fetched, checkAge = s.keyFetchTimes(ctx, dbResults)
+	}
+	s.cacheDatabaseKeys(dbResults, fetched)
 
 	// We successfully got some keys. Add them to the results.
+	expiring := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
 	for req, res := range dbResults {
 		// The key we've retrieved from the database/cache might
 		// have passed its validity period, but right now, it's
@@ -186,49 +897,345 @@ func (s *ServerKeyAPI) handleDatabaseKeys(
 		// from the request list as we don't need to fetch it again
 		// in that case. If the key isn't valid right now, then by
 		// leaving it in the 'requests' map, we'll try to update the
-		// key using the fetchers in handleFetcherKeys.
-		if res.WasValidAt(now, true) {
+		// key using the fetchers in handleFetcherKeys. We do the same
+		// if we fetched the key longer ago than MaxCacheAge.
+		if checkAge && s.tooOldToUse(now, fetched[req]) {
+			continue
+		}
+		if s.wasValidAt(res, now) {
+			if s.expiresSoon(now, res) {
+				expiring[req] = requests[req]
+			}
 			delete(requests, req)
+			keyLookups.WithLabelValues(keySourceDatabase, "").Inc()
 		}
 	}
+	if len(expiring) > 0 {
+		s.queueRevalidation(expiring)
+	}
 	return nil
 }
 
+// handleFetchers goes through each of the key fetchers in turn to ask
+// for the remaining keys, until either there are no keys left to find
+// or we have run out of fetchers. If FetcherParallelism is set then the
+// key fetchers are asked at the same time instead, followed by the
+// notary fetchers. Returns how many fetchers were asked, and the requests
+// that a fetcher answered without the key, which might still have been
+// found by another fetcher.
+func (s *ServerKeyAPI) handleFetchers(
+	ctx context.Context,
+	now gomatrixserverlib.Timestamp,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	provenance map[gomatrixserverlib.PublicKeyLookupRequest]string,
+) (int, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp) {
+	// Limit how long the fetchers can take between them, so that a chain
+	// of slow fetchers can't hold up the request for the sum of all of
+	// their timeouts.
+	if s.FetchBudget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.FetchBudget)
+		defer cancel()
+	}
+
+	tried := 0
+	notFound := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
+	for _, fetchers := range [][]gomatrixserverlib.KeyFetcher{s.OurKeyRing.KeyFetchers, s.NotaryFetchers} {
+		if s.fetchBudgetExhausted(ctx) {
+			break
+		}
+		if s.FetcherParallelism > 1 {
+			if len(requests) == 0 {
+				break
+			}
+			tried += s.handleFetchersConcurrently(ctx, fetchers, requests, results, provenance, notFound)
+			continue
+		}
+		for _, fetcher := range s.orderFetchers(fetchers, requests) {
+			// If there are no more keys to look up then stop.
+			if len(requests) == 0 {
+				break
+			}
+			// Likewise if we've run out of time to look them up.
+			if s.fetchBudgetExhausted(ctx) {
+				break
+			}
+
+			// Ask the fetcher to look up our keys.
+			tried++
+			if err := s.handleFetcherKeys(ctx, now, fetcher, requests, results, provenance, notFound); err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"fetcher_name": fetcher.FetcherName(),
+				}).Errorf("Failed to retrieve %d key(s)", len(requests))
+				continue
+			}
+		}
+	}
+	if len(requests) > 0 && s.fetchBudgetExhausted(ctx) {
+		logrus.WithFields(logrus.Fields{
+			"fetch_budget": s.FetchBudget,
+		}).Warnf("Fetch budget exhausted, giving up on %d key(s)", len(requests))
+	}
+	return tried, notFound
+}
+
+// fetchBudgetExhausted returns true if FetchBudget is set and has been
+// used up.
+func (s *ServerKeyAPI) fetchBudgetExhausted(ctx context.Context) bool {
+	return s.FetchBudget > 0 && ctx.Err() != nil
+}
+
 // handleFetcherKeys handles cases where a fetcher can satisfy
-// the remaining requests.
+// the remaining requests. Any requests that the fetcher answered without
+// the key are added to notFound.
 func (s *ServerKeyAPI) handleFetcherKeys(
 	ctx context.Context,
 	_ gomatrixserverlib.Timestamp,
 	fetcher gomatrixserverlib.KeyFetcher,
 	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
 	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	provenance map[gomatrixserverlib.PublicKeyLookupRequest]string,
+	notFound map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
 ) error {
+	span, ctx, finish := traceStage(ctx, "handleFetcherKeys", requests)
+	defer finish()
+	span.SetTag("fetcher_name", fetcher.FetcherName())
+
+	fetcherResults, asked, err := s.fetchFromFetcher(ctx, fetcher, requests)
+	noteNotFound(ctx, notFound, asked, fetcherResults, err)
+	if err != nil {
+		return err
+	}
+	return s.mergeFetcherResults(ctx, fetcher.FetcherName(), fetcherResults, requests, results, provenance)
+}
+
+// fetchFromFetcher asks the fetcher for the requested keys, subject to
+// rate limiting, the fetcher timeout and the retry policy, and returns
+// what it found with the validity periods clamped, along with which of
+// the requests the fetcher was actually asked for. If the fetcher only
+// failed for some of the servers then the requests for those servers are
+// left out unless the failure was definite.
+func (s *ServerKeyAPI) fetchFromFetcher(
+	ctx context.Context,
+	fetcher gomatrixserverlib.KeyFetcher,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (
+	map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+	error,
+) {
+	// Don't ask for keys from servers that keep failing.
+	allowedRequests := s.circuitBreakRequests(requests)
+	if skipped := len(requests) - len(allowedRequests); skipped > 0 {
+		logrus.WithFields(logrus.Fields{
+			"fetcher_name": fetcher.FetcherName(),
+		}).Warnf("Circuit breaker open, skipping %d key(s)", skipped)
+	}
+
+	// Don't ask for keys from servers that we've asked too often lately.
+	fetchRequests := s.rateLimitRequests(allowedRequests)
+	if deferred := len(allowedRequests) - len(fetchRequests); deferred > 0 {
+		logrus.WithFields(logrus.Fields{
+			"fetcher_name": fetcher.FetcherName(),
+		}).Warnf("Rate limited, deferring %d key(s)", deferred)
+	}
+	if len(fetchRequests) == 0 {
+		return nil, fetchRequests, nil
+	}
+
 	logrus.WithFields(logrus.Fields{
 		"fetcher_name": fetcher.FetcherName(),
-	}).Infof("Fetching %d key(s)", len(requests))
+	}).Logf(s.fetchLogLevel(), "Fetching %d key(s)", len(fetchRequests))
 
-	// Create a context that limits our requests to 30 seconds.
-	fetcherCtx, fetcherCancel := context.WithTimeout(ctx, time.Second*30)
+	// Create a context that limits how long we will wait for the
+	// fetcher to respond.
+	fetcherCtx, fetcherCancel := context.WithTimeout(ctx, s.fetcherTimeout(fetcher))
 	defer fetcherCancel()
 
+	fetcher = s.checkingFetcher(fetcher, s.shouldCaptureRawKeys(fetchRequests))
+
 	// Try to fetch the keys.
-	fetcherResults, err := fetcher.FetchKeys(fetcherCtx, requests)
+	fetcherResults, err := s.fetchWithRetry(fetcherCtx, fetcher, fetchRequests)
+	asked := fetchRequests
+	var serverErrs serverFetchErrors
+	if errors.As(err, &serverErrs) {
+		// Only some of the servers failed, so use what the others told us.
+		asked = s.noteServerFetchErrors(ctx, fetcher.FetcherName(), fetchRequests, fetcherResults, serverErrs)
+		err = nil
+	}
 	if err != nil {
-		return fmt.Errorf("fetcher.FetchKeys: %w", err)
+		failed := map[gomatrixserverlib.ServerName]bool{}
+		for req := range fetchRequests {
+			if s.OnFetcherError != nil {
+				s.OnFetcherError(fetcher.FetcherName(), req, err)
+			}
+			failed[req.ServerName] = true
+		}
+		for serverName := range failed {
+			s.recordFetchFailure(serverName)
+		}
+		s.recordFetcherOutcome(fetcher.FetcherName(), fetchRequests, nil)
+		return nil, fetchRequests, fmt.Errorf("fetcher.FetchKeys: %w", err)
+	}
+	fetcherResults = s.filterFetcherResults(fetcher.FetcherName(), fetchRequests, fetcherResults)
+	for req := range fetcherResults {
+		if _, failed := serverErrs[req.ServerName]; !failed {
+			s.recordFetchSuccess(req.ServerName)
+		}
+	}
+	s.recordFetcherOutcome(fetcher.FetcherName(), fetchRequests, fetcherResults)
+	return fetcherResults, asked, nil
+}
+
+// noteServerFetchErrors reports the servers that a fetcher failed to fetch
+// keys from while succeeding for others, in the same way as if the whole
+// fetch had failed. It returns the requests that the fetcher gave a
+// definite answer to, leaving out those for servers that failed in a way
+// that might not happen if we ask again, so that their keys aren't taken
+// to be missing.
+func (s *ServerKeyAPI) noteServerFetchErrors(
+	ctx context.Context,
+	fetcherName string,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+	fetcherResults map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	serverErrs serverFetchErrors,
+) map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp {
+	answered := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, len(requests))
+	for req, ts := range requests {
+		err, failed := serverErrs[req.ServerName]
+		if !failed || isDefiniteFetchError(ctx, err) {
+			answered[req] = ts
+		}
+		if _, ok := fetcherResults[req]; failed && !ok && s.OnFetcherError != nil {
+			s.OnFetcherError(fetcherName, req, err)
+		}
+	}
+	for serverName, err := range serverErrs {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"fetcher_name": fetcherName,
+			"server_name":  serverName,
+		}).Warn("Failed to retrieve keys for server")
+		s.recordFetchFailure(serverName)
+	}
+	return answered
+}
+
+// checkingFetcher returns the fetcher wrapped so that it asks for the
+// signed responses instead if we want to check them or, if capture is
+// set, to capture them. Responses from notaries are always checked if we
+// have been told which notaries to trust.
+func (s *ServerKeyAPI) checkingFetcher(fetcher gomatrixserverlib.KeyFetcher, capture bool) gomatrixserverlib.KeyFetcher {
+	if perspective, ok := fetcher.(*gomatrixserverlib.PerspectiveKeyFetcher); ok && len(s.TrustedNotaries) > 0 {
+		fetcher = PerspectiveKeyFetcher{perspective}
+	}
+	signed, ok := fetcher.(SignedKeyFetcher)
+	if !ok {
+		return fetcher
 	}
+	notary, isNotary := fetcher.(NotaryKeyFetcher)
+	if !capture && !s.VerifyFetchedKeys && !(isNotary && len(s.TrustedNotaries) > 0) {
+		return fetcher
+	}
+	verifying := verifyingFetcher{SignedKeyFetcher: signed}
+	if isNotary {
+		verifying.notaries = s.trustedNotaries(notary)
+	}
+	if capture {
+		verifying.capture = s.rawKeyCapturer(fetcher.FetcherName())
+	}
+	return verifying
+}
+
+// filterFetcherResults applies our own policies to the keys that a fetcher
+// returned for the requests before we use any of them.
+func (s *ServerKeyAPI) filterFetcherResults(
+	fetcherName string,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+	fetcherResults map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult {
+	// Don't let the fetcher give us keys for servers that we didn't ask
+	// it about, since they could poison the keys that we have for them.
+	fetcherResults = discardUnrequestedServers(fetcherName, requests, fetcherResults)
+	fetcherResults = s.discardUnacceptedAlgorithms(fetcherName, fetcherResults)
+
+	// Don't trust any validity period beyond our own maximum.
+	clamped := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, len(fetcherResults))
+	for req, res := range fetcherResults {
+		clamped[req] = s.clampKeyValidity(fetcherName, req, res)
+	}
+	return clamped
+}
+
+// noteNotFound adds to notFound any of the requests that the fetcher was
+// asked for and gave a definite answer to without the key, either by
+// responding without it or by failing with an error that won't go away if
+// we ask again. Requests that weren't asked for, i.e. because of the rate
+// limiter or the circuit breaker, and those that failed because we ran out
+// of time or the caller gave up, aren't counted.
+func noteNotFound(
+	ctx context.Context,
+	notFound map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+	asked map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+	fetcherResults map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	err error,
+) {
+	if err != nil && !isDefiniteFetchError(ctx, err) {
+		return
+	}
+	for req, ts := range asked {
+		if _, ok := fetcherResults[req]; !ok {
+			notFound[req] = ts
+		}
+	}
+}
+
+// mergeFetcherResults adds the keys that a fetcher found to the results,
+// removes them from the outstanding requests and stores any that are
+// newer than the ones that we already had. Fetchers often return all of
+// a server's keys rather than just the ones that we asked for, so any
+// extra keys are kept too, and satisfy any other requests for them that
+// are still pending rather than those being fetched again.
+func (s *ServerKeyAPI) mergeFetcherResults(
+	ctx context.Context,
+	fetcherName string,
+	fetcherResults map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	provenance map[gomatrixserverlib.PublicKeyLookupRequest]string,
+) error {
+	// The fetcher has only just given us these keys.
+	fetchedTS := gomatrixserverlib.AsTimestamp(s.now())
 
 	// Build a map of the results that we want to commit to the
 	// database. We do this in a separate map because otherwise we
 	// might end up trying to rewrite database entries.
 	storeResults := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	// The keys in storeResults that we had no previous entry for, which
+	// we might nevertheless have stored already.
+	unseen := map[gomatrixserverlib.PublicKeyLookupRequest]bool{}
 
 	// Now let's look at the results that we got from this fetcher.
+	bonus := 0
 	for req, res := range fetcherResults {
-		if prev, ok := results[req]; ok {
+		if _, ok := requests[req]; !ok {
+			bonus++
+		}
+		if !s.validForStoring(res) {
+			// The key is about to expire, so just use it for now.
+			logrus.WithFields(logrus.Fields{
+				"fetcher_name":   fetcherName,
+				"server_name":    req.ServerName,
+				"key_id":         req.KeyID,
+				"valid_until_ts": res.ValidUntilTS,
+			}).Debug("Not storing key that expires soon")
+		} else if prev, ok := results[req]; ok {
 			// We've already got a previous entry for this request
 			// so let's see if the newly retrieved one contains a more
-			// up-to-date validity period.
-			if res.ValidUntilTS > prev.ValidUntilTS {
+			// up-to-date validity period. If MaxCacheAge is set then we
+			// store the same key again too, so that its fetch time is
+			// updated and we don't fetch it again straight away.
+			if res.ValidUntilTS > prev.ValidUntilTS || (s.MaxCacheAge > 0 && res.ValidUntilTS == prev.ValidUntilTS) {
 				// This key is newer than the one we had so let's store
 				// it in the database.
 				storeResults[req] = res
@@ -237,30 +1244,151 @@ func (s *ServerKeyAPI) handleFetcherKeys(
 			// We didn't already have a previous entry for this request
 			// so store it in the database anyway for now.
 			storeResults[req] = res
+			unseen[req] = true
 		}
 
 		// Update the results map with this new result. If nothing
 		// else, we can try verifying against this key.
 		results[req] = res
+		if provenance != nil {
+			provenance[req] = fetcherName
+		}
 
 		// Remove it from the request list so we won't re-fetch it.
 		delete(requests, req)
+		keyLookups.WithLabelValues(keySourceFetcher, fetcherName).Inc()
 	}
+	if bonus > 0 {
+		logrus.WithFields(logrus.Fields{
+			"fetcher_name": fetcherName,
+		}).Debugf("Fetcher returned %d key(s) that weren't requested", bonus)
+	}
+
+	// Don't rewrite keys that are already stored exactly as they are, i.e.
+	// when a fetcher returns other keys of a server alongside the ones
+	// that we asked for.
+	s.skipUnchangedKeys(detachContext(ctx), storeResults, unseen)
 
 	// Store the keys from our store map.
-	if err = s.OurKeyRing.KeyDatabase.StoreKeys(context.Background(), storeResults); err != nil {
+	if err := s.storeKeys(detachContext(ctx), storeResults, fetchedTS); err != nil {
 		logrus.WithError(err).WithFields(logrus.Fields{
-			"fetcher_name":  fetcher.FetcherName(),
+			"fetcher_name":  fetcherName,
 			"database_name": s.OurKeyRing.KeyDatabase.FetcherName(),
 		}).Errorf("Failed to store keys in the database")
 		return fmt.Errorf("server key API failed to store retrieved keys: %w", err)
 	}
+	s.recordKeyProvenance(detachContext(ctx), fetcherName, storeResults)
 
 	if len(storeResults) > 0 {
 		logrus.WithFields(logrus.Fields{
-			"fetcher_name": fetcher.FetcherName(),
-		}).Infof("Updated %d of %d key(s) in database (%d keys remaining)", len(storeResults), len(results), len(requests))
+			"fetcher_name": fetcherName,
+		}).Logf(s.fetchLogLevel(), "Updated %d of %d key(s) in database (%d keys remaining)", len(storeResults), len(results), len(requests))
 	}
 
 	return nil
 }
+
+// discardUnrequestedServers returns the fetcher results without any keys
+// for servers that weren't in the requests. Keys for other key IDs of the
+// requested servers are kept, since fetchers often return all of a
+// server's keys at once.
+func discardUnrequestedServers(
+	fetcherName string,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+	fetcherResults map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult {
+	requested := make(map[gomatrixserverlib.ServerName]bool, len(requests))
+	for req := range requests {
+		requested[req.ServerName] = true
+	}
+	filtered := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, len(fetcherResults))
+	for req, res := range fetcherResults {
+		if !requested[req.ServerName] {
+			logrus.WithFields(logrus.Fields{
+				"fetcher_name": fetcherName,
+				"server_name":  req.ServerName,
+				"key_id":       req.KeyID,
+			}).Warn("Discarding key for a server that wasn't requested from the fetcher")
+			continue
+		}
+		filtered[req] = res
+	}
+	return filtered
+}
+
+// discardUnacceptedAlgorithms returns the fetcher results without any keys
+// whose algorithm isn't one of the AcceptedKeyAlgorithms.
+func (s *ServerKeyAPI) discardUnacceptedAlgorithms(
+	fetcherName string,
+	fetcherResults map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult {
+	filtered := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, len(fetcherResults))
+	for req, res := range fetcherResults {
+		if !s.acceptsKeyAlgorithm(req.KeyID) {
+			logrus.WithFields(logrus.Fields{
+				"fetcher_name": fetcherName,
+				"server_name":  req.ServerName,
+				"key_id":       req.KeyID,
+			}).Warn("Discarding key with an algorithm that we don't accept")
+			continue
+		}
+		filtered[req] = res
+	}
+	return filtered
+}
+
+// acceptsKeyAlgorithm returns true if the algorithm of the key ID is one
+// of the AcceptedKeyAlgorithms.
+func (s *ServerKeyAPI) acceptsKeyAlgorithm(keyID gomatrixserverlib.KeyID) bool {
+	algorithm := string(keyID)
+	if i := strings.Index(algorithm, ":"); i >= 0 {
+		algorithm = algorithm[:i]
+	}
+	accepted := s.AcceptedKeyAlgorithms
+	if len(accepted) == 0 {
+		accepted = defaultAcceptedKeyAlgorithms
+	}
+	for _, a := range accepted {
+		if algorithm == a {
+			return true
+		}
+	}
+	return false
+}
+
+// validForStoring returns true if the key is valid for long enough that
+// it's worth storing, as per MinStoreValidity.
+func (s *ServerKeyAPI) validForStoring(res gomatrixserverlib.PublicKeyLookupResult) bool {
+	if s.MinStoreValidity <= 0 || res.ExpiredTS != gomatrixserverlib.PublicKeyNotExpired {
+		return true
+	}
+	return res.ValidUntilTS >= gomatrixserverlib.AsTimestamp(s.now().Add(s.MinStoreValidity))
+}
+
+// clampKeyValidity limits the ValidUntilTS of a key that we got from
+// somewhere else to at most MaxKeyValidity from now, or the override in
+// MaxKeyValidityOverrides for the key's server if there is one.
+func (s *ServerKeyAPI) clampKeyValidity(
+	fetcherName string,
+	req gomatrixserverlib.PublicKeyLookupRequest,
+	res gomatrixserverlib.PublicKeyLookupResult,
+) gomatrixserverlib.PublicKeyLookupResult {
+	maxValidity, ok := s.MaxKeyValidityOverrides[req.ServerName]
+	if !ok {
+		maxValidity = s.MaxKeyValidity
+	}
+	if maxValidity <= 0 {
+		maxValidity = defaultMaxKeyValidity
+	}
+	maxValidUntil := gomatrixserverlib.AsTimestamp(s.now().Add(maxValidity))
+	if res.ValidUntilTS > maxValidUntil {
+		logrus.WithFields(logrus.Fields{
+			"fetcher_name":   fetcherName,
+			"server_name":    req.ServerName,
+			"key_id":         req.KeyID,
+			"valid_until_ts": res.ValidUntilTS,
+		}).Warnf("Clamping key validity to %s", maxValidity)
+		res.ValidUntilTS = maxValidUntil
+	}
+	return res
+}
@@ -0,0 +1,4161 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/signingkeyserver/api"
+	"github.com/matrix-org/dendrite/signingkeyserver/storage/inmemory"
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+)
+
+var (
+	testServerName = gomatrixserverlib.ServerName("local.com")
+	testKeyID      = gomatrixserverlib.KeyID("ed25519:auto")
+	remoteRequest  = gomatrixserverlib.PublicKeyLookupRequest{
+		ServerName: "remote.com",
+		KeyID:      testKeyID,
+	}
+)
+
+// testKeyResult returns a key result that is valid for the given
+// duration from now.
+func testKeyResult(key string, validity time.Duration) gomatrixserverlib.PublicKeyLookupResult {
+	return gomatrixserverlib.PublicKeyLookupResult{
+		VerifyKey: gomatrixserverlib.VerifyKey{
+			Key: gomatrixserverlib.Base64Bytes(key),
+		},
+		ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+		ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(validity)),
+	}
+}
+
+type mockKeyDatabase struct {
+	sync.Mutex
+	keys    map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult
+	fetched map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp
+	stores  int32
+	fetches int32
+	// How many times KeyFetchTimes has been called.
+	fetchTimeLookups int32
+	// Negative cache entries and when they expire.
+	negative map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp
+	// The context that StoreKeys was last called with.
+	storeCtx context.Context
+	// Which fetcher each key was last stored from.
+	provenance map[gomatrixserverlib.PublicKeyLookupRequest]api.KeyProvenance
+}
+
+func newMockKeyDatabase() *mockKeyDatabase {
+	return &mockKeyDatabase{
+		keys:     map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{},
+		fetched:  map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{},
+		negative: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{},
+	}
+}
+
+func (d *mockKeyDatabase) FetcherName() string {
+	return "mockKeyDatabase"
+}
+
+func (d *mockKeyDatabase) FetchKeys(
+	_ context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	atomic.AddInt32(&d.fetches, 1)
+	d.Lock()
+	defer d.Unlock()
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for req := range requests {
+		if res, ok := d.keys[req]; ok {
+			results[req] = res
+		}
+	}
+	return results, nil
+}
+
+func (d *mockKeyDatabase) StoreKeys(
+	ctx context.Context,
+	keys map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	return d.StoreKeysFetchedAt(ctx, keys, gomatrixserverlib.AsTimestamp(time.Now()))
+}
+
+func (d *mockKeyDatabase) StoreKeysFetchedAt(
+	ctx context.Context,
+	keys map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	fetchedTS gomatrixserverlib.Timestamp,
+) error {
+	atomic.AddInt32(&d.stores, 1)
+	d.Lock()
+	defer d.Unlock()
+	d.storeCtx = ctx
+	for req, res := range keys {
+		d.keys[req] = res
+		if fetchedTS != 0 {
+			d.fetched[req] = fetchedTS
+		}
+	}
+	return nil
+}
+
+func (d *mockKeyDatabase) DeleteKeys(
+	_ context.Context,
+	requests []gomatrixserverlib.PublicKeyLookupRequest,
+) error {
+	d.Lock()
+	defer d.Unlock()
+	for _, req := range requests {
+		delete(d.keys, req)
+	}
+	return nil
+}
+
+func (d *mockKeyDatabase) AllKeys(
+	_ context.Context,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	d.Lock()
+	defer d.Unlock()
+	results := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, len(d.keys))
+	for req, res := range d.keys {
+		results[req] = res
+	}
+	return results, nil
+}
+
+func (d *mockKeyDatabase) ServerNames(
+	_ context.Context,
+) ([]gomatrixserverlib.ServerName, error) {
+	d.Lock()
+	defer d.Unlock()
+	seen := map[gomatrixserverlib.ServerName]bool{}
+	var serverNames []gomatrixserverlib.ServerName
+	for req := range d.keys {
+		if !seen[req.ServerName] {
+			seen[req.ServerName] = true
+			serverNames = append(serverNames, req.ServerName)
+		}
+	}
+	sort.Slice(serverNames, func(i, j int) bool {
+		return serverNames[i] < serverNames[j]
+	})
+	return serverNames, nil
+}
+
+func (d *mockKeyDatabase) KeysAfter(
+	_ context.Context,
+	after gomatrixserverlib.PublicKeyLookupRequest,
+	limit int,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	d.Lock()
+	defer d.Unlock()
+	var reqs []gomatrixserverlib.PublicKeyLookupRequest
+	for req := range d.keys {
+		if req.ServerName > after.ServerName || (req.ServerName == after.ServerName && req.KeyID > after.KeyID) {
+			reqs = append(reqs, req)
+		}
+	}
+	sort.Slice(reqs, func(i, j int) bool {
+		if reqs[i].ServerName != reqs[j].ServerName {
+			return reqs[i].ServerName < reqs[j].ServerName
+		}
+		return reqs[i].KeyID < reqs[j].KeyID
+	})
+	if len(reqs) > limit {
+		reqs = reqs[:limit]
+	}
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for _, req := range reqs {
+		results[req] = d.keys[req]
+	}
+	return results, nil
+}
+
+func (d *mockKeyDatabase) KeyMetadata(
+	_ context.Context,
+	serverName gomatrixserverlib.ServerName,
+) ([]api.KeyMetadata, error) {
+	d.Lock()
+	defer d.Unlock()
+	var metadata []api.KeyMetadata
+	for req, res := range d.keys {
+		if req.ServerName != serverName {
+			continue
+		}
+		metadata = append(metadata, api.KeyMetadata{
+			KeyID:        req.KeyID,
+			ValidUntilTS: res.ValidUntilTS,
+			ExpiredTS:    res.ExpiredTS,
+			FetchedTS:    d.fetched[req],
+		})
+	}
+	sort.Slice(metadata, func(i, j int) bool {
+		return metadata[i].KeyID < metadata[j].KeyID
+	})
+	return metadata, nil
+}
+
+func (d *mockKeyDatabase) KeyFetchTimes(
+	_ context.Context,
+	requests []gomatrixserverlib.PublicKeyLookupRequest,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, error) {
+	atomic.AddInt32(&d.fetchTimeLookups, 1)
+	d.Lock()
+	defer d.Unlock()
+	fetched := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
+	for _, req := range requests {
+		if _, ok := d.keys[req]; ok {
+			fetched[req] = d.fetched[req]
+		}
+	}
+	return fetched, nil
+}
+
+type mockFetcher struct {
+	name    string
+	delay   time.Duration
+	timeout time.Duration
+	err     error
+	keys    map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult
+	calls   int32
+	// If non-zero, err is only returned from this many calls, after
+	// which the fetcher starts to succeed.
+	failures int32
+}
+
+func (f *mockFetcher) FetcherName() string {
+	return f.name
+}
+
+func (f *mockFetcher) FetcherTimeout() time.Duration {
+	return f.timeout
+}
+
+func (f *mockFetcher) FetchKeys(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	call := atomic.AddInt32(&f.calls, 1)
+	if f.delay > 0 {
+		select {
+		case <-time.After(f.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if f.err != nil && (f.failures == 0 || call <= f.failures) {
+		return nil, f.err
+	}
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for req := range requests {
+		if res, ok := f.keys[req]; ok {
+			results[req] = res
+		}
+	}
+	return results, nil
+}
+
+func (f *mockFetcher) callCount() int {
+	return int(atomic.LoadInt32(&f.calls))
+}
+
+func (d *mockKeyDatabase) StoreNegativeCacheEntries(
+	_ context.Context,
+	entries map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) error {
+	d.Lock()
+	defer d.Unlock()
+	for req, expires := range entries {
+		d.negative[req] = expires
+	}
+	return nil
+}
+
+func (d *mockKeyDatabase) NegativeCacheEntries(
+	_ context.Context,
+	now gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, error) {
+	d.Lock()
+	defer d.Unlock()
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
+	for req, expires := range d.negative {
+		if expires > now {
+			results[req] = expires
+		}
+	}
+	return results, nil
+}
+
+func (d *mockKeyDatabase) DeleteExpiredNegativeCacheEntries(
+	_ context.Context,
+	before gomatrixserverlib.Timestamp,
+) error {
+	d.Lock()
+	defer d.Unlock()
+	for req, expires := range d.negative {
+		if expires <= before {
+			delete(d.negative, req)
+		}
+	}
+	return nil
+}
+
+func (d *mockKeyDatabase) StoreKeyProvenance(
+	_ context.Context,
+	requests []gomatrixserverlib.PublicKeyLookupRequest,
+	fetcherName string,
+	fetchedTS gomatrixserverlib.Timestamp,
+) error {
+	d.Lock()
+	defer d.Unlock()
+	if d.provenance == nil {
+		d.provenance = map[gomatrixserverlib.PublicKeyLookupRequest]api.KeyProvenance{}
+	}
+	for _, req := range requests {
+		d.provenance[req] = api.KeyProvenance{FetcherName: fetcherName, FetchedTS: fetchedTS}
+	}
+	return nil
+}
+
+func (d *mockKeyDatabase) KeyProvenance(
+	_ context.Context,
+	request gomatrixserverlib.PublicKeyLookupRequest,
+) (*api.KeyProvenance, error) {
+	d.Lock()
+	defer d.Unlock()
+	provenance, ok := d.provenance[request]
+	if !ok {
+		return nil, nil
+	}
+	return &provenance, nil
+}
+
+func newTestServerKeyAPI(db gomatrixserverlib.KeyDatabase, fetchers ...gomatrixserverlib.KeyFetcher) *ServerKeyAPI {
+	return &ServerKeyAPI{
+		ServerName:        testServerName,
+		ServerPublicKey:   []byte("local-public-key"),
+		ServerKeyID:       testKeyID,
+		ServerKeyValidity: time.Hour,
+		OurKeyRing: gomatrixserverlib.KeyRing{
+			KeyDatabase: db,
+			KeyFetchers: fetchers,
+		},
+	}
+}
+
+func TestFetcherTimeoutFallsThrough(t *testing.T) {
+	slow := &mockFetcher{
+		name:  "slow",
+		delay: time.Second * 5,
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("slow-key", time.Hour),
+		},
+	}
+	fast := &mockFetcher{
+		name: "fast",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("fast-key", time.Hour),
+		},
+	}
+	s := newTestServerKeyAPI(newMockKeyDatabase(), slow, fast)
+	s.FetcherTimeout = time.Millisecond * 50
+
+	start := time.Now()
+	res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if took := time.Since(start); took >= slow.delay {
+		t.Fatalf("FetchKeys should have timed out the slow fetcher but took %s", took)
+	}
+	if slow.callCount() != 1 || fast.callCount() != 1 {
+		t.Fatalf("expected both fetchers to be called once, got slow=%d fast=%d", slow.callCount(), fast.callCount())
+	}
+	if got := string(res[remoteRequest].Key); got != "fast-key" {
+		t.Fatalf("expected key from the fast fetcher, got %q", got)
+	}
+}
+
+func TestFetchBudgetLimitsFetcherChain(t *testing.T) {
+	otherRequest := gomatrixserverlib.PublicKeyLookupRequest{
+		ServerName: "other.com",
+		KeyID:      testKeyID,
+	}
+	fast := &mockFetcher{
+		name: "fast",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("fast-key", time.Hour),
+		},
+	}
+	fetchers := []gomatrixserverlib.KeyFetcher{fast}
+	var slow []*mockFetcher
+	for i := 0; i < 3; i++ {
+		f := &mockFetcher{
+			name:  fmt.Sprintf("slow-%d", i),
+			delay: time.Second * 5,
+			keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+				otherRequest: testKeyResult("slow-key", time.Hour),
+			},
+		}
+		slow = append(slow, f)
+		fetchers = append(fetchers, f)
+	}
+	s := newTestServerKeyAPI(newMockKeyDatabase(), fetchers...)
+	s.FetcherTimeout = time.Second
+	s.FetchBudget = time.Millisecond * 200
+
+	start := time.Now()
+	res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+		otherRequest:  gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if took := time.Since(start); took >= s.FetcherTimeout {
+		t.Fatalf("FetchKeys should have stopped once the fetch budget was used up but took %s", took)
+	}
+	var missing *api.MissingKeysError
+	if !errors.As(err, &missing) || len(missing.Missing) != 1 || missing.Missing[0] != otherRequest {
+		t.Fatalf("expected a MissingKeysError for %v, got %v", otherRequest, err)
+	}
+	if got := string(res[remoteRequest].Key); got != "fast-key" {
+		t.Fatalf("expected the key found before the budget ran out, got %q", got)
+	}
+	if calls := slow[0].callCount(); calls != 1 {
+		t.Fatalf("expected the first slow fetcher to be called once, got %d calls", calls)
+	}
+	for _, f := range slow[1:] {
+		if calls := f.callCount(); calls != 0 {
+			t.Fatalf("expected %s not to be called once the budget was used up, got %d calls", f.name, calls)
+		}
+	}
+}
+
+func TestFetcherResultsForUnrequestedServersAreDiscarded(t *testing.T) {
+	poisonedRequest := gomatrixserverlib.PublicKeyLookupRequest{
+		ServerName: "victim.com",
+		KeyID:      testKeyID,
+	}
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest:   testKeyResult("remote-key", time.Hour),
+			poisonedRequest: testKeyResult("poisoned-key", time.Hour),
+		},
+	}
+	// Return every key that the fetcher has, whatever was asked for.
+	poisoning := &poisoningFetcher{fetcher}
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, poisoning)
+
+	res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if got := string(res[remoteRequest].Key); got != "remote-key" {
+		t.Fatalf("expected the requested key, got %q", got)
+	}
+	if _, ok := res[poisonedRequest]; ok {
+		t.Fatalf("expected the key for the unrequested server not to be returned")
+	}
+	db.Lock()
+	_, stored := db.keys[poisonedRequest]
+	db.Unlock()
+	if stored {
+		t.Fatalf("expected the key for the unrequested server not to be stored")
+	}
+}
+
+// poisoningFetcher returns all of the keys of the mockFetcher, including
+// ones for servers that weren't requested.
+type poisoningFetcher struct {
+	*mockFetcher
+}
+
+func (f *poisoningFetcher) FetchKeys(
+	ctx context.Context,
+	_ map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	all := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
+	for req := range f.keys {
+		all[req] = gomatrixserverlib.AsTimestamp(time.Now())
+	}
+	return f.mockFetcher.FetchKeys(ctx, all)
+}
+
+func TestSubscribeKeyUpdates(t *testing.T) {
+	otherKeyRequest := gomatrixserverlib.PublicKeyLookupRequest{
+		ServerName: remoteRequest.ServerName,
+		KeyID:      "ed25519:other",
+	}
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest:   testKeyResult("remote-key", time.Hour),
+			otherKeyRequest: testKeyResult("other-key", time.Hour),
+		},
+	}
+	s := newTestServerKeyAPI(newMockKeyDatabase(), fetcher)
+
+	var updates [][]gomatrixserverlib.PublicKeyLookupRequest
+	unsubscribe := s.SubscribeKeyUpdates(func(updated []gomatrixserverlib.PublicKeyLookupRequest) {
+		updates = append(updates, updated)
+	})
+	fetch := func() {
+		_, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			remoteRequest:   gomatrixserverlib.AsTimestamp(time.Now()),
+			otherKeyRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+		})
+		if err != nil {
+			t.Fatalf("FetchKeys failed: %s", err)
+		}
+	}
+
+	fetch()
+	want := [][]gomatrixserverlib.PublicKeyLookupRequest{
+		{otherKeyRequest, remoteRequest},
+	}
+	if !reflect.DeepEqual(updates, want) {
+		t.Fatalf("expected the subscriber to be told about the stored keys:\n got %v\nwant %v", updates, want)
+	}
+
+	// The keys are in the database now, so fetching them again doesn't
+	// store anything.
+	fetch()
+	if len(updates) != 1 {
+		t.Fatalf("expected no further updates when nothing was stored, got %v", updates)
+	}
+
+	unsubscribe()
+	if err := s.StoreKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		remoteRequest: testKeyResult("newer-key", time.Hour*2),
+	}); err != nil {
+		t.Fatalf("StoreKeys failed: %s", err)
+	}
+	if len(updates) != 1 {
+		t.Fatalf("expected no updates after unsubscribing, got %v", updates)
+	}
+}
+
+func TestEmptyLocalKeyIsRefused(t *testing.T) {
+	s := newTestServerKeyAPI(newMockKeyDatabase())
+	s.ServerPublicKey = nil
+
+	var emptyKey *api.EmptyLocalKeyError
+	if err := s.ValidateLocalKeys(); !errors.As(err, &emptyKey) || emptyKey.KeyID != testKeyID {
+		t.Fatalf("expected ValidateLocalKeys to fail with an EmptyLocalKeyError for %q, got %v", testKeyID, err)
+	}
+
+	res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		{ServerName: testServerName, KeyID: testKeyID}: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if !errors.As(err, &emptyKey) {
+		t.Fatalf("expected FetchKeys to fail with an EmptyLocalKeyError, got %v", err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("expected no keys to be returned, got %v", res)
+	}
+}
+
+func TestValidateLocalKeys(t *testing.T) {
+	publicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	s := newTestServerKeyAPI(newMockKeyDatabase())
+	s.ServerPublicKey = publicKey
+	if err = s.ValidateLocalKeys(); err != nil {
+		t.Fatalf("expected a valid key to pass validation, got %s", err)
+	}
+
+	s.ServerKeys = []LocalServerKey{{KeyID: "ed25519:short", PublicKey: publicKey[:16]}}
+	if err = s.ValidateLocalKeys(); err == nil {
+		t.Fatalf("expected a truncated key to fail validation")
+	}
+}
+
+func TestMaxCacheAgeForcesRefetch(t *testing.T) {
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("fresh-key", time.Hour*24*8),
+		},
+	}
+	db := newMockKeyDatabase()
+	db.keys[remoteRequest] = testKeyResult("old-key", time.Hour*24*7)
+	db.fetched[remoteRequest] = gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Hour * 48))
+	s := newTestServerKeyAPI(db, fetcher)
+	s.KeyCacheSize = 16
+	s.MaxCacheAge = time.Hour * 24
+
+	fetch := func() string {
+		res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+		})
+		if err != nil {
+			t.Fatalf("FetchKeys failed: %s", err)
+		}
+		return string(res[remoteRequest].Key)
+	}
+
+	// The key is still valid but was fetched too long ago.
+	if got := fetch(); got != "fresh-key" {
+		t.Fatalf("expected the old key to be fetched again, got %q", got)
+	}
+	if calls := fetcher.callCount(); calls != 1 {
+		t.Fatalf("expected the fetcher to be called once, got %d calls", calls)
+	}
+
+	// Now that it has been fetched again, it can be used.
+	if got := fetch(); got != "fresh-key" {
+		t.Fatalf("expected the refetched key, got %q", got)
+	}
+	if calls := fetcher.callCount(); calls != 1 {
+		t.Fatalf("expected no further fetches for a recently fetched key, got %d calls", calls)
+	}
+}
+
+func TestMaxCacheAgeWithoutFetchTime(t *testing.T) {
+	clock := time.Now()
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("fresh-key", time.Hour*24*8),
+		},
+	}
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, fetcher)
+	s.KeyCacheSize = 16
+	s.MaxCacheAge = time.Hour * 24
+	s.Now = func() time.Time { return clock }
+
+	// We don't know when this key was fetched, i.e. because it was
+	// imported, so its age is counted from when it was cached.
+	s.cacheKeys(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		remoteRequest: testKeyResult("cached-key", time.Hour*24*7),
+	}, 0)
+	fetch := func() string {
+		res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			remoteRequest: gomatrixserverlib.AsTimestamp(clock),
+		})
+		if err != nil {
+			t.Fatalf("FetchKeys failed: %s", err)
+		}
+		return string(res[remoteRequest].Key)
+	}
+
+	clock = clock.Add(time.Hour)
+	if got := fetch(); got != "cached-key" {
+		t.Fatalf("expected the recently cached key, got %q", got)
+	}
+	if calls := fetcher.callCount(); calls != 0 {
+		t.Fatalf("expected the fetcher not to be called, got %d calls", calls)
+	}
+
+	clock = clock.Add(time.Hour * 24)
+	if got := fetch(); got != "fresh-key" {
+		t.Fatalf("expected the key to be fetched again once it had been cached too long, got %q", got)
+	}
+	if calls := fetcher.callCount(); calls != 1 {
+		t.Fatalf("expected the fetcher to be called once, got %d calls", calls)
+	}
+}
+
+func TestMaxCacheAgeLooksUpFetchTimesTogether(t *testing.T) {
+	db := newMockKeyDatabase()
+	requests := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
+	for _, serverName := range []gomatrixserverlib.ServerName{"a.com", "b.com", "c.com"} {
+		req := gomatrixserverlib.PublicKeyLookupRequest{ServerName: serverName, KeyID: testKeyID}
+		db.keys[req] = testKeyResult("key", time.Hour)
+		db.fetched[req] = gomatrixserverlib.AsTimestamp(time.Now())
+		requests[req] = gomatrixserverlib.AsTimestamp(time.Now())
+	}
+	s := newTestServerKeyAPI(db)
+	s.MaxCacheAge = time.Hour * 24
+
+	res, err := s.FetchKeys(context.Background(), requests)
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if len(res) != 3 {
+		t.Fatalf("expected all 3 keys from the database, got %d", len(res))
+	}
+	if lookups := atomic.LoadInt32(&db.fetchTimeLookups); lookups != 1 {
+		t.Fatalf("expected the fetch times to be looked up at once, got %d lookups", lookups)
+	}
+}
+
+func TestMaxCacheAgeFallsBackToOldKey(t *testing.T) {
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		err:  errors.New("unreachable"),
+	}
+	db := newMockKeyDatabase()
+	db.keys[remoteRequest] = testKeyResult("old-key", time.Hour*24*7)
+	db.fetched[remoteRequest] = gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Hour * 48))
+	s := newTestServerKeyAPI(db, fetcher)
+	s.MaxCacheAge = time.Hour * 24
+
+	res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if calls := fetcher.callCount(); calls != 1 {
+		t.Fatalf("expected the fetcher to be tried, got %d calls", calls)
+	}
+	if got := string(res[remoteRequest].Key); got != "old-key" {
+		t.Fatalf("expected the old key to be used when fetching it again failed, got %q", got)
+	}
+}
+
+func TestFetchKeysValidFrom(t *testing.T) {
+	from := gomatrixserverlib.AsTimestamp(time.Now())
+	until := gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour))
+	keys := []gomatrixserverlib.PublicKeyLookupRequest{remoteRequest}
+
+	// A cached key that is valid now but not for the whole window is
+	// fetched again.
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("fresh-key", time.Hour*2),
+		},
+	}
+	db := newMockKeyDatabase()
+	db.keys[remoteRequest] = testKeyResult("short-key", time.Minute*30)
+	s := newTestServerKeyAPI(db, fetcher)
+	res, err := s.FetchKeysValidFrom(context.Background(), keys, from, until)
+	if err != nil {
+		t.Fatalf("FetchKeysValidFrom failed: %s", err)
+	}
+	if got := string(res[remoteRequest].Key); got != "fresh-key" {
+		t.Fatalf("expected the key to be fetched again to cover the window, got %q", got)
+	}
+	if calls := fetcher.callCount(); calls != 1 {
+		t.Fatalf("expected the fetcher to be called once, got %d calls", calls)
+	}
+
+	// Now that we have a key covering the window it isn't fetched again.
+	if _, err = s.FetchKeysValidFrom(context.Background(), keys, from, until); err != nil {
+		t.Fatalf("FetchKeysValidFrom failed: %s", err)
+	}
+	if calls := fetcher.callCount(); calls != 1 {
+		t.Fatalf("expected no further fetches for a key covering the window, got %d calls", calls)
+	}
+
+	// If we can't find a key covering the window then it isn't returned.
+	shortFetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("also-short-key", time.Minute*40),
+		},
+	}
+	db = newMockKeyDatabase()
+	db.keys[remoteRequest] = testKeyResult("short-key", time.Minute*30)
+	s = newTestServerKeyAPI(db, shortFetcher)
+	res, err = s.FetchKeysValidFrom(context.Background(), keys, from, until)
+	var missing *api.MissingKeysError
+	if !errors.As(err, &missing) || len(missing.Missing) != 1 || missing.Missing[0] != remoteRequest {
+		t.Fatalf("expected a MissingKeysError for the key that doesn't cover the window, got %v", err)
+	}
+	if _, ok := res[remoteRequest]; ok {
+		t.Fatalf("expected the key that doesn't cover the window not to be returned")
+	}
+}
+
+func TestNormaliseServerName(t *testing.T) {
+	for input, want := range map[gomatrixserverlib.ServerName]gomatrixserverlib.ServerName{
+		"example.com":        "example.com",
+		"Example.COM":        "example.com",
+		"example.com.":       "example.com",
+		"EXAMPLE.com.:8448":  "example.com:8448",
+		"example.com:08448":  "example.com:8448",
+		"1.2.3.4:443":        "1.2.3.4:443",
+		"[::1]":              "[::1]",
+		"[2001:DB8::1]:8448": "[2001:db8::1]:8448",
+		"example.com:":       "",
+		"example.com:0":      "",
+		"example.com:65536":  "",
+		"example.com:http":   "",
+		"exa mple.com":       "",
+		"example_com":        "",
+		"":                   "",
+		".":                  "",
+		"[::1":               "",
+		"[not-an-ip]:8448":   "",
+		"[::1]8448":          "",
+		"2001:db8::1":        "",
+		"example.com:8448:1": "",
+	} {
+		got, ok := normaliseServerName(input)
+		if ok != (want != "") || got != want {
+			t.Errorf("normaliseServerName(%q): got %q (valid %v), want %q", input, got, ok, want)
+		}
+	}
+}
+
+func TestServerNameVariantsShareCacheEntry(t *testing.T) {
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("remote-key", time.Hour),
+		},
+	}
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, fetcher)
+	s.KeyCacheSize = 10
+	ts := gomatrixserverlib.AsTimestamp(time.Now())
+
+	// Each spelling of the server name gets its results back under the
+	// request that it was asked for, but they all share one cache entry.
+	for _, serverName := range []gomatrixserverlib.ServerName{"Remote.COM.", "remote.com", "REMOTE.com"} {
+		req := gomatrixserverlib.PublicKeyLookupRequest{ServerName: serverName, KeyID: testKeyID}
+		results, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			req: ts,
+		})
+		if err != nil {
+			t.Fatalf("FetchKeys(%q) failed: %s", serverName, err)
+		}
+		if got := string(results[req].Key); got != "remote-key" || len(results) != 1 {
+			t.Fatalf("FetchKeys(%q): expected the remote key under the requested server name, got %v", serverName, results)
+		}
+	}
+	if calls := fetcher.callCount(); calls != 1 {
+		t.Fatalf("expected the key to be fetched once for all spellings of the server name, got %d calls", calls)
+	}
+	if s.keyCache().Len() != 1 || !s.keyCache().Contains(remoteRequest) {
+		t.Fatalf("expected a single cache entry for the normalised server name, got %v", s.keyCache().Keys())
+	}
+
+	// The same goes for our own server name.
+	localReq := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "LOCAL.com.", KeyID: testKeyID}
+	results, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		localReq: ts,
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed for our own keys: %s", err)
+	}
+	if got := string(results[localReq].Key); got != "local-public-key" {
+		t.Fatalf("expected our own key for a differently spelled local server name, got %q", got)
+	}
+
+	// Invalid server names are reported as missing without being fetched.
+	invalidReq := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com:http", KeyID: testKeyID}
+	results, err = s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		invalidReq:    ts,
+		remoteRequest: ts,
+	})
+	var missing *api.MissingKeysError
+	if !errors.As(err, &missing) || !reflect.DeepEqual(missing.Missing, []gomatrixserverlib.PublicKeyLookupRequest{invalidReq}) {
+		t.Fatalf("expected a MissingKeysError for the invalid server name, got %v", err)
+	}
+	if _, ok := results[remoteRequest]; !ok {
+		t.Fatalf("expected the valid request to be satisfied alongside the invalid one")
+	}
+	if calls := fetcher.callCount(); calls != 1 {
+		t.Fatalf("expected no fetches for an invalid server name, got %d calls", calls)
+	}
+}
+
+func TestInMemoryKeyDatabase(t *testing.T) {
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("remote-key", time.Hour),
+		},
+	}
+	db := inmemory.NewDatabase()
+	s := newTestServerKeyAPI(db, fetcher)
+	requests := func() map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp {
+		return map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+		}
+	}
+
+	// The key is fetched once and then found in the database.
+	for i := 0; i < 2; i++ {
+		results, err := s.FetchKeys(context.Background(), requests())
+		if err != nil {
+			t.Fatalf("FetchKeys failed: %s", err)
+		}
+		if got := string(results[remoteRequest].Key); got != "remote-key" {
+			t.Fatalf("expected the remote key, got %q", got)
+		}
+	}
+	if calls := fetcher.callCount(); calls != 1 {
+		t.Fatalf("expected the key to be fetched once, got %d calls", calls)
+	}
+	stored, err := db.FetchKeys(context.Background(), requests())
+	if err != nil {
+		t.Fatalf("db.FetchKeys failed: %s", err)
+	}
+	if got := string(stored[remoteRequest].Key); got != "remote-key" {
+		t.Fatalf("expected the fetched key to be stored in the database, got %q", got)
+	}
+}
+
+func TestUnacceptedKeyAlgorithmsAreDiscarded(t *testing.T) {
+	unknownRequest := gomatrixserverlib.PublicKeyLookupRequest{
+		ServerName: "remote.com",
+		KeyID:      "curve9000:new",
+	}
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest:  testKeyResult("ed25519-key", time.Hour),
+			unknownRequest: testKeyResult("curve9000-key", time.Hour),
+		},
+	}
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, fetcher)
+	ts := gomatrixserverlib.AsTimestamp(time.Now())
+
+	results, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest:  ts,
+		unknownRequest: ts,
+	})
+	var missing *api.MissingKeysError
+	if !errors.As(err, &missing) || !reflect.DeepEqual(missing.Missing, []gomatrixserverlib.PublicKeyLookupRequest{unknownRequest}) {
+		t.Fatalf("expected the key with an unknown algorithm to be missing, got %v", err)
+	}
+	if got := string(results[remoteRequest].Key); got != "ed25519-key" {
+		t.Fatalf("expected the ed25519 key to be returned, got %q", got)
+	}
+	if _, ok := results[unknownRequest]; ok {
+		t.Fatalf("expected the key with an unknown algorithm not to be returned")
+	}
+	if _, ok := db.keys[remoteRequest]; !ok {
+		t.Fatalf("expected the ed25519 key to be stored")
+	}
+	if _, ok := db.keys[unknownRequest]; ok {
+		t.Fatalf("expected the key with an unknown algorithm not to be stored")
+	}
+
+	// Once the algorithm is accepted the key is used and stored as usual.
+	s.AcceptedKeyAlgorithms = []string{"ed25519", "curve9000"}
+	results, err = s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		unknownRequest: ts,
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if got := string(results[unknownRequest].Key); got != "curve9000-key" {
+		t.Fatalf("expected the key to be returned once its algorithm is accepted, got %q", got)
+	}
+	if _, ok := db.keys[unknownRequest]; !ok {
+		t.Fatalf("expected the key to be stored once its algorithm is accepted")
+	}
+}
+
+func TestFetcherChain(t *testing.T) {
+	s := newTestServerKeyAPI(
+		newMockKeyDatabase(),
+		&mockFetcher{name: "first"},
+		&mockFetcher{name: "second"},
+	)
+	s.NotaryFetchers = []gomatrixserverlib.KeyFetcher{&mockFetcher{name: "notary"}}
+
+	want := []string{"mockKeyDatabase", "first", "second", "notary"}
+	if got := s.FetcherChain(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected fetcher chain %v, got %v", want, got)
+	}
+}
+
+func TestUnchangedKeysAreNotStoredAgain(t *testing.T) {
+	newRequest := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:new"}
+	existing := testKeyResult("remote-key", time.Hour)
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: existing,
+			newRequest:    testKeyResult("new-key", time.Hour),
+		},
+	}
+	db := newMockKeyDatabase()
+	db.keys[remoteRequest] = existing
+	db.fetched[remoteRequest] = 1
+	s := newTestServerKeyAPI(db, fetcher)
+
+	// The fetcher returns the key that we already have alongside the one
+	// that we asked for, but only the new one is written.
+	if _, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		newRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+	}); err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if stores := atomic.LoadInt32(&db.stores); stores != 1 {
+		t.Fatalf("expected one store for the new key, got %d", stores)
+	}
+	if _, ok := db.keys[newRequest]; !ok {
+		t.Fatalf("expected the new key to be stored")
+	}
+	if fetched := db.fetched[remoteRequest]; fetched != 1 {
+		t.Fatalf("expected the unchanged key not to be written again")
+	}
+
+	// Fetching the unchanged key again, i.e. to revalidate it, doesn't
+	// write anything, whether or not it's in the in-memory cache.
+	for _, cacheSize := range []int{0, 16} {
+		s.KeyCacheSize = cacheSize
+		s.cacheKeys(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: existing,
+		}, gomatrixserverlib.AsTimestamp(time.Now()))
+		requests := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+		}
+		results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+		if err := s.mergeFetcherResults(context.Background(), "fetcher", map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: existing,
+		}, requests, results, nil); err != nil {
+			t.Fatalf("mergeFetcherResults failed: %s", err)
+		}
+		if stores := atomic.LoadInt32(&db.stores); stores != 1 {
+			t.Fatalf("expected no store for an unchanged key with cache size %d, got %d stores in total", cacheSize, stores)
+		}
+		if got := string(results[remoteRequest].Key); got != "remote-key" {
+			t.Fatalf("expected the unchanged key to be returned, got %q", got)
+		}
+	}
+
+	// A key that has changed is written as usual.
+	changed := existing
+	changed.ValidUntilTS += 1000
+	if err := s.mergeFetcherResults(context.Background(), "fetcher", map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		remoteRequest: changed,
+	}, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}, nil); err != nil {
+		t.Fatalf("mergeFetcherResults failed: %s", err)
+	}
+	if stores := atomic.LoadInt32(&db.stores); stores != 2 {
+		t.Fatalf("expected the changed key to be stored, got %d stores in total", stores)
+	}
+}
+
+func TestFetcherTimeoutOverride(t *testing.T) {
+	slow := &mockFetcher{
+		name:    "slow",
+		delay:   time.Second * 5,
+		timeout: time.Millisecond * 50,
+	}
+	fast := &mockFetcher{
+		name: "fast",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("fast-key", time.Hour),
+		},
+	}
+	s := newTestServerKeyAPI(newMockKeyDatabase(), slow, fast)
+
+	if timeout := s.fetcherTimeout(fast); timeout != defaultFetcherTimeout {
+		t.Fatalf("expected default timeout %s, got %s", defaultFetcherTimeout, timeout)
+	}
+	if timeout := s.fetcherTimeout(slow); timeout != slow.timeout {
+		t.Fatalf("expected overridden timeout %s, got %s", slow.timeout, timeout)
+	}
+
+	res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if _, ok := res[remoteRequest]; !ok {
+		t.Fatalf("expected the fast fetcher to satisfy the request")
+	}
+}
+
+func TestFetchKeysReportsAllMissingKeys(t *testing.T) {
+	found := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "found.com", KeyID: testKeyID}
+	missingA := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "a.com", KeyID: testKeyID}
+	missingB := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "b.com", KeyID: testKeyID}
+
+	db := newMockKeyDatabase()
+	db.keys[found] = testKeyResult("found-key", time.Hour)
+	unreachable := &mockFetcher{
+		name: "unreachable",
+		err:  errors.New("connection refused"),
+	}
+	s := newTestServerKeyAPI(db, unreachable)
+
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+	res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		found:    now,
+		missingA: now,
+		missingB: now,
+	})
+	var missing *api.MissingKeysError
+	if !errors.As(err, &missing) {
+		t.Fatalf("expected a MissingKeysError, got %v", err)
+	}
+	want := []gomatrixserverlib.PublicKeyLookupRequest{missingA, missingB}
+	if !reflect.DeepEqual(missing.Missing, want) {
+		t.Fatalf("expected missing keys %v, got %v", want, missing.Missing)
+	}
+	if _, ok := res[found]; !ok || len(res) != 1 {
+		t.Fatalf("expected the found key to be returned alongside the error, got %v", res)
+	}
+}
+
+func TestConcurrentFetchesAreCoalesced(t *testing.T) {
+	fetcher := &mockFetcher{
+		name:  "slow",
+		delay: time.Millisecond * 200,
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("remote-key", time.Hour),
+		},
+	}
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, fetcher)
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+				remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+			})
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, ok := res[remoteRequest]; !ok {
+				errs <- errors.New("key missing from results")
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if calls := fetcher.callCount(); calls != 1 {
+		t.Fatalf("expected the fetcher to be called once, got %d calls", calls)
+	}
+	if stores := atomic.LoadInt32(&db.stores); stores != 1 {
+		t.Fatalf("expected the key to be stored once, got %d stores", stores)
+	}
+}
+
+func TestBonusKeysSatisfyPendingRequests(t *testing.T) {
+	wanted := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:wanted"}
+	bonus := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:bonus"}
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			wanted: testKeyResult("wanted-key", time.Hour),
+			bonus:  testKeyResult("bonus-key", time.Hour),
+		},
+	}
+	// Return all of the server's keys, whatever was asked for.
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, &poisoningFetcher{fetcher})
+
+	// Pretend that another FetchKeys call is fetching the bonus key and
+	// hasn't finished yet.
+	other := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		bonus: gomatrixserverlib.AsTimestamp(time.Now()),
+	}
+	owned, _ := s.claimInflight(other)
+	defer s.releaseInflight(owned, nil, nil)
+
+	type fetched struct {
+		res map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult
+		err error
+	}
+	done := make(chan fetched, 1)
+	go func() {
+		res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			wanted: gomatrixserverlib.AsTimestamp(time.Now()),
+			bonus:  gomatrixserverlib.AsTimestamp(time.Now()),
+		})
+		done <- fetched{res, err}
+	}()
+
+	var got fetched
+	select {
+	case got = <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("expected the bonus key to stop FetchKeys from waiting for the other call")
+	}
+	if got.err != nil {
+		t.Fatalf("FetchKeys failed: %s", got.err)
+	}
+	if key := string(got.res[wanted].Key); key != "wanted-key" {
+		t.Fatalf("expected the wanted key, got %q", key)
+	}
+	if key := string(got.res[bonus].Key); key != "bonus-key" {
+		t.Fatalf("expected the bonus key, got %q", key)
+	}
+	if calls := fetcher.callCount(); calls != 1 {
+		t.Fatalf("expected the fetcher to be called once, got %d calls", calls)
+	}
+	db.Lock()
+	_, stored := db.keys[bonus]
+	db.Unlock()
+	if !stored {
+		t.Fatalf("expected the bonus key to be stored")
+	}
+}
+
+func TestConcurrentFetchesOfExpiredKeyWaitForRefresh(t *testing.T) {
+	fetcher := &mockFetcher{
+		name:  "slow",
+		delay: time.Millisecond * 200,
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("fresh-key", time.Hour),
+		},
+	}
+	db := newMockKeyDatabase()
+	db.keys[remoteRequest] = testKeyResult("expired-key", -time.Hour)
+	s := newTestServerKeyAPI(db, fetcher)
+
+	fetch := func() (string, error) {
+		res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+		})
+		return string(res[remoteRequest].Key), err
+	}
+
+	type fetched struct {
+		key string
+		err error
+	}
+	first := make(chan fetched, 1)
+	go func() {
+		key, err := fetch()
+		first <- fetched{key, err}
+	}()
+
+	// Wait for the first caller to start refreshing the expired key, so
+	// that the second caller finds it in flight.
+	deadline := time.Now().Add(time.Second * 5)
+	for fetcher.callCount() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the first caller to ask the fetcher")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	key, err := fetch()
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if key != "fresh-key" {
+		t.Fatalf("expected the second caller to wait for the refreshed key, got %q", key)
+	}
+	if got := <-first; got.err != nil || got.key != "fresh-key" {
+		t.Fatalf("expected the first caller to get the refreshed key, got %q, %v", got.key, got.err)
+	}
+	if calls := fetcher.callCount(); calls != 1 {
+		t.Fatalf("expected the fetcher to be called once, got %d calls", calls)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	stale := testKeyResult("stale-key", -time.Hour)
+	fresh := testKeyResult("fresh-key", time.Hour)
+	fetcher := &mockFetcher{
+		name:  "fetcher",
+		delay: time.Millisecond * 200,
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: fresh,
+		},
+	}
+	db := newMockKeyDatabase()
+	db.keys[remoteRequest] = stale
+	s := newTestServerKeyAPI(db, fetcher)
+	s.StaleWhileRevalidate = true
+
+	start := time.Now()
+	res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if took := time.Since(start); took >= fetcher.delay {
+		t.Fatalf("FetchKeys should have returned the stale key without waiting, took %s", took)
+	}
+	if got := string(res[remoteRequest].Key); got != "stale-key" {
+		t.Fatalf("expected the stale key to be returned, got %q", got)
+	}
+
+	// The refreshed key should make its way into the database shortly.
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		stored, _ := db.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			remoteRequest: 0,
+		})
+		if string(stored[remoteRequest].Key) == "fresh-key" {
+			return
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	t.Fatalf("the stale key was not refreshed in the background")
+}
+
+func TestRefreshThresholdRefreshesExpiringKeys(t *testing.T) {
+	expiring := testKeyResult("expiring-key", time.Minute)
+	fresh := testKeyResult("fresh-key", time.Hour)
+	fetcher := &mockFetcher{
+		name:  "fetcher",
+		delay: time.Millisecond * 200,
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: fresh,
+		},
+	}
+	db := newMockKeyDatabase()
+	db.keys[remoteRequest] = expiring
+	s := newTestServerKeyAPI(db, fetcher)
+	s.RefreshThreshold = time.Minute * 5
+
+	start := time.Now()
+	res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if took := time.Since(start); took >= fetcher.delay {
+		t.Fatalf("FetchKeys should have returned the expiring key without waiting, took %s", took)
+	}
+	if got := string(res[remoteRequest].Key); got != "expiring-key" {
+		t.Fatalf("expected the expiring key to be returned, got %q", got)
+	}
+
+	// The refreshed key should make its way into the database shortly.
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		stored, _ := db.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			remoteRequest: 0,
+		})
+		if string(stored[remoteRequest].Key) == "fresh-key" {
+			return
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	t.Fatalf("the expiring key was not refreshed in the background")
+}
+
+func TestRefreshThresholdLeavesLongLivedKeys(t *testing.T) {
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("fresh-key", time.Hour),
+		},
+	}
+	db := newMockKeyDatabase()
+	db.keys[remoteRequest] = testKeyResult("stored-key", time.Hour)
+	s := newTestServerKeyAPI(db, fetcher)
+	s.RefreshThreshold = time.Minute * 5
+
+	if _, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+	}); err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if calls := fetcher.callCount(); calls != 0 {
+		t.Fatalf("expected no refresh for a key that isn't about to expire, got %d fetcher call(s)", calls)
+	}
+}
+
+func TestNegativeCachePreventsRefetch(t *testing.T) {
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		err:  errors.New("not found"),
+	}
+	s := newTestServerKeyAPI(newMockKeyDatabase(), fetcher)
+	s.NegativeCacheTTL = time.Minute
+
+	for i := 0; i < 2; i++ {
+		_, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+		})
+		var missing *api.MissingKeysError
+		if !errors.As(err, &missing) {
+			t.Fatalf("expected a MissingKeysError on attempt %d, got %v", i+1, err)
+		}
+	}
+	if calls := fetcher.callCount(); calls != 1 {
+		t.Fatalf("expected the fetcher to be called once, got %d calls", calls)
+	}
+}
+
+func TestNegativeCacheSweepsExpiredEntries(t *testing.T) {
+	other := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "other.com", KeyID: testKeyID}
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		err:  errors.New("not found"),
+	}
+	clock := time.Now()
+	s := newTestServerKeyAPI(newMockKeyDatabase(), fetcher)
+	s.NegativeCacheTTL = time.Minute
+	s.Now = func() time.Time { return clock }
+	request := func(req gomatrixserverlib.PublicKeyLookupRequest) {
+		if _, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			req: gomatrixserverlib.AsTimestamp(clock),
+		}); err == nil {
+			t.Fatalf("expected %s to be reported missing", req.ServerName)
+		}
+	}
+
+	// The entry for the first key should be removed once it has expired,
+	// even though nobody asks for that key again.
+	request(remoteRequest)
+	clock = clock.Add(time.Minute * 2)
+	request(other)
+	s.negativeCacheMutex.Lock()
+	_, expiredCached := s.negativeCache[remoteRequest]
+	_, otherCached := s.negativeCache[other]
+	s.negativeCacheMutex.Unlock()
+	if expiredCached {
+		t.Fatalf("expected the expired negative cache entry to be swept")
+	}
+	if !otherCached {
+		t.Fatalf("expected the new negative cache entry to be kept")
+	}
+}
+
+func TestNegativeCacheOnlyCachesAnsweredRequests(t *testing.T) {
+	asked := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:asked"}
+	deferred := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:deferred"}
+	fetcher := &mockFetcher{name: "fetcher"}
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, fetcher)
+	s.NegativeCacheTTL = time.Minute
+	s.PersistNegativeCache = true
+	s.FetchRateLimit = 1
+
+	// The fetcher answers the first request without the key, but the
+	// rate limiter stops us from asking it about the second one at all.
+	for _, req := range []gomatrixserverlib.PublicKeyLookupRequest{asked, deferred} {
+		if _, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			req: gomatrixserverlib.AsTimestamp(time.Now()),
+		}); err == nil {
+			t.Fatalf("expected %s to be reported missing", req.KeyID)
+		}
+	}
+	if calls := fetcher.callCount(); calls != 1 {
+		t.Fatalf("expected the fetcher to be asked once, got %d", calls)
+	}
+	s.negativeCacheMutex.Lock()
+	_, askedCached := s.negativeCache[asked]
+	_, deferredCached := s.negativeCache[deferred]
+	s.negativeCacheMutex.Unlock()
+	if !askedCached {
+		t.Fatalf("expected the key that the fetcher didn't have to be cached")
+	}
+	if deferredCached {
+		t.Fatalf("expected the deferred key not to be cached")
+	}
+	db.Lock()
+	_, deferredStored := db.negative[deferred]
+	db.Unlock()
+	if deferredStored {
+		t.Fatalf("expected the deferred key not to be persisted")
+	}
+
+	// Nor are keys that a fetcher only failed to find because of a
+	// transient error.
+	failing := &mockFetcher{name: "failing", err: context.DeadlineExceeded}
+	s = newTestServerKeyAPI(newMockKeyDatabase(), failing)
+	s.NegativeCacheTTL = time.Minute
+	for i := 0; i < 2; i++ {
+		if _, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+		}); err == nil {
+			t.Fatalf("expected the key to be reported missing")
+		}
+	}
+	if calls := failing.callCount(); calls != 2 {
+		t.Fatalf("expected the failing fetcher to be asked again, got %d calls", calls)
+	}
+}
+
+func TestPersistentNegativeCacheSurvivesRestart(t *testing.T) {
+	db := newMockKeyDatabase()
+	clock := time.Now()
+	request := func(s *ServerKeyAPI) {
+		_, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			remoteRequest: gomatrixserverlib.AsTimestamp(clock),
+		})
+		var missing *api.MissingKeysError
+		if !errors.As(err, &missing) {
+			t.Fatalf("expected a MissingKeysError, got %v", err)
+		}
+	}
+	newAPI := func(fetcher *mockFetcher) *ServerKeyAPI {
+		s := newTestServerKeyAPI(db, fetcher)
+		s.NegativeCacheTTL = time.Minute
+		s.PersistNegativeCache = true
+		s.Now = func() time.Time { return clock }
+		return s
+	}
+
+	before := &mockFetcher{
+		name: "fetcher",
+		err:  errors.New("not found"),
+	}
+	request(newAPI(before))
+	if calls := before.callCount(); calls != 1 {
+		t.Fatalf("expected the fetcher to be called once, got %d calls", calls)
+	}
+
+	// Simulate a restart by starting again with a new ServerKeyAPI that
+	// shares the same key database.
+	after := &mockFetcher{
+		name: "fetcher",
+		err:  errors.New("not found"),
+	}
+	restarted := newAPI(after)
+	if err := restarted.LoadNegativeCache(context.Background()); err != nil {
+		t.Fatalf("LoadNegativeCache failed: %s", err)
+	}
+	request(restarted)
+	if calls := after.callCount(); calls != 0 {
+		t.Fatalf("expected the persisted negative cache entry to be honoured, got %d fetcher call(s)", calls)
+	}
+
+	// Once the entry has expired it should be garbage collected and the
+	// key fetched again.
+	clock = clock.Add(time.Minute * 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	restarted.StartNegativeCacheGC(ctx, time.Millisecond)
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		db.Lock()
+		remaining := len(db.negative)
+		db.Unlock()
+		if remaining == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the expired negative cache entry to be removed, got %d entries", remaining)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	cancel()
+	restarted = newAPI(after)
+	if err := restarted.LoadNegativeCache(context.Background()); err != nil {
+		t.Fatalf("LoadNegativeCache failed: %s", err)
+	}
+	request(restarted)
+	if calls := after.callCount(); calls != 1 {
+		t.Fatalf("expected the fetcher to be called again after expiry, got %d calls", calls)
+	}
+}
+
+func TestInjectedClockControlsValidity(t *testing.T) {
+	clock := time.Unix(1600000000, 0)
+	cached := gomatrixserverlib.PublicKeyLookupResult{
+		VerifyKey: gomatrixserverlib.VerifyKey{
+			Key: gomatrixserverlib.Base64Bytes("cached-key"),
+		},
+		ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+		ValidUntilTS: gomatrixserverlib.AsTimestamp(clock.Add(time.Minute)),
+	}
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("fresh-key", time.Hour),
+		},
+	}
+	db := newMockKeyDatabase()
+	db.keys[remoteRequest] = cached
+	s := newTestServerKeyAPI(db, fetcher)
+	s.Now = func() time.Time { return clock }
+
+	fetch := func() gomatrixserverlib.PublicKeyLookupResult {
+		res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			remoteRequest: gomatrixserverlib.AsTimestamp(clock),
+		})
+		if err != nil {
+			t.Fatalf("FetchKeys failed: %s", err)
+		}
+		return res[remoteRequest]
+	}
+
+	// The cached key is still valid so we shouldn't need the fetcher.
+	if got := string(fetch().Key); got != "cached-key" || fetcher.callCount() != 0 {
+		t.Fatalf("expected the cached key without fetching, got %q after %d fetches", got, fetcher.callCount())
+	}
+
+	// Move the clock past the validity of the cached key, which should
+	// cause us to go to the fetcher instead.
+	clock = clock.Add(time.Minute * 2)
+	if got := string(fetch().Key); got != "fresh-key" || fetcher.callCount() != 1 {
+		t.Fatalf("expected the fetched key after expiry, got %q after %d fetches", got, fetcher.callCount())
+	}
+
+	// Our own key should be valid for exactly the key validity period
+	// from the injected time.
+	local := gomatrixserverlib.PublicKeyLookupRequest{ServerName: testServerName, KeyID: testKeyID}
+	res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		local: gomatrixserverlib.AsTimestamp(clock),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if want := gomatrixserverlib.AsTimestamp(clock.Add(s.ServerKeyValidity)); res[local].ValidUntilTS != want {
+		t.Fatalf("expected local key to be valid until %d, got %d", want, res[local].ValidUntilTS)
+	}
+}
+
+func TestSetKeyValidity(t *testing.T) {
+	clock := time.Unix(1600000000, 0)
+	s := newTestServerKeyAPI(newMockKeyDatabase())
+	s.Now = func() time.Time { return clock }
+	local := gomatrixserverlib.PublicKeyLookupRequest{ServerName: testServerName, KeyID: testKeyID}
+	validUntil := func() gomatrixserverlib.Timestamp {
+		res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			local: gomatrixserverlib.AsTimestamp(clock),
+		})
+		if err != nil {
+			t.Fatalf("FetchKeys failed: %s", err)
+		}
+		return res[local].ValidUntilTS
+	}
+
+	if got, want := validUntil(), gomatrixserverlib.AsTimestamp(clock.Add(time.Hour)); got != want {
+		t.Fatalf("expected local key to be valid until %d, got %d", want, got)
+	}
+
+	// Change the validity while keys are being served.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.SetKeyValidity(time.Minute * 5)
+	}()
+	validUntil()
+	wg.Wait()
+
+	if got, want := validUntil(), gomatrixserverlib.AsTimestamp(clock.Add(time.Minute*5)); got != want {
+		t.Fatalf("expected local key to be valid until %d after shortening, got %d", want, got)
+	}
+}
+
+func TestRotateKeyAnswersRetiredKeyLocally(t *testing.T) {
+	clock := time.Unix(1600000000, 0)
+	fetcher := &mockFetcher{name: "fetcher"}
+	s := newTestServerKeyAPI(newMockKeyDatabase(), fetcher)
+	s.Now = func() time.Time { return clock }
+	retiredAt := clock.Add(time.Minute)
+	clock = retiredAt
+	s.RotateKey("ed25519:new", ed25519.PublicKey("new-public-key"))
+	clock = clock.Add(time.Minute)
+
+	retired := gomatrixserverlib.PublicKeyLookupRequest{ServerName: testServerName, KeyID: testKeyID}
+	current := gomatrixserverlib.PublicKeyLookupRequest{ServerName: testServerName, KeyID: "ed25519:new"}
+	res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		retired: gomatrixserverlib.AsTimestamp(clock),
+		current: gomatrixserverlib.AsTimestamp(clock),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	want := gomatrixserverlib.PublicKeyLookupResult{
+		VerifyKey:    gomatrixserverlib.VerifyKey{Key: gomatrixserverlib.Base64Bytes("local-public-key")},
+		ExpiredTS:    gomatrixserverlib.AsTimestamp(retiredAt),
+		ValidUntilTS: gomatrixserverlib.PublicKeyNotValid,
+	}
+	if !reflect.DeepEqual(res[retired], want) {
+		t.Fatalf("unexpected result for the retired key:\n got %+v\nwant %+v", res[retired], want)
+	}
+	if got := string(res[current].Key); got != "new-public-key" {
+		t.Fatalf("expected the new key, got %q", got)
+	}
+	if want := gomatrixserverlib.AsTimestamp(clock.Add(s.ServerKeyValidity)); res[current].ValidUntilTS != want {
+		t.Fatalf("expected the new key to be valid until %d, got %d", want, res[current].ValidUntilTS)
+	}
+	if fetcher.callCount() != 0 {
+		t.Fatalf("expected our own keys not to be fetched, got %d call(s)", fetcher.callCount())
+	}
+}
+
+// failingKeyDatabase fails to store any batch of keys that contains the
+// poisoned request, but stores all other batches as normal.
+type failingKeyDatabase struct {
+	*mockKeyDatabase
+	poisoned gomatrixserverlib.PublicKeyLookupRequest
+}
+
+func (d *failingKeyDatabase) StoreKeysFetchedAt(
+	ctx context.Context,
+	keys map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	fetchedTS gomatrixserverlib.Timestamp,
+) error {
+	if _, ok := keys[d.poisoned]; ok {
+		return errors.New("database is broken")
+	}
+	return d.mockKeyDatabase.StoreKeysFetchedAt(ctx, keys, fetchedTS)
+}
+
+func syntheticKeys(count int) map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult {
+	keys := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for i := 0; i < count; i++ {
+		req := gomatrixserverlib.PublicKeyLookupRequest{
+			ServerName: gomatrixserverlib.ServerName(fmt.Sprintf("server%d.com", i)),
+			KeyID:      testKeyID,
+		}
+		keys[req] = testKeyResult(fmt.Sprintf("key%d", i), time.Hour)
+	}
+	return keys
+}
+
+func TestStoreKeysInBatches(t *testing.T) {
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db)
+
+	if err := s.StoreKeys(context.Background(), syntheticKeys(500)); err != nil {
+		t.Fatalf("StoreKeys failed: %s", err)
+	}
+	if len(db.keys) != 500 {
+		t.Fatalf("expected 500 keys to be stored, got %d", len(db.keys))
+	}
+	if stores := atomic.LoadInt32(&db.stores); stores != 5 {
+		t.Fatalf("expected 5 batches to be stored, got %d", stores)
+	}
+}
+
+func TestStoreKeysBatchFailure(t *testing.T) {
+	keys := syntheticKeys(500)
+	db := &failingKeyDatabase{
+		mockKeyDatabase: newMockKeyDatabase(),
+		poisoned: gomatrixserverlib.PublicKeyLookupRequest{
+			ServerName: "server0.com",
+			KeyID:      testKeyID,
+		},
+	}
+	s := newTestServerKeyAPI(db)
+	s.KeyCacheSize = 1000
+
+	if err := s.StoreKeys(context.Background(), keys); err == nil {
+		t.Fatalf("expected StoreKeys to report the failed batch")
+	}
+	if len(db.keys) != 400 {
+		t.Fatalf("expected the other 4 batches (400 keys) to be stored, got %d", len(db.keys))
+	}
+
+	// Only the keys that were stored should be cached.
+	if cached := s.keyCache().Len(); cached != 400 {
+		t.Fatalf("expected the 400 stored keys to be cached, got %d", cached)
+	}
+	if _, ok := s.keyCache().Peek(db.poisoned); ok {
+		t.Fatalf("expected the key that failed to store not to be cached")
+	}
+}
+
+func TestFetchedKeysForSameServerAreMergedPerKeyID(t *testing.T) {
+	first := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:first"}
+	second := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:second"}
+	firstFetcher := &mockFetcher{
+		name: "first",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			first: testKeyResult("first-key", time.Hour),
+		},
+	}
+	secondFetcher := &mockFetcher{
+		name: "second",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			second: testKeyResult("second-key", time.Hour),
+		},
+	}
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, firstFetcher, secondFetcher)
+
+	// Fetch the keys one after the other, so that each fetcher's keys
+	// are stored separately.
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+	for _, req := range []gomatrixserverlib.PublicKeyLookupRequest{first, second} {
+		if _, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			req: now,
+		}); err != nil {
+			t.Fatalf("FetchKeys failed: %s", err)
+		}
+	}
+
+	if got := string(db.keys[first].Key); got != "first-key" {
+		t.Fatalf("expected the first key to still be stored, got %q", got)
+	}
+	if got := string(db.keys[second].Key); got != "second-key" {
+		t.Fatalf("expected the second key to be stored, got %q", got)
+	}
+}
+
+func TestKeyExpiryWarningFiresOncePerCrossing(t *testing.T) {
+	clock := time.Unix(1600000000, 0)
+	s := newTestServerKeyAPI(newMockKeyDatabase())
+	s.Now = func() time.Time { return clock }
+	s.ServerKeyIssuedAt = clock
+	s.KeyExpiryWarning = time.Minute * 10
+
+	steps := []struct {
+		advance time.Duration
+		warn    bool
+	}{
+		{0, false},                // just issued
+		{time.Minute * 49, false}, // 11 minutes left
+		{time.Minute * 2, true},   // 9 minutes left, crossed threshold
+		{time.Minute * 1, false},  // still inside threshold, already warned
+		{time.Minute * 20, false}, // expired, already warned
+	}
+	for i, step := range steps {
+		clock = clock.Add(step.advance)
+		if warned := s.checkKeyExpiry(); warned != step.warn {
+			t.Fatalf("step %d: expected warning=%v, got %v", i, step.warn, warned)
+		}
+	}
+
+	// Rotating the key should reset the warning so that it fires again
+	// when the new key approaches the end of its validity period.
+	s.ServerKeyIssuedAt = clock
+	if s.checkKeyExpiry() {
+		t.Fatalf("expected no warning immediately after rotation")
+	}
+	clock = clock.Add(time.Minute * 55)
+	if !s.checkKeyExpiry() {
+		t.Fatalf("expected a warning when the rotated key crossed the threshold")
+	}
+}
+
+func TestKeyExpiryMonitorStopsWithContext(t *testing.T) {
+	clock := time.Unix(1600000000, 0)
+	s := newTestServerKeyAPI(newMockKeyDatabase())
+	s.Now = func() time.Time { return clock }
+	s.ServerKeyIssuedAt = clock.Add(-time.Minute * 55)
+	s.KeyExpiryWarning = time.Minute * 10
+	warned := func() bool {
+		s.keyExpiryMutex.Lock()
+		defer s.keyExpiryMutex.Unlock()
+		return s.keyExpiryWarned
+	}
+
+	// A monitor whose context is already done shouldn't check anything.
+	stopped, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.StartKeyExpiryMonitor(stopped, time.Millisecond)
+	time.Sleep(time.Millisecond * 20)
+	if warned() {
+		t.Fatalf("expected the stopped monitor not to check the key expiry")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.StartKeyExpiryMonitor(ctx, time.Millisecond)
+	deadline := time.Now().Add(time.Second * 5)
+	for !warned() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the monitor to warn that the key is about to expire")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestMultipleLocalKeys(t *testing.T) {
+	clock := time.Unix(1600000000, 0)
+	_, oldPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	retiredAt := gomatrixserverlib.AsTimestamp(clock.Add(-time.Hour))
+
+	s := newTestServerKeyAPI(newMockKeyDatabase())
+	s.Now = func() time.Time { return clock }
+	s.ServerKeys = []LocalServerKey{
+		{KeyID: "ed25519:new", PublicKey: []byte("new-public-key")},
+		{KeyID: "ed25519:retiring", PublicKey: []byte("retiring-public-key"), ValidUntilTS: retiredAt},
+	}
+	s.OldServerKeys = []config.OldVerifyKeys{
+		{KeyID: "ed25519:old", PrivateKey: oldPriv, ExpiredAt: retiredAt},
+	}
+
+	current := gomatrixserverlib.PublicKeyLookupRequest{ServerName: testServerName, KeyID: testKeyID}
+	rotated := gomatrixserverlib.PublicKeyLookupRequest{ServerName: testServerName, KeyID: "ed25519:new"}
+	retiring := gomatrixserverlib.PublicKeyLookupRequest{ServerName: testServerName, KeyID: "ed25519:retiring"}
+	old := gomatrixserverlib.PublicKeyLookupRequest{ServerName: testServerName, KeyID: "ed25519:old"}
+	now := gomatrixserverlib.AsTimestamp(clock)
+
+	res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		current: now, rotated: now, retiring: now, old: now,
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+
+	validUntil := gomatrixserverlib.AsTimestamp(clock.Add(s.ServerKeyValidity))
+	if got := res[current]; string(got.Key) != "local-public-key" || got.ValidUntilTS != validUntil {
+		t.Fatalf("unexpected result for current key: %+v", got)
+	}
+	if got := res[rotated]; string(got.Key) != "new-public-key" || got.ValidUntilTS != validUntil {
+		t.Fatalf("unexpected result for rotated key: %+v", got)
+	}
+	if got := res[retiring]; string(got.Key) != "retiring-public-key" || got.ExpiredTS != retiredAt || got.ValidUntilTS != gomatrixserverlib.PublicKeyNotValid {
+		t.Fatalf("unexpected result for retiring key: %+v", got)
+	}
+	if got := res[old]; string(got.Key) != string(oldPriv.Public().(ed25519.PublicKey)) || got.ExpiredTS != retiredAt {
+		t.Fatalf("unexpected result for old key: %+v", got)
+	}
+}
+
+func TestFailedDirectFetchFallsBackToNotary(t *testing.T) {
+	db := newMockKeyDatabase()
+	direct := &mockFetcher{
+		name: "direct",
+		err:  errors.New("connection refused"),
+	}
+	notary := &mockFetcher{
+		name: "notary",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("notary-key", time.Hour),
+		},
+	}
+	s := newTestServerKeyAPI(db, direct)
+	s.NotaryFetchers = []gomatrixserverlib.KeyFetcher{notary}
+
+	results, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if got := string(results[remoteRequest].Key); got != "notary-key" {
+		t.Fatalf("expected the notary key, got %q", got)
+	}
+	if direct.callCount() != 1 || notary.callCount() != 1 {
+		t.Fatalf("expected one call to each fetcher, got direct=%d notary=%d", direct.callCount(), notary.callCount())
+	}
+	if _, ok := db.keys[remoteRequest]; !ok {
+		t.Fatalf("expected the notary key to be stored")
+	}
+}
+
+func TestNotaryNotAskedWhenDirectFetchSucceeds(t *testing.T) {
+	direct := &mockFetcher{
+		name: "direct",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("direct-key", time.Hour),
+		},
+	}
+	notary := &mockFetcher{name: "notary"}
+	s := newTestServerKeyAPI(newMockKeyDatabase(), direct)
+	s.NotaryFetchers = []gomatrixserverlib.KeyFetcher{notary}
+
+	if _, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+	}); err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if notary.callCount() != 0 {
+		t.Fatalf("expected the notary not to be asked, got %d call(s)", notary.callCount())
+	}
+}
+
+func TestAddNotaryServerRequiresKeys(t *testing.T) {
+	s := newTestServerKeyAPI(newMockKeyDatabase())
+	if err := s.AddNotaryServer("notary.com", nil); err == nil {
+		t.Fatalf("expected an error when adding a notary without keys")
+	}
+	if err := s.AddNotaryServer("notary.com", map[gomatrixserverlib.KeyID]ed25519.PublicKey{
+		testKeyID: ed25519.PublicKey("notary-public-key"),
+	}); err != nil {
+		t.Fatalf("AddNotaryServer failed: %s", err)
+	}
+	if len(s.NotaryFetchers) != 1 {
+		t.Fatalf("expected one notary fetcher, got %d", len(s.NotaryFetchers))
+	}
+}
+
+// notarySign adds a notary's signature to a server key response.
+func notarySign(
+	t *testing.T, keys gomatrixserverlib.ServerKeys,
+	notaryName gomatrixserverlib.ServerName, notaryKey ed25519.PrivateKey,
+) gomatrixserverlib.ServerKeys {
+	var err error
+	keys.Raw, err = gomatrixserverlib.SignJSON(string(notaryName), testKeyID, notaryKey, keys.Raw)
+	if err != nil {
+		t.Fatalf("failed to sign server keys: %s", err)
+	}
+	return keys
+}
+
+func TestTrustedNotaries(t *testing.T) {
+	remotePublic, remotePrivate, _ := ed25519.GenerateKey(nil)
+	trustedPublic, trustedPrivate, _ := ed25519.GenerateKey(nil)
+	untrustedPublic, untrustedPrivate, _ := ed25519.GenerateKey(nil)
+	remoteKeys := signedServerKeys(t, "remote.com", remotePublic, remotePrivate)
+	client := &mockKeyClient{
+		lookups: map[gomatrixserverlib.ServerName][]gomatrixserverlib.ServerKeys{
+			"trusted.org":   {notarySign(t, remoteKeys, "trusted.org", trustedPrivate)},
+			"untrusted.org": {notarySign(t, remoteKeys, "untrusted.org", untrustedPrivate)},
+		},
+	}
+	notary := func(name gomatrixserverlib.ServerName, key ed25519.PublicKey) *gomatrixserverlib.PerspectiveKeyFetcher {
+		return &gomatrixserverlib.PerspectiveKeyFetcher{
+			PerspectiveServerName: name,
+			PerspectiveServerKeys: map[gomatrixserverlib.KeyID]ed25519.PublicKey{testKeyID: key},
+			Client:                client,
+		}
+	}
+	request := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: testKeyID}
+
+	for _, tc := range []struct {
+		name    string
+		fetcher gomatrixserverlib.KeyFetcher
+		want    bool
+	}{
+		{"untrusted notary", PerspectiveKeyFetcher{notary("untrusted.org", untrustedPublic)}, false},
+		{"untrusted notary without wrapper", notary("untrusted.org", untrustedPublic), false},
+		{"trusted notary", PerspectiveKeyFetcher{notary("trusted.org", trustedPublic)}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newMockKeyDatabase()
+			s := newTestServerKeyAPI(db)
+			s.NotaryFetchers = []gomatrixserverlib.KeyFetcher{tc.fetcher}
+			s.TrustedNotaries = map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]ed25519.PublicKey{
+				"trusted.org": {testKeyID: trustedPublic},
+			}
+
+			res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+				request: gomatrixserverlib.AsTimestamp(time.Now()),
+			})
+			if err != nil {
+				t.Fatalf("FetchKeys failed: %s", err)
+			}
+			_, found := res[request]
+			_, stored := db.keys[request]
+			if found != tc.want || stored != tc.want {
+				t.Fatalf("expected found and stored to be %v, got found=%v stored=%v", tc.want, found, stored)
+			}
+			if tc.want && !reflect.DeepEqual([]byte(res[request].Key), []byte(remotePublic)) {
+				t.Fatalf("expected the remote server's key, got %v", res[request].Key)
+			}
+		})
+	}
+}
+
+func TestFetcherRetriesTransientFailure(t *testing.T) {
+	fetcher := &mockFetcher{
+		name:     "flaky",
+		err:      gomatrix.HTTPError{Code: http.StatusServiceUnavailable},
+		failures: 1,
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("remote-key", time.Hour),
+		},
+	}
+	s := newTestServerKeyAPI(newMockKeyDatabase(), fetcher)
+	s.FetcherRetry = FetcherRetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond,
+		Jitter:      time.Millisecond,
+	}
+
+	results, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if got := string(results[remoteRequest].Key); got != "remote-key" {
+		t.Fatalf("expected the remote key, got %q", got)
+	}
+	if fetcher.callCount() != 2 {
+		t.Fatalf("expected two calls to the fetcher, got %d", fetcher.callCount())
+	}
+}
+
+func TestFetcherDoesNotRetryNotFound(t *testing.T) {
+	fetcher := &mockFetcher{
+		name: "missing",
+		err:  gomatrix.HTTPError{Code: http.StatusNotFound},
+	}
+	s := newTestServerKeyAPI(newMockKeyDatabase(), fetcher)
+	s.FetcherRetry = FetcherRetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond,
+	}
+
+	_, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	var missing *api.MissingKeysError
+	if !errors.As(err, &missing) {
+		t.Fatalf("expected a MissingKeysError, got %v", err)
+	}
+	if fetcher.callCount() != 1 {
+		t.Fatalf("expected one call to the fetcher, got %d", fetcher.callCount())
+	}
+}
+
+func TestFetchedKeyValidityIsClamped(t *testing.T) {
+	clock := time.Unix(1600000000, 0)
+	forever := testKeyResult("remote-key", 0)
+	forever.ValidUntilTS = gomatrixserverlib.AsTimestamp(time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC))
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: forever,
+		},
+	}
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, fetcher)
+	s.Now = func() time.Time { return clock }
+	s.MaxKeyValidity = time.Hour * 24
+
+	res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(clock),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	want := gomatrixserverlib.AsTimestamp(clock.Add(s.MaxKeyValidity))
+	if got := res[remoteRequest].ValidUntilTS; got != want {
+		t.Fatalf("expected returned key to be valid until %d, got %d", want, got)
+	}
+	if got := db.keys[remoteRequest].ValidUntilTS; got != want {
+		t.Fatalf("expected stored key to be valid until %d, got %d", want, got)
+	}
+}
+
+func TestKeyValidityClampOverrides(t *testing.T) {
+	clock := time.Unix(1600000000, 0)
+	trusted := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "trusted.com", KeyID: testKeyID}
+	longLived := testKeyResult("long-lived-key", 0)
+	longLived.ValidUntilTS = gomatrixserverlib.AsTimestamp(clock.Add(time.Hour * 24 * 30))
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: longLived,
+			trusted:       longLived,
+		},
+	}
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, fetcher)
+	s.Now = func() time.Time { return clock }
+	s.MaxKeyValidity = time.Hour * 24
+	s.MaxKeyValidityOverrides = map[gomatrixserverlib.ServerName]time.Duration{
+		"trusted.com": time.Hour * 24 * 365,
+	}
+
+	res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(clock),
+		trusted:       gomatrixserverlib.AsTimestamp(clock),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if got := res[trusted].ValidUntilTS; got != longLived.ValidUntilTS {
+		t.Fatalf("expected the trusted server's key to be valid until %d, got %d", longLived.ValidUntilTS, got)
+	}
+	if got := db.keys[trusted].ValidUntilTS; got != longLived.ValidUntilTS {
+		t.Fatalf("expected the trusted server's stored key to be valid until %d, got %d", longLived.ValidUntilTS, got)
+	}
+	want := gomatrixserverlib.AsTimestamp(clock.Add(s.MaxKeyValidity))
+	if got := res[remoteRequest].ValidUntilTS; got != want {
+		t.Fatalf("expected other servers' keys to be clamped to %d, got %d", want, got)
+	}
+}
+
+func TestMinStoreValidity(t *testing.T) {
+	clock := time.Unix(1600000000, 0)
+	expiring := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "expiring.com", KeyID: testKeyID}
+	lasting := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "lasting.com", KeyID: testKeyID}
+	retired := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "retired.com", KeyID: testKeyID}
+	result := func(key string, validity time.Duration) gomatrixserverlib.PublicKeyLookupResult {
+		res := testKeyResult(key, 0)
+		res.ValidUntilTS = gomatrixserverlib.AsTimestamp(clock.Add(validity))
+		return res
+	}
+	retiredKey := result("retired-key", 0)
+	retiredKey.ValidUntilTS = gomatrixserverlib.PublicKeyNotValid
+	retiredKey.ExpiredTS = gomatrixserverlib.AsTimestamp(clock.Add(-time.Hour))
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			expiring: result("expiring-key", time.Second*10),
+			lasting:  result("lasting-key", time.Hour),
+			retired:  retiredKey,
+		},
+	}
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, fetcher)
+	s.Now = func() time.Time { return clock }
+	s.MinStoreValidity = time.Second * 60
+
+	res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		expiring: gomatrixserverlib.AsTimestamp(clock),
+		lasting:  gomatrixserverlib.AsTimestamp(clock),
+		retired:  gomatrixserverlib.AsTimestamp(clock),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if got := string(res[expiring].Key); got != "expiring-key" {
+		t.Fatalf("expected the expiring key to still be returned, got %q", got)
+	}
+	if _, ok := db.keys[expiring]; ok {
+		t.Fatalf("expected the key expiring in 10 seconds not to be stored")
+	}
+	if got := string(db.keys[lasting].Key); got != "lasting-key" {
+		t.Fatalf("expected the key valid for an hour to be stored, got %q", got)
+	}
+	if got := string(db.keys[retired].Key); got != "retired-key" {
+		t.Fatalf("expected the retired key to be stored, got %q", got)
+	}
+}
+
+func TestInvalidatedKeyIsRefetched(t *testing.T) {
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("remote-key", time.Hour),
+		},
+	}
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, fetcher)
+
+	fetch := func() {
+		if _, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+		}); err != nil {
+			t.Fatalf("FetchKeys failed: %s", err)
+		}
+	}
+
+	// The second lookup should be satisfied from the database.
+	fetch()
+	fetch()
+	if fetcher.callCount() != 1 {
+		t.Fatalf("expected one call to the fetcher, got %d", fetcher.callCount())
+	}
+
+	if err := s.InvalidateKeys(context.Background(), []gomatrixserverlib.PublicKeyLookupRequest{remoteRequest}); err != nil {
+		t.Fatalf("InvalidateKeys failed: %s", err)
+	}
+	if _, ok := db.keys[remoteRequest]; ok {
+		t.Fatalf("expected the key to be removed from the database")
+	}
+
+	// Now the key has to be fetched again.
+	fetch()
+	if fetcher.callCount() != 2 {
+		t.Fatalf("expected the key to be re-fetched, got %d call(s)", fetcher.callCount())
+	}
+}
+
+func TestFetchKeysDryRunDoesNotPersist(t *testing.T) {
+	failing := &mockFetcher{
+		name: "failing",
+		err:  errors.New("connection refused"),
+	}
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("remote-key", time.Hour),
+		},
+	}
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, failing, fetcher)
+
+	res := s.FetchKeysDryRun(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if got := string(res.Results[remoteRequest].Key); got != "remote-key" {
+		t.Fatalf("expected the remote key, got %q", got)
+	}
+	if len(res.Fetchers) != 2 {
+		t.Fatalf("expected two fetcher results, got %d", len(res.Fetchers))
+	}
+	if res.Fetchers[0].Err == nil || res.Fetchers[1].Err != nil || res.Fetchers[1].KeysFound != 1 {
+		t.Fatalf("unexpected fetcher results: %+v", res.Fetchers)
+	}
+	if stores := atomic.LoadInt32(&db.stores); stores != 0 {
+		t.Fatalf("expected nothing to be stored, got %d store(s)", stores)
+	}
+	if len(db.keys) != 0 {
+		t.Fatalf("expected the database to be empty, got %d key(s)", len(db.keys))
+	}
+}
+
+func TestFetchKeysDryRunFiltersKeys(t *testing.T) {
+	// Keys for other servers and algorithms are discarded, and validity
+	// periods are clamped, as they would be by FetchKeys.
+	poisoned := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "poisoned.com", KeyID: testKeyID}
+	unaccepted := gomatrixserverlib.PublicKeyLookupRequest{ServerName: remoteRequest.ServerName, KeyID: "curve9000:abc"}
+	poisoning := &poisoningFetcher{&mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("remote-key", time.Hour*24*30),
+			poisoned:      testKeyResult("poisoned-key", time.Hour),
+			unaccepted:    testKeyResult("unaccepted-key", time.Hour),
+		},
+	}}
+	s := newTestServerKeyAPI(newMockKeyDatabase(), poisoning)
+	s.MaxKeyValidity = time.Hour
+
+	start := time.Now()
+	res := s.FetchKeysDryRun(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(start),
+		unaccepted:    gomatrixserverlib.AsTimestamp(start),
+	})
+	if len(res.Results) != 1 || string(res.Results[remoteRequest].Key) != "remote-key" {
+		t.Fatalf("expected only the remote key, got %+v", res.Results)
+	}
+	if max := gomatrixserverlib.AsTimestamp(start.Add(time.Hour + time.Second)); res.Results[remoteRequest].ValidUntilTS > max {
+		t.Fatalf("expected the remote key's validity to be clamped, got %v", res.Results[remoteRequest].ValidUntilTS)
+	}
+	if res.Fetchers[0].KeysFound != 1 {
+		t.Fatalf("expected the fetcher to be reported as finding 1 key, got %d", res.Fetchers[0].KeysFound)
+	}
+
+	// Responses with bad signatures are rejected if we check them.
+	goodPublic, goodPrivate, _ := ed25519.GenerateKey(nil)
+	tamperedPublic, tamperedPrivate, _ := ed25519.GenerateKey(nil)
+	good := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "good.com", KeyID: testKeyID}
+	tampered := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "tampered.com", KeyID: testKeyID}
+	signed := &mockSignedFetcher{
+		mockFetcher: mockFetcher{name: "fetcher"},
+		responses: []gomatrixserverlib.ServerKeys{
+			signedServerKeys(t, "good.com", goodPublic, goodPrivate),
+			tamperSignature(t, signedServerKeys(t, "tampered.com", tamperedPublic, tamperedPrivate)),
+		},
+	}
+	s = newTestServerKeyAPI(newMockKeyDatabase(), signed)
+	s.VerifyFetchedKeys = true
+	res = s.FetchKeysDryRun(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		good:     gomatrixserverlib.AsTimestamp(start),
+		tampered: gomatrixserverlib.AsTimestamp(start),
+	})
+	if !reflect.DeepEqual([]byte(res.Results[good].Key), []byte(goodPublic)) {
+		t.Fatalf("expected the correctly signed key, got %v", res.Results[good].Key)
+	}
+	if _, ok := res.Results[tampered]; ok {
+		t.Fatalf("expected the key with the tampered signature to be rejected")
+	}
+}
+
+func TestExpiredCachedKeyIsRefreshed(t *testing.T) {
+	clock := time.Unix(1600000000, 0)
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("fresh-key", time.Hour),
+		},
+	}
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, fetcher)
+	s.KeyCacheSize = 16
+	s.StaleWhileRevalidate = true
+	s.Now = func() time.Time { return clock }
+
+	expired := testKeyResult("cached-key", 0)
+	expired.ValidUntilTS = gomatrixserverlib.AsTimestamp(clock.Add(-time.Minute))
+	s.cacheKeys(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		remoteRequest: expired,
+	}, gomatrixserverlib.AsTimestamp(clock))
+
+	res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(clock),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if got := string(res[remoteRequest].Key); got != "cached-key" {
+		t.Fatalf("expected the cached key to be returned straight away, got %q", got)
+	}
+	if fetches := atomic.LoadInt32(&db.fetches); fetches != 0 {
+		t.Fatalf("expected the database not to be consulted, got %d fetch(es)", fetches)
+	}
+
+	// The refresh happens in the background, so wait for the fresh key
+	// to be stored.
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&db.stores) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the expired key to be refreshed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	val, _ := s.keyCache().Get(remoteRequest)
+	if got := string(val.(cachedKey).Key); got != "fresh-key" {
+		t.Fatalf("expected the cache to hold the fresh key, got %q", got)
+	}
+}
+
+func TestExpiredCachedKeyIsNotServedWithoutStaleWhileRevalidate(t *testing.T) {
+	clock := time.Unix(1600000000, 0)
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("fresh-key", time.Hour),
+		},
+	}
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, fetcher)
+	s.KeyCacheSize = 16
+	s.Now = func() time.Time { return clock }
+
+	expired := testKeyResult("cached-key", 0)
+	expired.ValidUntilTS = gomatrixserverlib.AsTimestamp(clock.Add(-time.Minute))
+	s.cacheKeys(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		remoteRequest: expired,
+	}, gomatrixserverlib.AsTimestamp(clock))
+
+	// The expired key should be left for the fetchers, which should be
+	// asked for a fresh one straight away.
+	res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(clock),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if got := string(res[remoteRequest].Key); got != "fresh-key" {
+		t.Fatalf("expected the fresh key to be returned, got %q", got)
+	}
+	if calls := fetcher.callCount(); calls != 1 {
+		t.Fatalf("expected the fetcher to be called once, got %d calls", calls)
+	}
+}
+
+func benchmarkRepeatedKeyLookups(b *testing.B, cacheSize int) {
+	db := newMockKeyDatabase()
+	db.keys[remoteRequest] = testKeyResult("remote-key", time.Hour)
+	s := newTestServerKeyAPI(db)
+	s.KeyCacheSize = cacheSize
+	ts := gomatrixserverlib.AsTimestamp(time.Now())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			remoteRequest: ts,
+		}); err != nil {
+			b.Fatalf("FetchKeys failed: %s", err)
+		}
+	}
+	b.ReportMetric(float64(atomic.LoadInt32(&db.fetches))/float64(b.N), "dbcalls/op")
+}
+
+func BenchmarkRepeatedKeyLookupsWithoutCache(b *testing.B) {
+	benchmarkRepeatedKeyLookups(b, 0)
+}
+
+func BenchmarkRepeatedKeyLookupsWithCache(b *testing.B) {
+	benchmarkRepeatedKeyLookups(b, 128)
+}
+
+func TestStoreKeysKeepsTraceButIgnoresCancellation(t *testing.T) {
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db)
+
+	span := opentracing.NoopTracer{}.StartSpan("StoreKeys")
+	ctx, cancel := context.WithCancel(opentracing.ContextWithSpan(context.Background(), span))
+	cancel()
+
+	if err := s.StoreKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		remoteRequest: testKeyResult("remote-key", time.Hour),
+	}); err != nil {
+		t.Fatalf("StoreKeys failed: %s", err)
+	}
+	if _, ok := db.keys[remoteRequest]; !ok {
+		t.Fatalf("expected the key to be stored despite the cancelled context")
+	}
+	if err := db.storeCtx.Err(); err != nil {
+		t.Fatalf("expected the store context not to be cancelled, got %s", err)
+	}
+	if got := opentracing.SpanFromContext(db.storeCtx); got != span {
+		t.Fatalf("expected the tracing span to be propagated to the store")
+	}
+}
+
+// slowKeyDatabase doesn't finish storing keys until release is closed.
+type slowKeyDatabase struct {
+	*mockKeyDatabase
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *slowKeyDatabase) StoreKeysFetchedAt(
+	ctx context.Context,
+	keys map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	fetchedTS gomatrixserverlib.Timestamp,
+) error {
+	close(d.started)
+	<-d.release
+	return d.mockKeyDatabase.StoreKeysFetchedAt(ctx, keys, fetchedTS)
+}
+
+func TestDrainWaitsForStores(t *testing.T) {
+	db := &slowKeyDatabase{
+		mockKeyDatabase: newMockKeyDatabase(),
+		started:         make(chan struct{}),
+		release:         make(chan struct{}),
+	}
+	s := newTestServerKeyAPI(db)
+
+	// Nothing is being stored yet, so there's nothing to wait for.
+	if err := s.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain failed: %s", err)
+	}
+
+	stored := make(chan error, 1)
+	go func() {
+		stored <- s.StoreKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("remote-key", time.Hour),
+		})
+	}()
+	<-db.started
+
+	// Drain gives up if the store takes longer than it is allowed to wait.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := s.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Drain to time out, got %v", err)
+	}
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- s.Drain(context.Background())
+	}()
+	select {
+	case err := <-drained:
+		t.Fatalf("expected Drain to wait for the store, but it returned %v", err)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	close(db.release)
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Fatalf("Drain failed: %s", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("expected Drain to return once the store finished")
+	}
+	if err := <-stored; err != nil {
+		t.Fatalf("StoreKeys failed: %s", err)
+	}
+	db.Lock()
+	_, ok := db.keys[remoteRequest]
+	db.Unlock()
+	if !ok {
+		t.Fatalf("expected the key to have been stored")
+	}
+}
+
+func TestStoresDontBlockWhileDraining(t *testing.T) {
+	s := newTestServerKeyAPI(newMockKeyDatabase())
+	finish := s.beginStore()
+
+	// Drain gives up on the store, which is still in progress.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := s.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Drain to time out, got %v", err)
+	}
+
+	// New stores shouldn't have to wait for the one that Drain gave up on.
+	began := make(chan struct{})
+	go func() {
+		s.beginStore()()
+		close(began)
+	}()
+	select {
+	case <-began:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("expected a new store to begin while Drain was waiting")
+	}
+
+	finish()
+	if err := s.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain failed: %s", err)
+	}
+}
+
+func TestFetchKeysHonoursCancellationWhenConfigured(t *testing.T) {
+	fetcher := &mockFetcher{
+		name:  "slow",
+		delay: time.Minute,
+	}
+	s := newTestServerKeyAPI(newMockKeyDatabase(), fetcher)
+	s.HonourFetchCancellation = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if _, err := s.FetchKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+	}); err == nil {
+		t.Fatalf("expected FetchKeys to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected FetchKeys to give up straight away, took %s", elapsed)
+	}
+}
+
+func TestFetchRateLimitDefersFetches(t *testing.T) {
+	clock := time.Unix(1600000000, 0)
+	expired := testKeyResult("old-key", 0)
+	expired.ValidUntilTS = gomatrixserverlib.AsTimestamp(clock.Add(-time.Minute))
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		err:  errors.New("connection refused"),
+	}
+	db := newMockKeyDatabase()
+	db.keys[remoteRequest] = expired
+	s := newTestServerKeyAPI(db, fetcher)
+	s.Now = func() time.Time { return clock }
+	s.FetchRateLimit = 1
+
+	fetch := func() gomatrixserverlib.PublicKeyLookupResult {
+		res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			remoteRequest: gomatrixserverlib.AsTimestamp(clock),
+		})
+		if err != nil {
+			t.Fatalf("FetchKeys failed: %s", err)
+		}
+		return res[remoteRequest]
+	}
+
+	// The first lookup is allowed to try the fetcher, the second isn't,
+	// but both fall back to the key that we already had.
+	for i := 1; i <= 2; i++ {
+		if got := string(fetch().Key); got != "old-key" {
+			t.Fatalf("lookup %d: expected the cached key, got %q", i, got)
+		}
+		if fetcher.callCount() != 1 {
+			t.Fatalf("lookup %d: expected one call to the fetcher, got %d", i, fetcher.callCount())
+		}
+	}
+
+	// Once the bucket has refilled we can try again.
+	clock = clock.Add(time.Minute)
+	fetch()
+	if fetcher.callCount() != 2 {
+		t.Fatalf("expected the fetcher to be tried again, got %d call(s)", fetcher.callCount())
+	}
+}
+
+type mockKeyClient struct {
+	sync.Mutex
+	keys    map[gomatrixserverlib.ServerName]gomatrixserverlib.ServerKeys
+	lookups map[gomatrixserverlib.ServerName][]gomatrixserverlib.ServerKeys
+	// The errors to return for each server instead of its keys.
+	errs map[gomatrixserverlib.ServerName]error
+	// The requests made to each endpoint.
+	getRequests    []gomatrixserverlib.ServerName
+	lookupRequests []map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp
+}
+
+func (c *mockKeyClient) GetServerKeys(
+	_ context.Context, matrixServer gomatrixserverlib.ServerName,
+) (gomatrixserverlib.ServerKeys, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.getRequests = append(c.getRequests, matrixServer)
+	if err := c.errs[matrixServer]; err != nil {
+		return gomatrixserverlib.ServerKeys{}, err
+	}
+	keys, ok := c.keys[matrixServer]
+	if !ok {
+		return gomatrixserverlib.ServerKeys{}, fmt.Errorf("no keys for %q", matrixServer)
+	}
+	return keys, nil
+}
+
+func (c *mockKeyClient) LookupServerKeys(
+	_ context.Context, s gomatrixserverlib.ServerName, keyRequests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) ([]gomatrixserverlib.ServerKeys, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.lookupRequests = append(c.lookupRequests, keyRequests)
+	keys, ok := c.lookups[s]
+	if !ok {
+		return nil, fmt.Errorf("not implemented")
+	}
+	return keys, nil
+}
+
+// signedServerKeys returns a key response for the server, signed with
+// signingKey, that advertises publicKey as its only key.
+func signedServerKeys(
+	t *testing.T, serverName gomatrixserverlib.ServerName,
+	publicKey ed25519.PublicKey, signingKey ed25519.PrivateKey,
+) gomatrixserverlib.ServerKeys {
+	var keys gomatrixserverlib.ServerKeys
+	keys.ServerName = serverName
+	keys.ValidUntilTS = gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour))
+	keys.VerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey{
+		testKeyID: {Key: gomatrixserverlib.Base64Bytes(publicKey)},
+	}
+	toSign, err := json.Marshal(keys.ServerKeyFields)
+	if err != nil {
+		t.Fatalf("failed to marshal server keys: %s", err)
+	}
+	keys.Raw, err = gomatrixserverlib.SignJSON(string(serverName), testKeyID, signingKey, toSign)
+	if err != nil {
+		t.Fatalf("failed to sign server keys: %s", err)
+	}
+	return keys
+}
+
+func TestPrefetchServerKeys(t *testing.T) {
+	goodPublic, goodPrivate, _ := ed25519.GenerateKey(nil)
+	badPublic, _, _ := ed25519.GenerateKey(nil)
+	_, otherPrivate, _ := ed25519.GenerateKey(nil)
+	good := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "good.com", KeyID: testKeyID}
+	forged := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "forged.com", KeyID: testKeyID}
+
+	fetcher := &mockFetcher{name: "fetcher"}
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, fetcher)
+	s.KeyCacheSize = 16
+	s.FedClient = &mockKeyClient{
+		keys: map[gomatrixserverlib.ServerName]gomatrixserverlib.ServerKeys{
+			"good.com": signedServerKeys(t, "good.com", goodPublic, goodPrivate),
+			// Signed with a key other than the one it advertises.
+			"forged.com": signedServerKeys(t, "forged.com", badPublic, otherPrivate),
+		},
+	}
+
+	err := s.PrefetchServerKeys(context.Background(), []gomatrixserverlib.ServerName{"good.com", "forged.com", "good.com"})
+	if err == nil {
+		t.Fatalf("expected an error for the badly signed server")
+	}
+	if got := db.keys[good].Key; !reflect.DeepEqual([]byte(got), []byte(goodPublic)) {
+		t.Fatalf("expected the prefetched key to be stored, got %v", got)
+	}
+	if _, ok := db.keys[forged]; ok {
+		t.Fatalf("expected the badly signed key not to be stored")
+	}
+
+	// Looking up the prefetched key shouldn't need the fetchers or the
+	// database any more.
+	fetches := atomic.LoadInt32(&db.fetches)
+	res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		good: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if !reflect.DeepEqual([]byte(res[good].Key), []byte(goodPublic)) {
+		t.Fatalf("expected the prefetched key, got %v", res[good].Key)
+	}
+	if fetcher.callCount() != 0 || atomic.LoadInt32(&db.fetches) != fetches {
+		t.Fatalf("expected the prefetched key to come from the cache")
+	}
+}
+
+func TestPrefetchServerKeysUsesFetchPolicies(t *testing.T) {
+	goodPublic, goodPrivate, _ := ed25519.GenerateKey(nil)
+	blockedPublic, blockedPrivate, _ := ed25519.GenerateKey(nil)
+	localPublic, localPrivate, _ := ed25519.GenerateKey(nil)
+	good := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "good.com", KeyID: testKeyID}
+
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db)
+	s.MaxKeyValidity = time.Minute * 10
+	s.CircuitBreakerThreshold = 1
+	client := &mockKeyClient{
+		keys: map[gomatrixserverlib.ServerName]gomatrixserverlib.ServerKeys{
+			"good.com":    signedServerKeys(t, "good.com", goodPublic, goodPrivate),
+			"blocked.com": signedServerKeys(t, "blocked.com", blockedPublic, blockedPrivate),
+			"LOCAL.com.":  signedServerKeys(t, "LOCAL.com.", localPublic, localPrivate),
+		},
+	}
+	s.FedClient = client
+	s.recordFetchFailure("blocked.com")
+
+	start := time.Now()
+	err := s.PrefetchServerKeys(context.Background(), []gomatrixserverlib.ServerName{"good.com", "blocked.com", "LOCAL.com."})
+	if err != nil {
+		t.Fatalf("PrefetchServerKeys failed: %s", err)
+	}
+	if !reflect.DeepEqual(client.getRequests, []gomatrixserverlib.ServerName{"good.com"}) {
+		t.Fatalf("expected only good.com to be asked, got %v", client.getRequests)
+	}
+	stored, ok := db.keys[good]
+	if !ok {
+		t.Fatalf("expected the prefetched key to be stored")
+	}
+	if max := gomatrixserverlib.AsTimestamp(start.Add(s.MaxKeyValidity + time.Second)); stored.ValidUntilTS > max {
+		t.Fatalf("expected the prefetched key's validity to be clamped, got %v", stored.ValidUntilTS)
+	}
+	if provenance := db.provenance[good]; provenance.FetcherName != prefetchFetcherName {
+		t.Fatalf("expected the prefetched key's provenance to be recorded, got %+v", provenance)
+	}
+}
+
+// blockingKeyClient is a key client whose requests block until their
+// context is done.
+type blockingKeyClient struct {
+	mockKeyClient
+	calls   int32
+	started chan gomatrixserverlib.ServerName
+}
+
+func (c *blockingKeyClient) GetServerKeys(
+	ctx context.Context, matrixServer gomatrixserverlib.ServerName,
+) (gomatrixserverlib.ServerKeys, error) {
+	atomic.AddInt32(&c.calls, 1)
+	c.started <- matrixServer
+	<-ctx.Done()
+	return gomatrixserverlib.ServerKeys{}, ctx.Err()
+}
+
+func TestPrefetchServerKeysCancellation(t *testing.T) {
+	client := &blockingKeyClient{started: make(chan gomatrixserverlib.ServerName, 10)}
+	s := newTestServerKeyAPI(newMockKeyDatabase())
+	s.FedClient = client
+	s.PrefetchConcurrency = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.PrefetchServerKeys(ctx, []gomatrixserverlib.ServerName{"a.com", "b.com", "c.com"})
+	}()
+
+	// Wait for the first request to be in flight and then give up.
+	select {
+	case <-client.started:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("timed out waiting for the prefetch to start")
+	}
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected the prefetch to report that it was cancelled, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("timed out waiting for the cancelled prefetch to return")
+	}
+	if calls := atomic.LoadInt32(&client.calls); calls != 1 {
+		t.Fatalf("expected no more servers to be asked after cancelling, got %d requests", calls)
+	}
+}
+
+func TestExportImportKeysRoundTrip(t *testing.T) {
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db)
+	keys := syntheticKeys(10)
+	if err := s.StoreKeys(context.Background(), keys); err != nil {
+		t.Fatalf("StoreKeys failed: %s", err)
+	}
+
+	exported, err := s.ExportKeys(context.Background())
+	if err != nil {
+		t.Fatalf("ExportKeys failed: %s", err)
+	}
+	if !reflect.DeepEqual(exported, keys) {
+		t.Fatalf("exported keys don't match the stored keys")
+	}
+
+	// Clear out the database and then restore it from the export.
+	requests := make([]gomatrixserverlib.PublicKeyLookupRequest, 0, len(exported))
+	for req := range exported {
+		requests = append(requests, req)
+	}
+	if err = s.InvalidateKeys(context.Background(), requests); err != nil {
+		t.Fatalf("InvalidateKeys failed: %s", err)
+	}
+	if len(db.keys) != 0 {
+		t.Fatalf("expected the database to be empty, got %d key(s)", len(db.keys))
+	}
+	if err = s.ImportKeys(context.Background(), exported); err != nil {
+		t.Fatalf("ImportKeys failed: %s", err)
+	}
+	if !reflect.DeepEqual(db.keys, keys) {
+		t.Fatalf("imported keys don't match the exported keys")
+	}
+}
+
+func TestStoredKeysFetchTimes(t *testing.T) {
+	clock := time.Unix(1600000000, 0)
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("remote-key", time.Hour),
+		},
+	}
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, fetcher)
+	s.Now = func() time.Time { return clock }
+
+	// Keys from a fetcher are recorded as fetched at our time.
+	if _, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(clock),
+	}); err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if fetched := db.fetched[remoteRequest]; fetched != gomatrixserverlib.AsTimestamp(clock) {
+		t.Fatalf("expected the key to have been fetched at %d, got %d", gomatrixserverlib.AsTimestamp(clock), fetched)
+	}
+
+	// Importing a newer copy of the key keeps the fetch time that we had,
+	// and imported keys that we didn't have aren't given one.
+	other := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "other.com", KeyID: testKeyID}
+	clock = clock.Add(time.Minute)
+	if err := s.ImportKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		remoteRequest: testKeyResult("remote-key", time.Hour*2),
+		other:         testKeyResult("other-key", time.Hour),
+	}); err != nil {
+		t.Fatalf("ImportKeys failed: %s", err)
+	}
+	if fetched := db.fetched[remoteRequest]; fetched != gomatrixserverlib.AsTimestamp(clock.Add(-time.Minute)) {
+		t.Fatalf("expected the imported key to keep its fetch time, got %d", fetched)
+	}
+	if fetched, ok := db.fetched[other]; ok {
+		t.Fatalf("expected the new imported key not to have a fetch time, got %d", fetched)
+	}
+}
+
+func TestExportKeysStream(t *testing.T) {
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db)
+	keys := syntheticKeys(1000)
+	if err := s.StoreKeys(context.Background(), keys); err != nil {
+		t.Fatalf("StoreKeys failed: %s", err)
+	}
+
+	seen := map[gomatrixserverlib.PublicKeyLookupRequest]int{}
+	batches := 0
+	if err := s.ExportKeysStream(context.Background(), func(batch map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult) error {
+		batches++
+		if len(batch) > defaultExportBatchSize {
+			t.Fatalf("expected batches of at most %d keys, got %d", defaultExportBatchSize, len(batch))
+		}
+		for req, res := range batch {
+			seen[req]++
+			if !reflect.DeepEqual(res, keys[req]) {
+				t.Fatalf("exported key %+v doesn't match: got %+v, want %+v", req, res, keys[req])
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("ExportKeysStream failed: %s", err)
+	}
+	if batches != 10 {
+		t.Fatalf("expected 10 batches, got %d", batches)
+	}
+	if len(seen) != len(keys) {
+		t.Fatalf("expected %d keys to be exported, got %d", len(keys), len(seen))
+	}
+	for req, count := range seen {
+		if count != 1 {
+			t.Fatalf("expected key %+v to be exported once, got %d", req, count)
+		}
+	}
+
+	// Errors from the callback stop the export.
+	stop := errors.New("stop")
+	batches = 0
+	if err := s.ExportKeysStream(context.Background(), func(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult) error {
+		batches++
+		return stop
+	}); err != stop {
+		t.Fatalf("expected the callback's error, got %v", err)
+	}
+	if batches != 1 {
+		t.Fatalf("expected the export to stop after the first batch, got %d", batches)
+	}
+}
+
+func TestImportKeysKeepsNewerKeys(t *testing.T) {
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db)
+	db.keys[remoteRequest] = testKeyResult("newer-key", time.Hour*2)
+
+	if err := s.ImportKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		remoteRequest: testKeyResult("older-key", time.Hour),
+	}); err != nil {
+		t.Fatalf("ImportKeys failed: %s", err)
+	}
+	if got := string(db.keys[remoteRequest].Key); got != "newer-key" {
+		t.Fatalf("expected the newer key to be kept, got %q", got)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	s := newTestServerKeyAPI(newMockKeyDatabase())
+	if err := s.HealthCheck(context.Background()); err != nil {
+		t.Fatalf("expected healthy server key API, got %s", err)
+	}
+}
+
+func TestHealthCheckMissingSigningKey(t *testing.T) {
+	s := newTestServerKeyAPI(newMockKeyDatabase())
+	s.ServerPublicKey = nil
+	if err := s.HealthCheck(context.Background()); err == nil {
+		t.Fatalf("expected error for missing signing key")
+	}
+
+	s = newTestServerKeyAPI(newMockKeyDatabase())
+	s.ServerKeyID = ""
+	if err := s.HealthCheck(context.Background()); err == nil {
+		t.Fatalf("expected error for missing signing key ID")
+	}
+}
+
+func TestHealthCheckExpiredSigningKey(t *testing.T) {
+	s := newTestServerKeyAPI(newMockKeyDatabase())
+	s.ServerKeyIssuedAt = time.Now().Add(-2 * s.ServerKeyValidity)
+	if err := s.HealthCheck(context.Background()); err == nil {
+		t.Fatalf("expected error for expired signing key")
+	}
+}
+
+func TestKeyProvenanceReflectsLatestFetcher(t *testing.T) {
+	start := time.Now()
+	clock := start
+	first := &mockFetcher{
+		name: "first",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: {
+				VerifyKey:    gomatrixserverlib.VerifyKey{Key: gomatrixserverlib.Base64Bytes("first-key")},
+				ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+				ValidUntilTS: gomatrixserverlib.AsTimestamp(start.Add(time.Hour)),
+			},
+		},
+	}
+	second := &mockFetcher{
+		name: "second",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: {
+				VerifyKey:    gomatrixserverlib.VerifyKey{Key: gomatrixserverlib.Base64Bytes("second-key")},
+				ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+				ValidUntilTS: gomatrixserverlib.AsTimestamp(start.Add(time.Hour * 3)),
+			},
+		},
+	}
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, first, second)
+	s.Now = func() time.Time { return clock }
+
+	fetchProvenance := func() *api.KeyProvenance {
+		if _, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			remoteRequest: gomatrixserverlib.AsTimestamp(clock),
+		}); err != nil {
+			t.Fatalf("FetchKeys failed: %s", err)
+		}
+		provenance, err := s.KeyProvenance(context.Background(), remoteRequest)
+		if err != nil {
+			t.Fatalf("KeyProvenance failed: %s", err)
+		}
+		if provenance == nil {
+			t.Fatalf("expected provenance for the stored key")
+		}
+		return provenance
+	}
+
+	provenance := fetchProvenance()
+	if provenance.FetcherName != "first" || provenance.FetchedTS != gomatrixserverlib.AsTimestamp(start) {
+		t.Fatalf("expected the key to have come from the first fetcher, got %+v", provenance)
+	}
+
+	// Once the key has expired, the first fetcher is unavailable and the
+	// second one stores a newer key instead.
+	clock = start.Add(time.Hour * 2)
+	first.err = errors.New("unavailable")
+	provenance = fetchProvenance()
+	if provenance.FetcherName != "second" || provenance.FetchedTS != gomatrixserverlib.AsTimestamp(clock) {
+		t.Fatalf("expected the key to have come from the second fetcher, got %+v", provenance)
+	}
+
+	unknown, err := s.KeyProvenance(context.Background(), gomatrixserverlib.PublicKeyLookupRequest{ServerName: "unknown.com", KeyID: testKeyID})
+	if err != nil || unknown != nil {
+		t.Fatalf("expected no provenance for an unknown key, got %+v, %v", unknown, err)
+	}
+}
+
+func TestPingFetchers(t *testing.T) {
+	healthy := &mockFetcher{name: "ping-healthy"}
+	failing := &mockFetcher{name: "ping-failing", err: errors.New("connection refused")}
+	slow := &mockFetcher{name: "ping-slow", delay: time.Second * 5, timeout: time.Millisecond * 50}
+	notary := &mockFetcher{name: "ping-notary"}
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, healthy, failing, slow)
+	s.NotaryFetchers = []gomatrixserverlib.KeyFetcher{notary}
+
+	before := histogramCounts(t, keyFetcherPingDuration)
+	outcomes := s.PingFetchers(context.Background())
+	after := histogramCounts(t, keyFetcherPingDuration)
+
+	if len(outcomes) != 4 {
+		t.Fatalf("expected an outcome for each of the 4 fetchers, got %d", len(outcomes))
+	}
+	for _, name := range []string{"ping-healthy", "ping-notary"} {
+		if err, ok := outcomes[name]; !ok || err != nil {
+			t.Fatalf("expected %q to succeed, got %v", name, err)
+		}
+	}
+	if err := outcomes["ping-failing"]; !errors.Is(err, failing.err) {
+		t.Fatalf("expected the failing fetcher's error, got %v", err)
+	}
+	if err := outcomes["ping-slow"]; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the slow fetcher to time out, got %v", err)
+	}
+	for labels, want := range map[[2]string]uint64{
+		{"ping-healthy", fetchOutcomeSuccess}: 1,
+		{"ping-notary", fetchOutcomeSuccess}:  1,
+		{"ping-failing", fetchOutcomeFailure}: 1,
+		{"ping-slow", fetchOutcomeFailure}:    1,
+	} {
+		if got := after[labels] - before[labels]; got != want {
+			t.Fatalf("expected %d ping observation(s) for %v, got %d", want, labels, got)
+		}
+	}
+	if stores := atomic.LoadInt32(&db.stores); stores != 0 {
+		t.Fatalf("expected nothing to be stored, got %d stores", stores)
+	}
+}
+
+func TestFetchKeysWithProvenance(t *testing.T) {
+	localRequest := gomatrixserverlib.PublicKeyLookupRequest{ServerName: testServerName, KeyID: testKeyID}
+	databaseRequest := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "database.com", KeyID: testKeyID}
+	fetcherRequest := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "fetcher.com", KeyID: testKeyID}
+
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			fetcherRequest: testKeyResult("fetcher-key", time.Hour),
+		},
+	}
+	db := newMockKeyDatabase()
+	db.keys[databaseRequest] = testKeyResult("database-key", time.Hour)
+	s := newTestServerKeyAPI(db, fetcher)
+
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+	results, provenance, err := s.FetchKeysWithProvenance(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		localRequest:    now,
+		databaseRequest: now,
+		fetcherRequest:  now,
+	})
+	if err != nil {
+		t.Fatalf("FetchKeysWithProvenance failed: %s", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	want := map[gomatrixserverlib.PublicKeyLookupRequest]string{
+		localRequest:    "local",
+		databaseRequest: "database",
+		fetcherRequest:  "fetcher",
+	}
+	if !reflect.DeepEqual(provenance, want) {
+		t.Fatalf("unexpected provenance:\n got %v\nwant %v", provenance, want)
+	}
+}
+
+func TestFetcherParallelism(t *testing.T) {
+	older := &mockFetcher{
+		name:  "older",
+		delay: time.Millisecond * 200,
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("older-key", time.Hour),
+		},
+	}
+	fresher := &mockFetcher{
+		name:  "fresher",
+		delay: time.Millisecond * 200,
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("fresher-key", time.Hour*2),
+		},
+	}
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, older, fresher)
+	s.FetcherParallelism = 2
+
+	start := time.Now()
+	res, provenance, err := s.FetchKeysWithProvenance(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if took := time.Since(start); took >= older.delay+fresher.delay {
+		t.Fatalf("expected the fetchers to run concurrently, took %s", took)
+	}
+	if older.callCount() != 1 || fresher.callCount() != 1 {
+		t.Fatalf("expected both fetchers to be asked, got %d and %d call(s)", older.callCount(), fresher.callCount())
+	}
+	if got := string(res[remoteRequest].Key); got != "fresher-key" {
+		t.Fatalf("expected the fresher key to win, got %q", got)
+	}
+	if got := provenance[remoteRequest]; got != "fresher" {
+		t.Fatalf("expected the key to come from the fresher fetcher, got %q", got)
+	}
+	if got := string(db.keys[remoteRequest].Key); got != "fresher-key" {
+		t.Fatalf("expected the fresher key to be stored, got %q", got)
+	}
+}
+
+func TestListCachedServers(t *testing.T) {
+	db := newMockKeyDatabase()
+	for _, req := range []gomatrixserverlib.PublicKeyLookupRequest{
+		{ServerName: "b.com", KeyID: "ed25519:1"},
+		{ServerName: "a.com", KeyID: "ed25519:1"},
+		{ServerName: "b.com", KeyID: "ed25519:2"},
+		{ServerName: "c.com", KeyID: "ed25519:1"},
+		{ServerName: testServerName, KeyID: testKeyID},
+	} {
+		db.keys[req] = testKeyResult("key", time.Hour)
+	}
+	s := newTestServerKeyAPI(db)
+
+	serverNames, err := s.ListCachedServers(context.Background())
+	if err != nil {
+		t.Fatalf("ListCachedServers failed: %s", err)
+	}
+	want := []gomatrixserverlib.ServerName{"a.com", "b.com", "c.com"}
+	if !reflect.DeepEqual(serverNames, want) {
+		t.Fatalf("got %v, want %v", serverNames, want)
+	}
+}
+
+func TestOnFetcherError(t *testing.T) {
+	fetchErr := errors.New("server unreachable")
+	failing := &mockFetcher{
+		name: "failing",
+		err:  fetchErr,
+	}
+	working := &mockFetcher{
+		name: "working",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("remote-key", time.Hour),
+		},
+	}
+	s := newTestServerKeyAPI(newMockKeyDatabase(), failing, working)
+
+	type fetcherError struct {
+		fetcherName string
+		req         gomatrixserverlib.PublicKeyLookupRequest
+		err         error
+	}
+	var mutex sync.Mutex
+	var got []fetcherError
+	s.OnFetcherError = func(fetcherName string, req gomatrixserverlib.PublicKeyLookupRequest, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		got = append(got, fetcherError{fetcherName, req, err})
+	}
+
+	if _, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+	}); err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(got) != 1 {
+		t.Fatalf("expected the callback to fire once, got %d", len(got))
+	}
+	if got[0].fetcherName != "failing" || got[0].req != remoteRequest {
+		t.Fatalf("unexpected callback arguments: %+v", got[0])
+	}
+	if !errors.Is(got[0].err, fetchErr) {
+		t.Fatalf("expected the fetcher's error, got %v", got[0].err)
+	}
+}
+
+func TestFetcherFailureForOneServer(t *testing.T) {
+	_, remoteKey, _ := ed25519.GenerateKey(nil)
+	otherRequest := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "other.com", KeyID: testKeyID}
+	client := &mockKeyClient{
+		keys: map[gomatrixserverlib.ServerName]gomatrixserverlib.ServerKeys{
+			"remote.com": multiKeyServerKeys(t, "remote.com", map[gomatrixserverlib.KeyID]ed25519.PrivateKey{
+				testKeyID: remoteKey,
+			}, nil),
+		},
+		errs: map[gomatrixserverlib.ServerName]error{
+			"other.com": context.DeadlineExceeded,
+		},
+	}
+	fetcher := DirectKeyFetcher{&gomatrixserverlib.DirectKeyFetcher{Client: client}}
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, fetcher)
+	s.NegativeCacheTTL = time.Minute
+	s.PersistNegativeCache = true
+	s.CircuitBreakerThreshold = 1
+	var failed []gomatrixserverlib.PublicKeyLookupRequest
+	s.OnFetcherError = func(fetcherName string, req gomatrixserverlib.PublicKeyLookupRequest, err error) {
+		failed = append(failed, req)
+	}
+
+	results, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+		otherRequest:  gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	var missing *api.MissingKeysError
+	if !errors.As(err, &missing) || !reflect.DeepEqual(missing.Missing, []gomatrixserverlib.PublicKeyLookupRequest{otherRequest}) {
+		t.Fatalf("expected only the other server's key to be missing, got %v", err)
+	}
+	if _, ok := results[remoteRequest]; !ok {
+		t.Fatalf("expected the key from the server that answered")
+	}
+
+	// The server that failed is treated as having failed, rather than as
+	// having answered without the key.
+	if !reflect.DeepEqual(failed, []gomatrixserverlib.PublicKeyLookupRequest{otherRequest}) {
+		t.Fatalf("expected OnFetcherError for the other server's key, got %v", failed)
+	}
+	if s.breakerAllows("other.com") {
+		t.Fatalf("expected the failure to count towards the other server's circuit breaker")
+	}
+	if !s.breakerAllows("remote.com") {
+		t.Fatalf("expected the server that answered not to be circuit broken")
+	}
+	s.negativeCacheMutex.Lock()
+	_, cached := s.negativeCache[otherRequest]
+	s.negativeCacheMutex.Unlock()
+	db.Lock()
+	_, stored := db.negative[otherRequest]
+	db.Unlock()
+	if cached || stored {
+		t.Fatalf("expected the key of the server that failed not to be negatively cached")
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	fetcher := &mockFetcher{
+		name:     "fetcher",
+		err:      errors.New("connection refused"),
+		failures: 2,
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("fresh-key", time.Hour),
+		},
+	}
+	db := newMockKeyDatabase()
+	db.keys[remoteRequest] = testKeyResult("stale-key", -time.Hour)
+	s := newTestServerKeyAPI(db, fetcher)
+	s.CircuitBreakerThreshold = 2
+	s.CircuitBreakerWindow = time.Minute
+	s.CircuitBreakerCooldown = time.Minute * 5
+	now := time.Now()
+	s.Now = func() time.Time { return now }
+
+	fetch := func() string {
+		t.Helper()
+		res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			remoteRequest: gomatrixserverlib.AsTimestamp(now),
+		})
+		if err != nil {
+			t.Fatalf("FetchKeys failed: %s", err)
+		}
+		return string(res[remoteRequest].Key)
+	}
+
+	// Two failures in a row open the breaker.
+	openBefore := testutil.ToFloat64(circuitBreakersOpen)
+	for i := 1; i <= 2; i++ {
+		if got := fetch(); got != "stale-key" {
+			t.Fatalf("expected the stale key while the fetcher is failing, got %q", got)
+		}
+		if calls := fetcher.callCount(); calls != i {
+			t.Fatalf("expected %d fetcher call(s), got %d", i, calls)
+		}
+	}
+	if open := testutil.ToFloat64(circuitBreakersOpen) - openBefore; open != 1 {
+		t.Fatalf("expected the breaker to be reported as open, got %v", open)
+	}
+
+	// While it's open, the fetcher isn't asked and the stale key is served.
+	now = now.Add(time.Minute)
+	if got := fetch(); got != "stale-key" {
+		t.Fatalf("expected the stale key while the breaker is open, got %q", got)
+	}
+	if calls := fetcher.callCount(); calls != 2 {
+		t.Fatalf("expected the breaker to short-circuit the fetcher, got %d call(s)", calls)
+	}
+
+	// After the cool-down, the breaker closes and we try again.
+	now = now.Add(time.Minute * 5)
+	if got := fetch(); got != "fresh-key" {
+		t.Fatalf("expected the fresh key once the breaker closed, got %q", got)
+	}
+	if calls := fetcher.callCount(); calls != 3 {
+		t.Fatalf("expected the fetcher to be asked after the cool-down, got %d call(s)", calls)
+	}
+	if open := testutil.ToFloat64(circuitBreakersOpen) - openBefore; open != 0 {
+		t.Fatalf("expected the breaker to be reported as closed, got %v", open)
+	}
+}
+
+type mockSignedFetcher struct {
+	mockFetcher
+	responses []gomatrixserverlib.ServerKeys
+}
+
+func (f *mockSignedFetcher) FetchSignedKeys(
+	_ context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) ([]gomatrixserverlib.ServerKeys, error) {
+	atomic.AddInt32(&f.calls, 1)
+	var responses []gomatrixserverlib.ServerKeys
+	for _, keys := range f.responses {
+		for req := range requests {
+			if req.ServerName == keys.ServerName {
+				responses = append(responses, keys)
+				break
+			}
+		}
+	}
+	return responses, nil
+}
+
+// tamperSignature replaces the server's signature on the key response
+// with a different one of the same length.
+func tamperSignature(t *testing.T, keys gomatrixserverlib.ServerKeys) gomatrixserverlib.ServerKeys {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(keys.Raw, &raw); err != nil {
+		t.Fatalf("failed to unmarshal server keys: %s", err)
+	}
+	signatures := raw["signatures"].(map[string]interface{})[string(keys.ServerName)].(map[string]interface{})
+	_, otherPrivate, _ := ed25519.GenerateKey(nil)
+	signatures[string(testKeyID)] = gomatrixserverlib.Base64Bytes(ed25519.Sign(otherPrivate, []byte("tampered"))).Encode()
+	var err error
+	if keys.Raw, err = json.Marshal(raw); err != nil {
+		t.Fatalf("failed to marshal server keys: %s", err)
+	}
+	return keys
+}
+
+func TestVerifyFetchedKeysDropsTamperedSignature(t *testing.T) {
+	goodPublic, goodPrivate, _ := ed25519.GenerateKey(nil)
+	tamperedPublic, tamperedPrivate, _ := ed25519.GenerateKey(nil)
+	good := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "good.com", KeyID: testKeyID}
+	tampered := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "tampered.com", KeyID: testKeyID}
+
+	fetcher := &mockSignedFetcher{
+		mockFetcher: mockFetcher{name: "fetcher"},
+		responses: []gomatrixserverlib.ServerKeys{
+			signedServerKeys(t, "good.com", goodPublic, goodPrivate),
+			tamperSignature(t, signedServerKeys(t, "tampered.com", tamperedPublic, tamperedPrivate)),
+		},
+	}
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, fetcher)
+	s.VerifyFetchedKeys = true
+
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+	res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		good:     now,
+		tampered: now,
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if !reflect.DeepEqual([]byte(res[good].Key), []byte(goodPublic)) {
+		t.Fatalf("expected the correctly signed key, got %v", res[good].Key)
+	}
+	if got := db.keys[good].Key; !reflect.DeepEqual([]byte(got), []byte(goodPublic)) {
+		t.Fatalf("expected the correctly signed key to be stored, got %v", got)
+	}
+	if _, ok := res[tampered]; ok {
+		t.Fatalf("expected the key with the tampered signature to be rejected")
+	}
+	if _, ok := db.keys[tampered]; ok {
+		t.Fatalf("expected the key with the tampered signature not to be stored")
+	}
+}
+
+func TestVerifyFetchedKeysDisabledUsesFetchKeys(t *testing.T) {
+	fetcher := &mockSignedFetcher{
+		mockFetcher: mockFetcher{
+			name: "fetcher",
+			keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+				remoteRequest: testKeyResult("remote-key", time.Hour),
+			},
+		},
+	}
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, fetcher)
+
+	res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if got := string(res[remoteRequest].Key); got != "remote-key" {
+		t.Fatalf("expected the key from FetchKeys, got %q", got)
+	}
+}
+
+func TestCaptureRawKeysOnlyForConfiguredServers(t *testing.T) {
+	capturedPublic, capturedPrivate, _ := ed25519.GenerateKey(nil)
+	otherPublic, otherPrivate, _ := ed25519.GenerateKey(nil)
+	captured := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "captured.com", KeyID: testKeyID}
+	other := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "other.com", KeyID: testKeyID}
+	capturedKeys := signedServerKeys(t, "captured.com", capturedPublic, capturedPrivate)
+
+	fetcher := &mockSignedFetcher{
+		mockFetcher: mockFetcher{name: "fetcher"},
+		responses: []gomatrixserverlib.ServerKeys{
+			capturedKeys,
+			signedServerKeys(t, "other.com", otherPublic, otherPrivate),
+		},
+	}
+	s := newTestServerKeyAPI(newMockKeyDatabase(), fetcher)
+	s.CaptureRawKeysFor = []gomatrixserverlib.ServerName{"captured.com"}
+	capturedRaw := map[gomatrixserverlib.ServerName][]byte{}
+	s.OnRawKeyResponse = func(
+		fetcherName string, serverName gomatrixserverlib.ServerName, raw []byte,
+		results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	) {
+		if fetcherName != "fetcher" {
+			t.Errorf("expected the response from %q, got %q", "fetcher", fetcherName)
+		}
+		if got := results[captured].Key; !reflect.DeepEqual([]byte(got), []byte(capturedPublic)) {
+			t.Errorf("expected the parsed key alongside the response, got %v", got)
+		}
+		capturedRaw[serverName] = raw
+	}
+
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+	res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		captured: now,
+		other:    now,
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if !reflect.DeepEqual([]byte(res[other].Key), []byte(otherPublic)) {
+		t.Fatalf("expected the key for the uncaptured server, got %v", res[other].Key)
+	}
+	if len(capturedRaw) != 1 {
+		t.Fatalf("expected only one response to be captured, got %d", len(capturedRaw))
+	}
+	if !bytes.Equal(capturedRaw["captured.com"], capturedKeys.Raw) {
+		t.Fatalf("expected the raw response to be captured, got %s", capturedRaw["captured.com"])
+	}
+
+	// Requests for servers that aren't being captured should be fetched
+	// using FetchKeys as normal.
+	uncaptured := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "uncaptured.com", KeyID: testKeyID}
+	fetcher.keys = map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		uncaptured: testKeyResult("uncaptured-key", time.Hour),
+	}
+	s.CaptureRawKeysFor = []gomatrixserverlib.ServerName{"elsewhere.com"}
+	capturedRaw = map[gomatrixserverlib.ServerName][]byte{}
+	res, err = s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		uncaptured: now,
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if got := string(res[uncaptured].Key); got != "uncaptured-key" {
+		t.Fatalf("expected the key from FetchKeys, got %q", got)
+	}
+	if len(capturedRaw) != 0 {
+		t.Fatalf("expected nothing to be captured, got %d response(s)", len(capturedRaw))
+	}
+}
+
+func TestClockSkewTolerance(t *testing.T) {
+	clock := time.Unix(1600000000, 0)
+	for _, tc := range []struct {
+		name      string
+		tolerance time.Duration
+		expiredBy time.Duration
+		wantFetch bool
+	}{
+		{"expired without tolerance", 0, time.Second * 30, true},
+		{"expired within tolerance", time.Minute, time.Second * 30, false},
+		{"expired at tolerance", time.Minute, time.Minute, false},
+		{"expired beyond tolerance", time.Minute, time.Minute + time.Second, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fetcher := &mockFetcher{
+				name: "fetcher",
+				keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+					remoteRequest: testKeyResult("fresh-key", time.Hour),
+				},
+			}
+			db := newMockKeyDatabase()
+			db.keys[remoteRequest] = gomatrixserverlib.PublicKeyLookupResult{
+				VerifyKey: gomatrixserverlib.VerifyKey{
+					Key: gomatrixserverlib.Base64Bytes("cached-key"),
+				},
+				ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+				ValidUntilTS: gomatrixserverlib.AsTimestamp(clock.Add(-tc.expiredBy)),
+			}
+			s := newTestServerKeyAPI(db, fetcher)
+			s.ClockSkewTolerance = tc.tolerance
+			s.Now = func() time.Time { return clock }
+
+			res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+				remoteRequest: gomatrixserverlib.AsTimestamp(clock),
+			})
+			if err != nil {
+				t.Fatalf("FetchKeys failed: %s", err)
+			}
+			want := "cached-key"
+			if tc.wantFetch {
+				want = "fresh-key"
+			}
+			if got := string(res[remoteRequest].Key); got != want {
+				t.Fatalf("expected %q, got %q", want, got)
+			}
+			if fetched := fetcher.callCount() > 0; fetched != tc.wantFetch {
+				t.Fatalf("expected fetch %v, got %v", tc.wantFetch, fetched)
+			}
+		})
+	}
+}
+
+func TestKeyInfo(t *testing.T) {
+	oldRequest := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:old"}
+	oldKey := gomatrixserverlib.PublicKeyLookupResult{
+		VerifyKey: gomatrixserverlib.VerifyKey{
+			Key: gomatrixserverlib.Base64Bytes("old-key"),
+		},
+		ExpiredTS:    gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Hour)),
+		ValidUntilTS: gomatrixserverlib.PublicKeyNotValid,
+	}
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("remote-key", time.Hour),
+			oldRequest:    oldKey,
+		},
+	}
+	db := newMockKeyDatabase()
+	db.keys[gomatrixserverlib.PublicKeyLookupRequest{ServerName: "other.com", KeyID: testKeyID}] = testKeyResult("other-key", time.Hour)
+	s := newTestServerKeyAPI(db, fetcher)
+
+	before := gomatrixserverlib.AsTimestamp(time.Now())
+	res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: before,
+		oldRequest:    before,
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	after := gomatrixserverlib.AsTimestamp(time.Now())
+
+	metadata, err := s.KeyInfo(context.Background(), "remote.com")
+	if err != nil {
+		t.Fatalf("KeyInfo failed: %s", err)
+	}
+	if len(metadata) != 2 {
+		t.Fatalf("expected metadata for 2 keys, got %+v", metadata)
+	}
+	for i, req := range []gomatrixserverlib.PublicKeyLookupRequest{remoteRequest, oldRequest} {
+		got := metadata[i]
+		if got.KeyID != req.KeyID || got.ValidUntilTS != res[req].ValidUntilTS || got.ExpiredTS != res[req].ExpiredTS {
+			t.Fatalf("metadata %+v doesn't match stored key %s %+v", got, req.KeyID, res[req])
+		}
+		if got.FetchedTS < before || got.FetchedTS > after {
+			t.Fatalf("expected %s to have been fetched between %d and %d, got %d", req.KeyID, before, after, got.FetchedTS)
+		}
+	}
+}
+
+func TestAdaptiveFetcherOrder(t *testing.T) {
+	for _, adaptive := range []bool{false, true} {
+		// The first fetcher never finds the remote server's keys, but the
+		// second always does.
+		unreliable := &mockFetcher{name: "unreliable"}
+		reliable := &mockFetcher{
+			name: "reliable",
+			keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{},
+		}
+		for i := 1; i <= 3; i++ {
+			req := gomatrixserverlib.PublicKeyLookupRequest{
+				ServerName: "remote.com",
+				KeyID:      gomatrixserverlib.KeyID(fmt.Sprintf("ed25519:%d", i)),
+			}
+			reliable.keys[req] = testKeyResult(fmt.Sprintf("key-%d", i), time.Hour)
+		}
+		s := newTestServerKeyAPI(newMockKeyDatabase(), unreliable, reliable)
+		s.AdaptiveFetcherOrder = adaptive
+
+		for req := range reliable.keys {
+			if _, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+				req: gomatrixserverlib.AsTimestamp(time.Now()),
+			}); err != nil {
+				t.Fatalf("adaptive=%v: FetchKeys failed: %s", adaptive, err)
+			}
+		}
+
+		// Without adaptive ordering the unreliable fetcher is always asked
+		// first. With it, the reliable fetcher is promoted after the first
+		// lookup, so the unreliable one isn't needed again.
+		want := 3
+		if adaptive {
+			want = 1
+		}
+		if calls := unreliable.callCount(); calls != want {
+			t.Fatalf("adaptive=%v: expected the unreliable fetcher to be asked %d time(s), got %d", adaptive, want, calls)
+		}
+		if calls := reliable.callCount(); calls != 3 {
+			t.Fatalf("adaptive=%v: expected the reliable fetcher to be asked 3 times, got %d", adaptive, calls)
+		}
+	}
+}
+
+func TestMaxRequestsPerFetch(t *testing.T) {
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: syntheticKeys(5),
+	}
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db, fetcher)
+	s.MaxRequestsPerFetch = 4
+
+	requests := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
+	for req := range fetcher.keys {
+		requests[req] = gomatrixserverlib.AsTimestamp(time.Now())
+	}
+	res, err := s.FetchKeys(context.Background(), requests)
+	var tooMany *api.TooManyKeyRequestsError
+	if !errors.As(err, &tooMany) {
+		t.Fatalf("expected a TooManyKeyRequestsError, got %v", err)
+	}
+	if tooMany.Requested != 5 || tooMany.Limit != 4 {
+		t.Fatalf("unexpected error details: %+v", tooMany)
+	}
+	if len(res) != 0 {
+		t.Fatalf("expected no results, got %d", len(res))
+	}
+	if fetcher.callCount() != 0 || atomic.LoadInt32(&db.fetches) != 0 {
+		t.Fatalf("expected nothing to be looked up, got %d fetch(es) and %d database lookup(s)", fetcher.callCount(), db.fetches)
+	}
+
+	// Requests within the limit are fetched as normal.
+	for req := range requests {
+		delete(requests, req)
+		break
+	}
+	if _, err = s.FetchKeys(context.Background(), requests); err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if fetcher.callCount() != 1 {
+		t.Fatalf("expected the fetcher to be asked once, got %d", fetcher.callCount())
+	}
+}
+
+func TestFetchKeysTracesStages(t *testing.T) {
+	tracer := mocktracer.New()
+	previous := opentracing.GlobalTracer()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(previous)
+
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("remote-key", time.Hour),
+		},
+	}
+	s := newTestServerKeyAPI(newMockKeyDatabase(), fetcher)
+
+	root := tracer.StartSpan("root")
+	ctx := opentracing.ContextWithSpan(context.Background(), root)
+	local := gomatrixserverlib.PublicKeyLookupRequest{ServerName: testServerName, KeyID: testKeyID}
+	if _, err := s.FetchKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		local:         gomatrixserverlib.AsTimestamp(time.Now()),
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+	}); err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	root.Finish()
+
+	rootID := root.Context().(mocktracer.MockSpanContext).SpanID
+	spans := map[string]*mocktracer.MockSpan{}
+	for _, span := range tracer.FinishedSpans() {
+		spans[span.OperationName] = span
+	}
+	for _, want := range []struct {
+		name     string
+		requests int
+		hits     int
+	}{
+		{"handleLocalKeys", 2, 1},
+		{"handleDatabaseKeys", 1, 0},
+		{"handleFetcherKeys", 1, 1},
+	} {
+		span, ok := spans[want.name]
+		if !ok {
+			t.Fatalf("expected a %q span, got %v", want.name, tracer.FinishedSpans())
+		}
+		if span.ParentID != rootID {
+			t.Fatalf("expected the %q span to be a child of the caller's span", want.name)
+		}
+		if got := span.Tag("requests"); got != want.requests {
+			t.Fatalf("expected the %q span to have %d requests, got %v", want.name, want.requests, got)
+		}
+		if got := span.Tag("hits"); got != want.hits {
+			t.Fatalf("expected the %q span to have %d hits, got %v", want.name, want.hits, got)
+		}
+	}
+	if got := spans["handleFetcherKeys"].Tag("fetcher_name"); got != "fetcher" {
+		t.Fatalf("expected the fetcher span to be tagged with the fetcher name, got %v", got)
+	}
+}
+
+func TestFetchLoggingIsQuietByDefault(t *testing.T) {
+	hook := logrustest.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.InfoLevel)
+	defer logrus.SetLevel(level)
+
+	fetchLogs := func(verbose bool) int {
+		hook.Reset()
+		fetcher := &mockFetcher{
+			name: "fetcher",
+			keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+				remoteRequest: testKeyResult("remote-key", time.Hour),
+			},
+		}
+		s := newTestServerKeyAPI(newMockKeyDatabase(), fetcher)
+		s.VerboseFetchLogging = verbose
+		if _, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+		}); err != nil {
+			t.Fatalf("FetchKeys failed: %s", err)
+		}
+		count := 0
+		for _, entry := range hook.AllEntries() {
+			if entry.Data["fetcher_name"] == "fetcher" {
+				count++
+			}
+		}
+		return count
+	}
+
+	if count := fetchLogs(false); count != 0 {
+		t.Fatalf("expected no fetch logs at info level by default, got %d", count)
+	}
+	if count := fetchLogs(true); count == 0 {
+		t.Fatalf("expected fetch logs at info level with verbose fetch logging")
+	}
+}
+
+func TestReadReplica(t *testing.T) {
+	newRequest := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:new"}
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			newRequest: testKeyResult("new-key", time.Hour),
+		},
+	}
+	primary := newMockKeyDatabase()
+	replica := newMockKeyDatabase()
+	replica.keys[remoteRequest] = testKeyResult("remote-key", time.Hour)
+	s := newTestServerKeyAPI(primary, fetcher)
+	s.ReadReplica = replica
+
+	// Stored keys are read from the replica.
+	results, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if _, ok := results[remoteRequest]; !ok {
+		t.Fatalf("expected the key to be read from the replica")
+	}
+	if fetches := atomic.LoadInt32(&primary.fetches); fetches != 0 {
+		t.Fatalf("expected no reads from the primary, got %d", fetches)
+	}
+
+	// Fetched keys are written to the primary.
+	if _, err = s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		newRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+	}); err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if stores := atomic.LoadInt32(&primary.stores); stores != 1 {
+		t.Fatalf("expected one store to the primary, got %d", stores)
+	}
+	if _, ok := primary.keys[newRequest]; !ok {
+		t.Fatalf("expected the fetched key to be stored in the primary")
+	}
+	if stores := atomic.LoadInt32(&replica.stores); stores != 0 {
+		t.Fatalf("expected no stores to the replica, got %d", stores)
+	}
+}
+
+func TestWarmKeyCache(t *testing.T) {
+	hot := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "hot.com", KeyID: testKeyID}
+	warm := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "warm.com", KeyID: testKeyID}
+	cold := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "cold.com", KeyID: testKeyID}
+	expired := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "expired.com", KeyID: testKeyID}
+	now := time.Now()
+
+	db := newMockKeyDatabase()
+	db.keys[hot] = testKeyResult("hot-key", time.Hour)
+	db.fetched[hot] = gomatrixserverlib.AsTimestamp(now.Add(-time.Minute))
+	db.keys[warm] = testKeyResult("warm-key", time.Hour)
+	db.fetched[warm] = gomatrixserverlib.AsTimestamp(now.Add(-time.Hour))
+	db.keys[cold] = testKeyResult("cold-key", time.Hour)
+	db.fetched[cold] = gomatrixserverlib.AsTimestamp(now.Add(-time.Hour * 24))
+	db.keys[expired] = testKeyResult("expired-key", -time.Hour)
+	db.fetched[expired] = gomatrixserverlib.AsTimestamp(now)
+	s := newTestServerKeyAPI(db)
+	s.KeyCacheSize = 2
+
+	loaded, err := s.WarmKeyCache(context.Background())
+	if err != nil {
+		t.Fatalf("WarmKeyCache failed: %s", err)
+	}
+	if loaded != 2 {
+		t.Fatalf("expected 2 keys to be loaded, got %d", loaded)
+	}
+	if s.keyCache().Contains(cold) || s.keyCache().Contains(expired) {
+		t.Fatalf("expected only the most recently fetched valid keys to be loaded")
+	}
+
+	// The hot keys are now served without asking the database.
+	results, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		hot:  gomatrixserverlib.AsTimestamp(now),
+		warm: gomatrixserverlib.AsTimestamp(now),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(results))
+	}
+	if fetches := atomic.LoadInt32(&db.fetches); fetches != 0 {
+		t.Fatalf("expected no database reads after warming the cache, got %d", fetches)
+	}
+}
+
+func TestNextRefreshDue(t *testing.T) {
+	db := newMockKeyDatabase()
+	s := newTestServerKeyAPI(db)
+
+	// There's nothing to refresh without any keys.
+	due, err := s.NextRefreshDue(context.Background())
+	if err != nil {
+		t.Fatalf("NextRefreshDue failed: %s", err)
+	}
+	if !due.IsZero() {
+		t.Fatalf("expected no refresh to be due, got %s", due)
+	}
+
+	soonest := testKeyResult("soonest-key", time.Hour)
+	db.keys[gomatrixserverlib.PublicKeyLookupRequest{ServerName: "a.com", KeyID: testKeyID}] = testKeyResult("a-key", time.Hour*3)
+	db.keys[gomatrixserverlib.PublicKeyLookupRequest{ServerName: "b.com", KeyID: testKeyID}] = soonest
+	db.keys[gomatrixserverlib.PublicKeyLookupRequest{ServerName: "c.com", KeyID: testKeyID}] = testKeyResult("c-key", time.Hour*2)
+	// Keys that have already expired or been replaced aren't refreshed.
+	db.keys[gomatrixserverlib.PublicKeyLookupRequest{ServerName: "d.com", KeyID: testKeyID}] = testKeyResult("d-key", -time.Hour)
+	replaced := testKeyResult("e-key", time.Minute)
+	replaced.ExpiredTS = gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Hour))
+	db.keys[gomatrixserverlib.PublicKeyLookupRequest{ServerName: "e.com", KeyID: "ed25519:old"}] = replaced
+	// Nor are our own keys, however our server name is spelled.
+	db.keys[gomatrixserverlib.PublicKeyLookupRequest{ServerName: testServerName, KeyID: testKeyID}] = testKeyResult("local-key", time.Minute)
+	db.keys[gomatrixserverlib.PublicKeyLookupRequest{ServerName: "LOCAL.com.", KeyID: testKeyID}] = testKeyResult("local-key", time.Minute)
+
+	due, err = s.NextRefreshDue(context.Background())
+	if err != nil {
+		t.Fatalf("NextRefreshDue failed: %s", err)
+	}
+	if want := soonest.ValidUntilTS.Time(); !due.Equal(want) {
+		t.Fatalf("expected the next refresh to be due at %s, got %s", want, due)
+	}
+
+	// The refresh threshold brings the deadline forward.
+	s.RefreshThreshold = time.Minute * 10
+	due, err = s.NextRefreshDue(context.Background())
+	if err != nil {
+		t.Fatalf("NextRefreshDue failed: %s", err)
+	}
+	if want := soonest.ValidUntilTS.Time().Add(-time.Minute * 10); !due.Equal(want) {
+		t.Fatalf("expected the next refresh to be due at %s, got %s", want, due)
+	}
+}
+
+func TestKeyRefresherRefreshesExpiringKeys(t *testing.T) {
+	lasting := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "lasting.com", KeyID: testKeyID}
+	expiring := testKeyResult("remote-key", time.Minute)
+	refreshed := testKeyResult("remote-key", time.Hour)
+	fetcher := &mockFetcher{
+		name: "fetcher",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: refreshed,
+			lasting:       testKeyResult("new-lasting-key", time.Hour*24),
+		},
+	}
+	db := newMockKeyDatabase()
+	db.keys[remoteRequest] = expiring
+	db.keys[lasting] = testKeyResult("lasting-key", time.Hour)
+	s := newTestServerKeyAPI(db, fetcher)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Without a refresh threshold the refresher doesn't run at all.
+	s.StartKeyRefresher(ctx, time.Millisecond)
+	time.Sleep(time.Millisecond * 20)
+	if calls := atomic.LoadInt32(&fetcher.calls); calls != 0 {
+		t.Fatalf("expected no fetches without a refresh threshold, got %d", calls)
+	}
+
+	s.RefreshThreshold = time.Minute * 5
+	s.StartKeyRefresher(ctx, time.Millisecond*10)
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		db.Lock()
+		res := db.keys[remoteRequest]
+		db.Unlock()
+		if res.ValidUntilTS == refreshed.ValidUntilTS {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the expiring key to be refreshed before it expires")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// Keys that aren't about to expire are left alone.
+	db.Lock()
+	defer db.Unlock()
+	if string(db.keys[lasting].Key) != "lasting-key" {
+		t.Fatalf("expected the key that isn't about to expire not to be refreshed")
+	}
+}
+
+// rolloverFetcher returns all of a server's keys, like the direct key
+// fetcher, but only starts returning the new key once it has been asked
+// more than publishAfter times, as if it were published part way through
+// a key rollover.
+type rolloverFetcher struct {
+	oldKey, newKey gomatrixserverlib.PublicKeyLookupRequest
+	publishAfter   int32
+	calls          int32
+}
+
+func (f *rolloverFetcher) FetcherName() string {
+	return "rollover"
+}
+
+func (f *rolloverFetcher) FetchKeys(
+	_ context.Context,
+	_ map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		f.oldKey: testKeyResult("old-key", -time.Minute),
+	}
+	if atomic.AddInt32(&f.calls, 1) > f.publishAfter {
+		results[f.newKey] = testKeyResult("new-key", time.Hour)
+	}
+	return results, nil
+}
+
+func TestRolloverGapIsRetried(t *testing.T) {
+	fetcher := &rolloverFetcher{
+		oldKey:       gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:old"},
+		newKey:       gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:new"},
+		publishAfter: 1,
+	}
+	s := newTestServerKeyAPI(newMockKeyDatabase(), fetcher)
+	s.RolloverRetryDelay = time.Millisecond * 10
+	// The negative cache entry from the first attempt mustn't stop the
+	// retry from asking the fetcher again.
+	s.NegativeCacheTTL = time.Hour
+
+	res, provenance, err := s.FetchKeysWithProvenance(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		fetcher.newKey: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if got := string(res[fetcher.newKey].Key); got != "new-key" {
+		t.Fatalf("expected the new key after retrying, got %q", got)
+	}
+	if got := provenance[fetcher.newKey]; got != "rollover" {
+		t.Fatalf("expected the new key to come from the fetcher, got %q", got)
+	}
+	if calls := atomic.LoadInt32(&fetcher.calls); calls != 2 {
+		t.Fatalf("expected the fetcher to be asked twice, got %d", calls)
+	}
+}
+
+func TestRolloverGapIsNotRetriedByDefault(t *testing.T) {
+	fetcher := &rolloverFetcher{
+		oldKey:       gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:old"},
+		newKey:       gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:new"},
+		publishAfter: 1,
+	}
+	s := newTestServerKeyAPI(newMockKeyDatabase(), fetcher)
+
+	_, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		fetcher.newKey: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	var missing *api.MissingKeysError
+	if !errors.As(err, &missing) || len(missing.Missing) != 1 || missing.Missing[0] != fetcher.newKey {
+		t.Fatalf("expected the new key to be reported missing, got %v", err)
+	}
+	if calls := atomic.LoadInt32(&fetcher.calls); calls != 1 {
+		t.Fatalf("expected the fetcher to be asked once, got %d", calls)
+	}
+}
+
+func TestRolloverRetrySkipsUnansweredServers(t *testing.T) {
+	fetcher := &mockFetcher{name: "fetcher"}
+	s := newTestServerKeyAPI(newMockKeyDatabase(), fetcher)
+	s.RolloverRetryDelay = time.Millisecond * 10
+
+	// The server didn't give us any keys at all, so it isn't rotating
+	// keys and there's no point waiting to ask it again.
+	if _, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+	}); err == nil {
+		t.Fatalf("expected the key to be reported missing")
+	}
+	if calls := fetcher.callCount(); calls != 1 {
+		t.Fatalf("expected the fetcher to be asked once, got %d", calls)
+	}
+
+	// Nor is there if all we have is an expired key from the database,
+	// since that doesn't tell us that the server can be reached.
+	db := newMockKeyDatabase()
+	db.keys[remoteRequest] = testKeyResult("expired-key", -time.Hour)
+	fetcher = &mockFetcher{name: "fetcher"}
+	s = newTestServerKeyAPI(db, fetcher)
+	s.RolloverRetryDelay = time.Millisecond * 10
+	res, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if got := string(res[remoteRequest].Key); got != "expired-key" {
+		t.Fatalf("expected the expired key from the database, got %q", got)
+	}
+	if calls := fetcher.callCount(); calls != 1 {
+		t.Fatalf("expected the fetcher to be asked once, got %d", calls)
+	}
+}
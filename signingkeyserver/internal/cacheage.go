@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"context"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// keyFetchTimeLister is implemented by key databases that are able to
+// report when the keys that they hold were fetched, all at once, such as
+// the signing key server storage.
+type keyFetchTimeLister interface {
+	KeyFetchTimes(
+		ctx context.Context,
+		requests []gomatrixserverlib.PublicKeyLookupRequest,
+	) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, error)
+}
+
+// keyFetchTimes returns when each of the keys was last fetched according
+// to the key database, so that MaxCacheAge can be enforced. Keys stored
+// before fetch times were recorded are reported with a zero timestamp.
+// Returns false if the key database doesn't record fetch times.
+func (s *ServerKeyAPI) keyFetchTimes(
+	ctx context.Context,
+	keys map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, bool) {
+	db, ok := s.OurKeyRing.KeyDatabase.(keyFetchTimeLister)
+	if !ok {
+		return nil, false
+	}
+	requests := make([]gomatrixserverlib.PublicKeyLookupRequest, 0, len(keys))
+	for req := range keys {
+		requests = append(requests, req)
+	}
+	fetched, err := db.KeyFetchTimes(ctx, requests)
+	if err != nil {
+		// Without the fetch times we can't tell how old the keys are,
+		// so err on the side of fetching them again.
+		logrus.WithError(err).Warnf("Failed to look up when %d key(s) were fetched", len(requests))
+		return map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}, true
+	}
+	return fetched, true
+}
+
+// tooOldToUse returns true if MaxCacheAge is set and the key was fetched
+// longer ago than that, or we don't know when it was fetched, and so it
+// should be fetched again even if it is still valid.
+func (s *ServerKeyAPI) tooOldToUse(now, fetchedTS gomatrixserverlib.Timestamp) bool {
+	if s.MaxCacheAge <= 0 {
+		return false
+	}
+	if fetchedTS == 0 {
+		return true
+	}
+	return fetchedTS.Time().Add(s.MaxCacheAge).Before(now.Time())
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultCircuitBreakerWindow is used when no CircuitBreakerWindow
+	// has been configured on the ServerKeyAPI.
+	defaultCircuitBreakerWindow = time.Minute
+	// defaultCircuitBreakerCooldown is used when no CircuitBreakerCooldown
+	// has been configured on the ServerKeyAPI.
+	defaultCircuitBreakerCooldown = time.Minute * 5
+)
+
+// circuitBreaker tracks the recent fetch failures for a single server.
+type circuitBreaker struct {
+	failures     int       // consecutive failures since firstFailure
+	firstFailure time.Time // when the first of the failures happened
+	openUntil    time.Time // if set, don't fetch keys for the server until then
+}
+
+// breakerAllows returns true if the circuit breaker for the server is
+// closed, i.e. we are allowed to try fetching keys for it. A breaker that
+// has been open for the cool-down period is closed again.
+func (s *ServerKeyAPI) breakerAllows(serverName gomatrixserverlib.ServerName) bool {
+	if s.CircuitBreakerThreshold <= 0 {
+		return true
+	}
+	s.breakerMutex.Lock()
+	defer s.breakerMutex.Unlock()
+	breaker, ok := s.breakers[serverName]
+	if !ok || breaker.openUntil.IsZero() {
+		return true
+	}
+	if s.now().Before(breaker.openUntil) {
+		return false
+	}
+	delete(s.breakers, serverName)
+	circuitBreakersOpen.Dec()
+	logrus.WithField("server_name", serverName).Info("Closing key fetch circuit breaker after cool-down")
+	return true
+}
+
+// recordFetchFailure counts a failed fetch for the server, opening its
+// circuit breaker if there have been CircuitBreakerThreshold failures in
+// a row within CircuitBreakerWindow.
+func (s *ServerKeyAPI) recordFetchFailure(serverName gomatrixserverlib.ServerName) {
+	if s.CircuitBreakerThreshold <= 0 {
+		return
+	}
+	window := s.CircuitBreakerWindow
+	if window <= 0 {
+		window = defaultCircuitBreakerWindow
+	}
+	cooldown := s.CircuitBreakerCooldown
+	if cooldown <= 0 {
+		cooldown = defaultCircuitBreakerCooldown
+	}
+	now := s.now()
+
+	s.breakerMutex.Lock()
+	defer s.breakerMutex.Unlock()
+	if s.breakers == nil {
+		s.breakers = map[gomatrixserverlib.ServerName]*circuitBreaker{}
+	}
+	breaker, ok := s.breakers[serverName]
+	if !ok || now.Sub(breaker.firstFailure) > window {
+		breaker = &circuitBreaker{
+			firstFailure: now,
+		}
+		s.breakers[serverName] = breaker
+	}
+	if !breaker.openUntil.IsZero() {
+		// Already open, i.e. a fetch that started before it opened.
+		return
+	}
+	breaker.failures++
+	if breaker.failures < s.CircuitBreakerThreshold {
+		return
+	}
+	breaker.openUntil = now.Add(cooldown)
+	circuitBreakersOpen.Inc()
+	logrus.WithFields(logrus.Fields{
+		"server_name": serverName,
+		"failures":    breaker.failures,
+	}).Warnf("Opening key fetch circuit breaker for %s", cooldown)
+}
+
+// recordFetchSuccess resets the count of failed fetches for the server.
+func (s *ServerKeyAPI) recordFetchSuccess(serverName gomatrixserverlib.ServerName) {
+	if s.CircuitBreakerThreshold <= 0 {
+		return
+	}
+	s.breakerMutex.Lock()
+	defer s.breakerMutex.Unlock()
+	if breaker, ok := s.breakers[serverName]; ok && breaker.openUntil.IsZero() {
+		delete(s.breakers, serverName)
+	}
+}
+
+// circuitBreakRequests returns the subset of the requests for servers
+// whose circuit breakers are closed. Any keys that we already have for
+// the other servers will be used instead, even if they have expired.
+func (s *ServerKeyAPI) circuitBreakRequests(
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp {
+	if s.CircuitBreakerThreshold <= 0 {
+		return requests
+	}
+	allowed := map[gomatrixserverlib.ServerName]bool{}
+	results := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, len(requests))
+	for req, ts := range requests {
+		ok, checked := allowed[req.ServerName]
+		if !checked {
+			ok = s.breakerAllows(req.ServerName)
+			allowed[req.ServerName] = ok
+		}
+		if ok {
+			results[req] = ts
+		} else {
+			circuitBreakerShortCircuits.Inc()
+		}
+	}
+	return results
+}
@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"context"
+	"time"
+)
+
+// detachedContext carries the values of its parent context, such as
+// tracing spans, but is never cancelled and has no deadline.
+type detachedContext struct {
+	parent context.Context
+}
+
+// detachContext returns a context with the same values as ctx which
+// won't be cancelled when ctx is. This lets us finish work that we've
+// started, like storing keys, after the caller has given up waiting,
+// without losing the request-scoped tracing information.
+func detachContext(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
+
+func (c detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (c detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (c detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// DirectKeyFetcher is a gomatrixserverlib.DirectKeyFetcher that also
+// implements SignedKeyFetcher, so that the signed responses from the
+// servers can be verified again or captured for auditing.
+type DirectKeyFetcher struct {
+	*gomatrixserverlib.DirectKeyFetcher
+}
+
+// FetchKeys implements gomatrixserverlib.KeyFetcher. All of the keys that
+// are requested for a server are fetched in one round trip to its
+// /_matrix/key/v2/server endpoint, which returns all of its current keys.
+// Only the keys that weren't in that response, e.g. old keys, are then
+// asked for by key ID using its /_matrix/key/v2/query endpoint. If the
+// keys of some of the servers couldn't be fetched then a serverFetchErrors
+// is returned along with the keys of the others.
+func (d DirectKeyFetcher) FetchKeys(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	byServer := map[gomatrixserverlib.ServerName]map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
+	for req, ts := range requests {
+		if _, ok := byServer[req.ServerName]; !ok {
+			byServer[req.ServerName] = map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
+		}
+		byServer[req.ServerName][req] = ts
+	}
+
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	errs := serverFetchErrors{}
+	for serverName, serverRequests := range byServer {
+		found, err := d.fetchKeysForServer(ctx, serverName, serverRequests)
+		if err != nil {
+			errs[serverName] = err
+		}
+		for req, res := range found {
+			results[req] = res
+		}
+	}
+	return results, errs.err(len(results))
+}
+
+// fetchKeysForServer fetches the requested keys, which must all belong
+// to the given server.
+func (d DirectKeyFetcher) fetchKeysForServer(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	keys, err := d.Client.GetServerKeys(ctx, serverName)
+	if err != nil {
+		return nil, fmt.Errorf("d.Client.GetServerKeys: %w", err)
+	}
+	if err = verifySelfSigned(serverName, keys); err != nil {
+		return nil, err
+	}
+	results := responseKeys(keys)
+	missing := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
+	for req, ts := range requests {
+		if _, ok := results[req]; !ok {
+			missing[req] = ts
+		}
+	}
+	if len(missing) == 0 {
+		return results, nil
+	}
+	responses, err := d.Client.LookupServerKeys(ctx, serverName, missing)
+	if err != nil {
+		return results, fmt.Errorf("d.Client.LookupServerKeys: %w", err)
+	}
+	for _, keys := range responses {
+		if err = verifySelfSigned(serverName, keys); err != nil {
+			return results, err
+		}
+		for req, res := range responseKeys(keys) {
+			// Keep the keys that we already have from the first response.
+			if _, ok := results[req]; !ok {
+				results[req] = res
+			}
+		}
+	}
+	return results, nil
+}
+
+// FetchSignedKeys implements SignedKeyFetcher
+func (d DirectKeyFetcher) FetchSignedKeys(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) ([]gomatrixserverlib.ServerKeys, error) {
+	servers := map[gomatrixserverlib.ServerName]struct{}{}
+	for req := range requests {
+		servers[req.ServerName] = struct{}{}
+	}
+
+	var responses []gomatrixserverlib.ServerKeys
+	errs := serverFetchErrors{}
+	for serverName := range servers {
+		keys, err := d.Client.GetServerKeys(ctx, serverName)
+		if err != nil {
+			errs[serverName] = fmt.Errorf("d.Client.GetServerKeys: %w", err)
+			continue
+		}
+		responses = append(responses, keys)
+	}
+	return responses, errs.err(len(responses))
+}
+
+// serverFetchErrors is returned by a fetcher that asked several servers
+// for their keys when some of them failed, along with whatever the others
+// returned, so that the servers that failed can be told apart from those
+// that answered without the keys. It maps each server that failed to its
+// error.
+type serverFetchErrors map[gomatrixserverlib.ServerName]error
+
+func (e serverFetchErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for serverName, err := range e {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", serverName, err))
+	}
+	sort.Strings(msgs)
+	return "failed to fetch keys from " + strings.Join(msgs, "; ")
+}
+
+// err returns the error to return along with the given number of results:
+// nil if no servers failed, or the error from the only server that failed
+// if nothing was found, so that it can be retried or treated as definite
+// in the same way as the error from any other fetcher.
+func (e serverFetchErrors) err(found int) error {
+	if len(e) == 0 {
+		return nil
+	}
+	if len(e) == 1 && found == 0 {
+		for _, err := range e {
+			return err
+		}
+	}
+	return e
+}
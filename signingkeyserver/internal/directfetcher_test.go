@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// multiKeyServerKeys returns a key response for the server that advertises
+// all of the given keys as current keys, signed with each of them, and any
+// old keys.
+func multiKeyServerKeys(
+	t *testing.T, serverName gomatrixserverlib.ServerName,
+	keys map[gomatrixserverlib.KeyID]ed25519.PrivateKey,
+	oldKeys map[gomatrixserverlib.KeyID]ed25519.PublicKey,
+) gomatrixserverlib.ServerKeys {
+	var res gomatrixserverlib.ServerKeys
+	res.ServerName = serverName
+	res.ValidUntilTS = gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour))
+	res.VerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey{}
+	for keyID, key := range keys {
+		res.VerifyKeys[keyID] = gomatrixserverlib.VerifyKey{
+			Key: gomatrixserverlib.Base64Bytes(key.Public().(ed25519.PublicKey)),
+		}
+	}
+	res.OldVerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.OldVerifyKey{}
+	for keyID, key := range oldKeys {
+		res.OldVerifyKeys[keyID] = gomatrixserverlib.OldVerifyKey{
+			VerifyKey: gomatrixserverlib.VerifyKey{Key: gomatrixserverlib.Base64Bytes(key)},
+			ExpiredTS: gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Hour)),
+		}
+	}
+	var err error
+	if res.Raw, err = json.Marshal(res.ServerKeyFields); err != nil {
+		t.Fatalf("failed to marshal server keys: %s", err)
+	}
+	for keyID, key := range keys {
+		if res.Raw, err = gomatrixserverlib.SignJSON(string(serverName), keyID, key, res.Raw); err != nil {
+			t.Fatalf("failed to sign server keys: %s", err)
+		}
+	}
+	return res
+}
+
+func TestDirectKeyFetcherCoalescesKeyIDs(t *testing.T) {
+	_, firstKey, _ := ed25519.GenerateKey(nil)
+	_, secondKey, _ := ed25519.GenerateKey(nil)
+	first := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:first"}
+	second := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:second"}
+	client := &mockKeyClient{
+		keys: map[gomatrixserverlib.ServerName]gomatrixserverlib.ServerKeys{
+			"remote.com": multiKeyServerKeys(t, "remote.com", map[gomatrixserverlib.KeyID]ed25519.PrivateKey{
+				first.KeyID:  firstKey,
+				second.KeyID: secondKey,
+			}, nil),
+		},
+	}
+	fetcher := DirectKeyFetcher{&gomatrixserverlib.DirectKeyFetcher{Client: client}}
+
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+	res, err := fetcher.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		first:  now,
+		second: now,
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	for req, key := range map[gomatrixserverlib.PublicKeyLookupRequest]ed25519.PrivateKey{first: firstKey, second: secondKey} {
+		if got := res[req].Key; !reflect.DeepEqual([]byte(got), []byte(key.Public().(ed25519.PublicKey))) {
+			t.Fatalf("expected key %q to be found, got %v", req.KeyID, got)
+		}
+	}
+	if len(client.getRequests) != 1 {
+		t.Fatalf("expected a single request for both keys, got %d", len(client.getRequests))
+	}
+	if len(client.lookupRequests) != 0 {
+		t.Fatalf("expected no per-key queries, got %d", len(client.lookupRequests))
+	}
+}
+
+func TestDirectKeyFetcherQueriesMissingKeyIDs(t *testing.T) {
+	_, currentKey, _ := ed25519.GenerateKey(nil)
+	oldPublic, _, _ := ed25519.GenerateKey(nil)
+	current := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:current"}
+	old := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:old"}
+	currentKeys := map[gomatrixserverlib.KeyID]ed25519.PrivateKey{current.KeyID: currentKey}
+	client := &mockKeyClient{
+		keys: map[gomatrixserverlib.ServerName]gomatrixserverlib.ServerKeys{
+			"remote.com": multiKeyServerKeys(t, "remote.com", currentKeys, nil),
+		},
+		lookups: map[gomatrixserverlib.ServerName][]gomatrixserverlib.ServerKeys{
+			"remote.com": {
+				multiKeyServerKeys(t, "remote.com", currentKeys, map[gomatrixserverlib.KeyID]ed25519.PublicKey{
+					old.KeyID: oldPublic,
+				}),
+			},
+		},
+	}
+	fetcher := DirectKeyFetcher{&gomatrixserverlib.DirectKeyFetcher{Client: client}}
+
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+	res, err := fetcher.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		current: now,
+		old:     now,
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if got := res[old].Key; !reflect.DeepEqual([]byte(got), []byte(oldPublic)) {
+		t.Fatalf("expected the old key to be found, got %v", got)
+	}
+	if _, ok := res[current]; !ok {
+		t.Fatalf("expected the current key to be found")
+	}
+	if len(client.getRequests) != 1 {
+		t.Fatalf("expected a single request for the current keys, got %d", len(client.getRequests))
+	}
+	want := []map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{{old: now}}
+	if !reflect.DeepEqual(client.lookupRequests, want) {
+		t.Fatalf("expected only the old key to be queried, got %v", client.lookupRequests)
+	}
+}
+
+func TestDirectKeyFetcherReportsFailedServers(t *testing.T) {
+	_, remoteKey, _ := ed25519.GenerateKey(nil)
+	other := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "other.com", KeyID: testKeyID}
+	otherErr := errors.New("connection refused")
+	client := &mockKeyClient{
+		keys: map[gomatrixserverlib.ServerName]gomatrixserverlib.ServerKeys{
+			"remote.com": multiKeyServerKeys(t, "remote.com", map[gomatrixserverlib.KeyID]ed25519.PrivateKey{
+				testKeyID: remoteKey,
+			}, nil),
+		},
+		errs: map[gomatrixserverlib.ServerName]error{
+			"other.com": otherErr,
+		},
+	}
+	fetcher := DirectKeyFetcher{&gomatrixserverlib.DirectKeyFetcher{Client: client}}
+
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+	res, err := fetcher.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: now,
+		other:         now,
+	})
+	if _, ok := res[remoteRequest]; !ok {
+		t.Fatalf("expected the key from the server that answered")
+	}
+	var serverErrs serverFetchErrors
+	if !errors.As(err, &serverErrs) || len(serverErrs) != 1 || !errors.Is(serverErrs["other.com"], otherErr) {
+		t.Fatalf("expected the error from the other server, got %v", err)
+	}
+
+	// If the only server fails then its error is returned as it is.
+	_, err = fetcher.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		other: now,
+	})
+	if !errors.Is(err, otherErr) || errors.As(err, &serverErrs) {
+		t.Fatalf("expected the other server's error, got %v", err)
+	}
+}
+
+func TestDirectKeyFetcherKeepsUnrequestedKeys(t *testing.T) {
+	_, wantedKey, _ := ed25519.GenerateKey(nil)
+	_, bonusKey, _ := ed25519.GenerateKey(nil)
+	wanted := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:wanted"}
+	bonus := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:bonus"}
+	for _, verify := range []bool{false, true} {
+		client := &mockKeyClient{
+			keys: map[gomatrixserverlib.ServerName]gomatrixserverlib.ServerKeys{
+				"remote.com": multiKeyServerKeys(t, "remote.com", map[gomatrixserverlib.KeyID]ed25519.PrivateKey{
+					wanted.KeyID: wantedKey,
+					bonus.KeyID:  bonusKey,
+				}, nil),
+			},
+		}
+		db := newMockKeyDatabase()
+		s := newTestServerKeyAPI(db, DirectKeyFetcher{&gomatrixserverlib.DirectKeyFetcher{Client: client}})
+		s.VerifyFetchedKeys = verify
+
+		if _, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			wanted: gomatrixserverlib.AsTimestamp(time.Now()),
+		}); err != nil {
+			t.Fatalf("FetchKeys failed (verify: %v): %s", verify, err)
+		}
+		// The server told us about the other key in the same response,
+		// so it is stored without being asked for.
+		db.Lock()
+		got, stored := db.keys[bonus]
+		db.Unlock()
+		if !stored || !reflect.DeepEqual([]byte(got.Key), []byte(bonusKey.Public().(ed25519.PublicKey))) {
+			t.Fatalf("expected the unrequested key to be stored (verify: %v)", verify)
+		}
+	}
+}
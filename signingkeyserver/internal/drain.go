@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+)
+
+// beginStore notes that we are about to write to the key database, and
+// returns a function that must be called once the write has finished, so
+// that Drain can wait for it. Stores aren't cancelled along with the
+// request that caused them, so without this they could be cut off part
+// way through when the process shuts down.
+func (s *ServerKeyAPI) beginStore() func() {
+	s.storesMutex.Lock()
+	defer s.storesMutex.Unlock()
+	if s.draining > 0 {
+		// Adding to the wait group while it is being waited on isn't
+		// safe, so stores that start while we are draining go ahead
+		// without being waited for.
+		return func() {}
+	}
+	s.stores.Add(1)
+	return s.stores.Done
+}
+
+// Drain waits for any stores to the key database that are still in
+// progress to finish, i.e. during shutdown so that keys which have been
+// fetched aren't lost. Returns an error if ctx is done first. Stores that
+// start while Drain is waiting aren't held back, but aren't waited for
+// either.
+func (s *ServerKeyAPI) Drain(ctx context.Context) error {
+	s.storesMutex.Lock()
+	s.draining++
+	s.storesMutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.stores.Wait()
+		s.storesMutex.Lock()
+		s.draining--
+		s.storesMutex.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("gave up waiting for key stores to finish: %w", ctx.Err())
+	}
+}
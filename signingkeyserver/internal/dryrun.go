@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// DryRunFetcherResult describes what happened when a single key fetcher
+// was asked for keys during a dry run.
+type DryRunFetcherResult struct {
+	FetcherName string
+	Duration    time.Duration
+	KeysFound   int
+	Err         error
+}
+
+// DryRunResult is the outcome of FetchKeysDryRun.
+type DryRunResult struct {
+	Results  map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult
+	Fetchers []DryRunFetcherResult
+}
+
+// FetchKeysDryRun asks the same chain of key fetchers as FetchKeys would
+// for the requested keys, but without consulting or updating the key
+// database, so that operators can check whether a remote server's keys
+// can be fetched without affecting what we have cached. The responses are
+// checked and filtered in the same way as for FetchKeys, and only the keys
+// that the fetchers returned and that passed are included in the results.
+func (s *ServerKeyAPI) FetchKeysDryRun(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) *DryRunResult {
+	// Take a copy of the requests, as we'll remove them as we go.
+	remaining := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, len(requests))
+	for req, ts := range requests {
+		remaining[req] = ts
+	}
+	res := &DryRunResult{
+		Results: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{},
+	}
+
+	fetchers := make([]gomatrixserverlib.KeyFetcher, 0, len(s.OurKeyRing.KeyFetchers)+len(s.NotaryFetchers))
+	fetchers = append(fetchers, s.OurKeyRing.KeyFetchers...)
+	fetchers = append(fetchers, s.NotaryFetchers...)
+	for _, fetcher := range fetchers {
+		if len(remaining) == 0 {
+			break
+		}
+		fetcherCtx, fetcherCancel := context.WithTimeout(ctx, s.fetcherTimeout(fetcher))
+		start := time.Now()
+		fetcherResults, err := s.fetchWithRetry(fetcherCtx, s.checkingFetcher(fetcher, false), remaining)
+		fetcherCancel()
+		// The fetcher may have found some of the keys even if it failed
+		// for some of the servers.
+		fetcherResults = s.filterFetcherResults(fetcher.FetcherName(), remaining, fetcherResults)
+		res.Fetchers = append(res.Fetchers, DryRunFetcherResult{
+			FetcherName: fetcher.FetcherName(),
+			Duration:    time.Since(start),
+			KeysFound:   len(fetcherResults),
+			Err:         err,
+		})
+		for req, key := range fetcherResults {
+			res.Results[req] = key
+			delete(remaining, req)
+		}
+	}
+	return res
+}
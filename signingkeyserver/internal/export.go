@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// keyExporter is implemented by key databases that are able to list all
+// of the keys that they hold, such as the signing key server storage.
+type keyExporter interface {
+	AllKeys(ctx context.Context) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error)
+}
+
+// ExportKeys returns every key in the key database, i.e. so that they
+// can be backed up and later restored with ImportKeys.
+func (s *ServerKeyAPI) ExportKeys(
+	ctx context.Context,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	db, ok := s.OurKeyRing.KeyDatabase.(keyExporter)
+	if !ok {
+		return nil, fmt.Errorf("key database %q doesn't support exporting keys", s.OurKeyRing.KeyDatabase.FetcherName())
+	}
+	keys, err := db.AllKeys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("db.AllKeys: %w", err)
+	}
+	return keys, nil
+}
+
+// keyPager is implemented by key databases that are able to return their
+// keys a page at a time, in order of server name and key ID.
+type keyPager interface {
+	KeysAfter(
+		ctx context.Context,
+		after gomatrixserverlib.PublicKeyLookupRequest,
+		limit int,
+	) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error)
+}
+
+// defaultExportBatchSize is used when no ExportBatchSize has been
+// configured on the ServerKeyAPI.
+const defaultExportBatchSize = 100
+
+// ExportKeysStream calls fn with every key in the key database, in batches
+// of at most ExportBatchSize keys, so that very large key databases can be
+// backed up without holding all of the keys in memory at once. Exporting
+// stops at the first error returned from fn, which is returned.
+func (s *ServerKeyAPI) ExportKeysStream(
+	ctx context.Context,
+	fn func(batch map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult) error,
+) error {
+	batchSize := s.ExportBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultExportBatchSize
+	}
+
+	db, ok := s.OurKeyRing.KeyDatabase.(keyPager)
+	if !ok {
+		// Fall back to exporting everything at once and then splitting
+		// it up, which at least keeps the batches small for fn.
+		keys, err := s.ExportKeys(ctx)
+		if err != nil {
+			return err
+		}
+		batch := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, batchSize)
+		for req, res := range keys {
+			batch[req] = res
+			if len(batch) == batchSize {
+				if err = fn(batch); err != nil {
+					return err
+				}
+				batch = make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, batchSize)
+			}
+		}
+		if len(batch) > 0 {
+			return fn(batch)
+		}
+		return nil
+	}
+
+	var after gomatrixserverlib.PublicKeyLookupRequest
+	for {
+		batch, err := db.KeysAfter(ctx, after, batchSize)
+		if err != nil {
+			return fmt.Errorf("db.KeysAfter: %w", err)
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		for req := range batch {
+			if req.ServerName > after.ServerName || (req.ServerName == after.ServerName && req.KeyID > after.KeyID) {
+				after = req
+			}
+		}
+		if err = fn(batch); err != nil {
+			return err
+		}
+		if len(batch) < batchSize {
+			return nil
+		}
+	}
+}
+
+// ImportKeys stores keys that were previously exported with ExportKeys.
+// Keys that we already have with a later ValidUntilTS are left alone, so
+// that restoring an old backup doesn't roll back newer keys.
+func (s *ServerKeyAPI) ImportKeys(
+	ctx context.Context,
+	keys map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	requests := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, len(keys))
+	for req := range keys {
+		requests[req] = gomatrixserverlib.AsTimestamp(s.now())
+	}
+	existing, err := s.OurKeyRing.KeyDatabase.FetchKeys(ctx, requests)
+	if err != nil {
+		return fmt.Errorf("s.OurKeyRing.KeyDatabase.FetchKeys: %w", err)
+	}
+
+	toStore := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, len(keys))
+	for req, res := range keys {
+		if prev, ok := existing[req]; ok && prev.ValidUntilTS > res.ValidUntilTS {
+			continue
+		}
+		toStore[req] = res
+	}
+	if len(toStore) == 0 {
+		return nil
+	}
+	// We don't know when the imported keys were fetched, so keep whatever
+	// fetch times we already have for them.
+	return s.storeKeys(detachContext(ctx), toStore, 0)
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"sort"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fetcherStatsKey identifies the history of one fetcher for one server.
+type fetcherStatsKey struct {
+	serverName  gomatrixserverlib.ServerName
+	fetcherName string
+}
+
+// fetcherStats counts how often a fetcher has found keys for a server.
+type fetcherStats struct {
+	attempts  int
+	successes int
+}
+
+// successRate returns the proportion of attempts that found keys. It is
+// smoothed so that a fetcher with no history scores 0.5, in between one
+// that always succeeds and one that always fails.
+func (f *fetcherStats) successRate() float64 {
+	if f == nil {
+		return 0.5
+	}
+	return float64(f.successes+1) / float64(f.attempts+2)
+}
+
+// recordFetcherOutcome remembers, for each server that the fetcher was
+// asked about, whether it found any of that server's keys. It does
+// nothing unless AdaptiveFetcherOrder is set.
+func (s *ServerKeyAPI) recordFetcherOutcome(
+	fetcherName string,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) {
+	if !s.AdaptiveFetcherOrder {
+		return
+	}
+	found := map[gomatrixserverlib.ServerName]bool{}
+	for req := range requests {
+		if _, ok := found[req.ServerName]; !ok {
+			found[req.ServerName] = false
+		}
+		if _, ok := results[req]; ok {
+			found[req.ServerName] = true
+		}
+	}
+
+	s.fetcherStatsMutex.Lock()
+	defer s.fetcherStatsMutex.Unlock()
+	if s.fetcherStats == nil {
+		s.fetcherStats = make(map[fetcherStatsKey]*fetcherStats)
+	}
+	for serverName, ok := range found {
+		key := fetcherStatsKey{serverName, fetcherName}
+		stats := s.fetcherStats[key]
+		if stats == nil {
+			stats = &fetcherStats{}
+			s.fetcherStats[key] = stats
+		}
+		stats.attempts++
+		if ok {
+			stats.successes++
+		}
+	}
+}
+
+// orderFetchers returns the fetchers in the order that they should be
+// tried for the requests. If AdaptiveFetcherOrder is set then the ones
+// that have found keys most often for the servers in the requests come
+// first. Otherwise, or where fetchers are tied, the configured order is
+// kept.
+func (s *ServerKeyAPI) orderFetchers(
+	fetchers []gomatrixserverlib.KeyFetcher,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) []gomatrixserverlib.KeyFetcher {
+	if !s.AdaptiveFetcherOrder || len(fetchers) < 2 {
+		return fetchers
+	}
+	serverNames := map[gomatrixserverlib.ServerName]struct{}{}
+	for req := range requests {
+		serverNames[req.ServerName] = struct{}{}
+	}
+
+	s.fetcherStatsMutex.Lock()
+	scores := make(map[string]float64, len(fetchers))
+	for _, fetcher := range fetchers {
+		var score float64
+		for serverName := range serverNames {
+			score += s.fetcherStats[fetcherStatsKey{serverName, fetcher.FetcherName()}].successRate()
+		}
+		scores[fetcher.FetcherName()] = score
+	}
+	s.fetcherStatsMutex.Unlock()
+
+	ordered := make([]gomatrixserverlib.KeyFetcher, len(fetchers))
+	copy(ordered, fetchers)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return scores[ordered[i].FetcherName()] > scores[ordered[j].FetcherName()]
+	})
+	return ordered
+}
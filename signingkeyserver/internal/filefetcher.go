@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultFileKeyValidity is used when no KeyValidity has been configured
+// on the FileKeyFetcher.
+const defaultFileKeyValidity = time.Hour * 24
+
+// FileKeyFetcher is a key fetcher that returns keys that have been pinned
+// in a JSON file on disk, rather than fetching them over federation. The
+// file is a map of server names to key IDs to verify keys, i.e.
+//
+//	{"example.com": {"ed25519:auto": {"key": "<base64 public key>"}}}
+//
+// The file is checked for changes whenever keys are requested, and is
+// reloaded if it has been modified.
+type FileKeyFetcher struct {
+	path string
+
+	// KeyValidity is how long keys from the file are reported as being
+	// valid for. If zero, defaultFileKeyValidity is used.
+	KeyValidity time.Duration
+
+	mutex   sync.Mutex
+	modTime time.Time
+	keys    map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey
+}
+
+// NewFileKeyFetcher creates a FileKeyFetcher for the given path. Returns
+// an error if the file can't be read or isn't valid.
+func NewFileKeyFetcher(path string) (*FileKeyFetcher, error) {
+	f := &FileKeyFetcher{
+		path: path,
+	}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// FetcherName implements gomatrixserverlib.KeyFetcher
+func (f *FileKeyFetcher) FetcherName() string {
+	return "file:" + f.path
+}
+
+// FetchKeys implements gomatrixserverlib.KeyFetcher
+func (f *FileKeyFetcher) FetchKeys(
+	_ context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	if err := f.reload(); err != nil {
+		// Keep using the keys that we last loaded successfully.
+		logrus.WithError(err).WithField("path", f.path).Warn("Failed to reload pinned server keys")
+	}
+
+	validity := f.KeyValidity
+	if validity <= 0 {
+		validity = defaultFileKeyValidity
+	}
+	validUntil := gomatrixserverlib.AsTimestamp(time.Now().Add(validity))
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for req := range requests {
+		key, ok := f.keys[req.ServerName][req.KeyID]
+		if !ok {
+			continue
+		}
+		results[req] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey:    key,
+			ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+			ValidUntilTS: validUntil,
+		}
+	}
+	return results, nil
+}
+
+// reload reads the file again if it has changed since we last read it.
+func (f *FileKeyFetcher) reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("os.Stat: %w", err)
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.keys != nil && info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("ioutil.ReadFile: %w", err)
+	}
+	var keys map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey
+	if err = json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	if keys == nil {
+		return fmt.Errorf("%q doesn't contain any server keys", f.path)
+	}
+	f.keys = keys
+	f.modTime = info.ModTime()
+	return nil
+}
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func writeKeyFile(t *testing.T, dir, contents string) string {
+	path := filepath.Join(dir, "keys.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("failed to write key file: %s", err)
+	}
+	return path
+}
+
+func TestFileKeyFetcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filekeyfetcher")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	// "cmVtb3RlLWtleQ" is "remote-key" in unpadded base64.
+	path := writeKeyFile(t, dir, `{"remote.com": {"ed25519:auto": {"key": "cmVtb3RlLWtleQ"}}}`)
+	f, err := NewFileKeyFetcher(path)
+	if err != nil {
+		t.Fatalf("NewFileKeyFetcher failed: %s", err)
+	}
+	if name := f.FetcherName(); name != "file:"+path {
+		t.Fatalf("unexpected fetcher name %q", name)
+	}
+
+	other := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "other.com", KeyID: testKeyID}
+	results, err := f.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+		other:         gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("expected one result, got %d", len(results))
+	}
+	if got := string(results[remoteRequest].Key); got != "remote-key" {
+		t.Fatalf("expected the pinned key, got %q", got)
+	}
+	if !results[remoteRequest].WasValidAt(gomatrixserverlib.AsTimestamp(time.Now()), true) {
+		t.Fatalf("expected the pinned key to be valid")
+	}
+}
+
+func TestFileKeyFetcherMissingFile(t *testing.T) {
+	if _, err := NewFileKeyFetcher(filepath.Join(os.TempDir(), "does-not-exist", "keys.json")); err == nil {
+		t.Fatalf("expected an error for a missing file")
+	}
+}
+
+func TestFileKeyFetcherMalformedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filekeyfetcher")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	for _, contents := range []string{`{"remote.com": `, `null`, `["remote.com"]`} {
+		path := writeKeyFile(t, dir, contents)
+		if _, err := NewFileKeyFetcher(path); err == nil {
+			t.Errorf("expected an error for malformed file %q", contents)
+		}
+	}
+}
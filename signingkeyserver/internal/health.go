@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// HealthCheck returns an error if the server key API isn't able to do
+// its job, i.e. because our own signing key is missing or has expired,
+// or because the key database can't be reached.
+func (s *ServerKeyAPI) HealthCheck(ctx context.Context) error {
+	keyID, publicKey := s.primaryKey()
+	if keyID == "" {
+		return fmt.Errorf("no server signing key ID is configured")
+	}
+	if len(publicKey) == 0 {
+		return fmt.Errorf("server signing key %q has no public key", keyID)
+	}
+	if issuedAt := s.keyIssuedAt(); !issuedAt.IsZero() {
+		if expiresAt := issuedAt.Add(s.keyValidity()); !s.now().Before(expiresAt) {
+			return fmt.Errorf("server signing key %q expired at %s", keyID, expiresAt)
+		}
+	}
+
+	// Make a cheap lookup against the database to check that it's there.
+	// We don't care whether the key is found or not.
+	if _, err := s.OurKeyRing.KeyDatabase.FetchKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		{ServerName: s.ServerName, KeyID: keyID}: gomatrixserverlib.AsTimestamp(s.now()),
+	}); err != nil {
+		return fmt.Errorf("key database %q is unavailable: %w", s.OurKeyRing.KeyDatabase.FetcherName(), err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// inflightFetch tracks a fetcher lookup for a single key that is in
+// progress, so that concurrent FetchKeys calls can wait for it to
+// finish rather than asking the fetchers for the same key again.
+type inflightFetch struct {
+	done   chan struct{}
+	result gomatrixserverlib.PublicKeyLookupResult
+	source string
+	found  bool
+}
+
+// inflightWait is a lookup that another caller is performing which we
+// are waiting for, along with the timestamp that we need the key for.
+type inflightWait struct {
+	fetch *inflightFetch
+	ts    gomatrixserverlib.Timestamp
+}
+
+// claimInflight takes ownership of any requests that aren't already
+// being fetched by someone else. Requests that are already in flight
+// are removed from the requests map and returned so that the caller can
+// wait for them instead. The caller must call releaseInflight with the
+// owned requests once it has finished fetching them.
+func (s *ServerKeyAPI) claimInflight(
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (
+	owned []gomatrixserverlib.PublicKeyLookupRequest,
+	waiting map[gomatrixserverlib.PublicKeyLookupRequest]inflightWait,
+) {
+	s.inflightMutex.Lock()
+	defer s.inflightMutex.Unlock()
+	if s.inflight == nil {
+		s.inflight = map[gomatrixserverlib.PublicKeyLookupRequest]*inflightFetch{}
+	}
+	waiting = map[gomatrixserverlib.PublicKeyLookupRequest]inflightWait{}
+	for req, ts := range requests {
+		if f, ok := s.inflight[req]; ok {
+			waiting[req] = inflightWait{f, ts}
+			delete(requests, req)
+			continue
+		}
+		s.inflight[req] = &inflightFetch{
+			done: make(chan struct{}),
+		}
+		owned = append(owned, req)
+	}
+	return owned, waiting
+}
+
+// releaseInflight publishes the results for the owned requests to any
+// waiters and marks them as no longer being in flight.
+func (s *ServerKeyAPI) releaseInflight(
+	owned []gomatrixserverlib.PublicKeyLookupRequest,
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	provenance map[gomatrixserverlib.PublicKeyLookupRequest]string,
+) {
+	s.inflightMutex.Lock()
+	defer s.inflightMutex.Unlock()
+	for _, req := range owned {
+		f, ok := s.inflight[req]
+		if !ok {
+			continue
+		}
+		f.result, f.found = results[req]
+		f.source = provenance[req]
+		delete(s.inflight, req)
+		close(f.done)
+	}
+}
+
+// waitInflight waits for the lookups that other callers were already
+// performing and adds anything they found into the results, along with
+// where they found it. Lookups that our own fetchers already answered,
+// i.e. because a fetcher returned more keys than we asked it for, aren't
+// waited for, and nor are those whose result is already valid at the
+// requested time. Expired keys from the cache or the database are still
+// waited for, since the other caller is fetching a fresh one. If
+// provenance is nil then the results must only hold fetcher results.
+func (s *ServerKeyAPI) waitInflight(
+	waiting map[gomatrixserverlib.PublicKeyLookupRequest]inflightWait,
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	provenance map[gomatrixserverlib.PublicKeyLookupRequest]string,
+) {
+	for req, w := range waiting {
+		if res, ok := results[req]; ok {
+			if provenance == nil || isFetcherSource(provenance[req]) || s.wasValidAt(res, w.ts) {
+				continue
+			}
+		}
+		<-w.fetch.done
+		if w.fetch.found {
+			results[req] = w.fetch.result
+			if provenance != nil {
+				provenance[req] = w.fetch.source
+			}
+		}
+	}
+}
+
+// isFetcherSource returns true if the provenance of a result is one of the
+// key fetchers rather than our own keys, the cache or the database.
+func isFetcherSource(source string) bool {
+	switch source {
+	case "", keySourceLocal, keySourceCache, keySourceDatabase:
+		return false
+	}
+	return true
+}
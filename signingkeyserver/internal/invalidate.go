@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// keyDeleter is implemented by key databases that are able to remove
+// keys, such as the signing key server storage.
+type keyDeleter interface {
+	DeleteKeys(ctx context.Context, requests []gomatrixserverlib.PublicKeyLookupRequest) error
+}
+
+// InvalidateKeys removes the given keys from the key database and from
+// any of our in-memory state, so that the next time they are requested
+// they will be fetched again. This is useful if a remote server's key is
+// known to have been compromised.
+func (s *ServerKeyAPI) InvalidateKeys(
+	ctx context.Context,
+	requests []gomatrixserverlib.PublicKeyLookupRequest,
+) error {
+	db, ok := s.OurKeyRing.KeyDatabase.(keyDeleter)
+	if !ok {
+		return fmt.Errorf("key database %q doesn't support invalidating keys", s.OurKeyRing.KeyDatabase.FetcherName())
+	}
+	if err := db.DeleteKeys(ctx, requests); err != nil {
+		return fmt.Errorf("db.DeleteKeys: %w", err)
+	}
+
+	s.evictCachedKeys(requests)
+
+	// Forget that we failed to find any of these keys too, otherwise
+	// we wouldn't try to fetch them again until the negative cache
+	// entries expire.
+	s.negativeCacheMutex.Lock()
+	for _, req := range requests {
+		delete(s.negativeCache, req)
+	}
+	s.negativeCacheMutex.Unlock()
+
+	for _, req := range requests {
+		logrus.WithFields(logrus.Fields{
+			"server_name": req.ServerName,
+			"key_id":      req.KeyID,
+		}).Info("Invalidated server key")
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// cachedKey is a key held in the in-memory cache.
+type cachedKey struct {
+	gomatrixserverlib.PublicKeyLookupResult
+	// FetchedTS is when the key was fetched, or 0 if we don't know.
+	FetchedTS gomatrixserverlib.Timestamp
+	// CachedTS is when the key was added to the cache.
+	CachedTS gomatrixserverlib.Timestamp
+}
+
+// age returns when the key was fetched or, if we don't know, when it was
+// added to the cache, for enforcing MaxCacheAge.
+func (k cachedKey) age() gomatrixserverlib.Timestamp {
+	if k.FetchedTS == 0 {
+		return k.CachedTS
+	}
+	return k.FetchedTS
+}
+
+// keyCache returns the in-memory LRU cache of keys, creating it if
+// needed. Returns nil if KeyCacheSize is not set.
+func (s *ServerKeyAPI) keyCache() *lru.Cache {
+	if s.KeyCacheSize <= 0 {
+		return nil
+	}
+	s.keyCacheOnce.Do(func() {
+		// lru.New only fails if the size isn't positive, which we've
+		// already checked for above.
+		s.keyCacheLRU, _ = lru.New(s.KeyCacheSize)
+	})
+	return s.keyCacheLRU
+}
+
+// handleCachedKeys satisfies key requests from the in-memory cache. Keys
+// that are still valid are removed from the requests. If
+// StaleWhileRevalidate is set then keys that have expired are returned
+// anyway, but are refreshed from the fetchers in the background, as are
+// keys that are due to expire within RefreshThreshold. Otherwise expired
+// keys are left for the database and the fetchers. Keys that are older
+// than MaxCacheAge, or that were added to the cache longer ago than that if
+// we don't know when they were fetched, are left for the database and the
+// fetchers.
+func (s *ServerKeyAPI) handleCachedKeys(
+	now gomatrixserverlib.Timestamp,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) {
+	cache := s.keyCache()
+	if cache == nil {
+		return
+	}
+	stale := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
+	for req, ts := range requests {
+		val, ok := cache.Get(req)
+		if !ok {
+			continue
+		}
+		cached := val.(cachedKey)
+		if s.tooOldToUse(now, cached.age()) {
+			continue
+		}
+		res := cached.PublicKeyLookupResult
+		expired := !s.wasValidAt(res, now)
+		if expired && !s.StaleWhileRevalidate {
+			continue
+		}
+		results[req] = res
+		delete(requests, req)
+		keyLookups.WithLabelValues(keySourceCache, "").Inc()
+		if expired || s.expiresSoon(now, res) {
+			stale[req] = ts
+		}
+	}
+	if len(stale) > 0 {
+		s.queueRevalidation(stale)
+	}
+}
+
+// cacheKeys adds keys that we have just stored to the in-memory cache, if
+// there is one, along with when they were fetched if we know.
+func (s *ServerKeyAPI) cacheKeys(
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	fetchedTS gomatrixserverlib.Timestamp,
+) {
+	cache := s.keyCache()
+	if cache == nil {
+		return
+	}
+	now := gomatrixserverlib.AsTimestamp(s.now())
+	for req, res := range results {
+		cache.Add(req, cachedKey{res, fetchedTS, now})
+	}
+}
+
+// cacheDatabaseKeys adds keys from the key database to the in-memory cache,
+// if there is one, along with when they were fetched if we know.
+func (s *ServerKeyAPI) cacheDatabaseKeys(
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	fetched map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) {
+	cache := s.keyCache()
+	if cache == nil {
+		return
+	}
+	now := gomatrixserverlib.AsTimestamp(s.now())
+	for req, res := range results {
+		cache.Add(req, cachedKey{res, fetched[req], now})
+	}
+}
+
+// evictCachedKeys removes the keys from the in-memory cache, if there
+// is one.
+func (s *ServerKeyAPI) evictCachedKeys(requests []gomatrixserverlib.PublicKeyLookupRequest) {
+	cache := s.keyCache()
+	if cache == nil {
+		return
+	}
+	for _, req := range requests {
+		cache.Remove(req)
+	}
+}
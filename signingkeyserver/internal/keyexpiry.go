@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// StartKeyExpiryMonitor starts a goroutine that checks, every interval
+// until the context is done, whether our own signing key is within
+// KeyExpiryWarning of the end of its validity period.
+func (s *ServerKeyAPI) StartKeyExpiryMonitor(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.checkKeyExpiry()
+			}
+		}
+	}()
+}
+
+// keyIssuedAt returns when our primary signing key was issued, if known.
+func (s *ServerKeyAPI) keyIssuedAt() time.Time {
+	s.keyExpiryMutex.Lock()
+	defer s.keyExpiryMutex.Unlock()
+	return s.ServerKeyIssuedAt
+}
+
+// checkKeyExpiry logs a warning and increments the key expiry metric if
+// our signing key has just come within KeyExpiryWarning of the end of
+// its validity period. We only warn once each time the threshold is
+// crossed. Returns true if a warning was emitted.
+func (s *ServerKeyAPI) checkKeyExpiry() bool {
+	if s.KeyExpiryWarning <= 0 {
+		return false
+	}
+	now := s.now()
+
+	s.keyExpiryMutex.Lock()
+	defer s.keyExpiryMutex.Unlock()
+
+	issuedAt := s.ServerKeyIssuedAt
+	if issuedAt.IsZero() {
+		if s.keyFirstSeenAt.IsZero() {
+			s.keyFirstSeenAt = now
+		}
+		issuedAt = s.keyFirstSeenAt
+	}
+	expiresAt := issuedAt.Add(s.keyValidity())
+	if now.Before(expiresAt.Add(-s.KeyExpiryWarning)) {
+		// We're not close to the end of the validity period, so reset
+		// the warning so that it'll fire again next time we are.
+		s.keyExpiryWarned = false
+		return false
+	}
+	if s.keyExpiryWarned {
+		return false
+	}
+	s.keyExpiryWarned = true
+	keyExpiryWarnings.Inc()
+	keyID, _ := s.primaryKey()
+	logrus.WithFields(logrus.Fields{
+		"key_id":     keyID,
+		"expires_at": expiresAt,
+	}).Warn("Our server signing key is about to reach the end of its validity period and should be rotated")
+	return true
+}
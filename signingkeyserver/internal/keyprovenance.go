@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/signingkeyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// keyProvenanceStore is implemented by key databases that are able to
+// record which key fetcher each key was last stored from, such as the
+// signing key server storage.
+type keyProvenanceStore interface {
+	StoreKeyProvenance(
+		ctx context.Context,
+		requests []gomatrixserverlib.PublicKeyLookupRequest,
+		fetcherName string,
+		fetchedTS gomatrixserverlib.Timestamp,
+	) error
+	KeyProvenance(
+		ctx context.Context,
+		request gomatrixserverlib.PublicKeyLookupRequest,
+	) (*api.KeyProvenance, error)
+}
+
+// recordKeyProvenance notes in the key database, if it supports it, that
+// the keys were just stored from the named fetcher.
+func (s *ServerKeyAPI) recordKeyProvenance(
+	ctx context.Context,
+	fetcherName string,
+	stored map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) {
+	db, ok := s.OurKeyRing.KeyDatabase.(keyProvenanceStore)
+	if !ok || len(stored) == 0 {
+		return
+	}
+	defer s.beginStore()()
+	requests := make([]gomatrixserverlib.PublicKeyLookupRequest, 0, len(stored))
+	for req := range stored {
+		requests = append(requests, req)
+	}
+	// The keys themselves have been stored, so failing to record where
+	// they came from only makes debugging harder. Just log it.
+	if err := db.StoreKeyProvenance(ctx, requests, fetcherName, gomatrixserverlib.AsTimestamp(s.now())); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"fetcher_name": fetcherName,
+		}).Warnf("Failed to record where %d key(s) were fetched from", len(requests))
+	}
+}
+
+// KeyProvenance returns which key fetcher the given key was last stored
+// from and when, i.e. to help work out why a particular key, which might
+// have expired, is being served. Returns nil if the key wasn't stored
+// from a fetcher, or was stored before this was recorded.
+func (s *ServerKeyAPI) KeyProvenance(
+	ctx context.Context,
+	request gomatrixserverlib.PublicKeyLookupRequest,
+) (*api.KeyProvenance, error) {
+	db, ok := s.OurKeyRing.KeyDatabase.(keyProvenanceStore)
+	if !ok {
+		return nil, fmt.Errorf("key database %q doesn't support key provenance", s.OurKeyRing.KeyDatabase.FetcherName())
+	}
+	if serverName, ok := normaliseServerName(request.ServerName); ok {
+		request.ServerName = serverName
+	}
+	provenance, err := db.KeyProvenance(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("db.KeyProvenance: %w", err)
+	}
+	return provenance, nil
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(
+		keyLookups, keyExpiryWarnings, keyFetchDuration,
+		circuitBreakersOpen, circuitBreakerShortCircuits, staleKeyServes,
+		keyFetcherPingDuration,
+	)
+}
+
+// Sources that a key request can be satisfied from, used as the
+// "source" label on keyLookups.
+const (
+	keySourceLocal    = "local"
+	keySourceCache    = "cache"
+	keySourceDatabase = "database"
+	keySourceFetcher  = "fetcher"
+	keySourceMissing  = "missing"
+)
+
+var keyLookups = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "signingkeyserver",
+		Name:      "key_lookups_total",
+		Help:      "Number of key requests, by the source that satisfied them or \"missing\" if nothing did",
+	},
+	[]string{"source", "fetcher_name"},
+)
+
+var keyExpiryWarnings = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "signingkeyserver",
+		Name:      "key_expiry_warnings_total",
+		Help:      "Number of times that our own signing key has come close to the end of its validity period",
+	},
+)
+
+// Outcomes of a call to a key fetcher, used as the "outcome" label on
+// keyFetchDuration.
+const (
+	fetchOutcomeSuccess = "success"
+	fetchOutcomeFailure = "failure"
+)
+
+var keyFetchDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "signingkeyserver",
+		Name:      "key_fetch_duration_seconds",
+		Help:      "How long calls to the key fetchers take, by fetcher and whether they succeeded",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	},
+	[]string{"fetcher_name", "outcome"},
+)
+
+var keyFetcherPingDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "signingkeyserver",
+		Name:      "key_fetcher_ping_duration_seconds",
+		Help:      "How long the key fetchers took to respond to PingFetchers, by fetcher and whether they succeeded",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	},
+	[]string{"fetcher_name", "outcome"},
+)
+
+var circuitBreakersOpen = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "signingkeyserver",
+		Name:      "circuit_breakers_open",
+		Help:      "Number of servers that we have stopped fetching keys for because of repeated failures",
+	},
+)
+
+var circuitBreakerShortCircuits = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "signingkeyserver",
+		Name:      "circuit_breaker_short_circuits_total",
+		Help:      "Number of key requests that weren't passed to the fetchers because the server's circuit breaker was open",
+	},
+)
+
+var staleKeyServes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "signingkeyserver",
+		Name:      "stale_key_serves_total",
+		Help:      "Number of keys returned from the cache or the database that were no longer valid, by server name",
+	},
+	[]string{"server_name"},
+)
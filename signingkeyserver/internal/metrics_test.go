@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fetchDurationCounts returns how many observations keyFetchDuration has
+// made, keyed on fetcher name and outcome.
+func fetchDurationCounts(t *testing.T) map[[2]string]uint64 {
+	return histogramCounts(t, keyFetchDuration)
+}
+
+// histogramCounts returns how many observations a histogram labelled by
+// fetcher name and outcome has made, keyed on those labels.
+func histogramCounts(t *testing.T, histogram *prometheus.HistogramVec) map[[2]string]uint64 {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(histogram)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %s", err)
+	}
+	counts := map[[2]string]uint64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			var labels [2]string
+			for _, label := range metric.GetLabel() {
+				switch label.GetName() {
+				case "fetcher_name":
+					labels[0] = label.GetValue()
+				case "outcome":
+					labels[1] = label.GetValue()
+				}
+			}
+			counts[labels] = metric.GetHistogram().GetSampleCount()
+		}
+	}
+	return counts
+}
+
+func TestKeyFetchDurationObservedPerFetcher(t *testing.T) {
+	failing := &mockFetcher{
+		name: "metrics-failing",
+		err:  errors.New("connection refused"),
+	}
+	working := &mockFetcher{
+		name: "metrics-working",
+		keys: map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			remoteRequest: testKeyResult("remote-key", time.Hour),
+		},
+	}
+	s := newTestServerKeyAPI(newMockKeyDatabase(), failing, working)
+
+	before := fetchDurationCounts(t)
+	if _, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		remoteRequest: gomatrixserverlib.AsTimestamp(time.Now()),
+	}); err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	after := fetchDurationCounts(t)
+
+	for labels, want := range map[[2]string]uint64{
+		{"metrics-failing", fetchOutcomeFailure}: 1,
+		{"metrics-failing", fetchOutcomeSuccess}: 0,
+		{"metrics-working", fetchOutcomeSuccess}: 1,
+		{"metrics-working", fetchOutcomeFailure}: 0,
+	} {
+		if got := after[labels] - before[labels]; got != want {
+			t.Errorf("expected %d observation(s) for %v, got %d", want, labels, got)
+		}
+	}
+}
+
+func TestStaleKeyServesCounted(t *testing.T) {
+	stale := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "stale.com", KeyID: testKeyID}
+	fresh := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "fresh.com", KeyID: testKeyID}
+	db := newMockKeyDatabase()
+	db.keys[stale] = testKeyResult("stale-key", -time.Hour)
+	db.keys[fresh] = testKeyResult("fresh-key", time.Hour)
+	s := newTestServerKeyAPI(db)
+	s.KeyCacheSize = 10
+
+	staleBefore := testutil.ToFloat64(staleKeyServes.WithLabelValues("stale.com"))
+	freshBefore := testutil.ToFloat64(staleKeyServes.WithLabelValues("fresh.com"))
+
+	// The first lookup is served from the database and the second from the
+	// cache. The expired key is returned both times as it's all we have.
+	for i := 0; i < 2; i++ {
+		results, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			stale: gomatrixserverlib.AsTimestamp(time.Now()),
+			fresh: gomatrixserverlib.AsTimestamp(time.Now()),
+		})
+		if err != nil {
+			t.Fatalf("FetchKeys failed: %s", err)
+		}
+		if got := string(results[stale].Key); got != "stale-key" {
+			t.Fatalf("expected the expired key to be returned, got %q", got)
+		}
+	}
+
+	if got := testutil.ToFloat64(staleKeyServes.WithLabelValues("stale.com")) - staleBefore; got != 2 {
+		t.Errorf("expected 2 stale serves for the expired key, got %v", got)
+	}
+	if got := testutil.ToFloat64(staleKeyServes.WithLabelValues("fresh.com")) - freshBefore; got != 0 {
+		t.Errorf("expected no stale serves for the valid key, got %v", got)
+	}
+}
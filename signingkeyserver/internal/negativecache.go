@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// negativeCacheStore is implemented by key databases that are able to
+// persist negative cache entries, so that they survive a restart.
+type negativeCacheStore interface {
+	StoreNegativeCacheEntries(
+		ctx context.Context,
+		entries map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+	) error
+	NegativeCacheEntries(
+		ctx context.Context,
+		now gomatrixserverlib.Timestamp,
+	) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, error)
+	DeleteExpiredNegativeCacheEntries(
+		ctx context.Context,
+		before gomatrixserverlib.Timestamp,
+	) error
+}
+
+// negativeCacheStore returns the key database if negative cache entries
+// should be persisted to it, or nil otherwise.
+func (s *ServerKeyAPI) negativeCacheStore() negativeCacheStore {
+	if !s.PersistNegativeCache || s.NegativeCacheTTL <= 0 {
+		return nil
+	}
+	db, _ := s.OurKeyRing.KeyDatabase.(negativeCacheStore)
+	return db
+}
+
+// skipNegativelyCached removes any requests from the requests map that
+// we recently failed to fetch and that we have no other result for, so
+// that we don't try the fetchers for them again until the negative
+// cache entry expires.
+func (s *ServerKeyAPI) skipNegativelyCached(
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) {
+	if s.NegativeCacheTTL <= 0 {
+		return
+	}
+	now := s.now()
+	s.negativeCacheMutex.Lock()
+	defer s.negativeCacheMutex.Unlock()
+	for req := range requests {
+		expires, ok := s.negativeCache[req]
+		if !ok {
+			continue
+		}
+		if now.After(expires) {
+			delete(s.negativeCache, req)
+			continue
+		}
+		if _, ok := results[req]; !ok {
+			delete(requests, req)
+		}
+	}
+}
+
+// cacheNegativeResults records any of the requests that a fetcher told us
+// it didn't have and that no other fetcher found, so that we don't try to
+// fetch them again for a while. The requests should only be those that a
+// fetcher actually answered, so that keys we didn't get to ask for, i.e.
+// because of rate limiting, aren't mistaken for missing keys. If
+// PersistNegativeCache is set then they are also written to the key
+// database.
+func (s *ServerKeyAPI) cacheNegativeResults(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) {
+	if s.NegativeCacheTTL <= 0 {
+		return
+	}
+	now := s.now()
+	expires := now.Add(s.NegativeCacheTTL)
+	s.negativeCacheMutex.Lock()
+	if s.negativeCache == nil {
+		s.negativeCache = map[gomatrixserverlib.PublicKeyLookupRequest]time.Time{}
+	}
+	s.sweepNegativeCache(now)
+	failed := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
+	for req := range requests {
+		if _, ok := results[req]; !ok {
+			s.negativeCache[req] = expires
+			failed[req] = gomatrixserverlib.AsTimestamp(expires)
+		}
+	}
+	s.negativeCacheMutex.Unlock()
+
+	if db := s.negativeCacheStore(); db != nil && len(failed) > 0 {
+		defer s.beginStore()()
+		// Failing to persist the entries only means that we might try
+		// these keys again sooner after a restart, so just log it.
+		if err := db.StoreNegativeCacheEntries(detachContext(ctx), failed); err != nil {
+			logrus.WithError(err).Warn("Failed to persist negative key cache entries")
+		}
+	}
+}
+
+// sweepNegativeCache removes expired entries from the in-memory negative
+// cache, so that entries for keys that are never asked for again don't
+// pile up. Sweeping means looking at every entry, so it is done at most
+// once every NegativeCacheTTL, which means that no entry outlives its
+// expiry by more than that. The negative cache mutex must be held.
+func (s *ServerKeyAPI) sweepNegativeCache(now time.Time) {
+	if now.Before(s.negativeCacheSweptAt.Add(s.NegativeCacheTTL)) {
+		return
+	}
+	s.negativeCacheSweptAt = now
+	for req, expires := range s.negativeCache {
+		if now.After(expires) {
+			delete(s.negativeCache, req)
+		}
+	}
+}
+
+// LoadNegativeCache loads any unexpired negative cache entries that were
+// persisted to the key database before a restart, and removes any that
+// have expired. It does nothing unless PersistNegativeCache is set.
+func (s *ServerKeyAPI) LoadNegativeCache(ctx context.Context) error {
+	db := s.negativeCacheStore()
+	if db == nil {
+		return nil
+	}
+	now := gomatrixserverlib.AsTimestamp(s.now())
+	if err := db.DeleteExpiredNegativeCacheEntries(ctx, now); err != nil {
+		return fmt.Errorf("db.DeleteExpiredNegativeCacheEntries: %w", err)
+	}
+	entries, err := db.NegativeCacheEntries(ctx, now)
+	if err != nil {
+		return fmt.Errorf("db.NegativeCacheEntries: %w", err)
+	}
+	s.negativeCacheMutex.Lock()
+	defer s.negativeCacheMutex.Unlock()
+	if s.negativeCache == nil {
+		s.negativeCache = map[gomatrixserverlib.PublicKeyLookupRequest]time.Time{}
+	}
+	for req, expires := range entries {
+		if existing, ok := s.negativeCache[req]; !ok || existing.Before(expires.Time()) {
+			s.negativeCache[req] = expires.Time()
+		}
+	}
+	return nil
+}
+
+// StartNegativeCacheGC starts a goroutine that removes expired negative
+// cache entries from the key database every interval, until the context
+// is done. It does nothing unless PersistNegativeCache is set.
+func (s *ServerKeyAPI) StartNegativeCacheGC(ctx context.Context, interval time.Duration) {
+	if s.negativeCacheStore() == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.collectNegativeCache(ctx)
+			}
+		}
+	}()
+}
+
+// collectNegativeCache removes expired negative cache entries from the key
+// database.
+func (s *ServerKeyAPI) collectNegativeCache(ctx context.Context) {
+	db := s.negativeCacheStore()
+	if db == nil {
+		return
+	}
+	now := gomatrixserverlib.AsTimestamp(s.now())
+	if err := db.DeleteExpiredNegativeCacheEntries(ctx, now); err != nil {
+		logrus.WithError(err).Warn("Failed to remove expired negative key cache entries")
+	}
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// AddNotaryServer adds a trusted notary server that will be asked for
+// keys, using the /_matrix/key/v2/query endpoint, after all of the other
+// key fetchers have failed to find them. The perspective fetcher checks
+// that responses are signed by the notary with one of the given keys,
+// as well as by the origin server itself, before we store them, so at
+// least one notary key must be supplied.
+func (s *ServerKeyAPI) AddNotaryServer(
+	serverName gomatrixserverlib.ServerName,
+	keys map[gomatrixserverlib.KeyID]ed25519.PublicKey,
+) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("notary server %q has no keys to validate responses with", serverName)
+	}
+	s.NotaryFetchers = append(s.NotaryFetchers, PerspectiveKeyFetcher{
+		PerspectiveKeyFetcher: &gomatrixserverlib.PerspectiveKeyFetcher{
+			PerspectiveServerName: serverName,
+			PerspectiveServerKeys: keys,
+			Client:                s.FedClient,
+		},
+	})
+	return nil
+}
+
+// NotaryKeyFetcher is implemented by key fetchers that get keys from a
+// notary server rather than from the servers that they belong to. The
+// signed responses from these must also be signed by a trusted notary.
+type NotaryKeyFetcher interface {
+	SignedKeyFetcher
+	// NotaryKeys returns the name of the notary server and the keys that
+	// its responses are expected to be signed with.
+	NotaryKeys() (gomatrixserverlib.ServerName, map[gomatrixserverlib.KeyID]ed25519.PublicKey)
+}
+
+// PerspectiveKeyFetcher is a gomatrixserverlib.PerspectiveKeyFetcher that
+// also implements NotaryKeyFetcher, so that the signed responses from the
+// notary can be checked against TrustedNotaries, verified again or
+// captured for auditing.
+type PerspectiveKeyFetcher struct {
+	*gomatrixserverlib.PerspectiveKeyFetcher
+}
+
+// FetchSignedKeys implements SignedKeyFetcher
+func (p PerspectiveKeyFetcher) FetchSignedKeys(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) ([]gomatrixserverlib.ServerKeys, error) {
+	responses, err := p.Client.LookupServerKeys(ctx, p.PerspectiveServerName, requests)
+	if err != nil {
+		return nil, fmt.Errorf("p.Client.LookupServerKeys: %w", err)
+	}
+	return responses, nil
+}
+
+// NotaryKeys implements NotaryKeyFetcher
+func (p PerspectiveKeyFetcher) NotaryKeys() (gomatrixserverlib.ServerName, map[gomatrixserverlib.KeyID]ed25519.PublicKey) {
+	return p.PerspectiveServerName, p.PerspectiveServerKeys
+}
+
+// trustedNotaries returns the notary keys that responses from the fetcher
+// must be signed with. These are TrustedNotaries if it has been set, or
+// otherwise the fetcher's own notary keys.
+func (s *ServerKeyAPI) trustedNotaries(
+	fetcher NotaryKeyFetcher,
+) map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]ed25519.PublicKey {
+	if len(s.TrustedNotaries) > 0 {
+		return s.TrustedNotaries
+	}
+	serverName, keys := fetcher.NotaryKeys()
+	return map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]ed25519.PublicKey{
+		serverName: keys,
+	}
+}
+
+// verifyNotarySigned checks that a server key response has been signed by
+// at least one of the notaries with one of their keys.
+func verifyNotarySigned(
+	keys gomatrixserverlib.ServerKeys,
+	notaries map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]ed25519.PublicKey,
+) error {
+	for notaryName, notaryKeys := range notaries {
+		for keyID, key := range notaryKeys {
+			if err := gomatrixserverlib.VerifyJSON(string(notaryName), keyID, key, keys.Raw); err == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("keys for %q aren't signed by a trusted notary", keys.ServerName)
+}
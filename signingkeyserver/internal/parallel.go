@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"context"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// handleFetchersConcurrently asks all of the given fetchers for the
+// outstanding keys at once, using up to FetcherParallelism goroutines.
+// Where more than one fetcher finds the same key, the result that is
+// valid for the longest wins. Any requests that a fetcher answered
+// without the key are added to notFound. Returns how many fetchers were
+// asked.
+func (s *ServerKeyAPI) handleFetchersConcurrently(
+	ctx context.Context,
+	fetchers []gomatrixserverlib.KeyFetcher,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	provenance map[gomatrixserverlib.PublicKeyLookupRequest]string,
+	notFound map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) int {
+	if len(fetchers) == 0 {
+		return 0
+	}
+
+	// Work out which fetcher found the freshest copy of each key.
+	type best struct {
+		fetcher int
+		result  gomatrixserverlib.PublicKeyLookupResult
+	}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	found := map[gomatrixserverlib.PublicKeyLookupRequest]best{}
+	workers := make(chan struct{}, s.FetcherParallelism)
+	for i, fetcher := range fetchers {
+		// Each fetcher gets its own copy of the requests, since the
+		// requests map isn't safe to share between goroutines.
+		fetchRequests := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, len(requests))
+		for req, ts := range requests {
+			fetchRequests[req] = ts
+		}
+		wg.Add(1)
+		go func(i int, fetcher gomatrixserverlib.KeyFetcher) {
+			defer wg.Done()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+			fetcherResults, asked, err := s.fetchFromFetcher(ctx, fetcher, fetchRequests)
+			mutex.Lock()
+			defer mutex.Unlock()
+			noteNotFound(ctx, notFound, asked, fetcherResults, err)
+			if err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"fetcher_name": fetcher.FetcherName(),
+				}).Errorf("Failed to retrieve %d key(s)", len(fetchRequests))
+				return
+			}
+			for req, res := range fetcherResults {
+				if prev, ok := found[req]; !ok || res.ValidUntilTS > prev.result.ValidUntilTS {
+					found[req] = best{i, res}
+				}
+			}
+		}(i, fetcher)
+	}
+	wg.Wait()
+
+	// Then merge the winning results in as if each fetcher had only
+	// found the keys that it won, so that each key is stored once.
+	won := make([]map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, len(fetchers))
+	for req, b := range found {
+		if won[b.fetcher] == nil {
+			won[b.fetcher] = map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+		}
+		won[b.fetcher][req] = b.result
+	}
+	for i, fetcherResults := range won {
+		if len(fetcherResults) == 0 {
+			continue
+		}
+		fetcherName := fetchers[i].FetcherName()
+		if err := s.mergeFetcherResults(ctx, fetcherName, fetcherResults, requests, results, provenance); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"fetcher_name": fetcherName,
+			}).Errorf("Failed to store %d key(s)", len(fetcherResults))
+		}
+	}
+	return len(fetchers)
+}
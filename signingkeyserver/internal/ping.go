@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// PingFetchers asks each of the key fetchers and notary fetchers for our
+// own signing key, all at the same time, to check that they can reach the
+// network and give a response, i.e. for a federation diagnostics page.
+// Returns the outcome for each fetcher by name, which is nil if the
+// fetcher responded without an error, whether or not it found the key.
+// How long each fetcher took is logged and recorded in the
+// key_fetcher_ping_duration_seconds metric. Nothing that the fetchers
+// return is used or stored.
+func (s *ServerKeyAPI) PingFetchers(ctx context.Context) map[string]error {
+	fetchers := make([]gomatrixserverlib.KeyFetcher, 0, len(s.OurKeyRing.KeyFetchers)+len(s.NotaryFetchers))
+	fetchers = append(fetchers, s.OurKeyRing.KeyFetchers...)
+	fetchers = append(fetchers, s.NotaryFetchers...)
+
+	keyID, _ := s.primaryKey()
+	request := gomatrixserverlib.PublicKeyLookupRequest{
+		ServerName: s.ServerName,
+		KeyID:      keyID,
+	}
+	now := gomatrixserverlib.AsTimestamp(s.now())
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	outcomes := make(map[string]error, len(fetchers))
+	for _, fetcher := range fetchers {
+		wg.Add(1)
+		go func(fetcher gomatrixserverlib.KeyFetcher) {
+			defer wg.Done()
+			err := s.pingFetcher(ctx, fetcher, request, now)
+			mutex.Lock()
+			outcomes[fetcher.FetcherName()] = err
+			mutex.Unlock()
+		}(fetcher)
+	}
+	wg.Wait()
+	return outcomes
+}
+
+// pingFetcher asks a single fetcher for the request, within the fetcher's
+// timeout, and records how long it took.
+func (s *ServerKeyAPI) pingFetcher(
+	ctx context.Context,
+	fetcher gomatrixserverlib.KeyFetcher,
+	request gomatrixserverlib.PublicKeyLookupRequest,
+	now gomatrixserverlib.Timestamp,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, s.fetcherTimeout(fetcher))
+	defer cancel()
+
+	start := time.Now()
+	_, err := fetcher.FetchKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		request: now,
+	})
+	latency := time.Since(start)
+
+	outcome := fetchOutcomeSuccess
+	if err != nil {
+		outcome = fetchOutcomeFailure
+		err = fmt.Errorf("fetcher.FetchKeys: %w", err)
+	}
+	keyFetcherPingDuration.WithLabelValues(fetcher.FetcherName(), outcome).Observe(latency.Seconds())
+
+	entry := logrus.WithFields(logrus.Fields{
+		"fetcher_name": fetcher.FetcherName(),
+		"latency":      latency,
+	})
+	if err != nil {
+		entry.WithError(err).Warn("Key fetcher ping failed")
+	} else {
+		entry.Info("Key fetcher ping succeeded")
+	}
+	return err
+}
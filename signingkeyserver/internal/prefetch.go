@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultPrefetchConcurrency is used when no PrefetchConcurrency has been
+// configured on the ServerKeyAPI.
+const defaultPrefetchConcurrency = 16
+
+// prefetchFetcherName is recorded as the source of prefetched keys.
+const prefetchFetcherName = "prefetch"
+
+// PrefetchServerKeys fetches the current keys of all of the given servers
+// at once and stores them, so that they are already to hand when we come
+// to verify events from those servers, i.e. after joining a large room.
+// The servers are asked directly and in parallel, up to
+// PrefetchConcurrency at a time, unless their circuit breakers are open or
+// they have been asked too often lately. Responses that aren't correctly
+// signed by the server's own keys are ignored, and the rest are stored in
+// the same way as keys from any other fetcher.
+//
+// If the context is cancelled, i.e. because the join was abandoned, then
+// any requests that are still in flight are cancelled and no more servers
+// are asked. The keys that were fetched before then are still stored.
+func (s *ServerKeyAPI) PrefetchServerKeys(
+	ctx context.Context,
+	serverNames []gomatrixserverlib.ServerName,
+) error {
+	if s.FedClient == nil {
+		return fmt.Errorf("no federation client to prefetch server keys with")
+	}
+	concurrency := s.PrefetchConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultPrefetchConcurrency
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var errs []error
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	seen := map[gomatrixserverlib.ServerName]bool{}
+	slots := make(chan struct{}, concurrency)
+servers:
+	for _, serverName := range serverNames {
+		if s.isLocalServerName(serverName) || seen[serverName] {
+			continue
+		}
+		if !s.prefetchAllowed(serverName) {
+			continue
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			break servers
+		}
+		if ctx.Err() != nil {
+			break servers
+		}
+		seen[serverName] = true
+		wg.Add(1)
+		go func(serverName gomatrixserverlib.ServerName) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			serverResults, err := s.prefetchServerKeys(ctx, serverName)
+			if err != nil && ctx.Err() == nil {
+				s.recordFetchFailure(serverName)
+			} else if err == nil {
+				s.recordFetchSuccess(serverName)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				logrus.WithError(err).WithField("server_name", serverName).Warn("Failed to prefetch server keys")
+				errs = append(errs, err)
+				return
+			}
+			for req, res := range serverResults {
+				results[req] = res
+			}
+		}(serverName)
+	}
+	wg.Wait()
+
+	if len(results) > 0 {
+		requests := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
+		previous := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+		if err := s.mergeFetcherResults(ctx, prefetchFetcherName, results, requests, previous, nil); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("server key prefetch was cancelled: %w", err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to prefetch keys for %d of %d server(s): %w", len(errs), len(seen), errs[0])
+	}
+	return nil
+}
+
+// prefetchAllowed reports whether we should ask the server for its keys,
+// which we shouldn't if it keeps failing or we've asked it too often.
+func (s *ServerKeyAPI) prefetchAllowed(serverName gomatrixserverlib.ServerName) bool {
+	requests := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		{ServerName: serverName}: gomatrixserverlib.AsTimestamp(s.now()),
+	}
+	if len(s.rateLimitRequests(s.circuitBreakRequests(requests))) == 0 {
+		logrus.WithField("server_name", serverName).Debug("Not prefetching keys from server that is blocked or rate limited")
+		return false
+	}
+	return true
+}
+
+// prefetchServerKeys asks a single server for its keys, checks that the
+// response has been signed with all of them and filters them in the same
+// way as the keys from any other fetcher.
+func (s *ServerKeyAPI) prefetchServerKeys(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	keys, err := s.FedClient.GetServerKeys(ctx, serverName)
+	if err != nil {
+		return nil, fmt.Errorf("s.FedClient.GetServerKeys: %w", err)
+	}
+	if err = verifySelfSigned(serverName, keys); err != nil {
+		return nil, err
+	}
+
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for keyID, key := range keys.VerifyKeys {
+		req := gomatrixserverlib.PublicKeyLookupRequest{
+			ServerName: serverName,
+			KeyID:      keyID,
+		}
+		results[req] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey:    key,
+			ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+			ValidUntilTS: keys.ValidUntilTS,
+		}
+	}
+	for keyID, key := range keys.OldVerifyKeys {
+		req := gomatrixserverlib.PublicKeyLookupRequest{
+			ServerName: serverName,
+			KeyID:      keyID,
+		}
+		results[req] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey:    key.VerifyKey,
+			ExpiredTS:    key.ExpiredTS,
+			ValidUntilTS: gomatrixserverlib.PublicKeyNotValid,
+		}
+	}
+	requests := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		{ServerName: serverName}: gomatrixserverlib.AsTimestamp(s.now()),
+	}
+	return s.filterFetcherResults(prefetchFetcherName, requests, results), nil
+}
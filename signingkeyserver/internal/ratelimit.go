@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fetchTokenBucket tracks how many more fetch attempts we can make for
+// a single server before we have to wait for the bucket to refill.
+type fetchTokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// allowFetch returns true if we are allowed to try fetching keys for
+// the given server, taking a token from the server's bucket if so. The
+// buckets hold FetchRateLimit tokens and refill completely each minute.
+func (s *ServerKeyAPI) allowFetch(serverName gomatrixserverlib.ServerName) bool {
+	if s.FetchRateLimit <= 0 {
+		return true
+	}
+	limit := float64(s.FetchRateLimit)
+	now := s.now()
+
+	s.rateLimitMutex.Lock()
+	defer s.rateLimitMutex.Unlock()
+	if s.rateLimits == nil {
+		s.rateLimits = map[gomatrixserverlib.ServerName]*fetchTokenBucket{}
+	}
+	bucket, ok := s.rateLimits[serverName]
+	if !ok {
+		bucket = &fetchTokenBucket{
+			tokens:  limit,
+			updated: now,
+		}
+		s.rateLimits[serverName] = bucket
+	}
+	if elapsed := now.Sub(bucket.updated); elapsed > 0 {
+		bucket.tokens += limit * elapsed.Minutes()
+		if bucket.tokens > limit {
+			bucket.tokens = limit
+		}
+		bucket.updated = now
+	}
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// rateLimitRequests returns the subset of the requests for servers that
+// we are currently allowed to fetch keys for. Requests for other servers
+// are deferred until the next time that they are asked for, and in the
+// meantime any keys that we already have for them will be used.
+func (s *ServerKeyAPI) rateLimitRequests(
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp {
+	if s.FetchRateLimit <= 0 {
+		return requests
+	}
+	allowed := map[gomatrixserverlib.ServerName]bool{}
+	results := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, len(requests))
+	for req, ts := range requests {
+		ok, checked := allowed[req.ServerName]
+		if !checked {
+			ok = s.allowFetch(req.ServerName)
+			allowed[req.ServerName] = ok
+		}
+		if ok {
+			results[req] = ts
+		}
+	}
+	return results
+}
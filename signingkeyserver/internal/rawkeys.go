@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// shouldCaptureRawKeys returns true if any of the requests are for a
+// server whose raw key responses we have been asked to capture.
+func (s *ServerKeyAPI) shouldCaptureRawKeys(
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) bool {
+	if s.OnRawKeyResponse == nil {
+		return false
+	}
+	for req := range requests {
+		if s.captureRawKeysFor(req.ServerName) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ServerKeyAPI) captureRawKeysFor(serverName gomatrixserverlib.ServerName) bool {
+	for _, name := range s.CaptureRawKeysFor {
+		if name == serverName {
+			return true
+		}
+	}
+	return false
+}
+
+// rawKeyCapturer returns a function that passes the signed key responses
+// fetched by the named fetcher on to OnRawKeyResponse, for only those
+// servers listed in CaptureRawKeysFor.
+func (s *ServerKeyAPI) rawKeyCapturer(fetcherName string) func(
+	keys gomatrixserverlib.ServerKeys,
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) {
+	return func(
+		keys gomatrixserverlib.ServerKeys,
+		results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	) {
+		if !s.captureRawKeysFor(keys.ServerName) {
+			return
+		}
+		raw := make([]byte, len(keys.Raw))
+		copy(raw, keys.Raw)
+		s.OnRawKeyResponse(fetcherName, keys.ServerName, raw, results)
+	}
+}
@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// NextRefreshDue returns when the soonest of the keys in the key database
+// will need to be fetched again, which is when it stops being valid, less
+// the RefreshThreshold, i.e. so that a background scheduler can wake up
+// just in time to refresh it rather than polling. Keys that have been
+// replaced by their server, or that have already stopped being valid, are
+// only fetched again when they are next requested, so they are left out,
+// as are our own keys.
+// Returns the zero time if there are no keys that will need refreshing.
+func (s *ServerKeyAPI) NextRefreshDue(ctx context.Context) (time.Time, error) {
+	now := gomatrixserverlib.AsTimestamp(s.now())
+	var earliest gomatrixserverlib.Timestamp
+	err := s.ExportKeysStream(ctx, func(batch map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult) error {
+		for req, res := range batch {
+			if s.isLocalServerName(req.ServerName) {
+				continue
+			}
+			if res.ExpiredTS != gomatrixserverlib.PublicKeyNotExpired || res.ValidUntilTS <= now {
+				continue
+			}
+			if earliest == 0 || res.ValidUntilTS < earliest {
+				earliest = res.ValidUntilTS
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("s.ExportKeysStream: %w", err)
+	}
+	if earliest == 0 {
+		return time.Time{}, nil
+	}
+	return earliest.Time().Add(-s.RefreshThreshold), nil
+}
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// StartKeyRefresher starts a goroutine that looks through the key database
+// every interval, until the context is done, for keys that will stop being
+// valid within RefreshThreshold, and fetches them again ahead of time, so
+// that they don't have to be fetched when someone next needs them to verify
+// an event. It does nothing unless RefreshThreshold is set.
+func (s *ServerKeyAPI) StartKeyRefresher(ctx context.Context, interval time.Duration) {
+	if s.RefreshThreshold <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.refreshExpiringKeys(ctx)
+			}
+		}
+	}()
+}
+
+// refreshExpiringKeys fetches again the keys in the key database that are
+// still valid but will stop being valid within RefreshThreshold. Keys that
+// have been replaced by their server, or that have already stopped being
+// valid, are left until someone asks for them. The fetchers are used in the
+// same way as for any other request, so rate limits and circuit breakers
+// still apply. Returns how many keys were refreshed.
+func (s *ServerKeyAPI) refreshExpiringKeys(ctx context.Context) int {
+	now := gomatrixserverlib.AsTimestamp(s.now())
+	expiring := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
+	err := s.ExportKeysStream(ctx, func(batch map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult) error {
+		for req, res := range batch {
+			if s.isLocalServerName(req.ServerName) || !res.WasValidAt(now, true) || !s.expiresSoon(now, res) {
+				continue
+			}
+			expiring[req] = now
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to look for keys that need refreshing")
+		return 0
+	}
+	if len(expiring) == 0 {
+		return 0
+	}
+	logrus.WithField("num_keys", len(expiring)).Debug("Refreshing keys that are about to stop being valid")
+	s.revalidate(expiring)
+	return len(expiring)
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// FetcherRetryPolicy controls how a key fetcher request that failed
+// with a transient error, such as a timeout or a 5xx response, is
+// retried before we move on to the next fetcher.
+type FetcherRetryPolicy struct {
+	// MaxAttempts is the total number of times that we will ask the
+	// fetcher, including the first attempt. Values less than 2 disable
+	// retries.
+	MaxAttempts int
+	// BaseDelay is how long we wait before the first retry. The delay
+	// doubles for each attempt after that.
+	BaseDelay time.Duration
+	// Jitter is the maximum amount of random delay that is added to
+	// each retry, so that retries from different requests don't all
+	// hit the remote server at the same time.
+	Jitter time.Duration
+}
+
+// backoff returns how long to wait after the given failed attempt.
+func (p FetcherRetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << uint(attempt-1)
+	if p.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(p.Jitter)))
+	}
+	return delay
+}
+
+// isTransientFetchError returns true if the fetcher error might go away
+// if we try again. Definitive answers from the remote server, like a
+// 404, are not transient.
+func isTransientFetchError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var httpErr gomatrix.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Timeout()
+	}
+	return false
+}
+
+// isDefiniteFetchError returns true if the fetcher failed in a way that
+// tells us that it doesn't have the keys, rather than because we ran out
+// of time, the caller gave up or the error might go away if we try again.
+func isDefiniteFetchError(ctx context.Context, err error) bool {
+	return ctx.Err() == nil && !errors.Is(err, context.Canceled) && !isTransientFetchError(err)
+}
+
+// fetchWithRetry asks the fetcher for the keys, retrying transient
+// failures according to the FetcherRetry policy for as long as the
+// context allows.
+func (s *ServerKeyAPI) fetchWithRetry(
+	ctx context.Context,
+	fetcher gomatrixserverlib.KeyFetcher,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		results, err := fetcher.FetchKeys(ctx, requests)
+		outcome := fetchOutcomeSuccess
+		if err != nil {
+			outcome = fetchOutcomeFailure
+		}
+		keyFetchDuration.WithLabelValues(fetcher.FetcherName(), outcome).Observe(time.Since(start).Seconds())
+		if err == nil || attempt >= s.FetcherRetry.MaxAttempts || !isTransientFetchError(err) {
+			return results, err
+		}
+		if ctx.Err() != nil {
+			// We've run out of time, so there's no point retrying.
+			return results, err
+		}
+		delay := s.FetcherRetry.backoff(attempt)
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"fetcher_name": fetcher.FetcherName(),
+			"attempt":      attempt,
+		}).Warnf("Retrying key fetch in %s", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return results, err
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultRevalidateWorkers is used when no RevalidateWorkers has
+	// been configured on the ServerKeyAPI.
+	defaultRevalidateWorkers = 4
+	// revalidateQueueSize is the number of background refreshes that
+	// can be waiting for a worker before we start dropping them.
+	revalidateQueueSize = 64
+)
+
+// revalidateStaleKeys removes any requests that we already have an
+// expired result for from the requests map, and queues them up to be
+// refreshed by the fetchers in the background.
+func (s *ServerKeyAPI) revalidateStaleKeys(
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) {
+	stale := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
+	for req, ts := range requests {
+		if _, ok := results[req]; ok {
+			stale[req] = ts
+			delete(requests, req)
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+	s.queueRevalidation(stale)
+}
+
+// expiresSoon returns true if RefreshThreshold is set and the key will stop
+// being valid within RefreshThreshold of now.
+func (s *ServerKeyAPI) expiresSoon(
+	now gomatrixserverlib.Timestamp, res gomatrixserverlib.PublicKeyLookupResult,
+) bool {
+	if s.RefreshThreshold <= 0 {
+		return false
+	}
+	threshold := gomatrixserverlib.Timestamp(s.RefreshThreshold / time.Millisecond)
+	return !res.WasValidAt(now+threshold, true)
+}
+
+// queueRevalidation queues up the given requests to be refreshed by the
+// fetchers in the background.
+func (s *ServerKeyAPI) queueRevalidation(
+	stale map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) {
+	s.revalidateOnce.Do(s.startRevalidateWorkers)
+	select {
+	case s.revalidateQueue <- stale:
+	default:
+		// All of the workers are busy and the queue is full. The keys
+		// will be queued again the next time that someone asks for them.
+		logrus.Warnf("Too many pending key refreshes, not refreshing %d stale key(s)", len(stale))
+	}
+}
+
+// startRevalidateWorkers starts the goroutines that refresh stale keys
+// in the background.
+func (s *ServerKeyAPI) startRevalidateWorkers() {
+	workers := s.RevalidateWorkers
+	if workers <= 0 {
+		workers = defaultRevalidateWorkers
+	}
+	s.revalidateQueue = make(chan map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, revalidateQueueSize)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for requests := range s.revalidateQueue {
+				s.revalidate(requests)
+			}
+		}()
+	}
+}
+
+// revalidate asks the fetchers for fresh copies of the given keys. Any
+// newer keys will be stored in the database by handleFetcherKeys.
+func (s *ServerKeyAPI) revalidate(
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) {
+	ctx := context.Background()
+	now := gomatrixserverlib.AsTimestamp(s.now())
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+
+	// If someone is already fetching some of these keys then there's no
+	// need for us to do it too.
+	owned, _ := s.claimInflight(requests)
+	defer s.releaseInflight(owned, results, nil)
+
+	s.handleFetchers(ctx, now, requests, results, nil)
+}
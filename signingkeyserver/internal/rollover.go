@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/dendrite/signingkeyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// rolloverGaps returns the requests that none of the results cover at the
+// requested time even though a fetcher gave us a different key for the
+// same server, which usually means that the server is rotating its keys
+// and that the key we need hasn't been published yet. Keys that only came
+// from the cache or the database don't count, since they don't tell us
+// that the server can be reached.
+func (s *ServerKeyAPI) rolloverGaps(
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	provenance map[gomatrixserverlib.PublicKeyLookupRequest]string,
+) map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp {
+	fetched := map[gomatrixserverlib.ServerName][]gomatrixserverlib.KeyID{}
+	for req := range results {
+		if isFetcherSource(provenance[req]) {
+			fetched[req.ServerName] = append(fetched[req.ServerName], req.KeyID)
+		}
+	}
+	gaps := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
+	for req, ts := range requests {
+		if res, ok := results[req]; ok && s.wasValidAt(res, ts) {
+			continue
+		}
+		for _, keyID := range fetched[req.ServerName] {
+			if keyID != req.KeyID {
+				gaps[req] = ts
+				break
+			}
+		}
+	}
+	return gaps
+}
+
+// retryRolloverGaps waits for RolloverRetryDelay and then tries once more
+// to find any keys that fell into a rollover gap, adding anything that
+// covers the requested time to the results. The error is updated to only
+// report the keys that are still missing afterwards. It does nothing
+// unless RolloverRetryDelay is set, or if the first attempt failed for
+// some reason other than missing keys.
+func (s *ServerKeyAPI) retryRolloverGaps(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	provenance map[gomatrixserverlib.PublicKeyLookupRequest]string,
+	err error,
+) (
+	map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	map[gomatrixserverlib.PublicKeyLookupRequest]string,
+	error,
+) {
+	if s.RolloverRetryDelay <= 0 {
+		return results, provenance, err
+	}
+	if _, ok := err.(*api.MissingKeysError); err != nil && !ok {
+		return results, provenance, err
+	}
+	gaps := s.rolloverGaps(requests, results, provenance)
+	if len(gaps) == 0 {
+		return results, provenance, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"retry_delay": s.RolloverRetryDelay,
+	}).Infof("Waiting to retry %d key(s) that may be part way through a key rollover", len(gaps))
+	timer := time.NewTimer(s.RolloverRetryDelay)
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+		return results, provenance, err
+	}
+
+	// We've only just failed to find some of these keys, so make sure
+	// that the negative cache doesn't stop us from looking again.
+	s.negativeCacheMutex.Lock()
+	for req := range gaps {
+		delete(s.negativeCache, req)
+	}
+	s.negativeCacheMutex.Unlock()
+
+	retry := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, len(gaps))
+	for req, ts := range gaps {
+		retry[req] = ts
+	}
+	retryResults, retryProvenance, _ := s.fetchKeysWithProvenance(ctx, retry)
+	for req, res := range retryResults {
+		if _, ok := results[req]; ok {
+			if ts, ok := gaps[req]; !ok || !s.wasValidAt(res, ts) {
+				continue
+			}
+		}
+		results[req] = res
+		provenance[req] = retryProvenance[req]
+	}
+
+	for req, ts := range gaps {
+		if res, ok := results[req]; ok && s.wasValidAt(res, ts) {
+			logrus.WithFields(logrus.Fields{
+				"server_name": req.ServerName,
+				"key_id":      req.KeyID,
+			}).Info("Found key after waiting for key rollover")
+		}
+	}
+	var missing []gomatrixserverlib.PublicKeyLookupRequest
+	for req := range requests {
+		if _, ok := results[req]; !ok {
+			missing = append(missing, req)
+		}
+	}
+	if len(missing) > 0 {
+		sortRequests(missing)
+		return results, provenance, &api.MissingKeysError{Missing: missing}
+	}
+	return results, provenance, nil
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"crypto/ed25519"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// retiredLocalKey is one of our own signing keys that was our primary key
+// until it was replaced by RotateKey.
+type retiredLocalKey struct {
+	KeyID     gomatrixserverlib.KeyID
+	PublicKey ed25519.PublicKey
+	RetiredAt gomatrixserverlib.Timestamp
+}
+
+// RotateKey replaces our primary signing key with a new one at runtime.
+// The previous primary key is retired rather than forgotten, so requests
+// for it are still answered locally, as a key that expired when it was
+// rotated out, and events that it signed before then can still be
+// verified. It is safe to call while keys are being served.
+func (s *ServerKeyAPI) RotateKey(keyID gomatrixserverlib.KeyID, publicKey ed25519.PublicKey) {
+	now := s.now()
+
+	s.localKeyMutex.Lock()
+	if s.ServerKeyID != "" && s.ServerKeyID != keyID {
+		s.retiredKeys = append(s.retiredKeys, retiredLocalKey{
+			KeyID:     s.ServerKeyID,
+			PublicKey: s.ServerPublicKey,
+			RetiredAt: gomatrixserverlib.AsTimestamp(now),
+		})
+	}
+	oldKeyID := s.ServerKeyID
+	s.ServerKeyID = keyID
+	s.ServerPublicKey = publicKey
+	s.localKeyMutex.Unlock()
+
+	// The new key's validity period starts now.
+	s.keyExpiryMutex.Lock()
+	s.ServerKeyIssuedAt = now
+	s.keyExpiryWarned = false
+	s.keyExpiryMutex.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"old_key_id": oldKeyID,
+		"new_key_id": keyID,
+	}).Info("Rotated server signing key")
+}
+
+// primaryKey returns the key ID and public key of our primary signing key.
+func (s *ServerKeyAPI) primaryKey() (gomatrixserverlib.KeyID, ed25519.PublicKey) {
+	s.localKeyMutex.RLock()
+	defer s.localKeyMutex.RUnlock()
+	return s.ServerKeyID, s.ServerPublicKey
+}
+
+// retiredLocalKey returns the lookup result for one of our own signing keys
+// that has been rotated out, if we have one with the given key ID.
+func (s *ServerKeyAPI) retiredLocalKey(keyID gomatrixserverlib.KeyID) (gomatrixserverlib.PublicKeyLookupResult, bool) {
+	s.localKeyMutex.RLock()
+	defer s.localKeyMutex.RUnlock()
+	// If a key was retired more than once then the latest time wins.
+	for i := len(s.retiredKeys) - 1; i >= 0; i-- {
+		key := s.retiredKeys[i]
+		if key.KeyID != keyID {
+			continue
+		}
+		return gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey: gomatrixserverlib.VerifyKey{
+				Key: gomatrixserverlib.Base64Bytes(key.PublicKey),
+			},
+			ExpiredTS:    key.RetiredAt,
+			ValidUntilTS: gomatrixserverlib.PublicKeyNotValid,
+		}, true
+	}
+	return gomatrixserverlib.PublicKeyLookupResult{}, false
+}
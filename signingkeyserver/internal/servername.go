@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/dendrite/signingkeyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// normaliseServerName returns the canonical form of a server name, so that
+// different spellings of the same server share cache and database entries:
+// the host is lowercased without any trailing dot, and the port is written
+// without leading zeroes. A port is never added or removed, since a server
+// name with an explicit port is discovered differently to one without.
+// Returns false if the server name isn't valid.
+func normaliseServerName(serverName gomatrixserverlib.ServerName) (gomatrixserverlib.ServerName, bool) {
+	name := string(serverName)
+	var host, port string
+	if strings.HasPrefix(name, "[") {
+		// An IPv6 literal, optionally followed by a port.
+		end := strings.Index(name, "]")
+		if end < 0 {
+			return "", false
+		}
+		host, port = name[:end+1], name[end+1:]
+		if net.ParseIP(host[1:end]) == nil || strings.Contains(host, "%") {
+			return "", false
+		}
+		if port != "" {
+			if !strings.HasPrefix(port, ":") {
+				return "", false
+			}
+			port = port[1:]
+		}
+		host = strings.ToLower(host)
+	} else {
+		host = name
+		if i := strings.LastIndex(name, ":"); i >= 0 {
+			host, port = name[:i], name[i+1:]
+			if port == "" {
+				return "", false
+			}
+		}
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		if host == "" {
+			return "", false
+		}
+		for _, c := range host {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '.' {
+				return "", false
+			}
+		}
+	}
+	if port == "" {
+		return gomatrixserverlib.ServerName(host), true
+	}
+	if len(port) > 5 {
+		return "", false
+	}
+	for _, c := range port {
+		if c < '0' || c > '9' {
+			return "", false
+		}
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return "", false
+	}
+	return gomatrixserverlib.ServerName(host + ":" + strconv.Itoa(n)), true
+}
+
+// isLocalServerName returns true if the server name is ours, however
+// either of them is spelled.
+func (s *ServerKeyAPI) isLocalServerName(serverName gomatrixserverlib.ServerName) bool {
+	if serverName == s.ServerName {
+		return true
+	}
+	ours, ok := normaliseServerName(s.ServerName)
+	if !ok {
+		return false
+	}
+	theirs, ok := normaliseServerName(serverName)
+	return ok && theirs == ours
+}
+
+// normaliseRequests returns the requests with their server names
+// normalised, along with the requests that we were given for each of
+// them. If several requests normalise to the same one then the latest of
+// their timestamps is used. Requests for invalid server names are left out
+// and returned separately.
+func normaliseRequests(
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (
+	normalised map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+	aliases map[gomatrixserverlib.PublicKeyLookupRequest][]gomatrixserverlib.PublicKeyLookupRequest,
+	invalid []gomatrixserverlib.PublicKeyLookupRequest,
+) {
+	normalised = make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, len(requests))
+	aliases = make(map[gomatrixserverlib.PublicKeyLookupRequest][]gomatrixserverlib.PublicKeyLookupRequest, len(requests))
+	for req, ts := range requests {
+		serverName, ok := normaliseServerName(req.ServerName)
+		if !ok {
+			logrus.WithField("server_name", req.ServerName).Warn("Ignoring key request for invalid server name")
+			invalid = append(invalid, req)
+			continue
+		}
+		canonical := gomatrixserverlib.PublicKeyLookupRequest{
+			ServerName: serverName,
+			KeyID:      req.KeyID,
+		}
+		if prev, ok := normalised[canonical]; !ok || ts > prev {
+			normalised[canonical] = ts
+		}
+		aliases[canonical] = append(aliases[canonical], req)
+	}
+	return normalised, aliases, invalid
+}
+
+// restoreRequests hands back the results and provenance for normalised
+// requests under each of the requests that we were given for them, and
+// does the same for the requests listed in a MissingKeysError, adding
+// those that were invalid.
+func restoreRequests(
+	aliases map[gomatrixserverlib.PublicKeyLookupRequest][]gomatrixserverlib.PublicKeyLookupRequest,
+	invalid []gomatrixserverlib.PublicKeyLookupRequest,
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	provenance map[gomatrixserverlib.PublicKeyLookupRequest]string,
+	err error,
+) (
+	map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	map[gomatrixserverlib.PublicKeyLookupRequest]string,
+	error,
+) {
+	if results != nil {
+		restored := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, len(results))
+		for req, res := range results {
+			for _, alias := range aliases[req] {
+				restored[alias] = res
+			}
+		}
+		results = restored
+	}
+	if provenance != nil {
+		restored := make(map[gomatrixserverlib.PublicKeyLookupRequest]string, len(provenance))
+		for req, source := range provenance {
+			for _, alias := range aliases[req] {
+				restored[alias] = source
+			}
+		}
+		provenance = restored
+	}
+
+	missing, ok := err.(*api.MissingKeysError)
+	if err != nil && !ok {
+		return results, provenance, err
+	}
+	restoredMissing := append([]gomatrixserverlib.PublicKeyLookupRequest{}, invalid...)
+	if missing != nil {
+		for _, req := range missing.Missing {
+			restoredMissing = append(restoredMissing, aliases[req]...)
+		}
+	}
+	if len(restoredMissing) == 0 {
+		return results, provenance, nil
+	}
+	sort.Slice(restoredMissing, func(i, j int) bool {
+		if restoredMissing[i].ServerName != restoredMissing[j].ServerName {
+			return restoredMissing[i].ServerName < restoredMissing[j].ServerName
+		}
+		return restoredMissing[i].KeyID < restoredMissing[j].KeyID
+	})
+	return results, provenance, &api.MissingKeysError{Missing: restoredMissing}
+}
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/signingkeyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// serverLister is implemented by key databases that are able to list the
+// servers that they hold keys for, such as the signing key server storage.
+type serverLister interface {
+	ServerNames(ctx context.Context) ([]gomatrixserverlib.ServerName, error)
+}
+
+// keyMetadataLister is implemented by key databases that are able to
+// report when the keys that they hold were fetched.
+type keyMetadataLister interface {
+	KeyMetadata(ctx context.Context, serverName gomatrixserverlib.ServerName) ([]api.KeyMetadata, error)
+}
+
+// ListCachedServers returns the names of all of the remote servers that
+// we have signing keys for in the key database, i.e. for auditing who we
+// federate with.
+func (s *ServerKeyAPI) ListCachedServers(
+	ctx context.Context,
+) ([]gomatrixserverlib.ServerName, error) {
+	db, ok := s.OurKeyRing.KeyDatabase.(serverLister)
+	if !ok {
+		return nil, fmt.Errorf("key database %q doesn't support listing servers", s.OurKeyRing.KeyDatabase.FetcherName())
+	}
+	serverNames, err := db.ServerNames(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("db.ServerNames: %w", err)
+	}
+	remote := make([]gomatrixserverlib.ServerName, 0, len(serverNames))
+	for _, serverName := range serverNames {
+		if serverName != s.ServerName {
+			remote = append(remote, serverName)
+		}
+	}
+	return remote, nil
+}
+
+// KeyInfo returns each of the keys that we have stored for the given
+// server, along with when it is valid until, when it expired and when we
+// last fetched it, i.e. for debugging federation with that server.
+func (s *ServerKeyAPI) KeyInfo(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName,
+) ([]api.KeyMetadata, error) {
+	db, ok := s.OurKeyRing.KeyDatabase.(keyMetadataLister)
+	if !ok {
+		return nil, fmt.Errorf("key database %q doesn't support key metadata", s.OurKeyRing.KeyDatabase.FetcherName())
+	}
+	metadata, err := db.KeyMetadata(ctx, serverName)
+	if err != nil {
+		return nil, fmt.Errorf("db.KeyMetadata: %w", err)
+	}
+	return metadata, nil
+}
@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// FetchStoredKeys returns the requested keys that we already have, i.e. our
+// own keys and those in the in-memory cache and the key database, without
+// asking any of the fetchers. This lets the other instances in a cluster
+// ask us for keys before going out over federation for them. Only keys that
+// were valid at the requested timestamps are returned, so that the caller
+// can still fetch a fresh copy of any others.
+func (s *ServerKeyAPI) FetchStoredKeys(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	now := gomatrixserverlib.AsTimestamp(s.now())
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	remaining := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, len(requests))
+	for req, ts := range requests {
+		remaining[req] = ts
+	}
+
+	if err := s.handleLocalKeys(ctx, remaining, results); err != nil {
+		return nil, fmt.Errorf("s.handleLocalKeys: %w", err)
+	}
+	s.handleCachedKeys(now, remaining, results)
+	if err := s.handleDatabaseKeys(ctx, now, remaining, results); err != nil {
+		return nil, fmt.Errorf("s.handleDatabaseKeys: %w", err)
+	}
+	for req, res := range results {
+		if !res.WasValidAt(requests[req], true) {
+			delete(results, req)
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"sort"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// KeyUpdateFunc is called with the keys that have just been written to
+// the key database.
+type KeyUpdateFunc func(updated []gomatrixserverlib.PublicKeyLookupRequest)
+
+// SubscribeKeyUpdates registers fn to be called whenever keys are written
+// to the key database, i.e. after fetching or importing them, so that other
+// components can react to a server's keys being refreshed. fn is called
+// synchronously from the goroutine that stored the keys, so it should
+// return quickly. The returned function unsubscribes fn again.
+func (s *ServerKeyAPI) SubscribeKeyUpdates(fn KeyUpdateFunc) (unsubscribe func()) {
+	s.subscribersMutex.Lock()
+	defer s.subscribersMutex.Unlock()
+	if s.subscribers == nil {
+		s.subscribers = map[int]KeyUpdateFunc{}
+	}
+	id := s.nextSubscriberID
+	s.nextSubscriberID++
+	s.subscribers[id] = fn
+	return func() {
+		s.subscribersMutex.Lock()
+		defer s.subscribersMutex.Unlock()
+		delete(s.subscribers, id)
+	}
+}
+
+// publishKeyUpdates tells any subscribers that the given keys have been
+// written to the key database.
+func (s *ServerKeyAPI) publishKeyUpdates(
+	stored map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) {
+	if len(stored) == 0 {
+		return
+	}
+	s.subscribersMutex.Lock()
+	subscribers := make([]KeyUpdateFunc, 0, len(s.subscribers))
+	for _, fn := range s.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	s.subscribersMutex.Unlock()
+	if len(subscribers) == 0 {
+		return
+	}
+
+	updated := make([]gomatrixserverlib.PublicKeyLookupRequest, 0, len(stored))
+	for req := range stored {
+		updated = append(updated, req)
+	}
+	sort.Slice(updated, func(i, j int) bool {
+		if updated[i].ServerName != updated[j].ServerName {
+			return updated[i].ServerName < updated[j].ServerName
+		}
+		return updated[i].KeyID < updated[j].KeyID
+	})
+	for _, fn := range subscribers {
+		// Give each subscriber its own copy, so that they can't affect
+		// each other.
+		fn(append([]gomatrixserverlib.PublicKeyLookupRequest(nil), updated...))
+	}
+}
@@ -0,0 +1,281 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// tlsKeyClientTimeout is how long we will wait for a key request to a
+// server with a custom TLS configuration.
+const tlsKeyClientTimeout = time.Second * 30
+
+// maxKeyResponseSize is the most that we will read of a response to a key
+// request to a server with a custom TLS configuration.
+const maxKeyResponseSize = 1024 * 1024
+
+// defaultFederationPort is the port that key requests are sent to when the
+// server name doesn't include one.
+const defaultFederationPort = "8448"
+
+// TLSKeyClient is a gomatrixserverlib.KeyClient that lets the TLS
+// configuration used for key requests be set per server name, i.e. to
+// trust a self-signed certificate in a test network without turning off
+// verification for every other server. Requests to servers without a
+// custom TLS configuration are passed through to Client.
+//
+// Servers with a custom TLS configuration or a KeyServerOverride are
+// contacted directly at their server name, on port 8448 unless the server
+// name includes a port: .well-known and SRV lookups are not performed for
+// them.
+type TLSKeyClient struct {
+	Client    gomatrixserverlib.KeyClient
+	mutex     sync.RWMutex
+	configs   map[gomatrixserverlib.ServerName]*tls.Config
+	overrides map[gomatrixserverlib.ServerName]KeyServerOverride
+	clients   map[gomatrixserverlib.ServerName]*http.Client
+}
+
+// KeyServerOverride changes how key requests are sent to a server whose
+// key endpoints are behind a reverse proxy that expects a different name
+// to the Matrix server name.
+type KeyServerOverride struct {
+	// The name to send in the TLS handshake as the SNI. The certificate
+	// that the server presents is verified against this name instead of
+	// the server name. Left empty, the server name is used.
+	TLSServerName string
+	// The Host header to send with the request. Left empty, the server
+	// name is used.
+	Host string
+}
+
+// NewTLSKeyClient returns a TLSKeyClient which falls back to the given
+// client for servers that don't have a custom TLS configuration.
+func NewTLSKeyClient(client gomatrixserverlib.KeyClient) *TLSKeyClient {
+	return &TLSKeyClient{
+		Client:    client,
+		configs:   make(map[gomatrixserverlib.ServerName]*tls.Config),
+		overrides: make(map[gomatrixserverlib.ServerName]KeyServerOverride),
+		clients:   make(map[gomatrixserverlib.ServerName]*http.Client),
+	}
+}
+
+// SetTLSConfig sets the TLS configuration to use for key requests to the
+// given server. A nil configuration removes any custom configuration, so
+// that requests go through the fallback client again.
+func (c *TLSKeyClient) SetTLSConfig(serverName gomatrixserverlib.ServerName, config *tls.Config) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if config == nil {
+		delete(c.configs, serverName)
+	} else {
+		c.configs[serverName] = config
+	}
+	c.updateClient(serverName)
+}
+
+// SetServerOverride sets the SNI and Host header to use for key requests
+// to the given server. An empty override removes any existing one.
+func (c *TLSKeyClient) SetServerOverride(serverName gomatrixserverlib.ServerName, override KeyServerOverride) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if override == (KeyServerOverride{}) {
+		delete(c.overrides, serverName)
+	} else {
+		c.overrides[serverName] = override
+	}
+	c.updateClient(serverName)
+}
+
+// updateClient builds the HTTP client used for key requests to the given
+// server from its TLS configuration and override, if it has either. The
+// caller must hold the mutex.
+func (c *TLSKeyClient) updateClient(serverName gomatrixserverlib.ServerName) {
+	config, configured := c.configs[serverName]
+	override, overridden := c.overrides[serverName]
+	if !configured && !overridden {
+		delete(c.clients, serverName)
+		return
+	}
+	if configured {
+		config = config.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if override.TLSServerName != "" {
+		config.ServerName = override.TLSServerName
+	}
+	c.clients[serverName] = &http.Client{
+		Timeout: tlsKeyClientTimeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: config,
+		},
+	}
+}
+
+// PinCertificates configures key requests to the given server to accept
+// only a leaf certificate whose SHA-256 fingerprint is one of those given,
+// regardless of who issued it.
+func (c *TLSKeyClient) PinCertificates(serverName gomatrixserverlib.ServerName, fingerprints [][]byte) error {
+	config, err := PinnedCertificateConfig(fingerprints)
+	if err != nil {
+		return fmt.Errorf("server %q: %w", serverName, err)
+	}
+	c.SetTLSConfig(serverName, config)
+	return nil
+}
+
+// PinnedCertificateConfig returns a TLS configuration that only accepts a
+// leaf certificate whose SHA-256 fingerprint is one of those given. The
+// usual chain verification is skipped, so that self-signed certificates
+// can be pinned.
+func PinnedCertificateConfig(fingerprints [][]byte) (*tls.Config, error) {
+	if len(fingerprints) == 0 {
+		return nil, fmt.Errorf("no certificate fingerprints to pin")
+	}
+	for _, fingerprint := range fingerprints {
+		if len(fingerprint) != sha256.Size {
+			return nil, fmt.Errorf("certificate fingerprint %x is not a SHA-256 hash", fingerprint)
+		}
+	}
+	return &tls.Config{
+		// Verification is done by VerifyPeerCertificate instead.
+		InsecureSkipVerify: true, // nolint:gosec
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("server presented no certificates")
+			}
+			leaf := sha256.Sum256(rawCerts[0])
+			for _, fingerprint := range fingerprints {
+				if subtle.ConstantTimeCompare(leaf[:], fingerprint) == 1 {
+					return nil
+				}
+			}
+			return fmt.Errorf("server certificate %x is not pinned", leaf)
+		},
+	}, nil
+}
+
+func (c *TLSKeyClient) httpClient(serverName gomatrixserverlib.ServerName) *http.Client {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.clients[serverName]
+}
+
+// newKeyRequest returns a request for the given path on the server. The
+// Host header is the server name, or the override for it if there is one.
+func (c *TLSKeyClient) newKeyRequest(
+	method string, serverName gomatrixserverlib.ServerName, path string, body io.Reader,
+) (*http.Request, error) {
+	req, err := http.NewRequest(method, "https://"+keyServerAddress(serverName)+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = string(serverName)
+	c.mutex.RLock()
+	override := c.overrides[serverName]
+	c.mutex.RUnlock()
+	if override.Host != "" {
+		req.Host = override.Host
+	}
+	return req, nil
+}
+
+// keyServerAddress returns the host and port to send key requests for the
+// server name to, which is the default federation port if the server name
+// doesn't include one.
+func keyServerAddress(serverName gomatrixserverlib.ServerName) string {
+	name := string(serverName)
+	if _, _, err := net.SplitHostPort(name); err == nil {
+		return name
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(name, "["), "]")
+	return net.JoinHostPort(host, defaultFederationPort)
+}
+
+// GetServerKeys implements gomatrixserverlib.KeyClient
+func (c *TLSKeyClient) GetServerKeys(
+	ctx context.Context, matrixServer gomatrixserverlib.ServerName,
+) (gomatrixserverlib.ServerKeys, error) {
+	client := c.httpClient(matrixServer)
+	if client == nil {
+		return c.Client.GetServerKeys(ctx, matrixServer)
+	}
+	var keys gomatrixserverlib.ServerKeys
+	req, err := c.newKeyRequest(http.MethodGet, matrixServer, "/_matrix/key/v2/server", nil)
+	if err != nil {
+		return keys, err
+	}
+	err = doKeyRequest(ctx, client, req, &keys)
+	return keys, err
+}
+
+// LookupServerKeys implements gomatrixserverlib.KeyClient
+func (c *TLSKeyClient) LookupServerKeys(
+	ctx context.Context, matrixServer gomatrixserverlib.ServerName,
+	keyRequests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) ([]gomatrixserverlib.ServerKeys, error) {
+	client := c.httpClient(matrixServer)
+	if client == nil {
+		return c.Client.LookupServerKeys(ctx, matrixServer, keyRequests)
+	}
+
+	type keyRequest struct {
+		MinimumValidUntilTS gomatrixserverlib.Timestamp `json:"minimum_valid_until_ts"`
+	}
+	var request struct {
+		ServerKeyMap map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]keyRequest `json:"server_keys"`
+	}
+	request.ServerKeyMap = map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]keyRequest{}
+	for req, ts := range keyRequests {
+		server := request.ServerKeyMap[req.ServerName]
+		if server == nil {
+			server = map[gomatrixserverlib.KeyID]keyRequest{}
+			request.ServerKeyMap[req.ServerName] = server
+		}
+		server[req.KeyID] = keyRequest{ts}
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := c.newKeyRequest(http.MethodPost, matrixServer, "/_matrix/key/v2/query", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var response struct {
+		ServerKeyList []gomatrixserverlib.ServerKeys `json:"server_keys"`
+	}
+	if err = doKeyRequest(ctx, client, req, &response); err != nil {
+		return nil, err
+	}
+	return response.ServerKeyList, nil
+}
+
+func doKeyRequest(ctx context.Context, client *http.Client, req *http.Request, response interface{}) error {
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: unexpected status %d", req.Method, req.URL, res.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, maxKeyResponseSize)).Decode(response)
+}
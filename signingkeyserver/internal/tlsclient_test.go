@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestTLSKeyClientPinnedCertificate(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+
+	// httptest.NewTLSServer uses a self-signed certificate.
+	var serverName gomatrixserverlib.ServerName
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/_matrix/key/v2/server" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(signedServerKeys(t, serverName, public, private).Raw)
+	}))
+	defer srv.Close()
+	serverName = gomatrixserverlib.ServerName(strings.TrimPrefix(srv.URL, "https://"))
+
+	fallback := &mockKeyClient{}
+	client := NewTLSKeyClient(fallback)
+
+	// Without any TLS configuration we go through the fallback client.
+	if _, err := client.GetServerKeys(context.Background(), serverName); err == nil {
+		t.Fatalf("expected the fallback client to be used")
+	}
+
+	// The usual verification rejects the self-signed certificate.
+	client.SetTLSConfig(serverName, &tls.Config{})
+	if _, err := client.GetServerKeys(context.Background(), serverName); err == nil {
+		t.Fatalf("expected the self-signed certificate to be rejected")
+	}
+
+	// Pinning some other certificate doesn't help.
+	wrong := sha256.Sum256([]byte("some other certificate"))
+	if err := client.PinCertificates(serverName, [][]byte{wrong[:]}); err != nil {
+		t.Fatalf("PinCertificates failed: %s", err)
+	}
+	if _, err := client.GetServerKeys(context.Background(), serverName); err == nil {
+		t.Fatalf("expected a certificate that isn't pinned to be rejected")
+	}
+
+	// Pinning the server's own certificate lets the request through.
+	fingerprint := sha256.Sum256(srv.Certificate().Raw)
+	if err := client.PinCertificates(serverName, [][]byte{wrong[:], fingerprint[:]}); err != nil {
+		t.Fatalf("PinCertificates failed: %s", err)
+	}
+	keys, err := client.GetServerKeys(context.Background(), serverName)
+	if err != nil {
+		t.Fatalf("expected the pinned certificate to be accepted, got %s", err)
+	}
+	if got := keys.VerifyKeys[testKeyID].Key; !reflect.DeepEqual([]byte(got), []byte(public)) {
+		t.Fatalf("expected the server's key, got %v", got)
+	}
+
+	// The pin only applies to the server it was set for.
+	if _, err := client.GetServerKeys(context.Background(), "other.com"); err == nil {
+		t.Fatalf("expected the fallback client to be used for other servers")
+	}
+}
+
+func TestPinnedCertificateConfigRejectsBadFingerprints(t *testing.T) {
+	if _, err := PinnedCertificateConfig(nil); err == nil {
+		t.Fatalf("expected an error with no fingerprints")
+	}
+	if _, err := PinnedCertificateConfig([][]byte{[]byte("short")}); err == nil {
+		t.Fatalf("expected an error for a fingerprint that isn't SHA-256")
+	}
+}
+
+func TestTLSKeyClientServerOverride(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+
+	// The httptest certificate is valid for example.com and 127.0.0.1.
+	var serverName gomatrixserverlib.ServerName
+	var gotHost, gotSNI string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotHost, gotSNI = req.Host, req.TLS.ServerName
+		_, _ = w.Write(signedServerKeys(t, serverName, public, private).Raw)
+	}))
+	defer srv.Close()
+	serverName = gomatrixserverlib.ServerName(strings.TrimPrefix(srv.URL, "https://"))
+	roots := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	client := NewTLSKeyClient(&mockKeyClient{})
+	client.SetTLSConfig(serverName, &tls.Config{RootCAs: roots})
+
+	// Without an override the request is sent to the server name as usual.
+	// No SNI is sent when connecting to an IP address.
+	if _, err := client.GetServerKeys(context.Background(), serverName); err != nil {
+		t.Fatalf("GetServerKeys failed: %s", err)
+	}
+	if gotHost != string(serverName) || gotSNI != "" {
+		t.Fatalf("expected Host %q and no SNI, got Host %q and SNI %q", serverName, gotHost, gotSNI)
+	}
+
+	// With an override the configured SNI and Host are sent instead.
+	client.SetServerOverride(serverName, KeyServerOverride{
+		TLSServerName: "example.com",
+		Host:          "keys.example.com",
+	})
+	if _, err := client.GetServerKeys(context.Background(), serverName); err != nil {
+		t.Fatalf("GetServerKeys failed: %s", err)
+	}
+	if gotHost != "keys.example.com" || gotSNI != "example.com" {
+		t.Fatalf("expected the overridden Host and SNI, got Host %q and SNI %q", gotHost, gotSNI)
+	}
+
+	// The certificate is verified against the overridden SNI.
+	client.SetServerOverride(serverName, KeyServerOverride{TLSServerName: "not-example.com"})
+	if _, err := client.GetServerKeys(context.Background(), serverName); err == nil {
+		t.Fatalf("expected the certificate to be rejected for the overridden SNI")
+	}
+
+	// Other servers still go through the fallback client.
+	if _, err := client.GetServerKeys(context.Background(), "other.com"); err == nil {
+		t.Fatalf("expected the fallback client to be used for other servers")
+	}
+
+	// Removing the override goes back to the usual behaviour.
+	client.SetServerOverride(serverName, KeyServerOverride{})
+	if _, err := client.GetServerKeys(context.Background(), serverName); err != nil {
+		t.Fatalf("GetServerKeys failed: %s", err)
+	}
+	if gotHost != string(serverName) || gotSNI != "" {
+		t.Fatalf("expected Host %q and no SNI, got Host %q and SNI %q", serverName, gotHost, gotSNI)
+	}
+}
+
+func TestTLSKeyClientDefaultPort(t *testing.T) {
+	client := NewTLSKeyClient(&mockKeyClient{})
+	for serverName, want := range map[gomatrixserverlib.ServerName]string{
+		"example.com":      "example.com:8448",
+		"example.com:8449": "example.com:8449",
+		"1.2.3.4":          "1.2.3.4:8448",
+		"[::1]":            "[::1]:8448",
+		"[::1]:8449":       "[::1]:8449",
+	} {
+		req, err := client.newKeyRequest(http.MethodGet, serverName, "/_matrix/key/v2/server", nil)
+		if err != nil {
+			t.Fatalf("newKeyRequest(%q) failed: %s", serverName, err)
+		}
+		if req.URL.Host != want {
+			t.Errorf("expected %q to be contacted at %q, got %q", serverName, want, req.URL.Host)
+		}
+		if req.Host != string(serverName) {
+			t.Errorf("expected Host %q, got %q", serverName, req.Host)
+		}
+	}
+}
+
+func TestTLSKeyClientLimitsResponseSize(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(`{"server_name":"` + strings.Repeat("a", maxKeyResponseSize) + `"}`))
+	}))
+	defer srv.Close()
+	serverName := gomatrixserverlib.ServerName(strings.TrimPrefix(srv.URL, "https://"))
+	roots := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	client := NewTLSKeyClient(&mockKeyClient{})
+	client.SetTLSConfig(serverName, &tls.Config{RootCAs: roots})
+	if _, err := client.GetServerKeys(context.Background(), serverName); err == nil {
+		t.Fatalf("expected a response larger than %d bytes to be rejected", maxKeyResponseSize)
+	}
+}
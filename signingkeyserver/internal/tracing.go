@@ -0,0 +1,26 @@
+package internal
+
+import (
+	"context"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/opentracing/opentracing-go"
+)
+
+// traceStage starts a tracing span for one stage of FetchKeys, as a child
+// of any span in the context. The span records how many key requests were
+// outstanding at the start of the stage and, once the returned function is
+// called, how many of them the stage satisfied.
+func traceStage(
+	ctx context.Context,
+	operationName string,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (opentracing.Span, context.Context, func()) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, operationName)
+	outstanding := len(requests)
+	span.SetTag("requests", outstanding)
+	return span, ctx, func() {
+		span.SetTag("hits", outstanding-len(requests))
+		span.Finish()
+	}
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// skipUnchangedKeys removes any of the candidate keys from storeResults
+// that are already stored exactly as they are, so that we don't write them
+// to the database again for nothing. The in-memory cache is checked first,
+// and the database only for keys that aren't in it. If MaxCacheAge is set
+// then nothing is skipped, since storing a key again is what records that
+// we have fetched it again.
+func (s *ServerKeyAPI) skipUnchangedKeys(
+	ctx context.Context,
+	storeResults map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	candidates map[gomatrixserverlib.PublicKeyLookupRequest]bool,
+) {
+	if s.MaxCacheAge > 0 || len(candidates) == 0 {
+		return
+	}
+	cache := s.keyCache()
+	now := gomatrixserverlib.AsTimestamp(s.now())
+	lookup := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
+	for req := range candidates {
+		if cache != nil {
+			if val, ok := cache.Peek(req); ok {
+				if sameKey(val.(cachedKey).PublicKeyLookupResult, storeResults[req]) {
+					delete(storeResults, req)
+				}
+				continue
+			}
+		}
+		lookup[req] = now
+	}
+	if len(lookup) == 0 {
+		return
+	}
+	existing, err := s.OurKeyRing.KeyDatabase.FetchKeys(ctx, lookup)
+	if err != nil {
+		// We'll just have to store them all.
+		logrus.WithError(err).Debug("Failed to check for unchanged keys before storing them")
+		return
+	}
+	for req, res := range existing {
+		if candidates[req] && sameKey(res, storeResults[req]) {
+			delete(storeResults, req)
+		}
+	}
+}
+
+// sameKey returns true if the two key results are identical.
+func sameKey(a, b gomatrixserverlib.PublicKeyLookupResult) bool {
+	return a.ValidUntilTS == b.ValidUntilTS &&
+		a.ExpiredTS == b.ExpiredTS &&
+		bytes.Equal(a.Key, b.Key)
+}
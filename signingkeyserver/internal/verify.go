@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// SignedKeyFetcher is implemented by key fetchers that can return the
+// signed server key responses that their keys came from, rather than
+// just the keys themselves. If VerifyFetchedKeys is set then these are
+// used so that the signatures can be checked again before the keys are
+// stored.
+type SignedKeyFetcher interface {
+	gomatrixserverlib.KeyFetcher
+	FetchSignedKeys(
+		ctx context.Context,
+		requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+	) ([]gomatrixserverlib.ServerKeys, error)
+}
+
+// verifyingFetcher wraps a SignedKeyFetcher so that only keys from
+// responses that are correctly signed by the server's own keys are
+// returned from FetchKeys. If notaries is set then the responses must
+// also be signed by one of them. If capture is set then it is called with
+// each response and the keys that were taken from it, if any.
+type verifyingFetcher struct {
+	SignedKeyFetcher
+	notaries map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]ed25519.PublicKey
+	capture  func(keys gomatrixserverlib.ServerKeys, results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult)
+}
+
+// FetchKeys implements gomatrixserverlib.KeyFetcher
+func (f verifyingFetcher) FetchKeys(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	responses, err := f.FetchSignedKeys(ctx, requests)
+	// If only some of the servers failed then we still check what the
+	// others returned, and pass on which ones failed.
+	var serverErrs serverFetchErrors
+	if err != nil && !errors.As(err, &serverErrs) {
+		return nil, err
+	}
+
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for _, keys := range responses {
+		var found map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult
+		if err = f.verify(keys); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"fetcher_name": f.FetcherName(),
+				"server_name":  keys.ServerName,
+			}).Warn("Dropping fetched keys that failed verification")
+		} else {
+			found = responseKeys(keys)
+		}
+		if f.capture != nil {
+			f.capture(keys, found)
+		}
+		for req, res := range found {
+			if prev, ok := results[req]; ok && prev.ValidUntilTS >= res.ValidUntilTS {
+				continue
+			}
+			results[req] = res
+		}
+	}
+	if serverErrs != nil {
+		return results, serverErrs
+	}
+	return results, nil
+}
+
+// verify checks the signatures on a server key response.
+func (f verifyingFetcher) verify(keys gomatrixserverlib.ServerKeys) error {
+	if err := verifySelfSigned(keys.ServerName, keys); err != nil {
+		return err
+	}
+	if f.notaries != nil {
+		return verifyNotarySigned(keys, f.notaries)
+	}
+	return nil
+}
+
+// responseKeys returns all of the keys from a server key response, not
+// just the ones that were asked for, so that any others that the server
+// told us about can be stored too.
+func responseKeys(
+	keys gomatrixserverlib.ServerKeys,
+) map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult {
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for keyID, key := range keys.OldVerifyKeys {
+		req := gomatrixserverlib.PublicKeyLookupRequest{
+			ServerName: keys.ServerName,
+			KeyID:      keyID,
+		}
+		results[req] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey:    key.VerifyKey,
+			ExpiredTS:    key.ExpiredTS,
+			ValidUntilTS: gomatrixserverlib.PublicKeyNotValid,
+		}
+	}
+	for keyID, key := range keys.VerifyKeys {
+		req := gomatrixserverlib.PublicKeyLookupRequest{
+			ServerName: keys.ServerName,
+			KeyID:      keyID,
+		}
+		results[req] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey:    key,
+			ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+			ValidUntilTS: keys.ValidUntilTS,
+		}
+	}
+	return results
+}
+
+// verifySelfSigned checks that a server key response is for the given
+// server and that it has been signed with all of the current keys in it.
+func verifySelfSigned(
+	serverName gomatrixserverlib.ServerName,
+	keys gomatrixserverlib.ServerKeys,
+) error {
+	if keys.ServerName != serverName {
+		return fmt.Errorf("server %q returned keys for %q", serverName, keys.ServerName)
+	}
+	if len(keys.VerifyKeys) == 0 {
+		return fmt.Errorf("server %q didn't return any keys", serverName)
+	}
+	for keyID, key := range keys.VerifyKeys {
+		if err := gomatrixserverlib.VerifyJSON(string(serverName), keyID, ed25519.PublicKey(key.Key), keys.Raw); err != nil {
+			return fmt.Errorf("gomatrixserverlib.VerifyJSON: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// warmKey is a key that is a candidate for warming the in-memory cache.
+type warmKey struct {
+	req gomatrixserverlib.PublicKeyLookupRequest
+	key cachedKey
+}
+
+// WarmKeyCache loads the keys that were fetched most recently from the key
+// database into the in-memory cache, up to KeyCacheSize of them, so that
+// the keys that were in use before a restart are served from memory
+// straight away rather than all being looked up again at once. Keys that
+// are no longer valid, or that are older than MaxCacheAge, are left out.
+// If the key database doesn't record when keys were fetched then the keys
+// that are valid for longest are loaded instead. Returns how many keys
+// were loaded, which is always 0 if there is no in-memory cache.
+func (s *ServerKeyAPI) WarmKeyCache(ctx context.Context) (int, error) {
+	cache := s.keyCache()
+	if cache == nil {
+		return 0, nil
+	}
+	now := gomatrixserverlib.AsTimestamp(s.now())
+
+	// Only hold on to the best candidates that we've seen so far, so that
+	// a large key database doesn't end up entirely in memory.
+	var warm []warmKey
+	err := s.ExportKeysStream(ctx, func(batch map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult) error {
+		fetched, _ := s.keyFetchTimes(ctx, batch)
+		for req, res := range batch {
+			if !s.wasValidAt(res, now) || s.tooOldToUse(now, fetched[req]) {
+				continue
+			}
+			warm = append(warm, warmKey{req, cachedKey{res, fetched[req], now}})
+		}
+		if len(warm) > 2*s.KeyCacheSize {
+			warm = hottestKeys(warm, s.KeyCacheSize)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("s.ExportKeysStream: %w", err)
+	}
+	warm = hottestKeys(warm, s.KeyCacheSize)
+
+	// Add the hottest keys last, so that they are the last to be evicted.
+	for i := len(warm) - 1; i >= 0; i-- {
+		cache.Add(warm[i].req, warm[i].key)
+	}
+	logrus.WithField("num_keys", len(warm)).Info("Warmed the in-memory key cache")
+	return len(warm), nil
+}
+
+// hottestKeys returns up to limit of the keys, starting with those that
+// were fetched most recently and then those that are valid for longest.
+func hottestKeys(keys []warmKey, limit int) []warmKey {
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.key.FetchedTS != b.key.FetchedTS {
+			return a.key.FetchedTS > b.key.FetchedTS
+		}
+		if a.key.ValidUntilTS != b.key.ValidUntilTS {
+			return a.key.ValidUntilTS > b.key.ValidUntilTS
+		}
+		if a.req.ServerName != b.req.ServerName {
+			return a.req.ServerName < b.req.ServerName
+		}
+		return a.req.KeyID < b.req.KeyID
+	})
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
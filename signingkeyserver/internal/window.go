@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"context"
+	"errors"
+
+	"github.com/matrix-org/dendrite/signingkeyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// FetchKeysValidFrom fetches the given keys, making sure that each of them
+// is valid for the whole of the window from the first timestamp until the
+// second, i.e. for a key that is needed now and for the next hour. Keys
+// that we already have but that stop being valid before the end of the
+// window are fetched again. Only keys that cover the window are returned.
+// If any of the keys don't, a MissingKeysError listing them is returned
+// alongside the rest.
+func (s *ServerKeyAPI) FetchKeysValidFrom(
+	ctx context.Context,
+	keys []gomatrixserverlib.PublicKeyLookupRequest,
+	from, until gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	requests := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, len(keys))
+	for _, req := range keys {
+		requests[req] = from
+	}
+	results, err := s.FetchKeys(ctx, requests)
+	var missing *api.MissingKeysError
+	if err != nil && !errors.As(err, &missing) {
+		return nil, err
+	}
+
+	// Fetch again any of the keys that we found that don't last until the
+	// end of the window. There's no point asking again for keys that the
+	// fetchers have just failed to find, or for our own keys.
+	refetch := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
+	for req, res := range results {
+		if !s.isLocalServerName(req.ServerName) && !s.coversWindow(res, from, until) {
+			refetch[req] = until
+		}
+	}
+	if len(refetch) > 0 {
+		// The results are for the requests that we were given, so ask the
+		// fetchers using the normalised server names, as FetchKeys does.
+		normalised, aliases, _ := normaliseRequests(refetch)
+		refetched := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+		owned, waiting := s.claimInflight(normalised)
+		s.handleFetchers(ctx, gomatrixserverlib.AsTimestamp(s.now()), normalised, refetched, nil)
+		s.releaseInflight(owned, refetched, nil)
+		s.waitInflight(waiting, refetched, nil)
+		refetched, _, _ = restoreRequests(aliases, nil, refetched, nil, nil)
+		for req, res := range refetched {
+			results[req] = res
+		}
+	}
+
+	covered := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, len(results))
+	var uncovered []gomatrixserverlib.PublicKeyLookupRequest
+	for req := range requests {
+		if res, ok := results[req]; ok && s.coversWindow(res, from, until) {
+			covered[req] = res
+		} else {
+			uncovered = append(uncovered, req)
+		}
+	}
+	if len(uncovered) > 0 {
+		return covered, &api.MissingKeysError{Missing: uncovered}
+	}
+	return covered, nil
+}
+
+// coversWindow returns true if the key is valid from the first timestamp
+// until the second.
+func (s *ServerKeyAPI) coversWindow(
+	res gomatrixserverlib.PublicKeyLookupResult,
+	from, until gomatrixserverlib.Timestamp,
+) bool {
+	return s.wasValidAt(res, from) && s.wasValidAt(res, until)
+}
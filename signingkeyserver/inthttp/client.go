@@ -16,6 +16,10 @@ import (
 const (
 	ServerKeyInputPublicKeyPath = "/signingkeyserver/inputPublicKey"
 	ServerKeyQueryPublicKeyPath = "/signingkeyserver/queryPublicKey"
+	ServerKeyInvalidateKeysPath = "/signingkeyserver/invalidateKeys"
+	ServerKeyHealthCheckPath    = "/signingkeyserver/healthCheck"
+
+	ServerKeyQueryStoredPublicKeysPath = "/signingkeyserver/queryStoredPublicKeys"
 )
 
 // NewSigningKeyServerClient creates a SigningKeyServerAPI implemented by talking to a HTTP POST API.
@@ -130,3 +134,33 @@ func (h *httpServerKeyInternalAPI) QueryPublicKeys(
 	apiURL := h.serverKeyAPIURL + ServerKeyQueryPublicKeyPath
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
+
+func (h *httpServerKeyInternalAPI) InvalidateKeys(
+	ctx context.Context,
+	requests []gomatrixserverlib.PublicKeyLookupRequest,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "InvalidateKeys")
+	defer span.Finish()
+
+	// Make sure that we don't keep serving the keys from our own cache.
+	for _, req := range requests {
+		h.cache.EvictServerKey(req)
+	}
+
+	request := api.InvalidatePublicKeysRequest{Requests: requests}
+	response := api.InvalidatePublicKeysResponse{}
+	apiURL := h.serverKeyAPIURL + ServerKeyInvalidateKeysPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, &request, &response)
+}
+
+func (h *httpServerKeyInternalAPI) HealthCheck(
+	ctx context.Context,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "HealthCheck")
+	defer span.Finish()
+
+	request := api.HealthCheckRequest{}
+	response := api.HealthCheckResponse{}
+	apiURL := h.serverKeyAPIURL + ServerKeyHealthCheckPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, &request, &response)
+}
@@ -0,0 +1,57 @@
+package inthttp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/signingkeyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/opentracing/opentracing-go"
+)
+
+// PeerKeyFetcher is a gomatrixserverlib.KeyFetcher that asks the signing
+// key server of another Dendrite instance in the same deployment for any
+// keys that it has already stored, so that each instance doesn't have to
+// fetch the same keys over federation. The peer doesn't fetch keys that it
+// doesn't have, so this should come before the federation fetchers in
+// OurKeyRing.KeyFetchers.
+type PeerKeyFetcher struct {
+	peerURL    string
+	httpClient *http.Client
+}
+
+// NewPeerKeyFetcher creates a PeerKeyFetcher for the signing key server
+// internal API at peerURL. If httpClient is nil an error is returned.
+func NewPeerKeyFetcher(peerURL string, httpClient *http.Client) (*PeerKeyFetcher, error) {
+	if httpClient == nil {
+		return nil, errors.New("NewPeerKeyFetcher: httpClient is <nil>")
+	}
+	return &PeerKeyFetcher{
+		peerURL:    peerURL,
+		httpClient: httpClient,
+	}, nil
+}
+
+// FetcherName implements gomatrixserverlib.KeyFetcher
+func (f *PeerKeyFetcher) FetcherName() string {
+	return "peer:" + f.peerURL
+}
+
+// FetchKeys implements gomatrixserverlib.KeyFetcher
+func (f *PeerKeyFetcher) FetchKeys(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryStoredPublicKeys")
+	defer span.Finish()
+
+	request := api.QueryPublicKeysRequest{Requests: requests}
+	response := api.QueryPublicKeysResponse{}
+	apiURL := f.peerURL + ServerKeyQueryStoredPublicKeysPath
+	if err := httputil.PostJSON(ctx, span, f.httpClient, apiURL, &request, &response); err != nil {
+		return nil, err
+	}
+	return response.Results, nil
+}
@@ -0,0 +1,121 @@
+package inthttp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/signingkeyserver/internal"
+	"github.com/matrix-org/dendrite/signingkeyserver/storage/inmemory"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// countingFetcher stands in for fetching keys over federation, and counts
+// how many times it was asked.
+type countingFetcher struct {
+	calls int32
+	keys  map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult
+}
+
+func (f *countingFetcher) FetcherName() string {
+	return "federation"
+}
+
+func (f *countingFetcher) FetchKeys(
+	_ context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	atomic.AddInt32(&f.calls, 1)
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for req := range requests {
+		if res, ok := f.keys[req]; ok {
+			results[req] = res
+		}
+	}
+	return results, nil
+}
+
+func newServerKeyAPI(serverName gomatrixserverlib.ServerName, db gomatrixserverlib.KeyDatabase, fetchers ...gomatrixserverlib.KeyFetcher) *internal.ServerKeyAPI {
+	return &internal.ServerKeyAPI{
+		ServerName:        serverName,
+		ServerPublicKey:   []byte(serverName + "-public-key"),
+		ServerKeyID:       "ed25519:auto",
+		ServerKeyValidity: time.Hour,
+		OurKeyRing: gomatrixserverlib.KeyRing{
+			KeyDatabase: db,
+			KeyFetchers: fetchers,
+		},
+	}
+}
+
+func TestPeerKeyFetcher(t *testing.T) {
+	stored := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:stored"}
+	unknown := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:unknown"}
+	key := gomatrixserverlib.PublicKeyLookupResult{
+		VerifyKey:    gomatrixserverlib.VerifyKey{Key: gomatrixserverlib.Base64Bytes("stored-key")},
+		ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+		ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour)),
+	}
+
+	// The peer already has one of the keys, and would fetch others over
+	// federation if it were asked to.
+	peerDB := inmemory.NewDatabase()
+	if err := peerDB.StoreKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		stored: key,
+	}); err != nil {
+		t.Fatalf("failed to store key on the peer: %s", err)
+	}
+	peerFederation := &countingFetcher{}
+	router := mux.NewRouter()
+	AddRoutes(newServerKeyAPI("peer.com", peerDB, peerFederation), router, nil)
+	peer := httptest.NewServer(router)
+	defer peer.Close()
+
+	peerFetcher, err := NewPeerKeyFetcher(peer.URL, http.DefaultClient)
+	if err != nil {
+		t.Fatalf("NewPeerKeyFetcher failed: %s", err)
+	}
+	federation := &countingFetcher{}
+	db := inmemory.NewDatabase()
+	s := newServerKeyAPI("local.com", db, peerFetcher, federation)
+
+	// The key that the peer has is fetched from the peer rather than over
+	// federation, and stored locally.
+	results, err := s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		stored: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if string(results[stored].Key) != "stored-key" {
+		t.Fatalf("expected the key from the peer, got %+v", results[stored])
+	}
+	if calls := atomic.LoadInt32(&federation.calls); calls != 0 {
+		t.Fatalf("expected no fetches over federation, got %d", calls)
+	}
+	localKeys, err := db.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		stored: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("failed to look up local keys: %s", err)
+	}
+	if _, ok := localKeys[stored]; !ok {
+		t.Fatalf("expected the key from the peer to be stored locally")
+	}
+
+	// Keys that the peer doesn't have are fetched over federation by us
+	// rather than by the peer.
+	_, _ = s.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		unknown: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if calls := atomic.LoadInt32(&peerFederation.calls); calls != 0 {
+		t.Fatalf("expected the peer not to fetch keys over federation, got %d", calls)
+	}
+	if calls := atomic.LoadInt32(&federation.calls); calls != 1 {
+		t.Fatalf("expected one fetch over federation, got %d", calls)
+	}
+}
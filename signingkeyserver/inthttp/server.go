@@ -1,17 +1,46 @@
 package inthttp
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/signingkeyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
+// storedKeyFetcher is implemented by signing key servers that can return
+// the keys that they already have without fetching any others.
+type storedKeyFetcher interface {
+	FetchStoredKeys(
+		ctx context.Context,
+		requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+	) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error)
+}
+
 func AddRoutes(s api.SigningKeyServerAPI, internalAPIMux *mux.Router, cache caching.ServerKeyCache) {
+	if stored, ok := s.(storedKeyFetcher); ok {
+		internalAPIMux.Handle(ServerKeyQueryStoredPublicKeysPath,
+			httputil.MakeInternalAPI("queryStoredPublicKeys", func(req *http.Request) util.JSONResponse {
+				request := api.QueryPublicKeysRequest{}
+				response := api.QueryPublicKeysResponse{}
+				if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+					return util.MessageResponse(http.StatusBadRequest, err.Error())
+				}
+				keys, err := stored.FetchStoredKeys(req.Context(), request.Requests)
+				if err != nil {
+					return util.ErrorResponse(err)
+				}
+				response.Results = keys
+				return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+			}),
+		)
+	}
 	internalAPIMux.Handle(ServerKeyQueryPublicKeyPath,
 		httputil.MakeInternalAPI("queryPublicKeys", func(req *http.Request) util.JSONResponse {
 			request := api.QueryPublicKeysRequest{}
@@ -20,7 +49,10 @@ func AddRoutes(s api.SigningKeyServerAPI, internalAPIMux *mux.Router, cache cach
 				return util.MessageResponse(http.StatusBadRequest, err.Error())
 			}
 			keys, err := s.FetchKeys(req.Context(), request.Requests)
-			if err != nil {
+			var missing *api.MissingKeysError
+			if err != nil && !errors.As(err, &missing) {
+				// Missing keys aren't fatal - the caller will work out for
+				// itself which keys it didn't get back.
 				return util.ErrorResponse(err)
 			}
 			response.Results = keys
@@ -40,4 +72,26 @@ func AddRoutes(s api.SigningKeyServerAPI, internalAPIMux *mux.Router, cache cach
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(ServerKeyInvalidateKeysPath,
+		httputil.MakeInternalAPI("invalidateKeys", func(req *http.Request) util.JSONResponse {
+			request := api.InvalidatePublicKeysRequest{}
+			response := api.InvalidatePublicKeysResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := s.InvalidateKeys(req.Context(), request.Requests); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(ServerKeyHealthCheckPath,
+		httputil.MakeInternalAPI("healthCheck", func(req *http.Request) util.JSONResponse {
+			response := api.HealthCheckResponse{}
+			if err := s.HealthCheck(req.Context()); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 }
@@ -1,8 +1,11 @@
 package signingkeyserver
 
 import (
+	"context"
 	"crypto/ed25519"
 	"encoding/base64"
+	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/internal/caching"
@@ -12,6 +15,7 @@ import (
 	"github.com/matrix-org/dendrite/signingkeyserver/inthttp"
 	"github.com/matrix-org/dendrite/signingkeyserver/storage"
 	"github.com/matrix-org/dendrite/signingkeyserver/storage/cache"
+	"github.com/matrix-org/dendrite/signingkeyserver/storage/codec"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
 )
@@ -38,30 +42,110 @@ func NewInternalAPI(
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to server key database")
 	}
+	if cfg.CompressKeys {
+		if db, ok := innerDB.(interface{ SetKeyCodec(codec.KeyCodec) }); ok {
+			db.SetKeyCodec(codec.Gzip{})
+		} else {
+			logrus.Warn("Server key database doesn't support compressing keys")
+		}
+	}
 
 	serverKeyDB, err := cache.NewKeyDatabase(innerDB, caches)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to set up caching wrapper for server key database")
 	}
 
+	if len(cfg.KeyServerTLSPins) > 0 || len(cfg.KeyServerOverrides) > 0 {
+		tlsClient := internal.NewTLSKeyClient(fedClient)
+		for _, pin := range cfg.KeyServerTLSPins {
+			fingerprints := make([][]byte, 0, len(pin.SHA256Fingerprints))
+			for _, fingerprint := range pin.SHA256Fingerprints {
+				b, err := config.ParseCertificateFingerprint(fingerprint)
+				if err != nil {
+					logrus.WithError(err).WithField("server_name", pin.ServerName).Warn("Couldn't parse pinned certificate fingerprint")
+					continue
+				}
+				fingerprints = append(fingerprints, b)
+			}
+			if err := tlsClient.PinCertificates(pin.ServerName, fingerprints); err != nil {
+				logrus.WithError(err).Warn("Couldn't pin key server certificates")
+				continue
+			}
+			logrus.WithFields(logrus.Fields{
+				"server_name":      pin.ServerName,
+				"num_certificates": len(fingerprints),
+			}).Info("Pinned key server certificates")
+		}
+		for _, override := range cfg.KeyServerOverrides {
+			tlsClient.SetServerOverride(override.ServerName, internal.KeyServerOverride{
+				TLSServerName: override.TLSServerName,
+				Host:          override.Host,
+			})
+			logrus.WithFields(logrus.Fields{
+				"server_name":     override.ServerName,
+				"tls_server_name": override.TLSServerName,
+				"host":            override.Host,
+			}).Info("Overriding key server SNI and Host")
+		}
+		fedClient = tlsClient
+	}
+
 	internalAPI := internal.ServerKeyAPI{
-		ServerName:        cfg.Matrix.ServerName,
-		ServerPublicKey:   cfg.Matrix.PrivateKey.Public().(ed25519.PublicKey),
-		ServerKeyID:       cfg.Matrix.KeyID,
-		ServerKeyValidity: cfg.Matrix.KeyValidityPeriod,
-		OldServerKeys:     cfg.Matrix.OldVerifyKeys,
-		FedClient:         fedClient,
+		ServerName:            cfg.Matrix.ServerName,
+		ServerPublicKey:       cfg.Matrix.PrivateKey.Public().(ed25519.PublicKey),
+		ServerKeyID:           cfg.Matrix.KeyID,
+		ServerKeyValidity:     cfg.Matrix.KeyValidityPeriod,
+		OldServerKeys:         cfg.Matrix.OldVerifyKeys,
+		KeyExpiryWarning:      cfg.KeyExpiryWarning,
+		FedClient:             fedClient,
+		AcceptedKeyAlgorithms: cfg.AcceptedKeyAlgorithms,
+		VerboseFetchLogging:   cfg.VerboseFetchLogging,
+		RolloverRetryDelay:    cfg.KeyRolloverRetryDelay,
+		NegativeCacheTTL:      cfg.NegativeCacheTTL,
+		PersistNegativeCache:  cfg.PersistNegativeCache,
 		OurKeyRing: gomatrixserverlib.KeyRing{
 			KeyFetchers: []gomatrixserverlib.KeyFetcher{},
 			KeyDatabase: serverKeyDB,
 		},
 	}
 
+	if err = internalAPI.ValidateLocalKeys(); err != nil {
+		logrus.WithError(err).Panicf("invalid server signing key configuration")
+	}
+
+	if cfg.KeyExpiryWarning > 0 {
+		internalAPI.StartKeyExpiryMonitor(context.Background(), time.Minute)
+	}
+
+	// Pick up any failed lookups that we remembered before a restart, so
+	// that we don't go straight back to asking for them.
+	if err = internalAPI.LoadNegativeCache(context.Background()); err != nil {
+		logrus.WithError(err).Warn("Failed to load negative key cache entries")
+	}
+	internalAPI.StartNegativeCacheGC(context.Background(), time.Hour)
+
+	// Ask the other instances in the deployment for keys before going out
+	// over federation for them.
+	if len(cfg.KeyServerPeers) > 0 {
+		peerClient := &http.Client{Timeout: time.Minute}
+		for _, peer := range cfg.KeyServerPeers {
+			fetcher, err := inthttp.NewPeerKeyFetcher(string(peer), peerClient)
+			if err != nil {
+				logrus.WithError(err).Warn("Couldn't add peer key fetcher")
+				continue
+			}
+			internalAPI.OurKeyRing.KeyFetchers = append(internalAPI.OurKeyRing.KeyFetchers, fetcher)
+			logrus.WithField("peer", peer).Info("Enabled peer key fetcher")
+		}
+	}
+
 	addDirectFetcher := func() {
 		internalAPI.OurKeyRing.KeyFetchers = append(
 			internalAPI.OurKeyRing.KeyFetchers,
-			&gomatrixserverlib.DirectKeyFetcher{
-				Client: fedClient,
+			internal.DirectKeyFetcher{
+				DirectKeyFetcher: &gomatrixserverlib.DirectKeyFetcher{
+					Client: fedClient,
+				},
 			},
 		)
 	}
@@ -74,12 +158,7 @@ func NewInternalAPI(
 
 	var b64e = base64.StdEncoding.WithPadding(base64.NoPadding)
 	for _, ps := range cfg.KeyPerspectives {
-		perspective := &gomatrixserverlib.PerspectiveKeyFetcher{
-			PerspectiveServerName: ps.ServerName,
-			PerspectiveServerKeys: map[gomatrixserverlib.KeyID]ed25519.PublicKey{},
-			Client:                fedClient,
-		}
-
+		keys := map[gomatrixserverlib.KeyID]ed25519.PublicKey{}
 		for _, key := range ps.Keys {
 			rawkey, err := b64e.DecodeString(key.PublicKey)
 			if err != nil {
@@ -89,17 +168,32 @@ func NewInternalAPI(
 				}).Warn("Couldn't parse perspective key")
 				continue
 			}
-			perspective.PerspectiveServerKeys[key.KeyID] = rawkey
+			keys[key.KeyID] = rawkey
 		}
 
-		internalAPI.OurKeyRing.KeyFetchers = append(
-			internalAPI.OurKeyRing.KeyFetchers,
-			perspective,
-		)
+		if cfg.PreferDirectFetch {
+			// Only fall back to the perspective server as a notary once
+			// the direct fetch has failed.
+			if err := internalAPI.AddNotaryServer(ps.ServerName, keys); err != nil {
+				logrus.WithError(err).Warn("Couldn't add perspective key fetcher")
+				continue
+			}
+		} else {
+			internalAPI.OurKeyRing.KeyFetchers = append(
+				internalAPI.OurKeyRing.KeyFetchers,
+				internal.PerspectiveKeyFetcher{
+					PerspectiveKeyFetcher: &gomatrixserverlib.PerspectiveKeyFetcher{
+						PerspectiveServerName: ps.ServerName,
+						PerspectiveServerKeys: keys,
+						Client:                fedClient,
+					},
+				},
+			)
+		}
 
 		logrus.WithFields(logrus.Fields{
 			"server_name":     ps.ServerName,
-			"num_public_keys": len(ps.Keys),
+			"num_public_keys": len(keys),
 		}).Info("Enabled perspective key fetcher")
 	}
 
@@ -5,17 +5,19 @@ import (
 	"errors"
 
 	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/signingkeyserver/api"
+	"github.com/matrix-org/dendrite/signingkeyserver/storage"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
 // A Database implements gomatrixserverlib.KeyDatabase and is used to store
 // the public keys for other matrix servers.
 type KeyDatabase struct {
-	inner gomatrixserverlib.KeyDatabase
+	inner storage.Database
 	cache caching.ServerKeyCache
 }
 
-func NewKeyDatabase(inner gomatrixserverlib.KeyDatabase, cache caching.ServerKeyCache) (*KeyDatabase, error) {
+func NewKeyDatabase(inner storage.Database, cache caching.ServerKeyCache) (*KeyDatabase, error) {
 	if inner == nil {
 		return nil, errors.New("inner database can't be nil")
 	}
@@ -66,3 +68,119 @@ func (d *KeyDatabase) StoreKeys(
 	}
 	return d.inner.StoreKeys(ctx, keyMap)
 }
+
+// StoreKeysFetchedAt stores the keys in both the cache and the database,
+// recording them as having been fetched at the given time.
+func (d *KeyDatabase) StoreKeysFetchedAt(
+	ctx context.Context,
+	keyMap map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	fetchedTS gomatrixserverlib.Timestamp,
+) error {
+	for req, res := range keyMap {
+		d.cache.StoreServerKey(req, res)
+	}
+	return d.inner.StoreKeysFetchedAt(ctx, keyMap, fetchedTS)
+}
+
+// DeleteKeys removes the keys from both the cache and the database.
+func (d *KeyDatabase) DeleteKeys(
+	ctx context.Context,
+	requests []gomatrixserverlib.PublicKeyLookupRequest,
+) error {
+	for _, req := range requests {
+		d.cache.EvictServerKey(req)
+	}
+	return d.inner.DeleteKeys(ctx, requests)
+}
+
+// AllKeys returns every key in the database. The cache only ever holds
+// keys that are also in the database, so it isn't consulted.
+func (d *KeyDatabase) AllKeys(
+	ctx context.Context,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	return d.inner.AllKeys(ctx)
+}
+
+// KeysAfter returns up to limit keys from the database, starting after
+// the given server name and key ID. As with AllKeys, the cache isn't
+// consulted.
+func (d *KeyDatabase) KeysAfter(
+	ctx context.Context,
+	after gomatrixserverlib.PublicKeyLookupRequest,
+	limit int,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	return d.inner.KeysAfter(ctx, after, limit)
+}
+
+// ServerNames returns the names of all of the servers that we have keys
+// for in the database.
+func (d *KeyDatabase) ServerNames(
+	ctx context.Context,
+) ([]gomatrixserverlib.ServerName, error) {
+	return d.inner.ServerNames(ctx)
+}
+
+// KeyMetadata returns the validity and fetch times of all of the keys that
+// we have for the given server in the database.
+func (d *KeyDatabase) KeyMetadata(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName,
+) ([]api.KeyMetadata, error) {
+	return d.inner.KeyMetadata(ctx, serverName)
+}
+
+// KeyFetchTimes returns when each of the given keys was last stored in the
+// database.
+func (d *KeyDatabase) KeyFetchTimes(
+	ctx context.Context,
+	requests []gomatrixserverlib.PublicKeyLookupRequest,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, error) {
+	return d.inner.KeyFetchTimes(ctx, requests)
+}
+
+// StoreKeyProvenance records that the given keys were just stored from
+// the named key fetcher at the given time.
+func (d *KeyDatabase) StoreKeyProvenance(
+	ctx context.Context,
+	requests []gomatrixserverlib.PublicKeyLookupRequest,
+	fetcherName string,
+	fetchedTS gomatrixserverlib.Timestamp,
+) error {
+	return d.inner.StoreKeyProvenance(ctx, requests, fetcherName, fetchedTS)
+}
+
+// KeyProvenance returns which key fetcher the given key was last stored
+// from and when, or nil if we don't know.
+func (d *KeyDatabase) KeyProvenance(
+	ctx context.Context,
+	request gomatrixserverlib.PublicKeyLookupRequest,
+) (*api.KeyProvenance, error) {
+	return d.inner.KeyProvenance(ctx, request)
+}
+
+// StoreNegativeCacheEntries records that we failed to fetch the given
+// keys. The cache only holds keys that we have, so it isn't affected.
+func (d *KeyDatabase) StoreNegativeCacheEntries(
+	ctx context.Context,
+	entries map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) error {
+	return d.inner.StoreNegativeCacheEntries(ctx, entries)
+}
+
+// NegativeCacheEntries returns all of the keys that we failed to fetch
+// and that we shouldn't try to fetch again until after now.
+func (d *KeyDatabase) NegativeCacheEntries(
+	ctx context.Context,
+	now gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, error) {
+	return d.inner.NegativeCacheEntries(ctx, now)
+}
+
+// DeleteExpiredNegativeCacheEntries removes any negative cache entries
+// that expired at or before the given time.
+func (d *KeyDatabase) DeleteExpiredNegativeCacheEntries(
+	ctx context.Context,
+	before gomatrixserverlib.Timestamp,
+) error {
+	return d.inner.DeleteExpiredNegativeCacheEntries(ctx, before)
+}
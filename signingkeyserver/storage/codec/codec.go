@@ -0,0 +1,101 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package codec contains the ways in which public keys can be encoded
+// for storage in the server key database.
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// A KeyCodec encodes public keys for storage in the server key database
+// and decodes them again. Every codec in this package can decode keys
+// that were encoded by any of the others, so the codec can be changed
+// without rewriting the keys that have already been stored.
+type KeyCodec interface {
+	Encode(key gomatrixserverlib.Base64Bytes) (string, error)
+	Decode(encoded string) (gomatrixserverlib.Base64Bytes, error)
+}
+
+// Default is the codec used by the key database unless another one has
+// been configured.
+var Default KeyCodec = Base64{}
+
+// gzipPrefix marks keys that have been encoded by Gzip. It can't appear
+// at the start of a base64-encoded key.
+const gzipPrefix = "gz:"
+
+// Base64 stores keys as unpadded base64.
+type Base64 struct{}
+
+// Encode implements KeyCodec
+func (Base64) Encode(key gomatrixserverlib.Base64Bytes) (string, error) {
+	return key.Encode(), nil
+}
+
+// Decode implements KeyCodec
+func (Base64) Decode(encoded string) (gomatrixserverlib.Base64Bytes, error) {
+	return decode(encoded)
+}
+
+// Gzip stores keys gzip-compressed and then base64-encoded.
+type Gzip struct{}
+
+// Encode implements KeyCodec
+func (Gzip) Encode(key gomatrixserverlib.Base64Bytes) (string, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(key); err != nil {
+		return "", fmt.Errorf("gzip.Write: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("gzip.Close: %w", err)
+	}
+	return gzipPrefix + gomatrixserverlib.Base64Bytes(buf.Bytes()).Encode(), nil
+}
+
+// Decode implements KeyCodec
+func (Gzip) Decode(encoded string) (gomatrixserverlib.Base64Bytes, error) {
+	return decode(encoded)
+}
+
+// decode decodes a key that was encoded by any of the codecs.
+func decode(encoded string) (gomatrixserverlib.Base64Bytes, error) {
+	if !strings.HasPrefix(encoded, gzipPrefix) {
+		var key gomatrixserverlib.Base64Bytes
+		err := key.Decode(encoded)
+		return key, err
+	}
+	var compressed gomatrixserverlib.Base64Bytes
+	if err := compressed.Decode(strings.TrimPrefix(encoded, gzipPrefix)); err != nil {
+		return nil, fmt.Errorf("compressed.Decode: %w", err)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("gzip.NewReader: %w", err)
+	}
+	defer r.Close() // nolint: errcheck
+	key, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("gzip.Read: %w", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,54 @@
+package codec
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestKeyCodecsRoundTrip(t *testing.T) {
+	key := gomatrixserverlib.Base64Bytes("a public key that is long enough to compress: aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	codecs := map[string]KeyCodec{
+		"base64": Base64{},
+		"gzip":   Gzip{},
+	}
+	for name, c := range codecs {
+		encoded, err := c.Encode(key)
+		if err != nil {
+			t.Fatalf("%s: Encode failed: %s", name, err)
+		}
+		// Every codec must be able to read keys written by any codec.
+		for otherName, other := range codecs {
+			decoded, err := other.Decode(encoded)
+			if err != nil {
+				t.Fatalf("%s: %s Decode failed: %s", name, otherName, err)
+			}
+			if !bytes.Equal(decoded, key) {
+				t.Fatalf("%s: %s Decode returned %q, want %q", name, otherName, decoded, key)
+			}
+		}
+	}
+}
+
+func TestGzipCodecCompresses(t *testing.T) {
+	key := gomatrixserverlib.Base64Bytes(strings.Repeat("a", 1024))
+	plain, _ := Base64{}.Encode(key)
+	compressed, err := Gzip{}.Encode(key)
+	if err != nil {
+		t.Fatalf("Encode failed: %s", err)
+	}
+	if !strings.HasPrefix(compressed, gzipPrefix) {
+		t.Fatalf("expected compressed key to start with %q, got %q", gzipPrefix, compressed)
+	}
+	if len(compressed) >= len(plain) {
+		t.Fatalf("expected compressed key to be smaller, got %d bytes vs %d", len(compressed), len(plain))
+	}
+}
+
+func TestDecodeRejectsCorruptKeys(t *testing.T) {
+	if _, err := (Gzip{}).Decode(gzipPrefix + "bm90IGd6aXA"); err == nil {
+		t.Fatalf("expected an error for a key that isn't gzipped")
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package inmemory provides a gomatrixserverlib.KeyDatabase that keeps keys
+// in memory, i.e. for unit tests that don't want to set up a real database.
+package inmemory
+
+import (
+	"context"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// A Database implements gomatrixserverlib.KeyDatabase by keeping the public
+// keys for other matrix servers in memory. Storing a key replaces any key
+// that was stored before for the same request, as with the SQL databases.
+// The zero value is an empty database, ready to use, and it is safe to use
+// from multiple goroutines.
+type Database struct {
+	// OnlyValid makes FetchKeys only return keys that were valid at the
+	// requested timestamps, in the same way as the key cache. Otherwise
+	// keys are returned whether they were valid or not, in the same way
+	// as the SQL databases, so that expired keys can still be used to
+	// verify old events.
+	OnlyValid bool
+	mutex     sync.RWMutex
+	keys      map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult
+}
+
+// NewDatabase returns an empty in-memory key database.
+func NewDatabase() *Database {
+	return &Database{
+		keys: make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult),
+	}
+}
+
+// FetcherName implements KeyFetcher
+func (d *Database) FetcherName() string {
+	return "InMemoryKeyDatabase"
+}
+
+// FetchKeys implements gomatrixserverlib.KeyDatabase
+func (d *Database) FetchKeys(
+	_ context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	results := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, len(requests))
+	for req, ts := range requests {
+		res, ok := d.keys[req]
+		if !ok {
+			continue
+		}
+		if d.OnlyValid && !res.WasValidAt(ts, true) {
+			continue
+		}
+		results[req] = res
+	}
+	return results, nil
+}
+
+// StoreKeys implements gomatrixserverlib.KeyDatabase
+func (d *Database) StoreKeys(
+	_ context.Context,
+	keyMap map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.keys == nil {
+		d.keys = make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult)
+	}
+	for req, res := range keyMap {
+		d.keys[req] = res
+	}
+	return nil
+}
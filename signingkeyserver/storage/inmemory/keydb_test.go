@@ -0,0 +1,93 @@
+package inmemory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var _ gomatrixserverlib.KeyDatabase = &Database{}
+
+func testKey(key string, validUntil time.Time, expired gomatrixserverlib.Timestamp) gomatrixserverlib.PublicKeyLookupResult {
+	return gomatrixserverlib.PublicKeyLookupResult{
+		VerifyKey: gomatrixserverlib.VerifyKey{
+			Key: gomatrixserverlib.Base64Bytes(key),
+		},
+		ExpiredTS:    expired,
+		ValidUntilTS: gomatrixserverlib.AsTimestamp(validUntil),
+	}
+}
+
+func TestStoreAndFetchKeys(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	current := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:current"}
+	old := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:old"}
+	unknown := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "other.com", KeyID: "ed25519:current"}
+
+	var db Database
+	if err := db.StoreKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		current: testKey("first", now.Add(time.Hour), gomatrixserverlib.PublicKeyNotExpired),
+		old:     testKey("old", now.Add(-time.Hour), gomatrixserverlib.PublicKeyNotExpired),
+	}); err != nil {
+		t.Fatalf("StoreKeys failed: %s", err)
+	}
+
+	// Storing a key again replaces the one we had.
+	if err := db.StoreKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		current: testKey("second", now.Add(time.Hour*2), gomatrixserverlib.PublicKeyNotExpired),
+	}); err != nil {
+		t.Fatalf("StoreKeys failed: %s", err)
+	}
+
+	requests := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		current: gomatrixserverlib.AsTimestamp(now),
+		old:     gomatrixserverlib.AsTimestamp(now),
+		unknown: gomatrixserverlib.AsTimestamp(now),
+	}
+	results, err := db.FetchKeys(ctx, requests)
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if got := string(results[current].Key); got != "second" {
+		t.Fatalf("expected the key to have been replaced, got %q", got)
+	}
+	// By default keys are returned even if they weren't valid at the
+	// requested time.
+	if got := string(results[old].Key); got != "old" {
+		t.Fatalf("expected the expired key to be returned, got %q", got)
+	}
+	if _, ok := results[unknown]; ok {
+		t.Fatalf("expected no result for a key that was never stored")
+	}
+	if len(requests) != 3 {
+		t.Fatalf("expected FetchKeys not to modify the requests")
+	}
+
+	// With OnlyValid set, keys that weren't valid at the requested time
+	// are left out.
+	db.OnlyValid = true
+	results, err = db.FetchKeys(ctx, requests)
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if _, ok := results[old]; ok {
+		t.Fatalf("expected the expired key to be left out")
+	}
+	if _, ok := results[current]; !ok {
+		t.Fatalf("expected the valid key to be returned")
+	}
+
+	// The same key is returned if we ask about a time that it was valid.
+	results, err = db.FetchKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		old: gomatrixserverlib.AsTimestamp(now.Add(-time.Hour * 2)),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if got := string(results[old].Key); got != "old" {
+		t.Fatalf("expected the key to be returned for a time that it was valid, got %q", got)
+	}
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 
+	"github.com/matrix-org/dendrite/signingkeyserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -10,4 +11,16 @@ type Database interface {
 	FetcherName() string
 	FetchKeys(ctx context.Context, requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error)
 	StoreKeys(ctx context.Context, keyMap map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult) error
+	StoreKeysFetchedAt(ctx context.Context, keyMap map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, fetchedTS gomatrixserverlib.Timestamp) error
+	DeleteKeys(ctx context.Context, requests []gomatrixserverlib.PublicKeyLookupRequest) error
+	AllKeys(ctx context.Context) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error)
+	KeysAfter(ctx context.Context, after gomatrixserverlib.PublicKeyLookupRequest, limit int) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error)
+	ServerNames(ctx context.Context) ([]gomatrixserverlib.ServerName, error)
+	KeyMetadata(ctx context.Context, serverName gomatrixserverlib.ServerName) ([]api.KeyMetadata, error)
+	KeyFetchTimes(ctx context.Context, requests []gomatrixserverlib.PublicKeyLookupRequest) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, error)
+	StoreKeyProvenance(ctx context.Context, requests []gomatrixserverlib.PublicKeyLookupRequest, fetcherName string, fetchedTS gomatrixserverlib.Timestamp) error
+	KeyProvenance(ctx context.Context, request gomatrixserverlib.PublicKeyLookupRequest) (*api.KeyProvenance, error)
+	StoreNegativeCacheEntries(ctx context.Context, entries map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp) error
+	NegativeCacheEntries(ctx context.Context, now gomatrixserverlib.Timestamp) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, error)
+	DeleteExpiredNegativeCacheEntries(ctx context.Context, before gomatrixserverlib.Timestamp) error
 }
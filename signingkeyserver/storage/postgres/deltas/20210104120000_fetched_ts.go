@@ -0,0 +1,33 @@
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/pressly/goose"
+)
+
+func LoadFromGoose() {
+	goose.AddMigration(UpFetchedTS, DownFetchedTS)
+}
+
+func LoadFetchedTS(m *sqlutil.Migrations) {
+	m.AddMigration(UpFetchedTS, DownFetchedTS)
+}
+
+func UpFetchedTS(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE keydb_server_keys ADD COLUMN IF NOT EXISTS fetched_ts BIGINT NOT NULL DEFAULT 0;")
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownFetchedTS(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE keydb_server_keys DROP COLUMN fetched_ts;")
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/signingkeyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const keyProvenanceSchema = `
+-- Where each of the keys in keydb_server_keys was last stored from, so
+-- that operators can see why a particular key is being served.
+CREATE TABLE IF NOT EXISTS keydb_key_provenance (
+	-- The name of the matrix server the key is for.
+	server_name TEXT NOT NULL,
+	-- The ID of the server key.
+	server_key_id TEXT NOT NULL,
+	-- The name of the key fetcher that the key was last stored from.
+	fetcher_name TEXT NOT NULL,
+	-- When the key was last stored from the fetcher as a millisecond timestamp.
+	fetched_ts BIGINT NOT NULL,
+	CONSTRAINT keydb_key_provenance_unique UNIQUE (server_name, server_key_id)
+);
+`
+
+const upsertKeyProvenanceSQL = "" +
+	"INSERT INTO keydb_key_provenance (server_name, server_key_id, fetcher_name, fetched_ts)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT ON CONSTRAINT keydb_key_provenance_unique" +
+	" DO UPDATE SET fetcher_name = $3, fetched_ts = $4"
+
+const selectKeyProvenanceSQL = "" +
+	"SELECT fetcher_name, fetched_ts FROM keydb_key_provenance" +
+	" WHERE server_name = $1 AND server_key_id = $2"
+
+const deleteKeyProvenanceSQL = "" +
+	"DELETE FROM keydb_key_provenance WHERE server_name = $1 AND server_key_id = $2"
+
+type keyProvenanceStatements struct {
+	upsertKeyProvenanceStmt *sql.Stmt
+	selectKeyProvenanceStmt *sql.Stmt
+	deleteKeyProvenanceStmt *sql.Stmt
+}
+
+func (s *keyProvenanceStatements) execSchema(db *sql.DB) error {
+	_, err := db.Exec(keyProvenanceSchema)
+	return err
+}
+
+func (s *keyProvenanceStatements) prepare(db *sql.DB) (err error) {
+	if s.upsertKeyProvenanceStmt, err = db.Prepare(upsertKeyProvenanceSQL); err != nil {
+		return
+	}
+	if s.selectKeyProvenanceStmt, err = db.Prepare(selectKeyProvenanceSQL); err != nil {
+		return
+	}
+	if s.deleteKeyProvenanceStmt, err = db.Prepare(deleteKeyProvenanceSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *keyProvenanceStatements) upsertKeyProvenance(
+	ctx context.Context,
+	requests []gomatrixserverlib.PublicKeyLookupRequest,
+	fetcherName string,
+	fetchedTS gomatrixserverlib.Timestamp,
+) error {
+	for _, request := range requests {
+		if _, err := s.upsertKeyProvenanceStmt.ExecContext(
+			ctx,
+			string(request.ServerName),
+			string(request.KeyID),
+			fetcherName,
+			fetchedTS,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *keyProvenanceStatements) selectKeyProvenance(
+	ctx context.Context,
+	request gomatrixserverlib.PublicKeyLookupRequest,
+) (*api.KeyProvenance, error) {
+	var fetcherName string
+	var fetchedTS int64
+	err := s.selectKeyProvenanceStmt.QueryRowContext(
+		ctx, string(request.ServerName), string(request.KeyID),
+	).Scan(&fetcherName, &fetchedTS)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &api.KeyProvenance{
+		FetcherName: fetcherName,
+		FetchedTS:   gomatrixserverlib.Timestamp(fetchedTS),
+	}, nil
+}
+
+func (s *keyProvenanceStatements) deleteKeyProvenance(
+	ctx context.Context,
+	request gomatrixserverlib.PublicKeyLookupRequest,
+) error {
+	_, err := s.deleteKeyProvenanceStmt.ExecContext(
+		ctx, string(request.ServerName), string(request.KeyID),
+	)
+	return err
+}
@@ -17,18 +17,24 @@ package postgres
 
 import (
 	"context"
+	"time"
 
 	"golang.org/x/crypto/ed25519"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/signingkeyserver/api"
+	"github.com/matrix-org/dendrite/signingkeyserver/storage/codec"
+	"github.com/matrix-org/dendrite/signingkeyserver/storage/postgres/deltas"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
 // A Database implements gomatrixserverlib.KeyDatabase and is used to store
 // the public keys for other matrix servers.
 type Database struct {
-	statements serverKeyStatements
+	statements    serverKeyStatements
+	negativeCache negativeCacheStatements
+	keyProvenance keyProvenanceStatements
 }
 
 // NewDatabase prepares a new key database.
@@ -46,13 +52,42 @@ func NewDatabase(
 		return nil, err
 	}
 	d := &Database{}
+	d.statements.codec = codec.Default
+	// Create tables before executing migrations so we don't fail if the table is missing,
+	// and THEN prepare statements so we don't fail due to referencing new columns
+	if err = d.statements.execSchema(db); err != nil {
+		return nil, err
+	}
+	if err = d.negativeCache.execSchema(db); err != nil {
+		return nil, err
+	}
+	if err = d.keyProvenance.execSchema(db); err != nil {
+		return nil, err
+	}
+	m := sqlutil.NewMigrations()
+	deltas.LoadFetchedTS(m)
+	if err = m.RunDeltas(db, dbProperties); err != nil {
+		return nil, err
+	}
 	err = d.statements.prepare(db)
 	if err != nil {
 		return nil, err
 	}
+	if err = d.negativeCache.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.keyProvenance.prepare(db); err != nil {
+		return nil, err
+	}
 	return d, nil
 }
 
+// SetKeyCodec changes how keys are encoded when they are stored. Keys
+// that have already been stored can still be read whatever the codec.
+func (d *Database) SetKeyCodec(c codec.KeyCodec) {
+	d.statements.codec = c
+}
+
 // FetcherName implements KeyFetcher
 func (d Database) FetcherName() string {
 	return "PostgresKeyDatabase"
@@ -66,17 +101,32 @@ func (d *Database) FetchKeys(
 	return d.statements.bulkSelectServerKeys(ctx, requests)
 }
 
-// StoreKeys implements gomatrixserverlib.KeyDatabase
+// StoreKeys implements gomatrixserverlib.KeyDatabase. Each key is upserted
+// by server name and key ID, so storing a key never drops any of the other
+// keys that we have for the same server. The keys are recorded as having
+// been fetched now.
 func (d *Database) StoreKeys(
 	ctx context.Context,
 	keyMap map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	return d.StoreKeysFetchedAt(ctx, keyMap, gomatrixserverlib.AsTimestamp(time.Now()))
+}
+
+// StoreKeysFetchedAt stores the keys in the same way as StoreKeys, but
+// records them as having been fetched at the given time. A zero fetchedTS
+// keeps the fetch time that we already have for each key, i.e. when the
+// keys are being imported rather than fetched.
+func (d *Database) StoreKeysFetchedAt(
+	ctx context.Context,
+	keyMap map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	fetchedTS gomatrixserverlib.Timestamp,
 ) error {
 	// TODO: Inserting all the keys within a single transaction may
 	// be more efficient since the transaction overhead can be quite
 	// high for a single insert statement.
 	var lastErr error
 	for request, keys := range keyMap {
-		if err := d.statements.upsertServerKeys(ctx, request, keys); err != nil {
+		if err := d.statements.upsertServerKeys(ctx, request, keys, fetchedTS); err != nil {
 			// Rather than returning immediately on error we try to insert the
 			// remaining keys.
 			// Since we are inserting the keys outside of a transaction it is
@@ -89,3 +139,116 @@ func (d *Database) StoreKeys(
 	}
 	return lastErr
 }
+
+// DeleteKeys removes the given keys from the database, if we have them,
+// along with where they came from.
+func (d *Database) DeleteKeys(
+	ctx context.Context,
+	requests []gomatrixserverlib.PublicKeyLookupRequest,
+) error {
+	var lastErr error
+	for _, request := range requests {
+		if err := d.statements.deleteServerKeys(ctx, request); err != nil {
+			// As with StoreKeys, try to delete the remaining keys anyway.
+			lastErr = err
+			continue
+		}
+		if err := d.keyProvenance.deleteKeyProvenance(ctx, request); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// AllKeys returns every key in the database.
+func (d *Database) AllKeys(
+	ctx context.Context,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	return d.statements.selectAllServerKeys(ctx)
+}
+
+// KeysAfter returns up to limit keys from the database, starting with the
+// first one after the given server name and key ID in order, so that all
+// of the keys can be paged through without loading them all at once. An
+// empty request starts from the beginning.
+func (d *Database) KeysAfter(
+	ctx context.Context,
+	after gomatrixserverlib.PublicKeyLookupRequest,
+	limit int,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	return d.statements.selectServerKeysAfter(ctx, after, limit)
+}
+
+// ServerNames returns the names of all of the servers that we have keys
+// for in the database.
+func (d *Database) ServerNames(
+	ctx context.Context,
+) ([]gomatrixserverlib.ServerName, error) {
+	return d.statements.selectServerNames(ctx)
+}
+
+// KeyMetadata returns the validity and fetch times of all of the keys that
+// we have for the given server in the database.
+func (d *Database) KeyMetadata(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName,
+) ([]api.KeyMetadata, error) {
+	return d.statements.selectKeyMetadata(ctx, serverName)
+}
+
+// KeyFetchTimes returns when each of the given keys was last stored, for
+// those keys that we have, all at once. Keys stored before fetch times were
+// recorded are reported with a zero timestamp.
+func (d *Database) KeyFetchTimes(
+	ctx context.Context,
+	requests []gomatrixserverlib.PublicKeyLookupRequest,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, error) {
+	return d.statements.bulkSelectFetchedTS(ctx, requests)
+}
+
+// StoreKeyProvenance records that the given keys were just stored from
+// the named key fetcher at the given time.
+func (d *Database) StoreKeyProvenance(
+	ctx context.Context,
+	requests []gomatrixserverlib.PublicKeyLookupRequest,
+	fetcherName string,
+	fetchedTS gomatrixserverlib.Timestamp,
+) error {
+	return d.keyProvenance.upsertKeyProvenance(ctx, requests, fetcherName, fetchedTS)
+}
+
+// KeyProvenance returns which key fetcher the given key was last stored
+// from and when, or nil if we don't know.
+func (d *Database) KeyProvenance(
+	ctx context.Context,
+	request gomatrixserverlib.PublicKeyLookupRequest,
+) (*api.KeyProvenance, error) {
+	return d.keyProvenance.selectKeyProvenance(ctx, request)
+}
+
+// StoreNegativeCacheEntries records that we failed to fetch the given
+// keys, along with when we should next try to fetch each of them.
+func (d *Database) StoreNegativeCacheEntries(
+	ctx context.Context,
+	entries map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) error {
+	return d.negativeCache.upsertNegativeCacheEntries(ctx, entries)
+}
+
+// NegativeCacheEntries returns all of the keys that we failed to fetch
+// and that we shouldn't try to fetch again until after now.
+func (d *Database) NegativeCacheEntries(
+	ctx context.Context,
+	now gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, error) {
+	return d.negativeCache.selectNegativeCacheEntries(ctx, now)
+}
+
+// DeleteExpiredNegativeCacheEntries removes any negative cache entries
+// that expired at or before the given time.
+func (d *Database) DeleteExpiredNegativeCacheEntries(
+	ctx context.Context,
+	before gomatrixserverlib.Timestamp,
+) error {
+	return d.negativeCache.deleteExpiredNegativeCacheEntries(ctx, before)
+}
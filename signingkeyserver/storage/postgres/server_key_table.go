@@ -21,6 +21,8 @@ import (
 
 	"github.com/lib/pq"
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/signingkeyserver/api"
+	"github.com/matrix-org/dendrite/signingkeyserver/storage/codec"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -42,6 +44,9 @@ CREATE TABLE IF NOT EXISTS keydb_server_keys (
 	expired_ts BIGINT NOT NULL,
 	-- The base64-encoded public key.
 	server_key TEXT NOT NULL,
+	-- When the key was last stored, i.e. fetched, as a millisecond timestamp.
+	-- 0 if the key was stored before this was recorded.
+	fetched_ts BIGINT NOT NULL DEFAULT 0,
 	CONSTRAINT keydb_server_keys_unique UNIQUE (server_name, server_key_id)
 );
 
@@ -55,27 +60,78 @@ const bulkSelectServerKeysSQL = "" +
 
 const upsertServerKeysSQL = "" +
 	"INSERT INTO keydb_server_keys (server_name, server_key_id," +
-	" server_name_and_key_id, valid_until_ts, expired_ts, server_key)" +
-	" VALUES ($1, $2, $3, $4, $5, $6)" +
+	" server_name_and_key_id, valid_until_ts, expired_ts, server_key, fetched_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7)" +
 	" ON CONFLICT ON CONSTRAINT keydb_server_keys_unique" +
-	" DO UPDATE SET valid_until_ts = $4, expired_ts = $5, server_key = $6"
+	" DO UPDATE SET valid_until_ts = $4, expired_ts = $5, server_key = $6," +
+	" fetched_ts = CASE WHEN $7 = 0 THEN keydb_server_keys.fetched_ts ELSE $7 END"
+
+const selectAllServerKeysSQL = "" +
+	"SELECT server_name, server_key_id, valid_until_ts, expired_ts, " +
+	"   server_key FROM keydb_server_keys"
+
+const selectServerKeysAfterSQL = "" +
+	"SELECT server_name, server_key_id, valid_until_ts, expired_ts, " +
+	"   server_key FROM keydb_server_keys" +
+	" WHERE server_name > $1 OR (server_name = $1 AND server_key_id > $2)" +
+	" ORDER BY server_name, server_key_id LIMIT $3"
+
+const selectServerNamesSQL = "" +
+	"SELECT DISTINCT server_name FROM keydb_server_keys ORDER BY server_name"
+
+const selectKeyMetadataSQL = "" +
+	"SELECT server_key_id, valid_until_ts, expired_ts, fetched_ts" +
+	" FROM keydb_server_keys WHERE server_name = $1 ORDER BY server_key_id"
+
+const bulkSelectFetchedTSSQL = "" +
+	"SELECT server_name, server_key_id, fetched_ts FROM keydb_server_keys" +
+	" WHERE server_name_and_key_id = ANY($1)"
+
+const deleteServerKeysSQL = "" +
+	"DELETE FROM keydb_server_keys WHERE server_name = $1 AND server_key_id = $2"
 
 type serverKeyStatements struct {
 	bulkSelectServerKeysStmt *sql.Stmt
+	bulkSelectFetchedTSStmt  *sql.Stmt
 	upsertServerKeysStmt     *sql.Stmt
+	deleteServerKeysStmt     *sql.Stmt
+	selectAllServerKeysStmt  *sql.Stmt
+	selectKeysAfterStmt      *sql.Stmt
+	selectServerNamesStmt    *sql.Stmt
+	selectKeyMetadataStmt    *sql.Stmt
+	codec                    codec.KeyCodec
+}
+
+func (s *serverKeyStatements) execSchema(db *sql.DB) error {
+	_, err := db.Exec(serverKeysSchema)
+	return err
 }
 
 func (s *serverKeyStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(serverKeysSchema)
-	if err != nil {
+	if s.bulkSelectServerKeysStmt, err = db.Prepare(bulkSelectServerKeysSQL); err != nil {
 		return
 	}
-	if s.bulkSelectServerKeysStmt, err = db.Prepare(bulkSelectServerKeysSQL); err != nil {
+	if s.bulkSelectFetchedTSStmt, err = db.Prepare(bulkSelectFetchedTSSQL); err != nil {
 		return
 	}
 	if s.upsertServerKeysStmt, err = db.Prepare(upsertServerKeysSQL); err != nil {
 		return
 	}
+	if s.deleteServerKeysStmt, err = db.Prepare(deleteServerKeysSQL); err != nil {
+		return
+	}
+	if s.selectAllServerKeysStmt, err = db.Prepare(selectAllServerKeysSQL); err != nil {
+		return
+	}
+	if s.selectKeysAfterStmt, err = db.Prepare(selectServerKeysAfterSQL); err != nil {
+		return
+	}
+	if s.selectServerNamesStmt, err = db.Prepare(selectServerNamesSQL); err != nil {
+		return
+	}
+	if s.selectKeyMetadataStmt, err = db.Prepare(selectKeyMetadataSQL); err != nil {
+		return
+	}
 	return
 }
 
@@ -108,7 +164,7 @@ func (s *serverKeyStatements) bulkSelectServerKeys(
 			KeyID:      gomatrixserverlib.KeyID(keyID),
 		}
 		vk := gomatrixserverlib.VerifyKey{}
-		err = vk.Key.Decode(key)
+		vk.Key, err = s.codec.Decode(key)
 		if err != nil {
 			return nil, err
 		}
@@ -121,23 +177,171 @@ func (s *serverKeyStatements) bulkSelectServerKeys(
 	return results, rows.Err()
 }
 
+func (s *serverKeyStatements) bulkSelectFetchedTS(
+	ctx context.Context,
+	requests []gomatrixserverlib.PublicKeyLookupRequest,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, error) {
+	nameAndKeyIDs := make([]string, 0, len(requests))
+	for _, request := range requests {
+		nameAndKeyIDs = append(nameAndKeyIDs, nameAndKeyID(request))
+	}
+	rows, err := s.bulkSelectFetchedTSStmt.QueryContext(ctx, pq.StringArray(nameAndKeyIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "bulkSelectFetchedTS: rows.close() failed")
+	results := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, len(requests))
+	for rows.Next() {
+		var serverName string
+		var keyID string
+		var fetchedTS int64
+		if err = rows.Scan(&serverName, &keyID, &fetchedTS); err != nil {
+			return nil, err
+		}
+		r := gomatrixserverlib.PublicKeyLookupRequest{
+			ServerName: gomatrixserverlib.ServerName(serverName),
+			KeyID:      gomatrixserverlib.KeyID(keyID),
+		}
+		results[r] = gomatrixserverlib.Timestamp(fetchedTS)
+	}
+	return results, rows.Err()
+}
+
 func (s *serverKeyStatements) upsertServerKeys(
 	ctx context.Context,
 	request gomatrixserverlib.PublicKeyLookupRequest,
 	key gomatrixserverlib.PublicKeyLookupResult,
+	fetchedTS gomatrixserverlib.Timestamp,
 ) error {
-	_, err := s.upsertServerKeysStmt.ExecContext(
+	encodedKey, err := s.codec.Encode(key.Key)
+	if err != nil {
+		return err
+	}
+	_, err = s.upsertServerKeysStmt.ExecContext(
 		ctx,
 		string(request.ServerName),
 		string(request.KeyID),
 		nameAndKeyID(request),
 		key.ValidUntilTS,
 		key.ExpiredTS,
-		key.Key.Encode(),
+		encodedKey,
+		fetchedTS,
 	)
 	return err
 }
 
+func (s *serverKeyStatements) deleteServerKeys(
+	ctx context.Context,
+	request gomatrixserverlib.PublicKeyLookupRequest,
+) error {
+	_, err := s.deleteServerKeysStmt.ExecContext(
+		ctx,
+		string(request.ServerName),
+		string(request.KeyID),
+	)
+	return err
+}
+
+func (s *serverKeyStatements) selectAllServerKeys(
+	ctx context.Context,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	rows, err := s.selectAllServerKeysStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectAllServerKeys: rows.close() failed")
+	return s.scanServerKeys(rows)
+}
+
+func (s *serverKeyStatements) selectServerKeysAfter(
+	ctx context.Context,
+	after gomatrixserverlib.PublicKeyLookupRequest,
+	limit int,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	rows, err := s.selectKeysAfterStmt.QueryContext(ctx, string(after.ServerName), string(after.KeyID), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectServerKeysAfter: rows.close() failed")
+	return s.scanServerKeys(rows)
+}
+
+func (s *serverKeyStatements) scanServerKeys(
+	rows *sql.Rows,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for rows.Next() {
+		var serverName string
+		var keyID string
+		var key string
+		var validUntilTS int64
+		var expiredTS int64
+		var err error
+		if err = rows.Scan(&serverName, &keyID, &validUntilTS, &expiredTS, &key); err != nil {
+			return nil, err
+		}
+		r := gomatrixserverlib.PublicKeyLookupRequest{
+			ServerName: gomatrixserverlib.ServerName(serverName),
+			KeyID:      gomatrixserverlib.KeyID(keyID),
+		}
+		vk := gomatrixserverlib.VerifyKey{}
+		if vk.Key, err = s.codec.Decode(key); err != nil {
+			return nil, err
+		}
+		results[r] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey:    vk,
+			ValidUntilTS: gomatrixserverlib.Timestamp(validUntilTS),
+			ExpiredTS:    gomatrixserverlib.Timestamp(expiredTS),
+		}
+	}
+	return results, rows.Err()
+}
+
+func (s *serverKeyStatements) selectServerNames(
+	ctx context.Context,
+) ([]gomatrixserverlib.ServerName, error) {
+	rows, err := s.selectServerNamesStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectServerNames: rows.close() failed")
+	var serverNames []gomatrixserverlib.ServerName
+	for rows.Next() {
+		var serverName string
+		if err = rows.Scan(&serverName); err != nil {
+			return nil, err
+		}
+		serverNames = append(serverNames, gomatrixserverlib.ServerName(serverName))
+	}
+	return serverNames, rows.Err()
+}
+
+func (s *serverKeyStatements) selectKeyMetadata(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName,
+) ([]api.KeyMetadata, error) {
+	rows, err := s.selectKeyMetadataStmt.QueryContext(ctx, string(serverName))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectKeyMetadata: rows.close() failed")
+	var metadata []api.KeyMetadata
+	for rows.Next() {
+		var keyID string
+		var validUntilTS, expiredTS, fetchedTS int64
+		if err = rows.Scan(&keyID, &validUntilTS, &expiredTS, &fetchedTS); err != nil {
+			return nil, err
+		}
+		metadata = append(metadata, api.KeyMetadata{
+			KeyID:        gomatrixserverlib.KeyID(keyID),
+			ValidUntilTS: gomatrixserverlib.Timestamp(validUntilTS),
+			ExpiredTS:    gomatrixserverlib.Timestamp(expiredTS),
+			FetchedTS:    gomatrixserverlib.Timestamp(fetchedTS),
+		})
+	}
+	return metadata, rows.Err()
+}
+
 func nameAndKeyID(request gomatrixserverlib.PublicKeyLookupRequest) string {
 	return string(request.ServerName) + "\x1F" + string(request.KeyID)
 }
@@ -0,0 +1,72 @@
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/pressly/goose"
+)
+
+func LoadFromGoose() {
+	goose.AddMigration(UpFetchedTS, DownFetchedTS)
+}
+
+func LoadFetchedTS(m *sqlutil.Migrations) {
+	m.AddMigration(UpFetchedTS, DownFetchedTS)
+}
+
+func UpFetchedTS(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	ALTER TABLE keydb_server_keys RENAME TO keydb_server_keys_tmp;
+CREATE TABLE keydb_server_keys (
+	server_name TEXT NOT NULL,
+	server_key_id TEXT NOT NULL,
+	server_name_and_key_id TEXT NOT NULL,
+	valid_until_ts BIGINT NOT NULL,
+	expired_ts BIGINT NOT NULL,
+	server_key TEXT NOT NULL,
+	fetched_ts BIGINT NOT NULL DEFAULT 0,
+	UNIQUE (server_name, server_key_id)
+);
+INSERT
+    INTO keydb_server_keys (
+      server_name, server_key_id, server_name_and_key_id, valid_until_ts, expired_ts, server_key
+    ) SELECT
+        server_name, server_key_id, server_name_and_key_id, valid_until_ts, expired_ts, server_key
+    FROM keydb_server_keys_tmp
+;
+DROP TABLE keydb_server_keys_tmp;
+CREATE INDEX IF NOT EXISTS keydb_server_name_and_key_id ON keydb_server_keys (server_name_and_key_id);`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownFetchedTS(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	ALTER TABLE keydb_server_keys RENAME TO keydb_server_keys_tmp;
+CREATE TABLE keydb_server_keys (
+	server_name TEXT NOT NULL,
+	server_key_id TEXT NOT NULL,
+	server_name_and_key_id TEXT NOT NULL,
+	valid_until_ts BIGINT NOT NULL,
+	expired_ts BIGINT NOT NULL,
+	server_key TEXT NOT NULL,
+	UNIQUE (server_name, server_key_id)
+);
+INSERT
+    INTO keydb_server_keys (
+      server_name, server_key_id, server_name_and_key_id, valid_until_ts, expired_ts, server_key
+    ) SELECT
+        server_name, server_key_id, server_name_and_key_id, valid_until_ts, expired_ts, server_key
+    FROM keydb_server_keys_tmp
+;
+DROP TABLE keydb_server_keys_tmp;
+CREATE INDEX IF NOT EXISTS keydb_server_name_and_key_id ON keydb_server_keys (server_name_and_key_id);`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,360 @@
+package sqlite3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/signingkeyserver/storage/codec"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func mustCreateDatabase(t *testing.T) (*Database, func()) {
+	tmpfile, err := ioutil.TempFile("", "signingkeyserver_storage_test")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %s", err)
+	}
+	db, err := NewDatabase(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(fmt.Sprintf("file://%s", tmpfile.Name())),
+	}, "localhost", nil, "ed25519:auto")
+	if err != nil {
+		t.Fatalf("failed to create database: %s", err)
+	}
+	return db, func() {
+		os.Remove(tmpfile.Name()) // nolint: errcheck
+	}
+}
+
+func TestStoreKeysRoundTrip(t *testing.T) {
+	req := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:auto"}
+	key := gomatrixserverlib.PublicKeyLookupResult{
+		VerifyKey: gomatrixserverlib.VerifyKey{
+			Key: gomatrixserverlib.Base64Bytes("remote-public-key"),
+		},
+		ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+		ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour)),
+	}
+
+	for _, compress := range []bool{false, true} {
+		db, closeDB := mustCreateDatabase(t)
+		if compress {
+			db.SetKeyCodec(codec.Gzip{})
+		}
+		ctx := context.Background()
+		if err := db.StoreKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			req: key,
+		}); err != nil {
+			t.Fatalf("compress=%v: StoreKeys failed: %s", compress, err)
+		}
+
+		res, err := db.FetchKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{req: 0})
+		if err != nil {
+			t.Fatalf("compress=%v: FetchKeys failed: %s", compress, err)
+		}
+		got, ok := res[req]
+		if !ok {
+			t.Fatalf("compress=%v: stored key not found", compress)
+		}
+		if !bytes.Equal(got.Key, key.Key) || got.ValidUntilTS != key.ValidUntilTS || got.ExpiredTS != key.ExpiredTS {
+			t.Fatalf("compress=%v: got %+v, want %+v", compress, got, key)
+		}
+
+		// Keys stored with one codec can be read after switching codecs.
+		db.SetKeyCodec(codec.Default)
+		all, err := db.AllKeys(ctx)
+		if err != nil {
+			t.Fatalf("compress=%v: AllKeys failed: %s", compress, err)
+		}
+		if !bytes.Equal(all[req].Key, key.Key) {
+			t.Fatalf("compress=%v: AllKeys returned %q after switching codecs, want %q", compress, all[req].Key, key.Key)
+		}
+		closeDB()
+	}
+}
+
+func TestStoreKeysMergesPerKeyID(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	ctx := context.Background()
+
+	first := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:first"}
+	second := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:second"}
+	keys := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for _, req := range []gomatrixserverlib.PublicKeyLookupRequest{first, second} {
+		keys[req] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey: gomatrixserverlib.VerifyKey{
+				Key: gomatrixserverlib.Base64Bytes(req.KeyID),
+			},
+			ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+			ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour)),
+		}
+		// Store each key separately, as two fetchers would.
+		if err := db.StoreKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			req: keys[req],
+		}); err != nil {
+			t.Fatalf("StoreKeys failed: %s", err)
+		}
+	}
+
+	res, err := db.FetchKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		first:  0,
+		second: 0,
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	for req, want := range keys {
+		got, ok := res[req]
+		if !ok {
+			t.Fatalf("key %q was dropped", req.KeyID)
+		}
+		if !bytes.Equal(got.Key, want.Key) {
+			t.Fatalf("key %q: got %q, want %q", req.KeyID, got.Key, want.Key)
+		}
+	}
+}
+
+func TestKeysAfter(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	ctx := context.Background()
+
+	keys := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for _, req := range []gomatrixserverlib.PublicKeyLookupRequest{
+		{ServerName: "a.com", KeyID: "ed25519:1"},
+		{ServerName: "a.com", KeyID: "ed25519:2"},
+		{ServerName: "b.com", KeyID: "ed25519:1"},
+		{ServerName: "c.com", KeyID: "ed25519:1"},
+		{ServerName: "c.com", KeyID: "ed25519:2"},
+	} {
+		keys[req] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey: gomatrixserverlib.VerifyKey{
+				Key: gomatrixserverlib.Base64Bytes(string(req.ServerName) + req.KeyID),
+			},
+			ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+			ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour)),
+		}
+	}
+	if err := db.StoreKeys(ctx, keys); err != nil {
+		t.Fatalf("StoreKeys failed: %s", err)
+	}
+
+	seen := map[gomatrixserverlib.PublicKeyLookupRequest]bool{}
+	var after gomatrixserverlib.PublicKeyLookupRequest
+	for _, want := range []gomatrixserverlib.PublicKeyLookupRequest{
+		{ServerName: "a.com", KeyID: "ed25519:2"},
+		{ServerName: "c.com", KeyID: "ed25519:1"},
+		{ServerName: "c.com", KeyID: "ed25519:2"},
+	} {
+		page, err := db.KeysAfter(ctx, after, 2)
+		if err != nil {
+			t.Fatalf("KeysAfter failed: %s", err)
+		}
+		for req, res := range page {
+			if seen[req] {
+				t.Fatalf("key %+v returned more than once", req)
+			}
+			seen[req] = true
+			if !bytes.Equal(res.Key, keys[req].Key) {
+				t.Fatalf("key %+v: got %q, want %q", req, res.Key, keys[req].Key)
+			}
+		}
+		if _, ok := page[want]; !ok {
+			t.Fatalf("expected page after %+v to end with %+v, got %+v", after, want, page)
+		}
+		after = want
+	}
+	if len(seen) != len(keys) {
+		t.Fatalf("expected all %d keys to be paged through, got %d", len(keys), len(seen))
+	}
+}
+
+func TestServerNames(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+
+	key := gomatrixserverlib.PublicKeyLookupResult{
+		VerifyKey: gomatrixserverlib.VerifyKey{
+			Key: gomatrixserverlib.Base64Bytes("remote-public-key"),
+		},
+		ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+		ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour)),
+	}
+	if err := db.StoreKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		{ServerName: "b.com", KeyID: "ed25519:1"}: key,
+		{ServerName: "a.com", KeyID: "ed25519:1"}: key,
+		{ServerName: "b.com", KeyID: "ed25519:2"}: key,
+	}); err != nil {
+		t.Fatalf("StoreKeys failed: %s", err)
+	}
+
+	serverNames, err := db.ServerNames(context.Background())
+	if err != nil {
+		t.Fatalf("ServerNames failed: %s", err)
+	}
+	want := []gomatrixserverlib.ServerName{"a.com", "b.com"}
+	if !reflect.DeepEqual(serverNames, want) {
+		t.Fatalf("got %v, want %v", serverNames, want)
+	}
+}
+
+func TestKeyMetadata(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+
+	current := gomatrixserverlib.PublicKeyLookupResult{
+		VerifyKey: gomatrixserverlib.VerifyKey{
+			Key: gomatrixserverlib.Base64Bytes("current-key"),
+		},
+		ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+		ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour)),
+	}
+	old := gomatrixserverlib.PublicKeyLookupResult{
+		VerifyKey: gomatrixserverlib.VerifyKey{
+			Key: gomatrixserverlib.Base64Bytes("old-key"),
+		},
+		ExpiredTS:    gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Hour)),
+		ValidUntilTS: gomatrixserverlib.PublicKeyNotValid,
+	}
+	before := gomatrixserverlib.AsTimestamp(time.Now())
+	if err := db.StoreKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		{ServerName: "remote.com", KeyID: "ed25519:current"}: current,
+		{ServerName: "remote.com", KeyID: "ed25519:old"}:     old,
+		{ServerName: "other.com", KeyID: "ed25519:current"}:  current,
+	}); err != nil {
+		t.Fatalf("StoreKeys failed: %s", err)
+	}
+	after := gomatrixserverlib.AsTimestamp(time.Now())
+
+	metadata, err := db.KeyMetadata(context.Background(), "remote.com")
+	if err != nil {
+		t.Fatalf("KeyMetadata failed: %s", err)
+	}
+	if len(metadata) != 2 {
+		t.Fatalf("expected metadata for 2 keys, got %+v", metadata)
+	}
+	for i, want := range []struct {
+		keyID gomatrixserverlib.KeyID
+		key   gomatrixserverlib.PublicKeyLookupResult
+	}{
+		{"ed25519:current", current},
+		{"ed25519:old", old},
+	} {
+		got := metadata[i]
+		if got.KeyID != want.keyID || got.ValidUntilTS != want.key.ValidUntilTS || got.ExpiredTS != want.key.ExpiredTS {
+			t.Fatalf("got %+v, want key %s with %+v", got, want.keyID, want.key)
+		}
+		if got.FetchedTS < before || got.FetchedTS > after {
+			t.Fatalf("expected %s to have been fetched between %d and %d, got %d", want.keyID, before, after, got.FetchedTS)
+		}
+	}
+}
+
+func TestStoreKeysFetchedAt(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+
+	req := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:current"}
+	key := gomatrixserverlib.PublicKeyLookupResult{
+		VerifyKey: gomatrixserverlib.VerifyKey{
+			Key: gomatrixserverlib.Base64Bytes("current-key"),
+		},
+		ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+		ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour)),
+	}
+	fetchedTS := func() gomatrixserverlib.Timestamp {
+		metadata, err := db.KeyMetadata(context.Background(), req.ServerName)
+		if err != nil || len(metadata) != 1 {
+			t.Fatalf("expected metadata for 1 key, got %+v, %v", metadata, err)
+		}
+		return metadata[0].FetchedTS
+	}
+
+	// The fetch time is the one that we were given.
+	if err := db.StoreKeysFetchedAt(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		req: key,
+	}, 1001); err != nil {
+		t.Fatalf("StoreKeysFetchedAt failed: %s", err)
+	}
+	if got := fetchedTS(); got != 1001 {
+		t.Fatalf("expected the key to have been fetched at 1001, got %d", got)
+	}
+
+	// Storing the key again without a fetch time keeps the one we had.
+	key.ValidUntilTS = gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour * 2))
+	if err := db.StoreKeysFetchedAt(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		req: key,
+	}, 0); err != nil {
+		t.Fatalf("StoreKeysFetchedAt failed: %s", err)
+	}
+	if got := fetchedTS(); got != 1001 {
+		t.Fatalf("expected the key to still have been fetched at 1001, got %d", got)
+	}
+	unknown := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "unknown.com", KeyID: "ed25519:current"}
+	fetched, err := db.KeyFetchTimes(context.Background(), []gomatrixserverlib.PublicKeyLookupRequest{req, unknown})
+	if err != nil {
+		t.Fatalf("KeyFetchTimes failed: %s", err)
+	}
+	if want := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{req: 1001}; !reflect.DeepEqual(fetched, want) {
+		t.Fatalf("expected fetch times %v, got %v", want, fetched)
+	}
+	res, err := db.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		req: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if res[req].ValidUntilTS != key.ValidUntilTS {
+		t.Fatalf("expected the key to be updated, got %+v", res[req])
+	}
+}
+
+func TestKeyProvenance(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+
+	req := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "remote.com", KeyID: "ed25519:auto"}
+	if err := db.StoreKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		req: {
+			VerifyKey:    gomatrixserverlib.VerifyKey{Key: gomatrixserverlib.Base64Bytes("remote-key")},
+			ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+			ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour)),
+		},
+	}); err != nil {
+		t.Fatalf("StoreKeys failed: %s", err)
+	}
+
+	provenance, err := db.KeyProvenance(context.Background(), req)
+	if err != nil || provenance != nil {
+		t.Fatalf("expected no provenance before it is recorded, got %+v, %v", provenance, err)
+	}
+
+	// The most recent fetcher to store the key wins.
+	for i, fetcherName := range []string{"DirectKeyFetcher", "PerspectiveKeyFetcher"} {
+		if err = db.StoreKeyProvenance(context.Background(), []gomatrixserverlib.PublicKeyLookupRequest{req}, fetcherName, gomatrixserverlib.Timestamp(1000+i)); err != nil {
+			t.Fatalf("StoreKeyProvenance failed: %s", err)
+		}
+	}
+	provenance, err = db.KeyProvenance(context.Background(), req)
+	if err != nil {
+		t.Fatalf("KeyProvenance failed: %s", err)
+	}
+	if provenance == nil || provenance.FetcherName != "PerspectiveKeyFetcher" || provenance.FetchedTS != 1001 {
+		t.Fatalf("expected the latest fetcher, got %+v", provenance)
+	}
+
+	// Deleting the key forgets where it came from too.
+	if err = db.DeleteKeys(context.Background(), []gomatrixserverlib.PublicKeyLookupRequest{req}); err != nil {
+		t.Fatalf("DeleteKeys failed: %s", err)
+	}
+	provenance, err = db.KeyProvenance(context.Background(), req)
+	if err != nil || provenance != nil {
+		t.Fatalf("expected no provenance after the key was deleted, got %+v, %v", provenance, err)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const negativeCacheSchema = `
+-- Keys that we recently failed to fetch from remote servers, so that we
+-- don't try to fetch them again straight away after a restart.
+CREATE TABLE IF NOT EXISTS keydb_negative_cache (
+	-- The name of the matrix server the key is for.
+	server_name TEXT NOT NULL,
+	-- The ID of the server key.
+	server_key_id TEXT NOT NULL,
+	-- When we should next try to fetch the key as a millisecond timestamp.
+	expires_ts BIGINT NOT NULL,
+	UNIQUE (server_name, server_key_id)
+);
+`
+
+const upsertNegativeCacheSQL = "" +
+	"INSERT INTO keydb_negative_cache (server_name, server_key_id, expires_ts)" +
+	" VALUES ($1, $2, $3)" +
+	" ON CONFLICT (server_name, server_key_id)" +
+	" DO UPDATE SET expires_ts = $3"
+
+const selectNegativeCacheSQL = "" +
+	"SELECT server_name, server_key_id, expires_ts FROM keydb_negative_cache" +
+	" WHERE expires_ts > $1"
+
+const deleteExpiredNegativeCacheSQL = "" +
+	"DELETE FROM keydb_negative_cache WHERE expires_ts <= $1"
+
+type negativeCacheStatements struct {
+	db                             *sql.DB
+	writer                         sqlutil.Writer
+	upsertNegativeCacheStmt        *sql.Stmt
+	selectNegativeCacheStmt        *sql.Stmt
+	deleteExpiredNegativeCacheStmt *sql.Stmt
+}
+
+func (s *negativeCacheStatements) execSchema(db *sql.DB) error {
+	_, err := db.Exec(negativeCacheSchema)
+	return err
+}
+
+func (s *negativeCacheStatements) prepare(db *sql.DB, writer sqlutil.Writer) (err error) {
+	s.db = db
+	s.writer = writer
+	if s.upsertNegativeCacheStmt, err = db.Prepare(upsertNegativeCacheSQL); err != nil {
+		return
+	}
+	if s.selectNegativeCacheStmt, err = db.Prepare(selectNegativeCacheSQL); err != nil {
+		return
+	}
+	if s.deleteExpiredNegativeCacheStmt, err = db.Prepare(deleteExpiredNegativeCacheSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *negativeCacheStatements) upsertNegativeCacheEntries(
+	ctx context.Context,
+	entries map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) error {
+	return s.writer.Do(s.db, nil, func(txn *sql.Tx) error {
+		stmt := sqlutil.TxStmt(txn, s.upsertNegativeCacheStmt)
+		for request, expires := range entries {
+			if _, err := stmt.ExecContext(
+				ctx,
+				string(request.ServerName),
+				string(request.KeyID),
+				expires,
+			); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *negativeCacheStatements) selectNegativeCacheEntries(
+	ctx context.Context,
+	now gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, error) {
+	rows, err := s.selectNegativeCacheStmt.QueryContext(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectNegativeCacheEntries: rows.close() failed")
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
+	for rows.Next() {
+		var serverName string
+		var keyID string
+		var expiresTS int64
+		if err = rows.Scan(&serverName, &keyID, &expiresTS); err != nil {
+			return nil, err
+		}
+		r := gomatrixserverlib.PublicKeyLookupRequest{
+			ServerName: gomatrixserverlib.ServerName(serverName),
+			KeyID:      gomatrixserverlib.KeyID(keyID),
+		}
+		results[r] = gomatrixserverlib.Timestamp(expiresTS)
+	}
+	return results, rows.Err()
+}
+
+func (s *negativeCacheStatements) deleteExpiredNegativeCacheEntries(
+	ctx context.Context,
+	before gomatrixserverlib.Timestamp,
+) error {
+	return s.writer.Do(s.db, nil, func(txn *sql.Tx) error {
+		stmt := sqlutil.TxStmt(txn, s.deleteExpiredNegativeCacheStmt)
+		_, err := stmt.ExecContext(ctx, before)
+		return err
+	})
+}
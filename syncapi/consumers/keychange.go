@@ -17,16 +17,24 @@ package consumers
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/keyserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	syncapi "github.com/matrix-org/dendrite/syncapi/sync"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -39,11 +47,199 @@ type OutputKeyChangeEventConsumer struct {
 	keyAPI              api.KeyInternalAPI
 	partitionToOffset   map[int32]int64
 	partitionToOffsetMu sync.Mutex
-	notifier            *syncapi.Notifier
+	partitionToOffsetCv *sync.Cond      // broadcast when partitionToOffset changes
+	failedOffset        map[int32]int64 // the earliest offset on each partition that failed, guarded by partitionToOffsetMu
+	notifier            keyChangeNotifier
+	ctx                 context.Context    // cancelled by Stop()
+	cancel              context.CancelFunc // cancels ctx
+	queryRetryDelay     time.Duration      // delay before the first QuerySharedUsers retry
+
+	// HaltOnQueryFailure stops the consumer if we can't find out from the
+	// roomserver who to notify about a key change, even after retrying.
+	// Otherwise we move on to the next key change, and the failed one is
+	// processed again after a restart, along with the ones after it as no
+	// offsets are committed past a failed key change.
+	HaltOnQueryFailure bool
+
+	// UserFilter, if set, limits this consumer to the users that it returns
+	// true for, i.e. when the sync API is sharded by user. Key changes for
+	// other users are skipped, and other users aren't woken up about key
+	// changes.
+	UserFilter func(userID string) bool
+
+	// ServerBlocklist lists servers whose users' key changes are ignored,
+	// i.e. so that a misbehaving server can't keep waking up our users
+	// with device list updates. Key changes from these servers are skipped
+	// without notifying anyone.
+	ServerBlocklist map[gomatrixserverlib.ServerName]bool
+
+	// NotifyCoalesceWindow, if set, holds back the notification for a key
+	// change for up to this long, so that further changes to the keys of
+	// the same user in the meantime wake each observer only once. 0 means
+	// that observers are woken up immediately for every change.
+	NotifyCoalesceWindow time.Duration
+	pendingMu            sync.Mutex
+	pending              map[string]*pendingKeyChange // by the user whose keys changed
+
+	// NotifyWorkers, if set, hands notifications to this many background
+	// workers instead of delivering them before returning from onMessage,
+	// so that a slow notifier doesn't hold up consuming key changes. The
+	// offset of a message is only committed once its notification has
+	// been queued. 0 means that notifications are delivered synchronously.
+	NotifyWorkers int
+	// NotifyQueueSize is how many notifications can be waiting for one of
+	// the NotifyWorkers before processing key changes blocks until there
+	// is room. If zero, defaultNotifyQueueSize is used.
+	NotifyQueueSize int
+	notifyOnce      sync.Once
+	notifyQueue     chan queuedKeyChange
+	notifyWorkers   sync.WaitGroup
+
+	// QueryBatchSize, if greater than 1, collects up to this many key
+	// changes and asks the roomserver who to notify about all of them in a
+	// single QueryBulkSharedUsers request, to cut down on round trips
+	// during bursts of key changes. Offsets are only committed once the
+	// batch has been processed. 0 means that each key change is queried
+	// for separately.
+	QueryBatchSize int
+	// QueryBatchWindow is the longest that a key change waits for the rest
+	// of its batch to arrive before the batch is processed anyway. Errors
+	// from batches processed this way are returned for the next key change
+	// instead, so that HaltOnQueryFailure still halts the consumer. If
+	// zero, defaultQueryBatchWindow is used.
+	QueryBatchWindow time.Duration
+	batchMu          sync.Mutex
+	batch            []*sarama.ConsumerMessage
+	batchTimer       *time.Timer
+	batchErr         error // from the last batch processed by batchTimer
+
+	// StrictOrdering processes key changes one at a time, across all of
+	// the partitions, and strictly in offset order on each partition.
+	// Messages that are delivered before the ones that come before them on
+	// their partition are held back until those have been processed. This
+	// assumes that offsets are contiguous: if more than
+	// strictOrderingMaxHeldBack messages are held back on a partition then
+	// we give up waiting for the gap to be filled. QueryBatchSize is
+	// ignored, and NotifyWorkers should be at most 1 so that notifications
+	// are delivered in the same order.
+	StrictOrdering bool
+	orderMu        sync.Mutex
+	orderedOffset  map[int32]int64                             // the last offset processed on each partition
+	heldBack       map[int32]map[int64]*sarama.ConsumerMessage // out-of-order messages by partition and offset
+
+	// PersistDeviceListChanges records device list changes in the sync API
+	// database, against each of the users who were notified about them,
+	// before notifying them, so that clients that weren't syncing at the
+	// time still find out about them when they next sync. Messages that
+	// can't be recorded aren't committed.
+	PersistDeviceListChanges bool
+
+	// MaxMessageSize is the largest key change event, in bytes, that we
+	// will try to decode. Larger events are logged and skipped, so that a
+	// huge event can't make us allocate a huge amount of memory. If zero,
+	// defaultMaxKeyChangeMessageSize is used.
+	MaxMessageSize int
+}
+
+// queuedKeyChange is a key change notification waiting for one of the
+// NotifyWorkers to deliver it.
+type queuedKeyChange struct {
+	posUpdate     types.StreamingToken
+	userIDs       []string
+	changedUserID string
 }
 
+// pendingKeyChange is a key change notification that is being held back.
+type pendingKeyChange struct {
+	posUpdate types.StreamingToken
+	userIDs   map[string]struct{}
+	timer     *time.Timer
+}
+
+const (
+	// keyChangeQueryAttempts is how many times we will ask the roomserver
+	// who shares rooms with a user when the query fails transiently.
+	keyChangeQueryAttempts = 5
+	// keyChangeQueryRetryDelay is how long we wait before the first retry.
+	// The delay doubles for each attempt after that.
+	keyChangeQueryRetryDelay = time.Millisecond * 200
+)
+
+// defaultNotifyQueueSize is used when NotifyWorkers is set but no
+// NotifyQueueSize has been given.
+const defaultNotifyQueueSize = 100
+
+// defaultQueryBatchWindow is used when QueryBatchSize is set but no
+// QueryBatchWindow has been given.
+const defaultQueryBatchWindow = time.Millisecond * 100
+
+// strictOrderingMaxHeldBack is how many out-of-order messages can be held
+// back on a partition when StrictOrdering is set before we stop waiting for
+// the ones that should come before them.
+const strictOrderingMaxHeldBack = 1000
+
+// defaultMaxKeyChangeMessageSize is used when no MaxMessageSize has been
+// given. The keys for a single device or user are much smaller than this.
+const defaultMaxKeyChangeMessageSize = 256 * 1024
+
+// maxKeyChangeUserIDLength is the longest user ID that we will accept in a
+// key change event, as user IDs are limited to 255 bytes by the spec.
+const maxKeyChangeUserIDLength = 255
+
+// keyChangeQueryTimeout is how long we will wait for the roomserver to tell
+// us who shares rooms with a user before giving up on a key change event.
+const keyChangeQueryTimeout = time.Second * 30
+
+func init() {
+	prometheus.MustRegister(keyChangeConsumerLag, keyChangeObservers)
+}
+
+var keyChangeConsumerLag = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "syncapi",
+		Name:      "keychange_consumer_lag",
+		Help:      "The number of key change events on each partition that have not been processed yet",
+	},
+	[]string{"partition"},
+)
+
+// The values of the origin label on keyChangeObservers.
+const (
+	keyChangeOriginLocal  = "local"
+	keyChangeOriginRemote = "remote"
+)
+
+var keyChangeObservers = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "syncapi",
+		Name:      "keychange_observers",
+		Help:      "How many users the roomserver says share rooms with a user whose keys changed, by whether the user is local or remote",
+		Buckets:   []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 5000},
+	},
+	[]string{"origin"},
+)
+
+// keyChangeNotifier is the part of the sync notifier that is used to
+// wake up /sync streams when device or cross-signing keys change, and to
+// drop the streams of devices that have been deleted.
+type keyChangeNotifier interface {
+	OnNewKeyChangeForUsers(posUpdate types.StreamingToken, wakeUserIDs []string, keyChangeUserID string)
+	OnDevicesDeleted(userID string, deviceIDs []string)
+}
+
+// errNoKeyChangeNotifier is returned when creating an
+// OutputKeyChangeEventConsumer without a notifier to wake users up with.
+var errNoKeyChangeNotifier = errors.New("syncapi: key change consumer needs a notifier")
+
+// errKeyChangeTooLarge is returned for key change events that are larger
+// than the MaxMessageSize.
+var errKeyChangeTooLarge = errors.New("syncapi: key change event is too large")
+
 // NewOutputKeyChangeEventConsumer creates a new OutputKeyChangeEventConsumer.
-// Call Start() to begin consuming from the key server.
+// Call Start() to begin consuming from the key server. Returns an error if
+// the notifier is nil, rather than failing on the first key change.
 func NewOutputKeyChangeEventConsumer(
 	serverName gomatrixserverlib.ServerName,
 	topic string,
@@ -52,15 +248,20 @@ func NewOutputKeyChangeEventConsumer(
 	keyAPI api.KeyInternalAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI,
 	store storage.Database,
-) *OutputKeyChangeEventConsumer {
+) (*OutputKeyChangeEventConsumer, error) {
+	if n == nil {
+		return nil, errNoKeyChangeNotifier
+	}
 
 	consumer := internal.ContinualConsumer{
 		ComponentName:  "syncapi/keychange",
 		Topic:          topic,
 		Consumer:       kafkaConsumer,
 		PartitionStore: store,
+		ManualCommit:   true,
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	s := &OutputKeyChangeEventConsumer{
 		keyChangeConsumer:   &consumer,
 		db:                  store,
@@ -70,11 +271,52 @@ func NewOutputKeyChangeEventConsumer(
 		partitionToOffset:   make(map[int32]int64),
 		partitionToOffsetMu: sync.Mutex{},
 		notifier:            n,
+		ctx:                 ctx,
+		cancel:              cancel,
+		queryRetryDelay:     keyChangeQueryRetryDelay,
 	}
 
 	consumer.ProcessMessage = s.onMessage
 
-	return s
+	return s, nil
+}
+
+// UseConsumerGroup makes the consumer join the given kafka consumer group
+// instead of consuming every partition of the topic itself, so that key
+// changes can be shared out between several sync API instances. It must be
+// called before Start. Offsets are still committed to the sync API database,
+// and partitions that move here from another member resume from there.
+func (s *OutputKeyChangeEventConsumer) UseConsumerGroup(group sarama.ConsumerGroup) {
+	s.keyChangeConsumer.ConsumerGroup = group
+	s.keyChangeConsumer.PartitionsAssigned = s.onPartitionsAssigned
+	s.keyChangeConsumer.PartitionsRevoked = s.onPartitionsRevoked
+}
+
+// onPartitionsAssigned picks up where the previous owner of the partitions
+// got to, so that messages it processed aren't processed again here.
+func (s *OutputKeyChangeEventConsumer) onPartitionsAssigned(offsets []sqlutil.PartitionOffset) {
+	s.partitionToOffsetMu.Lock()
+	defer s.partitionToOffsetMu.Unlock()
+	for _, o := range offsets {
+		s.partitionToOffset[o.Partition] = o.Offset
+		// Any messages that failed on the partition will be delivered
+		// again from the stored offset.
+		delete(s.failedOffset, o.Partition)
+	}
+	s.offsetChanged().Broadcast()
+}
+
+// onPartitionsRevoked forgets about partitions that another member of the
+// consumer group may now be consuming, so that we don't overwrite their
+// offsets with older ones when we stop.
+func (s *OutputKeyChangeEventConsumer) onPartitionsRevoked(partitions []int32) {
+	s.forgetOrdering(partitions)
+	s.partitionToOffsetMu.Lock()
+	defer s.partitionToOffsetMu.Unlock()
+	for _, partition := range partitions {
+		delete(s.partitionToOffset, partition)
+		delete(s.failedOffset, partition)
+	}
 }
 
 // Start consuming from the key server
@@ -84,44 +326,884 @@ func (s *OutputKeyChangeEventConsumer) Start() error {
 	for _, o := range offsets {
 		s.partitionToOffset[o.Partition] = o.Offset
 	}
+	s.offsetChanged().Broadcast()
 	s.partitionToOffsetMu.Unlock()
 	return err
 }
 
-func (s *OutputKeyChangeEventConsumer) updateOffset(msg *sarama.ConsumerMessage) {
+// Stop stops consuming from the key server. Any in-flight roomserver
+// queries made while processing key change events are cancelled, and
+// messages that fail as a result are not committed, so they will be
+// processed again after a restart, as are any key changes still waiting
+// to be processed in a batch. The offsets that we did reach are written to
+// the partition store before returning.
+func (s *OutputKeyChangeEventConsumer) Stop() {
+	s.cancel()
+	s.keyChangeConsumer.Stop()
+	s.dropBatch()
+	s.flushPendingNotifications()
+	s.notifyWorkers.Wait()
+
+	s.partitionToOffsetMu.Lock()
+	defer s.partitionToOffsetMu.Unlock()
+	consumer := s.keyChangeConsumer
+	for partition, offset := range s.partitionToOffset {
+		if err := consumer.PartitionStore.SetPartitionOffset(context.Background(), consumer.Topic, partition, offset); err != nil {
+			log.WithError(err).WithField("partition", partition).Error("syncapi: failed to flush key change partition offset")
+		}
+	}
+}
+
+// CurrentPosition returns the furthest position in the key change stream
+// that has been processed successfully. If several partitions are being
+// consumed then the one with the highest offset is returned.
+func (s *OutputKeyChangeEventConsumer) CurrentPosition() types.LogPosition {
+	s.partitionToOffsetMu.Lock()
+	defer s.partitionToOffsetMu.Unlock()
+	var pos types.LogPosition
+	first := true
+	for partition, offset := range s.partitionToOffset {
+		if first || offset > pos.Offset || (offset == pos.Offset && partition < pos.Partition) {
+			pos = types.LogPosition{
+				Partition: partition,
+				Offset:    offset,
+			}
+			first = false
+		}
+	}
+	return pos
+}
+
+// WaitForPosition blocks until the key change stream has been processed
+// up to at least the given position on its partition, or until the context
+// is done, in which case the context's error is returned.
+func (s *OutputKeyChangeEventConsumer) WaitForPosition(ctx context.Context, pos types.LogPosition) error {
+	// We can't select on the context while waiting on the condition
+	// variable, so wake ourselves up if the context is done first.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.partitionToOffsetMu.Lock()
+			s.offsetChanged().Broadcast()
+			s.partitionToOffsetMu.Unlock()
+		case <-done:
+		}
+	}()
+
 	s.partitionToOffsetMu.Lock()
 	defer s.partitionToOffsetMu.Unlock()
+	for {
+		if offset, ok := s.partitionToOffset[pos.Partition]; ok && offset >= pos.Offset {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.offsetChanged().Wait()
+	}
+}
+
+// offsetChanged returns the condition variable that is broadcast whenever
+// the processed offset of a partition changes. partitionToOffsetMu must be
+// held.
+func (s *OutputKeyChangeEventConsumer) offsetChanged() *sync.Cond {
+	if s.partitionToOffsetCv == nil {
+		s.partitionToOffsetCv = sync.NewCond(&s.partitionToOffsetMu)
+	}
+	return s.partitionToOffsetCv
+}
+
+// updateOffset commits the offset of a message that has been processed
+// successfully, both in memory and in the partition store so that we
+// resume after it on restart. If an earlier message on the partition
+// failed then the offset isn't committed, as we would skip past the
+// failed message on restart.
+func (s *OutputKeyChangeEventConsumer) updateOffset(msg *sarama.ConsumerMessage) error {
+	s.partitionToOffsetMu.Lock()
+	defer s.partitionToOffsetMu.Unlock()
+	if failed, ok := s.failedOffset[msg.Partition]; ok && msg.Offset >= failed {
+		log.WithFields(log.Fields{
+			"partition": msg.Partition,
+			"offset":    msg.Offset,
+			"failed":    failed,
+		}).Debug("syncapi: not committing key change event that comes after a failed one")
+		return nil
+	}
+	consumer := s.keyChangeConsumer
+	if err := consumer.PartitionStore.SetPartitionOffset(context.Background(), consumer.Topic, msg.Partition, msg.Offset); err != nil {
+		return err
+	}
 	s.partitionToOffset[msg.Partition] = msg.Offset
+	s.offsetChanged().Broadcast()
+	s.reportLag(msg.Partition, msg.Offset)
+	return nil
+}
+
+// holdOffset stops the offsets of the message and of any later messages on
+// its partition from being committed, because the message failed and so
+// needs to be processed again after a restart.
+func (s *OutputKeyChangeEventConsumer) holdOffset(msg *sarama.ConsumerMessage) {
+	s.partitionToOffsetMu.Lock()
+	defer s.partitionToOffsetMu.Unlock()
+	if s.failedOffset == nil {
+		s.failedOffset = make(map[int32]int64)
+	}
+	if failed, ok := s.failedOffset[msg.Partition]; !ok || msg.Offset < failed {
+		s.failedOffset[msg.Partition] = msg.Offset
+	}
+}
+
+// reportLag updates the lag metric for the partition, given the offset of
+// the last message that we have processed on it.
+func (s *OutputKeyChangeEventConsumer) reportLag(partition int32, offset int64) {
+	consumer := s.keyChangeConsumer
+	if consumer.Consumer == nil {
+		return
+	}
+	highWaterMark, ok := consumer.Consumer.HighWaterMarks()[consumer.Topic][partition]
+	if !ok {
+		return
+	}
+	// The high water mark is the offset that the next message will get.
+	lag := highWaterMark - offset - 1
+	if lag < 0 {
+		lag = 0
+	}
+	keyChangeConsumerLag.WithLabelValues(strconv.Itoa(int(partition))).Set(float64(lag))
+}
+
+// alreadyProcessed returns true if we have already committed an offset at
+// or beyond the offset of the message, i.e. because it has been delivered
+// again after a rebalance.
+func (s *OutputKeyChangeEventConsumer) alreadyProcessed(msg *sarama.ConsumerMessage) bool {
+	s.partitionToOffsetMu.Lock()
+	defer s.partitionToOffsetMu.Unlock()
+	offset, ok := s.partitionToOffset[msg.Partition]
+	if ok && msg.Offset <= offset {
+		s.reportLag(msg.Partition, offset)
+		return true
+	}
+	return false
 }
 
 func (s *OutputKeyChangeEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
-	defer s.updateOffset(msg)
+	// Kafka can deliver the same message more than once, so don't notify
+	// anyone about a key change that we've already dealt with.
+	if s.alreadyProcessed(msg) {
+		log.WithFields(log.Fields{
+			"partition": msg.Partition,
+			"offset":    msg.Offset,
+		}).Debug("syncapi: skipping key change event that has already been processed")
+		return nil
+	}
+	if s.StrictOrdering {
+		return s.processInOrder(msg)
+	}
+	if s.QueryBatchSize > 1 {
+		return s.batchKeyChange(msg)
+	}
 
-	var output api.DeviceMessage
-	if err := json.Unmarshal(msg.Value, &output); err != nil {
-		// If the message was invalid, log it and move on to the next message in the stream
-		log.WithError(err).Error("syncapi: failed to unmarshal key change event from key server")
+	commit, err := s.processKeyChange(msg, logPosition(msg))
+	return s.commitKeyChange(msg, commit, err)
+}
+
+// processInOrder processes the message if it is the next one on its
+// partition, followed by any held back messages that were waiting for it.
+// Otherwise the message is held back until the ones before it have been
+// processed.
+func (s *OutputKeyChangeEventConsumer) processInOrder(msg *sarama.ConsumerMessage) error {
+	s.orderMu.Lock()
+	defer s.orderMu.Unlock()
+	// The message may have been processed by another partition's consumer
+	// while we were waiting for the lock.
+	if s.alreadyProcessed(msg) {
+		return nil
+	}
+	if s.orderedOffset == nil {
+		s.orderedOffset = make(map[int32]int64)
+		s.heldBack = make(map[int32]map[int64]*sarama.ConsumerMessage)
+	}
+	partition := msg.Partition
+
+	last, ok := s.orderedOffset[partition]
+	if !ok {
+		s.partitionToOffsetMu.Lock()
+		last, ok = s.partitionToOffset[partition]
+		s.partitionToOffsetMu.Unlock()
+	}
+	if ok && msg.Offset > last+1 {
+		if s.heldBack[partition] == nil {
+			s.heldBack[partition] = make(map[int64]*sarama.ConsumerMessage)
+		}
+		s.heldBack[partition][msg.Offset] = msg
+		if len(s.heldBack[partition]) <= strictOrderingMaxHeldBack {
+			log.WithFields(log.Fields{
+				"partition": partition,
+				"offset":    msg.Offset,
+				"waiting":   last + 1,
+			}).Debug("syncapi: holding back key change event that arrived out of order")
+			return nil
+		}
+		// Skip over the gap to the earliest message that we have.
+		next := msg.Offset
+		for offset := range s.heldBack[partition] {
+			if offset < next {
+				next = offset
+			}
+		}
+		log.WithFields(log.Fields{
+			"partition": partition,
+			"from":      last + 1,
+			"to":        next - 1,
+		}).Warn("syncapi: gave up waiting for key change events that are missing from the partition")
+		msg = s.heldBack[partition][next]
+		delete(s.heldBack[partition], next)
+	}
+
+	var firstErr error
+	for msg != nil {
+		commit, err := s.processKeyChange(msg, logPosition(msg))
+		err = s.commitKeyChange(msg, commit, err)
+		// The message has had its turn even if it failed, so the ones
+		// after it don't wait for it. As with any failed message it will
+		// be processed again after a restart.
+		if last, ok := s.orderedOffset[partition]; !ok || msg.Offset > last {
+			s.orderedOffset[partition] = msg.Offset
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			if errors.Is(err, internal.ErrShutdown) {
+				break
+			}
+		}
+		next := msg.Offset + 1
+		msg = s.heldBack[partition][next]
+		delete(s.heldBack[partition], next)
+	}
+	return firstErr
+}
+
+// forgetOrdering drops any messages held back on the partitions, i.e.
+// because they have been handed to another member of the consumer group,
+// which will receive them again itself.
+func (s *OutputKeyChangeEventConsumer) forgetOrdering(partitions []int32) {
+	s.orderMu.Lock()
+	defer s.orderMu.Unlock()
+	for _, partition := range partitions {
+		delete(s.orderedOffset, partition)
+		delete(s.heldBack, partition)
+	}
+}
+
+// commitKeyChange commits the offset of the message if it has been dealt
+// with, returning the error from processing it or else from committing it.
+// Otherwise no more offsets are committed on the partition, so that the
+// message is processed again after a restart.
+func (s *OutputKeyChangeEventConsumer) commitKeyChange(msg *sarama.ConsumerMessage, commit bool, err error) error {
+	if !commit {
+		s.holdOffset(msg)
 		return err
 	}
+	if offsetErr := s.updateOffset(msg); offsetErr != nil {
+		log.WithError(offsetErr).Error("syncapi: failed to update key change partition offset")
+		s.holdOffset(msg)
+		if err == nil {
+			err = offsetErr
+		}
+	}
+	return err
+}
+
+// logPosition returns the position of the message in the key change stream.
+func logPosition(msg *sarama.ConsumerMessage) types.LogPosition {
+	return types.LogPosition{
+		Offset:    msg.Offset,
+		Partition: msg.Partition,
+	}
+}
+
+// batchKeyChange adds the message to the current batch, processing the
+// batch if it is now full. Otherwise the batch is processed once the
+// QueryBatchWindow has passed. Returns the error from processing the batch,
+// or else any error from the last batch that was processed once its window
+// had passed.
+func (s *OutputKeyChangeEventConsumer) batchKeyChange(msg *sarama.ConsumerMessage) error {
+	s.batchMu.Lock()
+	defer s.batchMu.Unlock()
+	prevErr := s.batchErr
+	s.batchErr = nil
+	if prevErr == internal.ErrShutdown {
+		// We're halting, so leave this message to be processed again after
+		// a restart along with the batch that failed.
+		s.holdOffset(msg)
+		return prevErr
+	}
+	s.batch = append(s.batch, msg)
+	if len(s.batch) >= s.QueryBatchSize {
+		if err := s.processBatch(); err != nil {
+			return err
+		}
+		return prevErr
+	}
+	if s.batchTimer == nil {
+		window := s.QueryBatchWindow
+		if window <= 0 {
+			window = defaultQueryBatchWindow
+		}
+		s.batchTimer = time.AfterFunc(window, func() {
+			s.batchMu.Lock()
+			defer s.batchMu.Unlock()
+			if err := s.processBatch(); err != nil {
+				log.WithError(err).Error("syncapi: failed to process batch of key change events")
+				// Nobody is waiting for the batch, so hand the error to
+				// the next key change. The offsets of the batch have been
+				// held back so that it is processed again after a restart.
+				if s.batchErr == nil || err == internal.ErrShutdown {
+					s.batchErr = err
+				}
+			}
+		})
+	}
+	return prevErr
+}
+
+// dropBatch forgets about any key changes waiting to be processed in a
+// batch, without committing them.
+func (s *OutputKeyChangeEventConsumer) dropBatch() {
+	s.batchMu.Lock()
+	defer s.batchMu.Unlock()
+	if s.batchTimer != nil {
+		s.batchTimer.Stop()
+		s.batchTimer = nil
+	}
+	s.batch = nil
+}
+
+// processBatch makes a single roomserver query for all of the key changes
+// in the current batch and then notifies about each of them in turn,
+// committing their offsets in order. batchMu must be held.
+func (s *OutputKeyChangeEventConsumer) processBatch() error {
+	batch := s.batch
+	s.batch = nil
+	if s.batchTimer != nil {
+		s.batchTimer.Stop()
+		s.batchTimer = nil
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	outputs := make([]api.DeviceMessage, len(batch))
+	decodeErrs := make([]error, len(batch))
+	skip := make([]bool, len(batch))
+	var userIDs []string
+	seen := make(map[string]bool, len(batch))
+	for i, msg := range batch {
+		// The message may have been delivered again while it was waiting.
+		if s.alreadyProcessed(msg) {
+			batch[i] = nil
+			continue
+		}
+		outputs[i], skip[i], decodeErrs[i] = s.decodeKeyChange(msg)
+		if !skip[i] && !seen[outputs[i].UserID] {
+			seen[outputs[i].UserID] = true
+			userIDs = append(userIDs, outputs[i].UserID)
+		}
+	}
+
+	var sharedUsers map[string]map[string]int
+	var queryErr error
+	if len(userIDs) > 0 {
+		if sharedUsers, queryErr = s.queryBulkSharedUsers(userIDs); queryErr != nil {
+			log.WithError(queryErr).Error("syncapi: failed to QueryBulkSharedUsers for key change events from key server")
+			if s.HaltOnQueryFailure {
+				queryErr = internal.ErrShutdown
+			}
+		}
+	}
+
+	var firstErr error
+	for i, msg := range batch {
+		if msg == nil {
+			continue
+		}
+		var commit bool
+		var err error
+		switch {
+		case skip[i]:
+			commit, err = true, decodeErrs[i]
+		case queryErr != nil:
+			commit, err = false, queryErr
+		default:
+			commit, err = s.notifyKeyChange(outputs[i], logPosition(msg), &roomserverAPI.QuerySharedUsersResponse{
+				UserIDsToCount: sharedUsers[outputs[i].UserID],
+			})
+		}
+		if err = s.commitKeyChange(msg, commit, err); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// processKeyChange notifies everyone who needs to know about the key
+// change in the message, using logPos as the position of the change. It
+// returns whether the message has been dealt with and so can be committed,
+// which it can even if there was an error if retrying won't help.
+func (s *OutputKeyChangeEventConsumer) processKeyChange(
+	msg *sarama.ConsumerMessage, logPos types.LogPosition,
+) (commit bool, err error) {
+	output, skip, err := s.decodeKeyChange(msg)
+	if skip {
+		return true, err
+	}
+
 	// work out who we need to notify about the new key
-	var queryRes roomserverAPI.QuerySharedUsersResponse
-	err := s.rsAPI.QuerySharedUsers(context.Background(), &roomserverAPI.QuerySharedUsersRequest{
-		UserID: output.UserID,
-	}, &queryRes)
+	queryRes, err := s.querySharedUsers(output.UserID)
 	if err != nil {
 		log.WithError(err).Error("syncapi: failed to QuerySharedUsers for key change event from key server")
-		return err
+		if s.HaltOnQueryFailure {
+			// Stop consuming rather than moving on to the next message.
+			// The failed message hasn't been committed so it will be the
+			// first message that we process after a restart.
+			return false, internal.ErrShutdown
+		}
+		return false, err
 	}
-	// make sure we get our own key updates too!
-	queryRes.UserIDsToCount[output.UserID] = 1
+	return s.notifyKeyChange(output, logPos, queryRes)
+}
+
+// decodeKeyChange unmarshals the key change in the message. It returns
+// skip if nobody needs to be notified about it, in which case the message
+// can be committed straight away, along with any error.
+func (s *OutputKeyChangeEventConsumer) decodeKeyChange(
+	msg *sarama.ConsumerMessage,
+) (output api.DeviceMessage, skip bool, err error) {
+	maxSize := s.MaxMessageSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxKeyChangeMessageSize
+	}
+	if len(msg.Value) > maxSize {
+		log.WithFields(log.Fields{
+			"size":      len(msg.Value),
+			"max_size":  maxSize,
+			"partition": msg.Partition,
+			"offset":    msg.Offset,
+		}).Error("syncapi: skipping key change event from key server that is too large")
+		return output, true, errKeyChangeTooLarge
+	}
+	if err = json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Error("syncapi: failed to unmarshal key change event from key server")
+		// Retrying won't make the message any more valid, so skip past it.
+		return output, true, err
+	}
+	// Without a user ID we have no way of knowing who to notify, so skip
+	// the message rather than asking the roomserver about nobody.
+	if output.UserID == "" {
+		log.WithFields(log.Fields{
+			"device_id": output.DeviceID,
+			"partition": msg.Partition,
+			"offset":    msg.Offset,
+		}).Error("syncapi: skipping key change event from key server with no user ID")
+		return output, true, nil
+	}
+	if len(output.UserID) > maxKeyChangeUserIDLength {
+		log.WithFields(log.Fields{
+			"user_id_length": len(output.UserID),
+			"partition":      msg.Partition,
+			"offset":         msg.Offset,
+		}).Error("syncapi: skipping key change event from key server with an invalid user ID")
+		return output, true, nil
+	}
+
+	// If the user whose keys changed isn't one of ours then another sync
+	// API instance will deal with it.
+	if s.UserFilter != nil && !s.UserFilter(output.UserID) {
+		return output, true, nil
+	}
+
+	// Don't let blocked servers wake anyone up.
+	if s.isBlocked(output.UserID) {
+		log.WithFields(log.Fields{
+			"user_id":   output.UserID,
+			"partition": msg.Partition,
+			"offset":    msg.Offset,
+		}).Debug("syncapi: skipping key change event from blocked server")
+		return output, true, nil
+	}
+
+	if output.Type == api.TypeCrossSigningKeyUpdate {
+		log.WithField("user_id", output.UserID).Debug("syncapi: received cross-signing key change event from key server")
+	} else {
+		log.WithFields(log.Fields{
+			"user_id":   output.UserID,
+			"device_id": output.DeviceID,
+			"deleted":   deviceDeleted(output),
+		}).Debug("syncapi: received key change event from key server")
+	}
+	return output, false, nil
+}
+
+// notifyKeyChange notifies the users who share rooms with the user whose
+// keys changed, as given by queryRes, about the key change at logPos. It
+// returns whether the message can be committed, as for processKeyChange.
+func (s *OutputKeyChangeEventConsumer) notifyKeyChange(
+	output api.DeviceMessage, logPos types.LogPosition, queryRes *roomserverAPI.QuerySharedUsersResponse,
+) (commit bool, err error) {
+	// Only the users that the roomserver told us about still share a room
+	// with the user whose keys changed, so they are the only other users
+	// that we notify. Anyone who has left all of the shared rooms will
+	// find out about it through the device list "left" section instead.
+	if len(queryRes.UserIDsToCount) == 0 {
+		log.WithField("user_id", output.UserID).Debug("syncapi: key change event has no other observers")
+	}
+	keyChangeObservers.WithLabelValues(s.keyChangeOrigin(output.UserID)).Observe(float64(len(queryRes.UserIDsToCount)))
+	userIDs := s.usersToNotify(output.UserID, queryRes)
+	if s.PersistDeviceListChanges {
+		if err = s.db.StoreDeviceListChange(s.ctx, userIDs, output.UserID, logPos); err != nil {
+			log.WithError(err).WithField("user_id", output.UserID).Error("syncapi: failed to store device list change")
+			return false, err
+		}
+	}
+	// Cross-signing key changes are reported to clients as device list
+	// changes, as /sync has no separate section for them, so both kinds
+	// of change advance the device list position.
 	posUpdate := types.StreamingToken{
-		DeviceListPosition: types.LogPosition{
-			Offset:    msg.Offset,
-			Partition: msg.Partition,
-		},
+		DeviceListPosition: logPos,
+	}
+	if err = s.notify(posUpdate, userIDs, output.UserID); err != nil {
+		// We're shutting down, so leave the message to be processed
+		// again after a restart.
+		return false, err
 	}
+	if deviceDeleted(output) {
+		s.notifier.OnDevicesDeleted(output.UserID, []string{output.DeviceID})
+	}
+	return true, nil
+}
+
+// deviceDeleted returns true if the key change is the deletion of a device,
+// which the key server sends as a device message with no keys. Per the
+// /sync device_lists contract, deletions are reported to the users who
+// share rooms with the owner as "changed", in the same way as new or
+// updated keys, and users who stop sharing rooms altogether are reported
+// as "left" based on membership when the sync is calculated. The only
+// difference is that the device's own sync stream is dropped.
+func deviceDeleted(output api.DeviceMessage) bool {
+	return output.Type == api.TypeDeviceKeyUpdate && output.DeviceID != "" && len(output.KeyJSON) == 0
+}
+
+// Replay notifies everyone about the key changes on the partition again,
+// starting from the given offset and ending with the last one that has
+// been processed, e.g. to recover from a bug that meant that some clients
+// missed them. Replayed key changes are reported at the current position
+// rather than their original one, so that /sync tokens don't go backwards,
+// and no offsets are committed. Replaying stops if the context is done.
+func (s *OutputKeyChangeEventConsumer) Replay(ctx context.Context, partition int32, fromOffset int64) error {
+	s.partitionToOffsetMu.Lock()
+	lastOffset, ok := s.partitionToOffset[partition]
+	s.partitionToOffsetMu.Unlock()
+	if !ok || fromOffset > lastOffset {
+		return nil
+	}
+
+	consumer := s.keyChangeConsumer
+	partitionConsumer, err := consumer.Consumer.ConsumePartition(consumer.Topic, partition, fromOffset)
+	if err != nil {
+		return fmt.Errorf("consumer.ConsumePartition: %w", err)
+	}
+	defer partitionConsumer.Close() // nolint: errcheck
+
+	replayed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg, ok := <-partitionConsumer.Messages():
+			if !ok {
+				return fmt.Errorf("partition %d closed while replaying", partition)
+			}
+			if msg.Offset > lastOffset {
+				return nil
+			}
+			if _, err = s.processKeyChange(msg, s.CurrentPosition()); err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"partition": msg.Partition,
+					"offset":    msg.Offset,
+				}).Warn("syncapi: failed to replay key change event")
+			}
+			replayed++
+			if msg.Offset == lastOffset {
+				log.WithFields(log.Fields{
+					"partition": partition,
+					"replayed":  replayed,
+				}).Info("syncapi: finished replaying key change events")
+				return nil
+			}
+		}
+	}
+}
+
+// keyChangeOrigin returns whether the user is one of ours, for labelling
+// metrics.
+func (s *OutputKeyChangeEventConsumer) keyChangeOrigin(userID string) string {
+	if _, domain, err := gomatrixserverlib.SplitID('@', userID); err == nil && domain == s.serverName {
+		return keyChangeOriginLocal
+	}
+	return keyChangeOriginRemote
+}
+
+// isBlocked returns true if the user belongs to a server in the
+// ServerBlocklist.
+func (s *OutputKeyChangeEventConsumer) isBlocked(userID string) bool {
+	if len(s.ServerBlocklist) == 0 {
+		return false
+	}
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		log.WithError(err).WithField("user_id", userID).Warn("syncapi: failed to work out the server of key change user")
+		return false
+	}
+	return s.ServerBlocklist[domain]
+}
+
+// ResyncUser wakes up everyone who shares a room with the user as if the
+// user's device keys had just changed, so that their clients fetch the
+// user's device list again, i.e. after recovering from a gap in the key
+// change stream that may have left them with a stale copy.
+func (s *OutputKeyChangeEventConsumer) ResyncUser(userID string) error {
+	queryRes, err := s.querySharedUsers(userID)
+	if err != nil {
+		return fmt.Errorf("s.querySharedUsers: %w", err)
+	}
+	posUpdate := types.StreamingToken{
+		DeviceListPosition: s.CurrentPosition(),
+	}
+	s.dispatch(posUpdate, s.usersToNotify(userID, queryRes), userID)
+	return nil
+}
+
+// usersToNotify returns the users who should be told that the keys of the
+// given user changed: everyone who shares a room with them and that this
+// consumer is responsible for, along with the user themselves. The users
+// are sorted so that they are always notified in the same order.
+func (s *OutputKeyChangeEventConsumer) usersToNotify(
+	changedUserID string, queryRes *roomserverAPI.QuerySharedUsersResponse,
+) []string {
+	userIDs := make([]string, 0, len(queryRes.UserIDsToCount)+1)
 	for userID := range queryRes.UserIDsToCount {
-		s.notifier.OnNewKeyChange(posUpdate, userID, output.UserID)
+		if userID == changedUserID {
+			continue
+		}
+		if s.UserFilter != nil && !s.UserFilter(userID) {
+			continue
+		}
+		userIDs = append(userIDs, userID)
+	}
+	// make sure we get our own key updates too!
+	userIDs = append(userIDs, changedUserID)
+	sort.Strings(userIDs)
+	return userIDs
+}
+
+// notify wakes up the given users about a key change, either straight away
+// or, if NotifyCoalesceWindow is set, once the window has passed, along with
+// anyone else who needs to know about later changes to the same user's keys.
+// If NotifyWorkers is set then the notification is queued for delivery
+// instead, and an error is returned if we stop before there is room for it.
+func (s *OutputKeyChangeEventConsumer) notify(
+	posUpdate types.StreamingToken, userIDs []string, changedUserID string,
+) error {
+	if s.NotifyCoalesceWindow <= 0 {
+		if s.NotifyWorkers > 0 {
+			return s.enqueue(queuedKeyChange{posUpdate, userIDs, changedUserID})
+		}
+		s.dispatch(posUpdate, userIDs, changedUserID)
+		return nil
+	}
+
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	if s.pending == nil {
+		s.pending = make(map[string]*pendingKeyChange)
+	}
+	p, ok := s.pending[changedUserID]
+	if !ok {
+		p = &pendingKeyChange{
+			userIDs: make(map[string]struct{}, len(userIDs)),
+		}
+		p.timer = time.AfterFunc(s.NotifyCoalesceWindow, func() {
+			s.pendingMu.Lock()
+			if s.pending[changedUserID] != p {
+				// Already flushed by Stop().
+				s.pendingMu.Unlock()
+				return
+			}
+			delete(s.pending, changedUserID)
+			s.pendingMu.Unlock()
+			s.dispatchPending(changedUserID, p)
+		})
+		s.pending[changedUserID] = p
+	}
+	p.posUpdate.ApplyUpdates(posUpdate)
+	for _, userID := range userIDs {
+		p.userIDs[userID] = struct{}{}
 	}
 	return nil
 }
+
+// enqueue queues the notification for the NotifyWorkers, starting them if
+// need be. If the queue is full then it blocks until there is room, so
+// that we don't consume key changes faster than we can notify about them.
+// Returns internal.ErrShutdown if we stop first.
+func (s *OutputKeyChangeEventConsumer) enqueue(n queuedKeyChange) error {
+	s.notifyOnce.Do(s.startNotifyWorkers)
+	if s.ctx.Err() != nil {
+		return internal.ErrShutdown
+	}
+	select {
+	case s.notifyQueue <- n:
+		return nil
+	default:
+	}
+	log.WithField("user_id", n.changedUserID).Debug("syncapi: key change notification queue is full, waiting for room")
+	select {
+	case s.notifyQueue <- n:
+		return nil
+	case <-s.ctx.Done():
+		return internal.ErrShutdown
+	}
+}
+
+// startNotifyWorkers starts the NotifyWorkers. They deliver any queued
+// notifications that are left when we stop before exiting.
+func (s *OutputKeyChangeEventConsumer) startNotifyWorkers() {
+	size := s.NotifyQueueSize
+	if size <= 0 {
+		size = defaultNotifyQueueSize
+	}
+	s.notifyQueue = make(chan queuedKeyChange, size)
+	for i := 0; i < s.NotifyWorkers; i++ {
+		s.notifyWorkers.Add(1)
+		go func() {
+			defer s.notifyWorkers.Done()
+			for {
+				select {
+				case n := <-s.notifyQueue:
+					s.dispatch(n.posUpdate, n.userIDs, n.changedUserID)
+				case <-s.ctx.Done():
+					for {
+						select {
+						case n := <-s.notifyQueue:
+							s.dispatch(n.posUpdate, n.userIDs, n.changedUserID)
+						default:
+							return
+						}
+					}
+				}
+			}
+		}()
+	}
+}
+
+// flushPendingNotifications sends any key change notifications that are
+// still being held back, without waiting for the coalescing window.
+func (s *OutputKeyChangeEventConsumer) flushPendingNotifications() {
+	s.pendingMu.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.pendingMu.Unlock()
+	for changedUserID, p := range pending {
+		p.timer.Stop()
+		s.dispatchPending(changedUserID, p)
+	}
+}
+
+func (s *OutputKeyChangeEventConsumer) dispatchPending(changedUserID string, p *pendingKeyChange) {
+	userIDs := make([]string, 0, len(p.userIDs))
+	for userID := range p.userIDs {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+	s.dispatch(p.posUpdate, userIDs, changedUserID)
+}
+
+func (s *OutputKeyChangeEventConsumer) dispatch(
+	posUpdate types.StreamingToken, userIDs []string, changedUserID string,
+) {
+	s.notifier.OnNewKeyChangeForUsers(posUpdate, userIDs, changedUserID)
+}
+
+// querySharedUsers asks the roomserver who shares rooms with the user,
+// retrying with backoff if the roomserver is temporarily unavailable, i.e.
+// because it is restarting.
+func (s *OutputKeyChangeEventConsumer) querySharedUsers(userID string) (*roomserverAPI.QuerySharedUsersResponse, error) {
+	var queryRes roomserverAPI.QuerySharedUsersResponse
+	err := s.retryQuery("QuerySharedUsers", func(ctx context.Context) error {
+		queryRes = roomserverAPI.QuerySharedUsersResponse{}
+		return s.rsAPI.QuerySharedUsers(ctx, &roomserverAPI.QuerySharedUsersRequest{
+			UserID: userID,
+		}, &queryRes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &queryRes, nil
+}
+
+// queryBulkSharedUsers asks the roomserver who shares rooms with each of
+// the users in a single request, retrying in the same way as
+// querySharedUsers.
+func (s *OutputKeyChangeEventConsumer) queryBulkSharedUsers(userIDs []string) (map[string]map[string]int, error) {
+	var queryRes roomserverAPI.QueryBulkSharedUsersResponse
+	err := s.retryQuery("QueryBulkSharedUsers", func(ctx context.Context) error {
+		queryRes = roomserverAPI.QueryBulkSharedUsersResponse{}
+		return s.rsAPI.QueryBulkSharedUsers(ctx, &roomserverAPI.QueryBulkSharedUsersRequest{
+			UserIDs: userIDs,
+		}, &queryRes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return queryRes.UserIDsToCount, nil
+}
+
+// retryQuery calls query until it succeeds, retrying with backoff for as
+// long as it fails transiently and we haven't been stopped.
+func (s *OutputKeyChangeEventConsumer) retryQuery(name string, query func(ctx context.Context) error) error {
+	delay := s.queryRetryDelay
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(s.ctx, keyChangeQueryTimeout)
+		err := query(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if attempt >= keyChangeQueryAttempts || !isTransientQueryError(err) || s.ctx.Err() != nil {
+			return err
+		}
+		log.WithError(err).WithField("attempt", attempt).Warnf("syncapi: retrying %s in %s", name, delay)
+		select {
+		case <-time.After(delay):
+		case <-s.ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// isTransientQueryError returns true if the roomserver query failed in a
+// way that might succeed if we try again, such as a timeout or not being
+// able to connect.
+func isTransientQueryError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
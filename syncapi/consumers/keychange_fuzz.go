@@ -0,0 +1,47 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build gofuzz
+// +build gofuzz
+
+package consumers
+
+import (
+	"github.com/Shopify/sarama"
+)
+
+// FuzzDecodeKeyChange is a go-fuzz target for decoding key change events
+// from the key server. Build it with:
+//
+//	go-fuzz-build -func FuzzDecodeKeyChange github.com/matrix-org/dendrite/syncapi/consumers
+func FuzzDecodeKeyChange(data []byte) int {
+	s := &OutputKeyChangeEventConsumer{}
+	output, skip, err := s.decodeKeyChange(&sarama.ConsumerMessage{Value: data})
+	if err != nil {
+		if !skip {
+			panic("key change event that failed to decode wasn't skipped")
+		}
+		return 0
+	}
+	if skip {
+		return 0
+	}
+	if output.UserID == "" || len(output.UserID) > maxKeyChangeUserIDLength {
+		panic("key change event with an invalid user ID wasn't skipped")
+	}
+	if len(data) > defaultMaxKeyChangeMessageSize {
+		panic("key change event that is too large wasn't skipped")
+	}
+	return 1
+}
@@ -0,0 +1,1851 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	keyapi "github.com/matrix-org/dendrite/keyserver/api"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var (
+	alice = "@alice:localhost"
+	bob   = "@bob:localhost"
+	carol = "@carol:localhost"
+)
+
+type keyChangeNotification struct {
+	pos         types.StreamingToken
+	wakeUserIDs []string
+	changedUser string
+}
+
+type mockKeyChangeNotifier struct {
+	sync.Mutex
+	notifications  []keyChangeNotification
+	deletedDevices map[string][]string // by user ID
+}
+
+func (n *mockKeyChangeNotifier) OnNewKeyChangeForUsers(posUpdate types.StreamingToken, wakeUserIDs []string, keyChangeUserID string) {
+	n.Lock()
+	defer n.Unlock()
+	sorted := append([]string{}, wakeUserIDs...)
+	sort.Strings(sorted)
+	n.notifications = append(n.notifications, keyChangeNotification{
+		pos:         posUpdate,
+		wakeUserIDs: sorted,
+		changedUser: keyChangeUserID,
+	})
+}
+
+func (n *mockKeyChangeNotifier) OnDevicesDeleted(userID string, deviceIDs []string) {
+	n.Lock()
+	defer n.Unlock()
+	if n.deletedDevices == nil {
+		n.deletedDevices = make(map[string][]string)
+	}
+	n.deletedDevices[userID] = append(n.deletedDevices[userID], deviceIDs...)
+}
+
+type mockRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPITrace
+	// A map of user ID => users who share a room with them
+	sharedUsers map[string][]string
+	queries     int
+	bulkQueries int
+	err         error
+	// The number of queries that should fail as if the roomserver
+	// couldn't be reached, before any succeed.
+	transientFailures int
+	// If set, QuerySharedUsers signals on this channel and then blocks
+	// until its context is done.
+	blocked chan struct{}
+}
+
+// QuerySharedUsers returns a list of users who share at least 1 room in common with the given user.
+func (s *mockRoomserverAPI) QuerySharedUsers(ctx context.Context, req *roomserverAPI.QuerySharedUsersRequest, res *roomserverAPI.QuerySharedUsersResponse) error {
+	s.queries++
+	if s.blocked != nil {
+		close(s.blocked)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if s.queries <= s.transientFailures {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+	if s.err != nil {
+		return s.err
+	}
+	res.UserIDsToCount = make(map[string]int)
+	for _, userID := range s.sharedUsers[req.UserID] {
+		res.UserIDsToCount[userID]++
+	}
+	return nil
+}
+
+// QueryBulkSharedUsers returns the users who share a room with each of the given users.
+func (s *mockRoomserverAPI) QueryBulkSharedUsers(ctx context.Context, req *roomserverAPI.QueryBulkSharedUsersRequest, res *roomserverAPI.QueryBulkSharedUsersResponse) error {
+	s.bulkQueries++
+	if s.err != nil {
+		return s.err
+	}
+	res.UserIDsToCount = make(map[string]map[string]int)
+	for _, userID := range req.UserIDs {
+		res.UserIDsToCount[userID] = make(map[string]int)
+		for _, sharedUserID := range s.sharedUsers[userID] {
+			res.UserIDsToCount[userID][sharedUserID]++
+		}
+	}
+	return nil
+}
+
+type mockPartitionStore struct {
+	sync.Mutex
+	offsets map[int32]int64
+}
+
+func (p *mockPartitionStore) PartitionOffsets(ctx context.Context, topic string) ([]sqlutil.PartitionOffset, error) {
+	p.Lock()
+	defer p.Unlock()
+	var offsets []sqlutil.PartitionOffset
+	for partition, offset := range p.offsets {
+		offsets = append(offsets, sqlutil.PartitionOffset{Partition: partition, Offset: offset})
+	}
+	return offsets, nil
+}
+
+func (p *mockPartitionStore) SetPartitionOffset(ctx context.Context, topic string, partition int32, offset int64) error {
+	p.Lock()
+	defer p.Unlock()
+	p.offsets[partition] = offset
+	return nil
+}
+
+func newTestKeyChangeConsumer(rsAPI roomserverAPI.RoomserverInternalAPI) (*OutputKeyChangeEventConsumer, *mockKeyChangeNotifier) {
+	n := &mockKeyChangeNotifier{}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &OutputKeyChangeEventConsumer{
+		keyChangeConsumer: &internal.ContinualConsumer{
+			Topic:          "keychange",
+			PartitionStore: &mockPartitionStore{offsets: make(map[int32]int64)},
+			ManualCommit:   true,
+		},
+		serverName:        "localhost",
+		rsAPI:             rsAPI,
+		partitionToOffset: make(map[int32]int64),
+		notifier:          n,
+		ctx:               ctx,
+		cancel:            cancel,
+		queryRetryDelay:   time.Millisecond,
+	}, n
+}
+
+func deviceMessage(t *testing.T, partition int32, offset int64, dm keyapi.DeviceMessage) *sarama.ConsumerMessage {
+	value, err := json.Marshal(dm)
+	if err != nil {
+		t.Fatalf("failed to marshal device message: %s", err)
+	}
+	return &sarama.ConsumerMessage{
+		Partition: partition,
+		Offset:    offset,
+		Value:     value,
+	}
+}
+
+func TestKeyChangeConsumerRequiresNotifier(t *testing.T) {
+	consumer, err := NewOutputKeyChangeEventConsumer("localhost", "keychange", nil, nil, nil, &mockRoomserverAPI{}, nil)
+	if err == nil {
+		t.Fatalf("expected an error when creating a consumer without a notifier")
+	}
+	if consumer != nil {
+		t.Fatalf("expected no consumer to be returned without a notifier")
+	}
+}
+
+func TestKeyChangeAddedAndRemovedDevices(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			alice: {alice, bob},
+		},
+	}
+	consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+
+	added := keyapi.DeviceMessage{
+		DeviceKeys: keyapi.DeviceKeys{
+			UserID:   alice,
+			DeviceID: "ADDED",
+			KeyJSON:  []byte(`{"keys":{}}`),
+		},
+		StreamID: 1,
+	}
+	removed := keyapi.DeviceMessage{
+		DeviceKeys: keyapi.DeviceKeys{
+			UserID:   alice,
+			DeviceID: "REMOVED",
+		},
+		StreamID: 2,
+	}
+	if err := consumer.onMessage(deviceMessage(t, 0, 1, added)); err != nil {
+		t.Fatalf("failed to process added device: %s", err)
+	}
+	if err := consumer.onMessage(deviceMessage(t, 0, 2, removed)); err != nil {
+		t.Fatalf("failed to process removed device: %s", err)
+	}
+
+	want := []keyChangeNotification{
+		{
+			pos:         types.StreamingToken{DeviceListPosition: types.LogPosition{Partition: 0, Offset: 1}},
+			wakeUserIDs: []string{alice, bob},
+			changedUser: alice,
+		},
+		{
+			pos:         types.StreamingToken{DeviceListPosition: types.LogPosition{Partition: 0, Offset: 2}},
+			wakeUserIDs: []string{alice, bob},
+			changedUser: alice,
+		},
+	}
+	if !reflect.DeepEqual(notifier.notifications, want) {
+		t.Fatalf("unexpected notifications:\n got %+v\nwant %+v", notifier.notifications, want)
+	}
+	// Only the removed device is reported as deleted.
+	wantDeleted := map[string][]string{alice: {"REMOVED"}}
+	if !reflect.DeepEqual(notifier.deletedDevices, wantDeleted) {
+		t.Fatalf("unexpected deleted devices:\n got %v\nwant %v", notifier.deletedDevices, wantDeleted)
+	}
+}
+
+func TestKeyChangeAfterLeavingAllRooms(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			// alice used to share rooms with bob and carol but has left
+			// all of them, so the roomserver returns nobody.
+			alice: {},
+			bob:   {bob, carol},
+		},
+	}
+	consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+
+	msg := keyapi.DeviceMessage{
+		DeviceKeys: keyapi.DeviceKeys{
+			UserID:   alice,
+			DeviceID: "DEVICE",
+			KeyJSON:  []byte(`{"keys":{}}`),
+		},
+	}
+	if err := consumer.onMessage(deviceMessage(t, 0, 1, msg)); err != nil {
+		t.Fatalf("failed to process key change: %s", err)
+	}
+	if len(notifier.notifications) != 1 {
+		t.Fatalf("expected one notification, got %d", len(notifier.notifications))
+	}
+	if got := notifier.notifications[0].wakeUserIDs; !reflect.DeepEqual(got, []string{alice}) {
+		t.Fatalf("expected only alice to be notified, got %v", got)
+	}
+}
+
+func TestKeyChangeErrorDoesNotAdvanceOffset(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			alice: {alice, bob},
+		},
+	}
+	consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+	store := consumer.keyChangeConsumer.PartitionStore.(*mockPartitionStore)
+
+	msg := keyapi.DeviceMessage{
+		DeviceKeys: keyapi.DeviceKeys{
+			UserID:   alice,
+			DeviceID: "DEVICE",
+			KeyJSON:  []byte(`{"keys":{}}`),
+		},
+	}
+	if err := consumer.onMessage(deviceMessage(t, 0, 1, msg)); err != nil {
+		t.Fatalf("failed to process key change: %s", err)
+	}
+
+	rsAPI.err = errors.New("roomserver unavailable")
+	if err := consumer.onMessage(deviceMessage(t, 0, 2, msg)); err == nil {
+		t.Fatalf("expected an error when the roomserver query fails")
+	}
+	if len(notifier.notifications) != 1 {
+		t.Fatalf("expected one notification, got %d", len(notifier.notifications))
+	}
+	if offset := consumer.partitionToOffset[0]; offset != 1 {
+		t.Fatalf("expected in-memory offset to stay at 1, got %d", offset)
+	}
+	if offset := store.offsets[0]; offset != 1 {
+		t.Fatalf("expected stored offset to stay at 1, got %d", offset)
+	}
+}
+
+func TestKeyChangeSuccessAfterErrorDoesNotAdvanceOffset(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			alice: {alice, bob},
+		},
+	}
+	consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+	store := consumer.keyChangeConsumer.PartitionStore.(*mockPartitionStore)
+
+	msg := keyapi.DeviceMessage{
+		DeviceKeys: keyapi.DeviceKeys{
+			UserID:   alice,
+			DeviceID: "DEVICE",
+			KeyJSON:  []byte(`{"keys":{}}`),
+		},
+	}
+	if err := consumer.onMessage(deviceMessage(t, 0, 1, msg)); err != nil {
+		t.Fatalf("failed to process key change: %s", err)
+	}
+	rsAPI.err = errors.New("roomserver unavailable")
+	if err := consumer.onMessage(deviceMessage(t, 0, 2, msg)); err == nil {
+		t.Fatalf("expected an error when the roomserver query fails")
+	}
+	rsAPI.err = nil
+	if err := consumer.onMessage(deviceMessage(t, 0, 3, msg)); err != nil {
+		t.Fatalf("failed to process key change: %s", err)
+	}
+	if len(notifier.notifications) != 2 {
+		t.Fatalf("expected two notifications, got %d", len(notifier.notifications))
+	}
+
+	// Committing offset 3 would mean that the failed key change at offset
+	// 2 is never processed again, even after a restart.
+	if offset := consumer.partitionToOffset[0]; offset != 1 {
+		t.Fatalf("expected in-memory offset to stay at 1, got %d", offset)
+	}
+	if offset := store.offsets[0]; offset != 1 {
+		t.Fatalf("expected stored offset to stay at 1, got %d", offset)
+	}
+	consumer.Stop()
+	if offset := store.offsets[0]; offset != 1 {
+		t.Fatalf("expected offset 1 to be flushed on stop, got %d", offset)
+	}
+}
+
+func TestKeyChangeStopUnblocksQuery(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		blocked: make(chan struct{}),
+	}
+	consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+
+	msg := keyapi.DeviceMessage{
+		DeviceKeys: keyapi.DeviceKeys{
+			UserID:   alice,
+			DeviceID: "DEVICE",
+			KeyJSON:  []byte(`{"keys":{}}`),
+		},
+	}
+	consumerMsg := deviceMessage(t, 0, 1, msg)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- consumer.onMessage(consumerMsg)
+	}()
+
+	<-rsAPI.blocked
+	consumer.Stop()
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatalf("expected an error after the consumer was stopped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("onMessage did not return after the consumer was stopped")
+	}
+	if len(notifier.notifications) != 0 {
+		t.Fatalf("expected no notifications, got %d", len(notifier.notifications))
+	}
+	if _, ok := consumer.partitionToOffset[0]; ok {
+		t.Fatalf("expected the offset not to be committed")
+	}
+}
+
+func TestKeyChangeCurrentPositionAdvances(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			alice: {alice, bob},
+		},
+	}
+	consumer, _ := newTestKeyChangeConsumer(rsAPI)
+
+	if pos := consumer.CurrentPosition(); !pos.IsEmpty() {
+		t.Fatalf("expected an empty position before consuming, got %+v", pos)
+	}
+	msg := keyapi.DeviceMessage{
+		DeviceKeys: keyapi.DeviceKeys{
+			UserID:   alice,
+			DeviceID: "DEVICE",
+			KeyJSON:  []byte(`{"keys":{}}`),
+		},
+	}
+	var last types.LogPosition
+	for offset := int64(1); offset <= 5; offset++ {
+		if err := consumer.onMessage(deviceMessage(t, 0, offset, msg)); err != nil {
+			t.Fatalf("failed to process key change: %s", err)
+		}
+		pos := consumer.CurrentPosition()
+		if !pos.IsAfter(&last) {
+			t.Fatalf("expected position %+v to be after %+v", pos, last)
+		}
+		last = pos
+	}
+	if last.Offset != 5 {
+		t.Fatalf("expected final offset 5, got %d", last.Offset)
+	}
+
+	// A failed message must not move the position.
+	rsAPI.err = errors.New("roomserver unavailable")
+	if err := consumer.onMessage(deviceMessage(t, 0, 6, msg)); err == nil {
+		t.Fatalf("expected an error when the roomserver query fails")
+	}
+	if pos := consumer.CurrentPosition(); pos != last {
+		t.Fatalf("expected position to stay at %+v, got %+v", last, pos)
+	}
+}
+
+// blockingKeyChangeNotifier holds up each device key change notification
+// until release is closed.
+type blockingKeyChangeNotifier struct {
+	*mockKeyChangeNotifier
+	started chan struct{}
+	release chan struct{}
+}
+
+func (n *blockingKeyChangeNotifier) OnNewKeyChangeForUsers(posUpdate types.StreamingToken, wakeUserIDs []string, keyChangeUserID string) {
+	n.started <- struct{}{}
+	<-n.release
+	n.mockKeyChangeNotifier.OnNewKeyChangeForUsers(posUpdate, wakeUserIDs, keyChangeUserID)
+}
+
+// newBlockedAsyncKeyChangeConsumer returns a consumer with a single notify
+// worker and room for one queued notification, which has processed key
+// changes at offsets 1 and 2 so that the worker is stuck delivering the
+// first and the second is filling the queue.
+func newBlockedAsyncKeyChangeConsumer(t *testing.T) (*OutputKeyChangeEventConsumer, *blockingKeyChangeNotifier, keyapi.DeviceMessage) {
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			alice: {alice, bob},
+		},
+	}
+	consumer, mock := newTestKeyChangeConsumer(rsAPI)
+	notifier := &blockingKeyChangeNotifier{
+		mockKeyChangeNotifier: mock,
+		started:               make(chan struct{}, 10),
+		release:               make(chan struct{}),
+	}
+	consumer.notifier = notifier
+	consumer.NotifyWorkers = 1
+	consumer.NotifyQueueSize = 1
+
+	msg := keyapi.DeviceMessage{
+		DeviceKeys: keyapi.DeviceKeys{
+			UserID:   alice,
+			DeviceID: "DEVICE",
+			KeyJSON:  []byte(`{"keys":{}}`),
+		},
+	}
+	if err := consumer.onMessage(deviceMessage(t, 0, 1, msg)); err != nil {
+		t.Fatalf("failed to process key change: %s", err)
+	}
+	select {
+	case <-notifier.started:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the notify worker to start delivering the first notification")
+	}
+	if err := consumer.onMessage(deviceMessage(t, 0, 2, msg)); err != nil {
+		t.Fatalf("failed to process key change: %s", err)
+	}
+	if pos := consumer.CurrentPosition(); pos.Offset != 2 {
+		t.Fatalf("expected the offset to advance once the notification was queued, got %+v", pos)
+	}
+	return consumer, notifier, msg
+}
+
+func TestKeyChangeAsyncNotificationBackpressure(t *testing.T) {
+	consumer, notifier, msg := newBlockedAsyncKeyChangeConsumer(t)
+
+	// The queue is full, so the next key change has to wait for room.
+	done := make(chan error, 1)
+	go func() {
+		done <- consumer.onMessage(deviceMessage(t, 0, 3, msg))
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expected processing to block while the notification queue is full, got %v", err)
+	case <-time.After(time.Millisecond * 50):
+	}
+	if pos := consumer.CurrentPosition(); pos.Offset != 2 {
+		t.Fatalf("expected the offset not to advance while the notification queue is full, got %+v", pos)
+	}
+
+	close(notifier.release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("failed to process key change: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected processing to continue once there was room in the notification queue")
+	}
+	if pos := consumer.CurrentPosition(); pos.Offset != 3 {
+		t.Fatalf("expected the offset to advance once the notification was queued, got %+v", pos)
+	}
+
+	consumer.Stop()
+	notifier.Lock()
+	defer notifier.Unlock()
+	if len(notifier.notifications) != 3 {
+		t.Fatalf("expected all 3 notifications to be delivered by Stop, got %d", len(notifier.notifications))
+	}
+}
+
+func TestKeyChangeAsyncNotificationQueueFullAtShutdown(t *testing.T) {
+	consumer, notifier, msg := newBlockedAsyncKeyChangeConsumer(t)
+	defer close(notifier.release)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- consumer.onMessage(deviceMessage(t, 0, 3, msg))
+	}()
+	time.Sleep(time.Millisecond * 20)
+	consumer.cancel()
+	select {
+	case err := <-done:
+		if err != internal.ErrShutdown {
+			t.Fatalf("expected ErrShutdown when stopping with a full notification queue, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected processing to stop when the consumer was stopped")
+	}
+	if pos := consumer.CurrentPosition(); pos.Offset != 2 {
+		t.Fatalf("expected the offset of the unqueued key change not to be committed, got %+v", pos)
+	}
+}
+
+func TestKeyChangeBatchedQueriesMatchPerMessageQueries(t *testing.T) {
+	sharedUsers := map[string][]string{
+		alice: {alice, bob},
+		bob:   {alice, bob, carol},
+		carol: {bob, carol},
+	}
+	messages := []keyapi.DeviceMessage{
+		{DeviceKeys: keyapi.DeviceKeys{UserID: alice, DeviceID: "A", KeyJSON: []byte(`{"keys":{}}`)}},
+		{DeviceKeys: keyapi.DeviceKeys{UserID: bob, DeviceID: "B", KeyJSON: []byte(`{"keys":{}}`)}},
+		{DeviceKeys: keyapi.DeviceKeys{UserID: alice, DeviceID: "A2", KeyJSON: []byte(`{"keys":{}}`)}},
+		{DeviceKeys: keyapi.DeviceKeys{UserID: carol, DeviceID: "C", KeyJSON: []byte(`{"keys":{}}`)}},
+	}
+	run := func(batchSize int) (*mockRoomserverAPI, *OutputKeyChangeEventConsumer, []keyChangeNotification) {
+		rsAPI := &mockRoomserverAPI{sharedUsers: sharedUsers}
+		consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+		consumer.QueryBatchSize = batchSize
+		consumer.QueryBatchWindow = time.Hour
+		for i, msg := range messages {
+			if err := consumer.onMessage(deviceMessage(t, 0, int64(i+1), msg)); err != nil {
+				t.Fatalf("failed to process key change: %s", err)
+			}
+		}
+		notifier.Lock()
+		defer notifier.Unlock()
+		return rsAPI, consumer, notifier.notifications
+	}
+
+	perMessageAPI, _, perMessage := run(0)
+	batchedAPI, batchedConsumer, batched := run(len(messages))
+	if !reflect.DeepEqual(batched, perMessage) {
+		t.Fatalf("expected batching to notify the same users:\n got %+v\nwant %+v", batched, perMessage)
+	}
+	if perMessageAPI.queries != len(messages) || perMessageAPI.bulkQueries != 0 {
+		t.Fatalf("expected %d QuerySharedUsers requests without batching, got %d (and %d bulk)", len(messages), perMessageAPI.queries, perMessageAPI.bulkQueries)
+	}
+	if batchedAPI.queries != 0 || batchedAPI.bulkQueries != 1 {
+		t.Fatalf("expected a single QueryBulkSharedUsers request with batching, got %d (and %d single)", batchedAPI.bulkQueries, batchedAPI.queries)
+	}
+	if pos := batchedConsumer.CurrentPosition(); pos.Offset != int64(len(messages)) {
+		t.Fatalf("expected the whole batch to be committed, got %+v", pos)
+	}
+}
+
+func TestKeyChangeBatchIsProcessedAfterWindow(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			alice: {alice, bob},
+		},
+	}
+	consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+	consumer.QueryBatchSize = 10
+	consumer.QueryBatchWindow = time.Millisecond * 20
+
+	msg := keyapi.DeviceMessage{
+		DeviceKeys: keyapi.DeviceKeys{
+			UserID:   alice,
+			DeviceID: "DEVICE",
+			KeyJSON:  []byte(`{"keys":{}}`),
+		},
+	}
+	if err := consumer.onMessage(deviceMessage(t, 0, 1, msg)); err != nil {
+		t.Fatalf("failed to process key change: %s", err)
+	}
+	if pos := consumer.CurrentPosition(); !pos.IsEmpty() {
+		t.Fatalf("expected the offset not to be committed while the batch is waiting, got %+v", pos)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := consumer.WaitForPosition(ctx, types.LogPosition{Partition: 0, Offset: 1}); err != nil {
+		t.Fatalf("expected the batch to be processed once the window had passed: %s", err)
+	}
+	notifier.Lock()
+	defer notifier.Unlock()
+	if len(notifier.notifications) != 1 {
+		t.Fatalf("expected 1 notification, got %d", len(notifier.notifications))
+	}
+}
+
+func TestKeyChangeBatchFailureAfterWindowHaltsConsumer(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		err: errors.New("roomserver unavailable"),
+	}
+	consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+	store := consumer.keyChangeConsumer.PartitionStore.(*mockPartitionStore)
+	consumer.QueryBatchSize = 10
+	consumer.QueryBatchWindow = time.Millisecond * 20
+	consumer.HaltOnQueryFailure = true
+	consumer.partitionToOffset[0] = 1
+
+	msg := keyapi.DeviceMessage{
+		DeviceKeys: keyapi.DeviceKeys{
+			UserID:   alice,
+			DeviceID: "DEVICE",
+			KeyJSON:  []byte(`{"keys":{}}`),
+		},
+	}
+	if err := consumer.onMessage(deviceMessage(t, 0, 2, msg)); err != nil {
+		t.Fatalf("failed to batch key change: %s", err)
+	}
+
+	// Wait for the batch to be processed once the window has passed.
+	deadline := time.Now().Add(time.Second)
+	for {
+		consumer.batchMu.Lock()
+		processed := consumer.batchTimer == nil && len(consumer.batch) == 0
+		consumer.batchMu.Unlock()
+		if processed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the batch to be processed once the window had passed")
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	// The failure is returned for the next key change, which isn't
+	// processed as we're halting.
+	if err := consumer.onMessage(deviceMessage(t, 0, 3, msg)); err != internal.ErrShutdown {
+		t.Fatalf("expected the consumer to halt, got %v", err)
+	}
+	if len(notifier.notifications) != 0 {
+		t.Fatalf("expected no notifications, got %d", len(notifier.notifications))
+	}
+	consumer.Stop()
+	if offset := store.offsets[0]; offset != 1 {
+		t.Fatalf("expected the offset to stay at 1, got %d", offset)
+	}
+}
+
+func TestKeyChangeStopReturnsPromptly(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		blocked: make(chan struct{}),
+	}
+	consumer, _ := newTestKeyChangeConsumer(rsAPI)
+	store := consumer.keyChangeConsumer.PartitionStore.(*mockPartitionStore)
+	consumer.partitionToOffset[0] = 41
+
+	consumerMsg := deviceMessage(t, 0, 42, keyapi.DeviceMessage{
+		DeviceKeys: keyapi.DeviceKeys{
+			UserID:   alice,
+			DeviceID: "DEVICE",
+			KeyJSON:  []byte(`{"keys":{}}`),
+		},
+	})
+	processed := make(chan struct{})
+	go func() {
+		defer close(processed)
+		_ = consumer.onMessage(consumerMsg)
+	}()
+	<-rsAPI.blocked
+
+	stopped := make(chan struct{})
+	go func() {
+		consumer.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Stop did not return while a message was being processed")
+	}
+	<-processed
+
+	// The in-flight message didn't complete, so only the offset that we
+	// had already reached should have been flushed.
+	if offset, ok := store.offsets[0]; !ok || offset != 41 {
+		t.Fatalf("expected offset 41 to be flushed, got %d (found: %v)", offset, ok)
+	}
+}
+
+func TestKeyChangeWithoutUserIDIsSkipped(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			"": {alice, bob},
+		},
+	}
+	consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+
+	msg := keyapi.DeviceMessage{
+		DeviceKeys: keyapi.DeviceKeys{
+			DeviceID: "DEVICE",
+			KeyJSON:  []byte(`{"keys":{}}`),
+		},
+	}
+	if err := consumer.onMessage(deviceMessage(t, 0, 1, msg)); err != nil {
+		t.Fatalf("expected the message to be skipped without an error, got %s", err)
+	}
+	if rsAPI.queries != 0 {
+		t.Fatalf("expected no roomserver queries, got %d", rsAPI.queries)
+	}
+	if len(notifier.notifications) != 0 {
+		t.Fatalf("expected no notifications, got %d", len(notifier.notifications))
+	}
+	// The message can never succeed, so we shouldn't see it again.
+	if pos := consumer.CurrentPosition(); pos.Offset != 1 {
+		t.Fatalf("expected the offset to be committed, got %d", pos.Offset)
+	}
+}
+
+func TestKeyChangeRetriesTransientRoomserverFailures(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			alice: {alice, bob},
+		},
+		transientFailures: 2,
+	}
+	consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+
+	msg := keyapi.DeviceMessage{
+		DeviceKeys: keyapi.DeviceKeys{
+			UserID:   alice,
+			DeviceID: "DEVICE",
+			KeyJSON:  []byte(`{"keys":{}}`),
+		},
+	}
+	if err := consumer.onMessage(deviceMessage(t, 0, 1, msg)); err != nil {
+		t.Fatalf("failed to process key change: %s", err)
+	}
+	if rsAPI.queries != 3 {
+		t.Fatalf("expected three roomserver queries, got %d", rsAPI.queries)
+	}
+	if len(notifier.notifications) != 1 {
+		t.Fatalf("expected one notification, got %d", len(notifier.notifications))
+	}
+	if pos := consumer.CurrentPosition(); pos.Offset != 1 {
+		t.Fatalf("expected the offset to be committed, got %d", pos.Offset)
+	}
+}
+
+func TestKeyChangeHaltsAfterRetriesWhenConfigured(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		transientFailures: keyChangeQueryAttempts,
+	}
+	consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+	consumer.HaltOnQueryFailure = true
+
+	msg := keyapi.DeviceMessage{
+		DeviceKeys: keyapi.DeviceKeys{
+			UserID:   alice,
+			DeviceID: "DEVICE",
+			KeyJSON:  []byte(`{"keys":{}}`),
+		},
+	}
+	if err := consumer.onMessage(deviceMessage(t, 0, 1, msg)); err != internal.ErrShutdown {
+		t.Fatalf("expected the consumer to halt, got %v", err)
+	}
+	if rsAPI.queries != keyChangeQueryAttempts {
+		t.Fatalf("expected %d roomserver queries, got %d", keyChangeQueryAttempts, rsAPI.queries)
+	}
+	if len(notifier.notifications) != 0 {
+		t.Fatalf("expected no notifications, got %d", len(notifier.notifications))
+	}
+	if _, ok := consumer.partitionToOffset[0]; ok {
+		t.Fatalf("expected the offset not to be committed")
+	}
+}
+
+func TestKeyChangeCrossSigningUpdate(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			alice: {alice, bob},
+		},
+	}
+	consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+
+	device := keyapi.DeviceMessage{
+		DeviceKeys: keyapi.DeviceKeys{
+			UserID:   alice,
+			DeviceID: "DEVICE",
+			KeyJSON:  []byte(`{"keys":{}}`),
+		},
+	}
+	crossSigning := keyapi.DeviceMessage{
+		Type: keyapi.TypeCrossSigningKeyUpdate,
+		DeviceKeys: keyapi.DeviceKeys{
+			UserID: alice,
+		},
+		CrossSigningKeyUpdate: &keyapi.CrossSigningKeyUpdate{
+			MasterKey: []byte(`{"keys":{}}`),
+		},
+	}
+	if err := consumer.onMessage(deviceMessage(t, 0, 1, device)); err != nil {
+		t.Fatalf("failed to process device key change: %s", err)
+	}
+	if err := consumer.onMessage(deviceMessage(t, 0, 2, crossSigning)); err != nil {
+		t.Fatalf("failed to process cross-signing key change: %s", err)
+	}
+
+	// Both kinds of change are reported as device list changes, as that
+	// is the only position that /sync looks at.
+	want := []keyChangeNotification{
+		{
+			pos:         types.StreamingToken{DeviceListPosition: types.LogPosition{Partition: 0, Offset: 1}},
+			wakeUserIDs: []string{alice, bob},
+			changedUser: alice,
+		},
+		{
+			pos:         types.StreamingToken{DeviceListPosition: types.LogPosition{Partition: 0, Offset: 2}},
+			wakeUserIDs: []string{alice, bob},
+			changedUser: alice,
+		},
+	}
+	if !reflect.DeepEqual(notifier.notifications, want) {
+		t.Fatalf("unexpected notifications:\n got %+v\nwant %+v", notifier.notifications, want)
+	}
+	if pos := consumer.CurrentPosition(); pos.Offset != 2 {
+		t.Fatalf("expected the cross-signing update to be committed, got offset %d", pos.Offset)
+	}
+}
+
+func TestKeyChangeNotificationsAreCoalesced(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			alice: {alice, bob},
+		},
+	}
+	consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+	consumer.NotifyCoalesceWindow = time.Millisecond * 50
+
+	for offset := int64(1); offset <= 2; offset++ {
+		msg := keyapi.DeviceMessage{
+			DeviceKeys: keyapi.DeviceKeys{
+				UserID:   alice,
+				DeviceID: "DEVICE",
+				KeyJSON:  []byte(`{"keys":{}}`),
+			},
+		}
+		if err := consumer.onMessage(deviceMessage(t, 0, offset, msg)); err != nil {
+			t.Fatalf("failed to process key change: %s", err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		notifier.Lock()
+		n := len(notifier.notifications)
+		notifier.Unlock()
+		if n > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	// Give any further notifications a chance to arrive.
+	time.Sleep(consumer.NotifyCoalesceWindow * 2)
+
+	notifier.Lock()
+	defer notifier.Unlock()
+	want := []keyChangeNotification{
+		{
+			pos:         types.StreamingToken{DeviceListPosition: types.LogPosition{Partition: 0, Offset: 2}},
+			wakeUserIDs: []string{alice, bob},
+			changedUser: alice,
+		},
+	}
+	if !reflect.DeepEqual(notifier.notifications, want) {
+		t.Fatalf("expected a single coalesced notification:\n got %+v\nwant %+v", notifier.notifications, want)
+	}
+}
+
+func TestKeyChangeStopFlushesCoalescedNotifications(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			alice: {alice, bob},
+		},
+	}
+	consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+	consumer.NotifyCoalesceWindow = time.Hour
+
+	msg := keyapi.DeviceMessage{
+		DeviceKeys: keyapi.DeviceKeys{
+			UserID:   alice,
+			DeviceID: "DEVICE",
+			KeyJSON:  []byte(`{"keys":{}}`),
+		},
+	}
+	if err := consumer.onMessage(deviceMessage(t, 0, 1, msg)); err != nil {
+		t.Fatalf("failed to process key change: %s", err)
+	}
+	if len(notifier.notifications) != 0 {
+		t.Fatalf("expected the notification to be held back")
+	}
+	consumer.Stop()
+	if len(notifier.notifications) != 1 {
+		t.Fatalf("expected Stop to send the held back notification, got %d", len(notifier.notifications))
+	}
+}
+
+func TestKeyChangeRedeliveredMessageIsSkipped(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			alice: {alice, bob},
+		},
+	}
+	consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+
+	msg := deviceMessage(t, 0, 1, keyapi.DeviceMessage{
+		DeviceKeys: keyapi.DeviceKeys{
+			UserID:   alice,
+			DeviceID: "DEVICE",
+			KeyJSON:  []byte(`{"keys":{}}`),
+		},
+	})
+	for i := 0; i < 2; i++ {
+		if err := consumer.onMessage(msg); err != nil {
+			t.Fatalf("failed to process key change: %s", err)
+		}
+	}
+	if len(notifier.notifications) != 1 {
+		t.Fatalf("expected one notification for a redelivered message, got %d", len(notifier.notifications))
+	}
+	if rsAPI.queries != 1 {
+		t.Fatalf("expected the redelivered message to be dropped before querying the roomserver, got %d queries", rsAPI.queries)
+	}
+
+	// Messages on other partitions are tracked separately.
+	other := *msg
+	other.Partition = 1
+	if err := consumer.onMessage(&other); err != nil {
+		t.Fatalf("failed to process key change: %s", err)
+	}
+	if len(notifier.notifications) != 2 {
+		t.Fatalf("expected a notification for the other partition, got %d in total", len(notifier.notifications))
+	}
+}
+
+func TestKeyChangeStrictOrdering(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			alice: {alice, bob},
+		},
+	}
+	consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+	consumer.StrictOrdering = true
+	consumer.partitionToOffset[0] = 0
+
+	msg := func(offset int64) *sarama.ConsumerMessage {
+		return deviceMessage(t, 0, offset, keyapi.DeviceMessage{
+			DeviceKeys: keyapi.DeviceKeys{
+				UserID:   alice,
+				DeviceID: "DEVICE",
+				KeyJSON:  []byte(`{"keys":{}}`),
+			},
+		})
+	}
+	offsets := func() []int64 {
+		var got []int64
+		for _, n := range notifier.notifications {
+			got = append(got, n.pos.DeviceListPosition.Offset)
+		}
+		return got
+	}
+
+	// Messages that arrive before the ones that come before them are held
+	// back.
+	for _, offset := range []int64{3, 2} {
+		if err := consumer.onMessage(msg(offset)); err != nil {
+			t.Fatalf("failed to process key change: %s", err)
+		}
+	}
+	if len(notifier.notifications) != 0 {
+		t.Fatalf("expected out-of-order key changes to be held back, got notifications for offsets %v", offsets())
+	}
+	if offset := consumer.partitionToOffset[0]; offset != 0 {
+		t.Fatalf("expected the offset to stay at 0, got %d", offset)
+	}
+
+	// Once the first one arrives they are all processed in order.
+	if err := consumer.onMessage(msg(1)); err != nil {
+		t.Fatalf("failed to process key change: %s", err)
+	}
+	if got := offsets(); !reflect.DeepEqual(got, []int64{1, 2, 3}) {
+		t.Fatalf("expected notifications in offset order, got %v", got)
+	}
+	if offset := consumer.partitionToOffset[0]; offset != 3 {
+		t.Fatalf("expected the offset to advance to 3, got %d", offset)
+	}
+
+	// A partition that we have no offset for starts wherever it starts.
+	other := msg(7)
+	other.Partition = 1
+	if err := consumer.onMessage(other); err != nil {
+		t.Fatalf("failed to process key change: %s", err)
+	}
+	if len(notifier.notifications) != 4 {
+		t.Fatalf("expected the key change on the other partition to be processed, got %d notifications", len(notifier.notifications))
+	}
+}
+
+func TestKeyChangeStrictOrderingGivesUpOnGaps(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			alice: {alice},
+		},
+	}
+	consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+	consumer.StrictOrdering = true
+	consumer.partitionToOffset[0] = 0
+
+	// Offset 1 never arrives, so once too many messages are held back we
+	// carry on from offset 2.
+	dm := keyapi.DeviceMessage{
+		DeviceKeys: keyapi.DeviceKeys{
+			UserID:   alice,
+			DeviceID: "DEVICE",
+			KeyJSON:  []byte(`{"keys":{}}`),
+		},
+	}
+	last := int64(strictOrderingMaxHeldBack + 2)
+	for offset := last; offset >= 2; offset-- {
+		if err := consumer.onMessage(deviceMessage(t, 0, offset, dm)); err != nil {
+			t.Fatalf("failed to process key change: %s", err)
+		}
+		if offset > 2 && len(notifier.notifications) != 0 {
+			t.Fatalf("expected key changes to be held back until the limit is reached")
+		}
+	}
+	if len(notifier.notifications) != strictOrderingMaxHeldBack+1 {
+		t.Fatalf("expected %d notifications, got %d", strictOrderingMaxHeldBack+1, len(notifier.notifications))
+	}
+	for i, n := range notifier.notifications {
+		if want := int64(i + 2); n.pos.DeviceListPosition.Offset != want {
+			t.Fatalf("expected notification %d to be for offset %d, got %d", i, want, n.pos.DeviceListPosition.Offset)
+		}
+	}
+	if offset := consumer.partitionToOffset[0]; offset != last {
+		t.Fatalf("expected the offset to advance to %d, got %d", last, offset)
+	}
+}
+
+// orderRecordingNotifier records the users woken up by each notification
+// in the order that they were given.
+type orderRecordingNotifier struct {
+	sync.Mutex
+	wakeUserIDs [][]string
+}
+
+func (n *orderRecordingNotifier) OnNewKeyChangeForUsers(posUpdate types.StreamingToken, wakeUserIDs []string, keyChangeUserID string) {
+	n.Lock()
+	defer n.Unlock()
+	n.wakeUserIDs = append(n.wakeUserIDs, append([]string{}, wakeUserIDs...))
+}
+
+func (n *orderRecordingNotifier) OnDevicesDeleted(userID string, deviceIDs []string) {}
+
+func TestKeyChangeNotificationsAreSorted(t *testing.T) {
+	// Enough users that iterating over a map of them is very unlikely to
+	// come out sorted by chance.
+	var shared []string
+	for i := 0; i < 50; i++ {
+		shared = append(shared, fmt.Sprintf("@user%02d:localhost", i))
+	}
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			carol: shared,
+		},
+	}
+	consumer, _ := newTestKeyChangeConsumer(rsAPI)
+	notifier := &orderRecordingNotifier{}
+	consumer.notifier = notifier
+
+	msg := keyapi.DeviceMessage{
+		DeviceKeys: keyapi.DeviceKeys{
+			UserID:   carol,
+			DeviceID: "DEVICE",
+			KeyJSON:  []byte(`{"keys":{}}`),
+		},
+	}
+	if err := consumer.onMessage(deviceMessage(t, 0, 1, msg)); err != nil {
+		t.Fatalf("failed to process key change: %s", err)
+	}
+
+	// The same goes for notifications that have been held back.
+	consumer.NotifyCoalesceWindow = time.Hour
+	if err := consumer.onMessage(deviceMessage(t, 0, 2, msg)); err != nil {
+		t.Fatalf("failed to process key change: %s", err)
+	}
+	consumer.flushPendingNotifications()
+
+	if len(notifier.wakeUserIDs) != 2 {
+		t.Fatalf("expected 2 notifications, got %d", len(notifier.wakeUserIDs))
+	}
+	for i, userIDs := range notifier.wakeUserIDs {
+		if len(userIDs) != len(shared)+1 {
+			t.Fatalf("notification %d: expected %d users, got %d", i, len(shared)+1, len(userIDs))
+		}
+		if !sort.StringsAreSorted(userIDs) {
+			t.Fatalf("notification %d: expected users in sorted order, got %v", i, userIDs)
+		}
+	}
+}
+
+func TestKeyChangeUserFilter(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			alice: {alice, bob, carol},
+			carol: {alice, carol},
+		},
+	}
+	consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+	// This instance owns everyone except carol.
+	consumer.UserFilter = func(userID string) bool {
+		return userID != carol
+	}
+
+	for offset, userID := range []string{alice, carol} {
+		msg := keyapi.DeviceMessage{
+			DeviceKeys: keyapi.DeviceKeys{
+				UserID:   userID,
+				DeviceID: "DEVICE",
+				KeyJSON:  []byte(`{"keys":{}}`),
+			},
+		}
+		if err := consumer.onMessage(deviceMessage(t, 0, int64(offset+1), msg)); err != nil {
+			t.Fatalf("failed to process key change: %s", err)
+		}
+	}
+
+	want := []keyChangeNotification{
+		{
+			pos:         types.StreamingToken{DeviceListPosition: types.LogPosition{Partition: 0, Offset: 1}},
+			wakeUserIDs: []string{alice, bob},
+			changedUser: alice,
+		},
+	}
+	if !reflect.DeepEqual(notifier.notifications, want) {
+		t.Fatalf("unexpected notifications:\n got %+v\nwant %+v", notifier.notifications, want)
+	}
+	if rsAPI.queries != 1 {
+		t.Fatalf("expected the roomserver not to be asked about carol, got %d queries", rsAPI.queries)
+	}
+	if pos := consumer.CurrentPosition(); pos.Offset != 2 {
+		t.Fatalf("expected the skipped key change to be committed, got offset %d", pos.Offset)
+	}
+}
+
+func TestKeyChangeServerBlocklist(t *testing.T) {
+	mallory := "@mallory:evil.com"
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			alice:   {alice, bob},
+			mallory: {alice, mallory},
+		},
+	}
+	consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+	consumer.ServerBlocklist = map[gomatrixserverlib.ServerName]bool{
+		"evil.com": true,
+	}
+	deviceChange := func(userID string) keyapi.DeviceMessage {
+		return keyapi.DeviceMessage{
+			DeviceKeys: keyapi.DeviceKeys{
+				UserID:   userID,
+				DeviceID: "DEVICE",
+				KeyJSON:  []byte(`{"keys":{}}`),
+			},
+		}
+	}
+
+	if err := consumer.onMessage(deviceMessage(t, 0, 1, deviceChange(mallory))); err != nil {
+		t.Fatalf("failed to process key change: %s", err)
+	}
+	if len(notifier.notifications) != 0 || rsAPI.queries != 0 {
+		t.Fatalf("expected the key change from the blocked server to be dropped, got %+v", notifier.notifications)
+	}
+	if pos := consumer.CurrentPosition(); pos.Offset != 1 {
+		t.Fatalf("expected the dropped key change to be committed, got offset %d", pos.Offset)
+	}
+
+	if err := consumer.onMessage(deviceMessage(t, 0, 2, deviceChange(alice))); err != nil {
+		t.Fatalf("failed to process key change: %s", err)
+	}
+	want := []keyChangeNotification{
+		{
+			pos:         types.StreamingToken{DeviceListPosition: types.LogPosition{Partition: 0, Offset: 2}},
+			wakeUserIDs: []string{alice, bob},
+			changedUser: alice,
+		},
+	}
+	if !reflect.DeepEqual(notifier.notifications, want) {
+		t.Fatalf("unexpected notifications:\n got %+v\nwant %+v", notifier.notifications, want)
+	}
+}
+
+// keyChangeObserverStats returns how many observations keyChangeObservers
+// has made for the origin, and their sum.
+func keyChangeObserverStats(t *testing.T, origin string) (uint64, float64) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(keyChangeObservers)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %s", err)
+	}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "origin" && label.GetValue() == origin {
+					return metric.GetHistogram().GetSampleCount(), metric.GetHistogram().GetSampleSum()
+				}
+			}
+		}
+	}
+	return 0, 0
+}
+
+func TestKeyChangeObserversMetric(t *testing.T) {
+	erin := "@erin:remote.com"
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			alice: {alice, bob, carol, "@dave:localhost"},
+			erin:  {alice, erin},
+		},
+	}
+	consumer, _ := newTestKeyChangeConsumer(rsAPI)
+	localCount, localSum := keyChangeObserverStats(t, keyChangeOriginLocal)
+	remoteCount, remoteSum := keyChangeObserverStats(t, keyChangeOriginRemote)
+
+	for offset, userID := range []string{alice, erin} {
+		msg := keyapi.DeviceMessage{
+			DeviceKeys: keyapi.DeviceKeys{
+				UserID:   userID,
+				DeviceID: "DEVICE",
+				KeyJSON:  []byte(`{"keys":{}}`),
+			},
+		}
+		if err := consumer.onMessage(deviceMessage(t, 0, int64(offset+1), msg)); err != nil {
+			t.Fatalf("failed to process key change: %s", err)
+		}
+	}
+
+	if count, sum := keyChangeObserverStats(t, keyChangeOriginLocal); count != localCount+1 || sum != localSum+4 {
+		t.Fatalf("expected one local observation of 4 observers, got %d observation(s) totalling %v", count-localCount, sum-localSum)
+	}
+	if count, sum := keyChangeObserverStats(t, keyChangeOriginRemote); count != remoteCount+1 || sum != remoteSum+2 {
+		t.Fatalf("expected one remote observation of 2 observers, got %d observation(s) totalling %v", count-remoteCount, sum-remoteSum)
+	}
+}
+
+type mockKafkaConsumer struct {
+	sarama.Consumer
+	highWaterMarks map[string]map[int32]int64
+	messages       []*sarama.ConsumerMessage
+}
+
+func (c *mockKafkaConsumer) HighWaterMarks() map[string]map[int32]int64 {
+	return c.highWaterMarks
+}
+
+func (c *mockKafkaConsumer) ConsumePartition(topic string, partition int32, offset int64) (sarama.PartitionConsumer, error) {
+	pc := &mockPartitionConsumer{
+		messages: make(chan *sarama.ConsumerMessage, len(c.messages)),
+	}
+	for _, msg := range c.messages {
+		if msg.Partition == partition && msg.Offset >= offset {
+			pc.messages <- msg
+		}
+	}
+	return pc, nil
+}
+
+type mockPartitionConsumer struct {
+	sarama.PartitionConsumer
+	messages chan *sarama.ConsumerMessage
+}
+
+func (pc *mockPartitionConsumer) Messages() <-chan *sarama.ConsumerMessage { return pc.messages }
+func (pc *mockPartitionConsumer) Close() error                             { return nil }
+
+func TestKeyChangeConsumerLag(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			alice: {alice, bob},
+		},
+	}
+	consumer, _ := newTestKeyChangeConsumer(rsAPI)
+	// There's a backlog of 5 messages on partition 3.
+	consumer.keyChangeConsumer.Consumer = &mockKafkaConsumer{
+		highWaterMarks: map[string]map[int32]int64{
+			"keychange": {3: 5},
+		},
+	}
+	lag := keyChangeConsumerLag.WithLabelValues("3")
+
+	for offset := int64(0); offset < 5; offset++ {
+		msg := deviceMessage(t, 3, offset, keyapi.DeviceMessage{
+			DeviceKeys: keyapi.DeviceKeys{
+				UserID:   alice,
+				DeviceID: "DEVICE",
+				KeyJSON:  []byte(`{"keys":{}}`),
+			},
+		})
+		if err := consumer.onMessage(msg); err != nil {
+			t.Fatalf("failed to process key change: %s", err)
+		}
+		if got, want := testutil.ToFloat64(lag), float64(4-offset); got != want {
+			t.Fatalf("expected lag %v after processing offset %d, got %v", want, offset, got)
+		}
+	}
+}
+
+func TestKeyChangeReplay(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			alice: {alice, bob},
+			carol: {alice, carol},
+		},
+	}
+	consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+	kafkaConsumer := &mockKafkaConsumer{}
+	consumer.keyChangeConsumer.Consumer = kafkaConsumer
+	for offset, userID := range []string{alice, carol, alice, carol} {
+		kafkaConsumer.messages = append(kafkaConsumer.messages, deviceMessage(t, 0, int64(offset+1), keyapi.DeviceMessage{
+			DeviceKeys: keyapi.DeviceKeys{
+				UserID:   userID,
+				DeviceID: "DEVICE",
+				KeyJSON:  []byte(`{"keys":{}}`),
+			},
+		}))
+	}
+	// Only the first three messages have been processed so far.
+	for _, msg := range kafkaConsumer.messages[:3] {
+		if err := consumer.onMessage(msg); err != nil {
+			t.Fatalf("failed to process key change: %s", err)
+		}
+	}
+	notifier.notifications = nil
+
+	if err := consumer.Replay(context.Background(), 0, 2); err != nil {
+		t.Fatalf("failed to replay key changes: %s", err)
+	}
+
+	current := types.StreamingToken{DeviceListPosition: types.LogPosition{Partition: 0, Offset: 3}}
+	want := []keyChangeNotification{
+		{pos: current, wakeUserIDs: []string{alice, carol}, changedUser: carol},
+		{pos: current, wakeUserIDs: []string{alice, bob}, changedUser: alice},
+	}
+	if !reflect.DeepEqual(notifier.notifications, want) {
+		t.Fatalf("unexpected notifications:\n got %+v\nwant %+v", notifier.notifications, want)
+	}
+	if pos := consumer.CurrentPosition(); pos.Offset != 3 {
+		t.Fatalf("expected replaying not to move the position, got offset %d", pos.Offset)
+	}
+	store := consumer.keyChangeConsumer.PartitionStore.(*mockPartitionStore)
+	if offset := store.offsets[0]; offset != 3 {
+		t.Fatalf("expected replaying not to commit offsets, got offset %d", offset)
+	}
+}
+
+func TestKeyChangeResyncUser(t *testing.T) {
+	dave := "@dave:localhost"
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			// alice shares one room with bob and another with bob, carol
+			// and dave.
+			alice: {alice, bob, alice, bob, carol, dave},
+		},
+	}
+	consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+	consumer.partitionToOffset[0] = 7
+
+	if err := consumer.ResyncUser(alice); err != nil {
+		t.Fatalf("failed to resync user: %s", err)
+	}
+
+	want := []keyChangeNotification{
+		{
+			pos:         types.StreamingToken{DeviceListPosition: types.LogPosition{Partition: 0, Offset: 7}},
+			wakeUserIDs: []string{alice, bob, carol, dave},
+			changedUser: alice,
+		},
+	}
+	if !reflect.DeepEqual(notifier.notifications, want) {
+		t.Fatalf("unexpected notifications:\n got %+v\nwant %+v", notifier.notifications, want)
+	}
+}
+
+func TestKeyChangeResyncUserQueryFailure(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		err: errors.New("roomserver exploded"),
+	}
+	consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+
+	if err := consumer.ResyncUser(alice); err == nil {
+		t.Fatalf("expected an error when the roomserver query fails")
+	}
+	if len(notifier.notifications) != 0 {
+		t.Fatalf("expected no notifications, got %+v", notifier.notifications)
+	}
+}
+
+func TestKeyChangeWaitForPosition(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			alice: {alice, bob},
+		},
+	}
+	consumer, _ := newTestKeyChangeConsumer(rsAPI)
+	msg := keyapi.DeviceMessage{
+		DeviceKeys: keyapi.DeviceKeys{
+			UserID:   alice,
+			DeviceID: "DEVICE",
+			KeyJSON:  []byte(`{"keys":{}}`),
+		},
+	}
+
+	waited := make(chan error, 1)
+	go func() {
+		waited <- consumer.WaitForPosition(context.Background(), types.LogPosition{Partition: 0, Offset: 3})
+	}()
+
+	for offset := int64(1); offset <= 2; offset++ {
+		if err := consumer.onMessage(deviceMessage(t, 0, offset, msg)); err != nil {
+			t.Fatalf("failed to process key change: %s", err)
+		}
+	}
+	// Other partitions reaching the offset don't count.
+	if err := consumer.onMessage(deviceMessage(t, 1, 5, msg)); err != nil {
+		t.Fatalf("failed to process key change: %s", err)
+	}
+	select {
+	case err := <-waited:
+		t.Fatalf("expected to still be waiting, returned %v", err)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	if err := consumer.onMessage(deviceMessage(t, 0, 3, msg)); err != nil {
+		t.Fatalf("failed to process key change: %s", err)
+	}
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Fatalf("failed to wait for position: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the wait to return once the position was reached")
+	}
+
+	// A position that has already been passed returns straight away.
+	if err := consumer.WaitForPosition(context.Background(), types.LogPosition{Partition: 0, Offset: 2}); err != nil {
+		t.Fatalf("failed to wait for position: %s", err)
+	}
+}
+
+func TestKeyChangeWaitForPositionContextDone(t *testing.T) {
+	consumer, _ := newTestKeyChangeConsumer(&mockRoomserverAPI{})
+	consumer.partitionToOffset[0] = 1
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	start := time.Now()
+	err := consumer.WaitForPosition(ctx, types.LogPosition{Partition: 0, Offset: 2})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the wait to return promptly, took %s", elapsed)
+	}
+}
+
+// fakeConsumerGroup is a consumer group member that is given the next
+// assignment from assignments each time it joins, and whose session ends
+// whenever there is a value on rebalance.
+type fakeConsumerGroup struct {
+	sarama.ConsumerGroup
+	topic       *fakeTopic
+	assignments chan []int32
+	rebalance   chan struct{}
+}
+
+// fakeTopic is the log of messages that fakeConsumerGroup members consume.
+type fakeTopic struct {
+	sync.Mutex
+	messages []*sarama.ConsumerMessage
+}
+
+func (g *fakeConsumerGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	var partitions []int32
+	select {
+	case partitions = <-g.assignments:
+	case <-ctx.Done():
+		return nil
+	}
+	sessionCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	session := &fakeGroupSession{
+		ctx:    sessionCtx,
+		claims: map[string][]int32{topics[0]: partitions},
+		next:   map[int32]int64{},
+	}
+	if err := handler.Setup(session); err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	for _, partition := range partitions {
+		claim := &fakeGroupClaim{messages: make(chan *sarama.ConsumerMessage)}
+		g.topic.Lock()
+		var messages []*sarama.ConsumerMessage
+		for _, msg := range g.topic.messages {
+			if msg.Partition == partition && msg.Offset >= session.next[partition] {
+				messages = append(messages, msg)
+			}
+		}
+		g.topic.Unlock()
+		go func() {
+			for _, msg := range messages {
+				select {
+				case claim.messages <- msg:
+				case <-sessionCtx.Done():
+					return
+				}
+			}
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = handler.ConsumeClaim(session, claim)
+		}()
+	}
+	select {
+	case <-g.rebalance:
+	case <-ctx.Done():
+	}
+	cancel()
+	wg.Wait()
+	return handler.Cleanup(session)
+}
+
+type fakeGroupSession struct {
+	sarama.ConsumerGroupSession
+	ctx    context.Context
+	claims map[string][]int32
+	next   map[int32]int64
+}
+
+func (s *fakeGroupSession) Context() context.Context                    { return s.ctx }
+func (s *fakeGroupSession) Claims() map[string][]int32                  { return s.claims }
+func (s *fakeGroupSession) MarkMessage(*sarama.ConsumerMessage, string) {}
+
+func (s *fakeGroupSession) MarkOffset(_ string, partition int32, offset int64, _ string) {
+	if offset > s.next[partition] {
+		s.next[partition] = offset
+	}
+}
+
+func (s *fakeGroupSession) ResetOffset(_ string, partition int32, offset int64, _ string) {
+	if offset < s.next[partition] {
+		s.next[partition] = offset
+	}
+}
+
+type fakeGroupClaim struct {
+	sarama.ConsumerGroupClaim
+	messages chan *sarama.ConsumerMessage
+}
+
+func (c *fakeGroupClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+func TestKeyChangeConsumerGroupRebalance(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			alice: {alice, bob},
+		},
+	}
+	topic := &fakeTopic{}
+	addMessages := func(from, to int64) {
+		topic.Lock()
+		defer topic.Unlock()
+		for offset := from; offset < to; offset++ {
+			topic.messages = append(topic.messages, deviceMessage(t, 0, offset, keyapi.DeviceMessage{
+				DeviceKeys: keyapi.DeviceKeys{
+					UserID:   alice,
+					DeviceID: "DEVICE",
+					KeyJSON:  []byte(`{"keys":{}}`),
+				},
+			}))
+		}
+	}
+
+	// Both members share the same partition store, as sync API instances
+	// share the same database.
+	store := &mockPartitionStore{offsets: make(map[int32]int64)}
+	newMember := func() (*OutputKeyChangeEventConsumer, *mockKeyChangeNotifier, *fakeConsumerGroup) {
+		consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+		consumer.keyChangeConsumer.PartitionStore = store
+		consumer.keyChangeConsumer.ProcessMessage = consumer.onMessage
+		group := &fakeConsumerGroup{
+			topic:       topic,
+			assignments: make(chan []int32, 2),
+			rebalance:   make(chan struct{}),
+		}
+		consumer.UseConsumerGroup(group)
+		return consumer, notifier, group
+	}
+	waitForOffset := func(offset int64) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second * 5)
+		for {
+			store.Lock()
+			got, ok := store.offsets[0]
+			store.Unlock()
+			if ok && got == offset {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for offset %d to be committed", offset)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+	offsets := func(n *mockKeyChangeNotifier) []int64 {
+		n.Lock()
+		defer n.Unlock()
+		var offsets []int64
+		for _, notification := range n.notifications {
+			offsets = append(offsets, notification.pos.DeviceListPosition.Offset)
+		}
+		return offsets
+	}
+
+	// The first member consumes the partition to start with.
+	addMessages(0, 5)
+	first, firstNotifier, firstGroup := newMember()
+	firstGroup.assignments <- []int32{0}
+	if err := first.Start(); err != nil {
+		t.Fatalf("failed to start consumer: %s", err)
+	}
+	waitForOffset(4)
+
+	// More key changes arrive, and then the partition is moved to the
+	// second member.
+	addMessages(5, 10)
+	firstGroup.assignments <- nil
+	firstGroup.rebalance <- struct{}{}
+	second, secondNotifier, secondGroup := newMember()
+	secondGroup.assignments <- []int32{0}
+	if err := second.Start(); err != nil {
+		t.Fatalf("failed to start consumer: %s", err)
+	}
+	waitForOffset(9)
+	first.Stop()
+	second.Stop()
+
+	// Every key change should have been notified exactly once, by one
+	// member or the other.
+	if got, want := offsets(firstNotifier), []int64{0, 1, 2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("first member notified offsets %v, want %v", got, want)
+	}
+	if got, want := offsets(secondNotifier), []int64{5, 6, 7, 8, 9}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("second member notified offsets %v, want %v", got, want)
+	}
+	if pos := first.CurrentPosition(); pos != (types.LogPosition{}) {
+		t.Fatalf("expected the first member to forget the revoked partition, got %+v", pos)
+	}
+	if pos := second.CurrentPosition(); pos.Offset != 9 {
+		t.Fatalf("expected the second member to have reached offset 9, got %+v", pos)
+	}
+}
+
+func TestKeyChangeMessageSizeLimit(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			alice: {alice, bob},
+		},
+	}
+	consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+	consumer.MaxMessageSize = 1024
+
+	msg := keyapi.DeviceMessage{
+		DeviceKeys: keyapi.DeviceKeys{
+			UserID:   alice,
+			DeviceID: "DEVICE",
+			KeyJSON:  []byte(`{"keys":{"padding":"` + strings.Repeat("a", 2048) + `"}}`),
+		},
+	}
+	if err := consumer.onMessage(deviceMessage(t, 0, 1, msg)); !errors.Is(err, errKeyChangeTooLarge) {
+		t.Fatalf("expected the message to be rejected as too large, got %v", err)
+	}
+	if rsAPI.queries != 0 {
+		t.Fatalf("expected no roomserver queries, got %d", rsAPI.queries)
+	}
+	if len(notifier.notifications) != 0 {
+		t.Fatalf("expected no notifications, got %d", len(notifier.notifications))
+	}
+	// The message can never succeed, so we shouldn't see it again.
+	if pos := consumer.CurrentPosition(); pos.Offset != 1 {
+		t.Fatalf("expected the offset to be committed, got %d", pos.Offset)
+	}
+
+	// Messages within the limit are processed as normal.
+	msg.KeyJSON = []byte(`{"keys":{}}`)
+	if err := consumer.onMessage(deviceMessage(t, 0, 2, msg)); err != nil {
+		t.Fatalf("onMessage failed: %s", err)
+	}
+	if len(notifier.notifications) != 1 {
+		t.Fatalf("expected one notification, got %d", len(notifier.notifications))
+	}
+}
+
+func TestKeyChangeMalformedMessagesAreSkipped(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{}
+	consumer, notifier := newTestKeyChangeConsumer(rsAPI)
+
+	// These are the kinds of inputs that FuzzDecodeKeyChange explores.
+	for i, value := range []string{
+		``,
+		`null`,
+		`{`,
+		`[]`,
+		`"string"`,
+		`{"UserID":123}`,
+		`{"UserID":"` + strings.Repeat("a", maxKeyChangeUserIDLength+1) + `"}`,
+		`{"Type":"nope","UserID":"@alice:localhost"}`,
+		`{"UserID":"@alice:localhost","KeyJSON":"not base64"}`,
+		string([]byte{0xff, 0xfe, 0x00}),
+	} {
+		offset := int64(i + 1)
+		msg := &sarama.ConsumerMessage{Partition: 0, Offset: offset, Value: []byte(value)}
+		_ = consumer.onMessage(msg)
+		if pos := consumer.CurrentPosition(); pos.Offset != offset {
+			t.Fatalf("expected malformed message %q to be skipped, got offset %d", value, pos.Offset)
+		}
+	}
+	if rsAPI.queries != 0 {
+		t.Fatalf("expected no roomserver queries, got %d", rsAPI.queries)
+	}
+	if len(notifier.notifications) != 0 {
+		t.Fatalf("expected no notifications, got %d", len(notifier.notifications))
+	}
+}
+
+// failingDeviceListStore is a sync API database that fails to store device
+// list changes.
+type failingDeviceListStore struct {
+	storage.Database
+}
+
+func (d *failingDeviceListStore) StoreDeviceListChange(
+	ctx context.Context, observerUserIDs []string, changedUserID string, pos types.LogPosition,
+) error {
+	return errors.New("database unavailable")
+}
+
+func TestKeyChangePersistDeviceListChanges(t *testing.T) {
+	dbname := fmt.Sprintf("test_%s.db", t.Name())
+	_ = os.Remove(dbname)
+	defer os.Remove(dbname) // nolint: errcheck
+	db, err := sqlite3.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(fmt.Sprintf("file:%s", dbname)),
+	})
+	if err != nil {
+		t.Fatalf("failed to create sync API database: %s", err)
+	}
+
+	rsAPI := &mockRoomserverAPI{
+		sharedUsers: map[string][]string{
+			alice: {alice, bob},
+		},
+	}
+	consumer, _ := newTestKeyChangeConsumer(rsAPI)
+	consumer.db = db
+	consumer.PersistDeviceListChanges = true
+
+	msg := keyapi.DeviceMessage{
+		DeviceKeys: keyapi.DeviceKeys{
+			UserID:   alice,
+			DeviceID: "DEVICE",
+			KeyJSON:  []byte(`{"keys":{}}`),
+		},
+	}
+	if err = consumer.onMessage(deviceMessage(t, 0, 7, msg)); err != nil {
+		t.Fatalf("onMessage failed: %s", err)
+	}
+
+	// Bob wasn't syncing when the change happened, and reconnects with a
+	// token from before it. The change is still there for him.
+	since := types.LogPosition{Partition: 0, Offset: 3}
+	changed, err := db.DeviceListChanges(context.Background(), bob, since, consumer.CurrentPosition())
+	if err != nil {
+		t.Fatalf("DeviceListChanges failed: %s", err)
+	}
+	if !reflect.DeepEqual(changed, []string{alice}) {
+		t.Fatalf("expected bob to see that alice's devices changed, got %v", changed)
+	}
+
+	// If the change can't be stored then the message isn't committed, so
+	// that it is processed again later.
+	consumer.db = &failingDeviceListStore{}
+	if err = consumer.onMessage(deviceMessage(t, 0, 8, msg)); err == nil {
+		t.Fatalf("expected an error when the device list change can't be stored")
+	}
+	if pos := consumer.CurrentPosition(); pos.Offset != 7 {
+		t.Fatalf("expected the offset not to be committed, got %d", pos.Offset)
+	}
+}
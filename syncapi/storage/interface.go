@@ -156,4 +156,10 @@ type Database interface {
 	StoreReceipt(ctx context.Context, roomId, receiptType, userId, eventId string, timestamp gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error)
 	// GetRoomReceipts gets all receipts for a given roomID
 	GetRoomReceipts(ctx context.Context, roomIDs []string, streamPos types.StreamPosition) ([]eduAPI.OutputReceiptEvent, error)
+	// StoreDeviceListChange records that the devices of changedUserID changed at the given position in the key change
+	// log, so that each of the observers finds out about it even if they weren't syncing when it happened.
+	StoreDeviceListChange(ctx context.Context, observerUserIDs []string, changedUserID string, pos types.LogPosition) error
+	// DeviceListChanges returns the users who share a room with the given user and whose devices changed after from
+	// and up to and including to in the key change log.
+	DeviceListChanges(ctx context.Context, userID string, from, to types.LogPosition) ([]string, error)
 }
@@ -0,0 +1,103 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+)
+
+const deviceListChangesSchema = `
+-- Stores the latest position in the key change log at which the devices of
+-- a user changed, for each user who shares a room with them, so that clients
+-- that weren't syncing at the time still find out about it.
+CREATE TABLE IF NOT EXISTS syncapi_device_list_changes (
+	-- The user who should be told about the change
+	observer_user_id TEXT NOT NULL,
+	-- The user whose devices changed
+	changed_user_id TEXT NOT NULL,
+	-- The partition and offset of the change in the key change log
+	log_partition INTEGER NOT NULL,
+	log_offset BIGINT NOT NULL,
+	CONSTRAINT syncapi_device_list_changes_unique UNIQUE (observer_user_id, changed_user_id)
+);
+`
+
+const upsertDeviceListChangeSQL = "" +
+	"INSERT INTO syncapi_device_list_changes" +
+	" (observer_user_id, changed_user_id, log_partition, log_offset)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (observer_user_id, changed_user_id)" +
+	" DO UPDATE SET log_partition = $3, log_offset = $4"
+
+const selectDeviceListChangesSQL = "" +
+	"SELECT changed_user_id FROM syncapi_device_list_changes" +
+	" WHERE observer_user_id = $1 AND log_partition = $2 AND log_offset > $3 AND log_offset <= $4"
+
+type deviceListChangesStatements struct {
+	upsertDeviceListChangeStmt  *sql.Stmt
+	selectDeviceListChangesStmt *sql.Stmt
+}
+
+func NewPostgresDeviceListChangesTable(db *sql.DB) (tables.DeviceListChanges, error) {
+	s := &deviceListChangesStatements{}
+	_, err := db.Exec(deviceListChangesSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.upsertDeviceListChangeStmt, err = db.Prepare(upsertDeviceListChangeSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare upsertDeviceListChange statement: %w", err)
+	}
+	if s.selectDeviceListChangesStmt, err = db.Prepare(selectDeviceListChangesSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectDeviceListChanges statement: %w", err)
+	}
+	return s, nil
+}
+
+// UpsertDeviceListChange records that the devices of changedUserID changed
+// at the given position, replacing any earlier change.
+func (s *deviceListChangesStatements) UpsertDeviceListChange(
+	ctx context.Context, txn *sql.Tx, observerUserID, changedUserID string, partition int32, offset int64,
+) (err error) {
+	stmt := sqlutil.TxStmt(txn, s.upsertDeviceListChangeStmt)
+	_, err = stmt.ExecContext(ctx, observerUserID, changedUserID, partition, offset)
+	return
+}
+
+// SelectDeviceListChanges returns the users whose devices changed on the
+// given partition after fromOffset and up to and including toOffset, who
+// share a room with observerUserID.
+func (s *deviceListChangesStatements) SelectDeviceListChanges(
+	ctx context.Context, observerUserID string, partition int32, fromOffset, toOffset int64,
+) (changedUserIDs []string, err error) {
+	rows, err := s.selectDeviceListChangesStmt.QueryContext(ctx, observerUserID, partition, fromOffset, toOffset)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectDeviceListChanges: rows.close() failed")
+	for rows.Next() {
+		var changedUserID string
+		if err = rows.Scan(&changedUserID); err != nil {
+			return nil, err
+		}
+		changedUserIDs = append(changedUserIDs, changedUserID)
+	}
+	return changedUserIDs, rows.Err()
+}
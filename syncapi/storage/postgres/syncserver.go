@@ -88,6 +88,10 @@ func NewDatabase(dbProperties *config.DatabaseOptions) (*SyncServerDatasource, e
 	if err != nil {
 		return nil, err
 	}
+	deviceListChanges, err := NewPostgresDeviceListChangesTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadFixSequences(m)
 	if err = m.RunDeltas(d.db, dbProperties); err != nil {
@@ -106,6 +110,7 @@ func NewDatabase(dbProperties *config.DatabaseOptions) (*SyncServerDatasource, e
 		Filter:              filter,
 		SendToDevice:        sendToDevice,
 		Receipts:            receipts,
+		DeviceListChanges:   deviceListChanges,
 		EDUCache:            cache.New(),
 	}
 	return &d, nil
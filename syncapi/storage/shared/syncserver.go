@@ -50,6 +50,7 @@ type Database struct {
 	SendToDevice        tables.SendToDevice
 	Filter              tables.Filter
 	Receipts            tables.Receipts
+	DeviceListChanges   tables.DeviceListChanges
 	EDUCache            *cache.EDUCache
 }
 
@@ -1531,3 +1532,35 @@ func (d *Database) GetRoomReceipts(ctx context.Context, roomIDs []string, stream
 	_, receipts, err := d.Receipts.SelectRoomReceiptsAfter(ctx, roomIDs, streamPos)
 	return receipts, err
 }
+
+// StoreDeviceListChange records that the devices of changedUserID changed
+// at the given position in the key change log, for each of the observers.
+func (d *Database) StoreDeviceListChange(
+	ctx context.Context, observerUserIDs []string, changedUserID string, pos types.LogPosition,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		for _, observerUserID := range observerUserIDs {
+			if err := d.DeviceListChanges.UpsertDeviceListChange(ctx, txn, observerUserID, changedUserID, pos.Partition, pos.Offset); err != nil {
+				return fmt.Errorf("d.DeviceListChanges.UpsertDeviceListChange: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// DeviceListChanges returns the users whose devices changed after from and
+// up to and including to in the key change log, who share a room with the
+// given user. If from is on a different partition to to then all of the
+// changes up to to are returned.
+func (d *Database) DeviceListChanges(
+	ctx context.Context, userID string, from, to types.LogPosition,
+) ([]string, error) {
+	if to.IsEmpty() {
+		return nil, nil
+	}
+	fromOffset := int64(-1)
+	if !from.IsEmpty() && from.Partition == to.Partition {
+		fromOffset = from.Offset
+	}
+	return d.DeviceListChanges.SelectDeviceListChanges(ctx, userID, to.Partition, fromOffset, to.Offset)
+}
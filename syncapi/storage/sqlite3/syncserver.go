@@ -101,6 +101,10 @@ func (d *SyncServerDatasource) prepare(dbProperties *config.DatabaseOptions) (er
 	if err != nil {
 		return err
 	}
+	deviceListChanges, err := NewSqliteDeviceListChangesTable(d.db)
+	if err != nil {
+		return err
+	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadFixSequences(m)
 	if err = m.RunDeltas(d.db, dbProperties); err != nil {
@@ -119,6 +123,7 @@ func (d *SyncServerDatasource) prepare(dbProperties *config.DatabaseOptions) (er
 		Filter:              filter,
 		SendToDevice:        sendToDevice,
 		Receipts:            receipts,
+		DeviceListChanges:   deviceListChanges,
 		EDUCache:            cache.New(),
 	}
 	return nil
@@ -746,3 +746,56 @@ func reversed(in []*gomatrixserverlib.HeaderedEvent) []*gomatrixserverlib.Header
 	}
 	return out
 }
+
+func TestDeviceListChanges(t *testing.T) {
+	db := MustCreateDatabase(t)
+	observers := []string{testUserIDA, testUserIDB}
+
+	// The devices of user B change while user A isn't syncing.
+	if err := db.StoreDeviceListChange(ctx, observers, testUserIDB, types.LogPosition{Partition: 0, Offset: 5}); err != nil {
+		t.Fatalf("StoreDeviceListChange failed: %s", err)
+	}
+	for _, tc := range []struct {
+		name     string
+		from, to types.LogPosition
+		want     int
+	}{
+		{"before the change", types.LogPosition{Partition: 0, Offset: 3}, types.LogPosition{Partition: 0, Offset: 10}, 1},
+		{"initial sync", types.LogPosition{}, types.LogPosition{Partition: 0, Offset: 10}, 1},
+		{"different partition", types.LogPosition{Partition: 1, Offset: 8}, types.LogPosition{Partition: 0, Offset: 10}, 1},
+		{"at the change", types.LogPosition{Partition: 0, Offset: 5}, types.LogPosition{Partition: 0, Offset: 10}, 0},
+		{"ending before the change", types.LogPosition{Partition: 0, Offset: 1}, types.LogPosition{Partition: 0, Offset: 4}, 0},
+		{"no position", types.LogPosition{}, types.LogPosition{}, 0},
+	} {
+		changed, err := db.DeviceListChanges(ctx, testUserIDA, tc.from, tc.to)
+		if err != nil {
+			t.Fatalf("%s: DeviceListChanges failed: %s", tc.name, err)
+		}
+		if len(changed) != tc.want {
+			t.Fatalf("%s: expected %d changed user(s), got %v", tc.name, tc.want, changed)
+		}
+		if tc.want > 0 && changed[0] != testUserIDB {
+			t.Fatalf("%s: expected %s to have changed, got %v", tc.name, testUserIDB, changed)
+		}
+	}
+
+	// A later change replaces the earlier one.
+	if err := db.StoreDeviceListChange(ctx, observers, testUserIDB, types.LogPosition{Partition: 0, Offset: 12}); err != nil {
+		t.Fatalf("StoreDeviceListChange failed: %s", err)
+	}
+	changed, err := db.DeviceListChanges(ctx, testUserIDA, types.LogPosition{Partition: 0, Offset: 10}, types.LogPosition{Partition: 0, Offset: 12})
+	if err != nil {
+		t.Fatalf("DeviceListChanges failed: %s", err)
+	}
+	if len(changed) != 1 || changed[0] != testUserIDB {
+		t.Fatalf("expected %s to have changed again, got %v", testUserIDB, changed)
+	}
+	// Users who weren't observing the change don't see it.
+	changed, err = db.DeviceListChanges(ctx, "@someone:else", types.LogPosition{}, types.LogPosition{Partition: 0, Offset: 12})
+	if err != nil {
+		t.Fatalf("DeviceListChanges failed: %s", err)
+	}
+	if len(changed) != 0 {
+		t.Fatalf("expected no changes for an unrelated user, got %v", changed)
+	}
+}
@@ -163,3 +163,11 @@ type Receipts interface {
 	SelectRoomReceiptsAfter(ctx context.Context, roomIDs []string, streamPos types.StreamPosition) (types.StreamPosition, []eduAPI.OutputReceiptEvent, error)
 	SelectMaxReceiptID(ctx context.Context, txn *sql.Tx) (id int64, err error)
 }
+
+// DeviceListChanges records the latest position in the key change log at
+// which the devices of each user changed, for each user who shares a room
+// with them.
+type DeviceListChanges interface {
+	UpsertDeviceListChange(ctx context.Context, txn *sql.Tx, observerUserID, changedUserID string, partition int32, offset int64) (err error)
+	SelectDeviceListChanges(ctx context.Context, observerUserID string, partition int32, fromOffset, toOffset int64) (changedUserIDs []string, err error)
+}
@@ -193,6 +193,35 @@ func (n *Notifier) OnNewKeyChange(
 	n.wakeupUsers([]string{wakeUserID}, nil, n.currPos)
 }
 
+// OnNewKeyChangeForUsers is the bulk form of OnNewKeyChange. It updates
+// the current position and wakes up all of the given users under a
+// single acquisition of the stream lock.
+func (n *Notifier) OnNewKeyChangeForUsers(
+	posUpdate types.StreamingToken, wakeUserIDs []string, keyChangeUserID string,
+) {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+
+	n.currPos.ApplyUpdates(posUpdate)
+	n.wakeupUsers(wakeUserIDs, nil, n.currPos)
+}
+
+// OnDevicesDeleted wakes up any requests that are waiting on the sync
+// streams of the given devices, which have been deleted, and then drops
+// the streams rather than keeping them around until they time out.
+func (n *Notifier) OnDevicesDeleted(userID string, deviceIDs []string) {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+
+	n.wakeupUserDevice(userID, deviceIDs, n.currPos)
+	for _, deviceID := range deviceIDs {
+		delete(n.userDeviceStreams[userID], deviceID)
+	}
+	if len(n.userDeviceStreams[userID]) == 0 {
+		delete(n.userDeviceStreams, userID)
+	}
+}
+
 func (n *Notifier) OnNewInvite(
 	posUpdate types.StreamingToken, wakeUserID string,
 ) {
@@ -300,7 +329,6 @@ func (n *Notifier) wakeupUsers(userIDs []string, peekingDevices []types.PeekingD
 
 // wakeupUserDevice will wake up the sync stream for a specific user device. Other
 // device streams will be left alone.
-// nolint:unused
 func (n *Notifier) wakeupUserDevice(userID string, deviceIDs []string, newPos types.StreamingToken) {
 	for _, deviceID := range deviceIDs {
 		if stream := n.fetchUserDeviceStream(userID, deviceID, false); stream != nil {
@@ -178,6 +178,36 @@ func TestCorrectStreamWakeup(t *testing.T) {
 	}
 }
 
+// Test that deleting a device wakes up its stream and then drops it.
+func TestDeviceDeletedWakeupAndDrop(t *testing.T) {
+	n := NewNotifier(syncPositionBefore)
+	lockedFetchUserStream(n, alice, "kept")
+	deleted := lockedFetchUserStream(n, alice, "deleted")
+
+	signal := deleted.signalChannel
+	awoken := make(chan struct{})
+	go func() {
+		<-signal
+		close(awoken)
+	}()
+
+	n.OnDevicesDeleted(alice, []string{"deleted"})
+
+	select {
+	case <-awoken:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the deleted device's stream to be woken up")
+	}
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+	if n.fetchUserDeviceStream(alice, "deleted", false) != nil {
+		t.Fatalf("expected the deleted device's stream to be dropped")
+	}
+	if n.fetchUserDeviceStream(alice, "kept", false) == nil {
+		t.Fatalf("expected the other device's stream to be kept")
+	}
+}
+
 // Test that an invite unblocks the request
 func TestNewInviteEventForUser(t *testing.T) {
 	n := NewNotifier(syncPositionBefore)
@@ -372,3 +402,39 @@ func newTestSyncRequest(userID, deviceID string, since types.StreamingToken) syn
 		ctx:           context.TODO(),
 	}
 }
+
+func benchmarkKeyChangeNotifier(b *testing.B, numUsers int) (*Notifier, []string) {
+	n := NewNotifier(syncPositionBefore)
+	userIDs := make([]string, numUsers)
+	for i := range userIDs {
+		userIDs[i] = fmt.Sprintf("@user%d:localhost", i)
+		lockedFetchUserStream(n, userIDs[i], "device")
+	}
+	b.ResetTimer()
+	return n, userIDs
+}
+
+func keyChangePosition(offset int) types.StreamingToken {
+	return types.StreamingToken{
+		DeviceListPosition: types.LogPosition{
+			Offset: int64(offset),
+		},
+	}
+}
+
+func BenchmarkKeyChangePerUser(b *testing.B) {
+	n, userIDs := benchmarkKeyChangeNotifier(b, 5000)
+	for i := 0; i < b.N; i++ {
+		pos := keyChangePosition(i + 1)
+		for _, userID := range userIDs {
+			n.OnNewKeyChange(pos, userID, alice)
+		}
+	}
+}
+
+func BenchmarkKeyChangeForUsers(b *testing.B) {
+	n, userIDs := benchmarkKeyChangeNotifier(b, 5000)
+	for i := 0; i < b.N; i++ {
+		n.OnNewKeyChangeForUsers(keyChangePosition(i+1), userIDs, alice)
+	}
+}
@@ -338,10 +338,34 @@ func (rp *RequestPool) appendDeviceLists(
 	if err != nil {
 		return nil, fmt.Errorf("internal.DeviceListCatchup: %w", err)
 	}
+	if rp.cfg.PersistDeviceListChanges {
+		// Include any changes that were stored while the client wasn't
+		// syncing, in case the key server no longer knows about them.
+		changed, err := rp.db.DeviceListChanges(context.Background(), userID, since.DeviceListPosition, to.DeviceListPosition)
+		if err != nil {
+			return nil, fmt.Errorf("rp.db.DeviceListChanges: %w", err)
+		}
+		data.DeviceLists.Changed = appendMissing(data.DeviceLists.Changed, changed)
+	}
 
 	return data, nil
 }
 
+// appendMissing appends the user IDs in add that aren't already in userIDs.
+func appendMissing(userIDs, add []string) []string {
+	seen := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		seen[userID] = true
+	}
+	for _, userID := range add {
+		if !seen[userID] {
+			seen[userID] = true
+			userIDs = append(userIDs, userID)
+		}
+	}
+	return userIDs
+}
+
 // nolint:gocyclo
 func (rp *RequestPool) appendAccountData(
 	data *types.Response, userID string, req syncRequest, currentPos types.StreamPosition,
@@ -63,10 +63,19 @@ func AddPublicRoutes(
 
 	requestPool := sync.NewRequestPool(syncDB, cfg, notifier, userAPI, keyAPI, rsAPI)
 
-	keyChangeConsumer := consumers.NewOutputKeyChangeEventConsumer(
+	keyChangeConsumer, err := consumers.NewOutputKeyChangeEventConsumer(
 		cfg.Matrix.ServerName, string(cfg.Matrix.Kafka.TopicFor(config.TopicOutputKeyChangeEvent)),
 		consumer, notifier, keyAPI, rsAPI, syncDB,
 	)
+	if err != nil {
+		logrus.WithError(err).Panicf("failed to create key change consumer")
+	}
+	keyChangeConsumer.PersistDeviceListChanges = cfg.PersistDeviceListChanges
+	if cfg.KeyChangeConsumerGroup != "" {
+		keyChangeConsumer.UseConsumerGroup(
+			kafka.SetupConsumerGroup(&cfg.Matrix.Kafka, cfg.KeyChangeConsumerGroup),
+		)
+	}
 	if err = keyChangeConsumer.Start(); err != nil {
 		logrus.WithError(err).Panicf("failed to start key change consumer")
 	}